@@ -0,0 +1,76 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+// CheckStorage verifies the configured storage with a round trip of a small test object under
+// the storage path: upload, download and delete, each step is logged with its latency.
+// The first failing step is returned, the test object is deleted even if the download failed.
+func CheckStorage(config *Config) error {
+	if config.StorageType == "stdout" || config.StorageType == "stdin" {
+		logging.Infof("Storage check skipped, %s storage is a one-way stream", config.StorageType)
+		return nil
+	}
+	var s storage.RemoteStorage
+	if err := checkStep("connect to "+config.StorageType+" storage", func() (err error) {
+		s, err = newRemoteStorage(config)
+		return err
+	}); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			logging.Warnf("failed to close storage connection: %v", closeErr)
+		}
+	}()
+
+	filename := path.Join(config.StorageConfig["path"], fmt.Sprintf(".clickhouse-dump-check-%d", time.Now().UnixNano()))
+	content := []byte("clickhouse-dump storage check " + time.Now().UTC().Format(time.RFC3339Nano) + "\n")
+	if err := checkStep("upload "+filename, func() error {
+		return s.Upload(filename, bytes.NewReader(content), "none", 0, "")
+	}); err != nil {
+		return err
+	}
+	downloadErr := checkStep("download "+filename, func() error {
+		reader, err := s.Download(filename)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = reader.Close()
+		}()
+		downloaded, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(downloaded, content) {
+			return fmt.Errorf("downloaded %d bytes differ from the %d uploaded bytes", len(downloaded), len(content))
+		}
+		return nil
+	})
+	deleteErr := checkStep("delete "+filename, func() error {
+		return s.Delete(filename)
+	})
+	if downloadErr != nil {
+		return downloadErr
+	}
+	return deleteErr
+}
+
+// checkStep runs one step of a check and logs its latency.
+func checkStep(name string, step func() error) error {
+	start := time.Now()
+	if err := step(); err != nil {
+		return fmt.Errorf("storage check failed to %s: %w", name, err)
+	}
+	logging.Infof("Storage check: %s OK in %s", name, time.Since(start).Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,25 @@
+package clickhousedump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckStorage(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, CheckStorage(&Config{StorageType: "file", StorageConfig: map[string]string{"path": dir}}))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "the test object is deleted")
+
+	// A regular file can't be the storage directory
+	notDir := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(notDir, []byte("x"), 0o644))
+	err = CheckStorage(&Config{StorageType: "file", StorageConfig: map[string]string{"path": notDir}})
+	require.ErrorContains(t, err, "storage check failed to connect to file storage")
+
+	require.NoError(t, CheckStorage(&Config{StorageType: "stdout"}), "streams are skipped")
+}
@@ -0,0 +1,455 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mathRand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+type ClickHouseClient struct {
+	config *Config
+	client *http.Client
+	// sessionID is sent as session_id with every query when set, see --consistent
+	sessionID string
+	// runID and querySeq make the query_id of table queries unique across runs and queries
+	runID    string
+	querySeq atomic.Uint64
+}
+
+func NewClickHouseClient(config *Config) *ClickHouseClient {
+	return &ClickHouseClient{
+		config: config,
+		client: &http.Client{Transport: newTransport(config)},
+		runID:  randomHex(4),
+	}
+}
+
+// withSession returns a client sending queries in the ClickHouse session sessionID, sharing the
+// connections of c.
+func (c *ClickHouseClient) withSession(sessionID string) *ClickHouseClient {
+	return &ClickHouseClient{
+		config:    c.config,
+		client:    c.client,
+		sessionID: sessionID,
+		runID:     randomHex(4),
+	}
+}
+
+// Close closes the idle connections to ClickHouse, the client can still be used afterwards.
+func (c *ClickHouseClient) Close() {
+	c.client.CloseIdleConnections()
+}
+
+// newTransport applies --connect-timeout and --read-timeout. http.Client.Timeout can't be used,
+// it limits the whole request including reading the body, which kills dumps streaming a big table
+// for longer than the timeout. The read timeout only limits the wait for response headers.
+func newTransport(config *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	if config.ConnectTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.ConnectTimeout
+	}
+	transport.ResponseHeaderTimeout = config.ReadTimeout
+	return transport
+}
+
+// defaultUserAgent is sent when Config.UserAgent is empty.
+const defaultUserAgent = "clickhouse-dump"
+
+// userAgent returns the User-Agent of ClickHouse and S3 requests.
+func (c *Config) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	return defaultUserAgent
+}
+
+type queryTableKey struct{}
+
+// withQueryTable marks queries run with ctx as queries of table, they get a query_id naming it.
+func withQueryTable(ctx context.Context, table string) context.Context {
+	return context.WithValue(ctx, queryTableKey{}, table)
+}
+
+type querySettingsKey struct{}
+
+// withQuerySettings sends settings as URL parameters with the queries run with ctx, see --safe-mode.
+func withQuerySettings(ctx context.Context, settings map[string]string) context.Context {
+	if len(settings) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, querySettingsKey{}, settings)
+}
+
+// queryID returns the query_id of a query run with ctx, or "" to let ClickHouse generate one
+// for queries which don't belong to a table.
+func (c *ClickHouseClient) queryID(ctx context.Context) string {
+	table, ok := ctx.Value(queryTableKey{}).(string)
+	if !ok {
+		return ""
+	}
+	id := fmt.Sprintf("%s-%s-%d", c.runID, table, c.querySeq.Add(1))
+	if c.config.QueryIDPrefix != "" {
+		id = c.config.QueryIDPrefix + "-" + id
+	}
+	return id
+}
+
+// newRequest creates a POST request to the ClickHouse HTTP interface with authentication,
+// User-Agent, the query_id of table queries and the settings of ctx. Parameters set by the caller
+// take precedence over the settings of ctx.
+func (c *ClickHouseClient) newRequest(ctx context.Context, params url.Values, body io.Reader) (*http.Request, error) {
+	settings, _ := ctx.Value(querySettingsKey{}).(map[string]string)
+	for key, value := range settings {
+		if !params.Has(key) {
+			params.Set(key, value)
+		}
+	}
+	if id := c.queryID(ctx); id != "" {
+		params.Set("query_id", id)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.queryURL(params), body)
+	if err != nil {
+		return nil, err
+	}
+	c.setAuth(req)
+	req.Header.Set("User-Agent", c.config.userAgent())
+	for key, value := range c.config.Headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+func (c *ClickHouseClient) ExecuteQuery(ctx context.Context, query string) ([]byte, error) {
+	body, _, err := c.ExecuteQueryStreaming(ctx, query, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	return io.ReadAll(body)
+}
+
+// ExecuteQueryStreaming runs query and returns the response body with its Content-Encoding. Queries
+// rejected because the server already runs max_concurrent_queries are sent again up to --ch-retries times.
+func (c *ClickHouseClient) ExecuteQueryStreaming(ctx context.Context, query string, compressFormat string) (io.ReadCloser, string, error) {
+	for attempt := 1; ; attempt++ {
+		body, contentEncoding, err := c.executeQueryStreaming(ctx, query, compressFormat)
+		var busy *tooManyQueriesError
+		if !errors.As(err, &busy) || attempt > c.config.CHRetries {
+			return body, contentEncoding, err
+		}
+		delay := chRetryDelay(attempt)
+		if busy.suggested {
+			delay = busy.retryAfter
+		}
+		logging.Warnf("ClickHouse runs too many queries, retrying %s... in %s (%d/%d)", firstNChars(query, 80), delay, attempt, c.config.CHRetries)
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// tooManyQueriesError is returned for queries rejected with TOO_MANY_SIMULTANEOUS_QUERIES or
+// HTTP 503, the query didn't run, so it can be sent again.
+type tooManyQueriesError struct {
+	err        error
+	retryAfter time.Duration
+	suggested  bool // the server sent Retry-After
+}
+
+func (e *tooManyQueriesError) Error() string {
+	return e.err.Error()
+}
+
+func (e *tooManyQueriesError) Unwrap() error {
+	return e.err
+}
+
+// tooManyQueriesCode is the exception code of TOO_MANY_SIMULTANEOUS_QUERIES.
+const tooManyQueriesCode = "202"
+
+// checkTooManyQueries wraps err of a failed response into tooManyQueriesError when the server
+// rejected the query because of its concurrency limit.
+func checkTooManyQueries(resp *http.Response, respText []byte, err error) error {
+	if resp.StatusCode != http.StatusServiceUnavailable && resp.Header.Get("X-ClickHouse-Exception-Code") != tooManyQueriesCode && !bytes.Contains(respText, []byte("TOO_MANY_SIMULTANEOUS_QUERIES")) {
+		return err
+	}
+	busy := &tooManyQueriesError{err: err}
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds >= 0 {
+		busy.retryAfter = time.Duration(seconds) * time.Second
+		busy.suggested = true
+	}
+	return busy
+}
+
+// chRetryDelay returns the backoff before retry attempt, 1s doubling up to 30s with jitter,
+// so parallel workers rejected together don't come back at the same moment.
+func chRetryDelay(attempt int) time.Duration {
+	delay := min(time.Second<<(attempt-1), 30*time.Second)
+	return delay/2 + mathRand.N(delay/2+1)
+}
+
+func (c *ClickHouseClient) executeQueryStreaming(ctx context.Context, query string, compressFormat string) (io.ReadCloser, string, error) {
+	if strings.EqualFold(compressFormat, "none") {
+		// Same as no compression, the response is stored as is
+		compressFormat = ""
+	}
+	params := url.Values{}
+	if compressFormat != "" {
+		// enable_http_compression=0 by default for POST without Accept-Encoding
+		params.Set("enable_http_compression", "1")
+	}
+	req, reqErr := c.newRequest(ctx, params, strings.NewReader(query))
+	if reqErr != nil {
+		return nil, "", reqErr
+	}
+
+	// Content-Type остается text/plain, так как это SQL по своей сути.
+	// Content-Encoding укажет на сжатие.
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	// Add Accept-Encoding header if compression format is specified for the response
+	if compressFormat != "" {
+		switch strings.ToLower(compressFormat) {
+		case "gzip":
+			req.Header.Set("Accept-Encoding", "gzip")
+		case "zstd":
+			req.Header.Set("Accept-Encoding", "zstd")
+		}
+	}
+
+	resp, reqErr := c.client.Do(req)
+	if reqErr != nil {
+		return nil, "", reqErr
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		respText := readResponseText(resp)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		return nil, "", checkTooManyQueries(resp, respText, fmt.Errorf("HTTP request POST %s..., failed with status code: %d, response: %s", firstNChars(query, 255), resp.StatusCode, string(respText)))
+	}
+
+	// Some errors come with status 200 and the exception code header, the body holds the message
+	if exceptionCode := resp.Header.Get("X-ClickHouse-Exception-Code"); exceptionCode != "" {
+		respText, _ := io.ReadAll(io.LimitReader(resp.Body, exceptionTailSize))
+		_ = resp.Body.Close()
+		respText = decodeResponse(respText, resp.Header.Get("Content-Encoding"))
+		return nil, "", checkTooManyQueries(resp, respText, fmt.Errorf("HTTP request POST %s..., failed with exception code: %s, response: %s", firstNChars(query, 255), exceptionCode, strings.TrimSpace(string(respText))))
+	}
+
+	// Check if compression was used in the response
+	contentEncoding := resp.Header.Get("Content-Encoding")
+
+	return newExceptionCheckReader(resp.Body, contentEncoding, query), contentEncoding, nil
+}
+
+// ExecuteQueryWithBody отправляет запрос с заданным телом и Content-Encoding.
+// queryForLog используется для логирования в случае ошибки.
+// The response is requested compressed like the body, see acceptEncoding.
+func (c *ClickHouseClient) ExecuteQueryWithBody(ctx context.Context, body io.Reader, contentEncoding string, queryForLog string) ([]byte, error) {
+	params := url.Values{}
+	acceptEncoding := acceptEncoding(params, contentEncoding)
+	req, reqErr := c.newRequest(ctx, params, body)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	resp, reqErr := c.client.Do(req)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		respText := readResponseText(resp)
+		return nil, fmt.Errorf("HTTP request POST %s..., failed with status code: %d, response: %s", firstNChars(queryForLog, 255), resp.StatusCode, string(respText))
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(respBody, resp.Header.Get("Content-Encoding")), nil
+}
+
+// acceptEncoding requests the response of a restore request with a compressed body in the same
+// format, gzip or zstd, and returns the Accept-Encoding to send, "" for uncompressed bodies.
+// ClickHouse compresses responses only with enable_http_compression=1, error messages with the
+// stack trace of a failed INSERT are then sent compressed too.
+func acceptEncoding(params url.Values, contentEncoding string) string {
+	switch strings.ToLower(contentEncoding) {
+	case "gzip", "zstd":
+		params.Set("enable_http_compression", "1")
+		return strings.ToLower(contentEncoding)
+	}
+	return ""
+}
+
+// queryURL builds the ClickHouse HTTP endpoint URL with params and the session_id, if any.
+func (c *ClickHouseClient) queryURL(params url.Values) string {
+	if c.sessionID != "" {
+		params.Set("session_id", c.sessionID)
+	}
+	if c.config.DefaultDatabase != "" {
+		params.Set("database", c.config.DefaultDatabase)
+	}
+	scheme := "http"
+	if c.config.Secure {
+		scheme = "https"
+	}
+	// JoinHostPort brackets IPv6 literals, which may also be passed already bracketed
+	hostPort := net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(c.config.Host, "["), "]"), strconv.Itoa(c.config.Port))
+	u := fmt.Sprintf("%s://%s%s", scheme, hostPort, normalizeHTTPPath(c.config.HTTPPath))
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	return u
+}
+
+// setAuth sends the --ch-access-token as a bearer token, or the user and password with basic auth.
+// Nothing is sent when --ch-header authenticates, ClickHouse rejects basic auth together with
+// X-ClickHouse-User or X-ClickHouse-Key.
+func (c *ClickHouseClient) setAuth(req *http.Request) {
+	if c.config.headerAuth() {
+		return
+	}
+	if c.config.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+		return
+	}
+	req.SetBasicAuth(c.config.User, c.config.Password)
+}
+
+// headerNameRe matches the token characters allowed in HTTP header names.
+var headerNameRe = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// ParseHeaders parses the --ch-header key=value values into headers keyed by canonical name,
+// a repeated header keeps the last value.
+func ParseHeaders(values []string) (map[string]string, error) {
+	headers := make(map[string]string, len(values))
+	for _, value := range values {
+		key, headerValue, ok := strings.Cut(value, "=")
+		key, headerValue = strings.TrimSpace(key), strings.TrimSpace(headerValue)
+		if !ok || !headerNameRe.MatchString(key) {
+			return nil, fmt.Errorf("invalid header %q, expected key=value", value)
+		}
+		if strings.ContainsAny(headerValue, "\r\n") {
+			return nil, fmt.Errorf("invalid header %q, the value must not contain line breaks", key)
+		}
+		headers[http.CanonicalHeaderKey(key)] = headerValue
+	}
+	return headers, nil
+}
+
+// headerAuth reports whether the extra headers carry the ClickHouse credentials.
+func (c *Config) headerAuth() bool {
+	for _, key := range []string{"X-ClickHouse-User", "X-ClickHouse-Key"} {
+		if _, ok := c.Headers[http.CanonicalHeaderKey(key)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHTTPPath turns --ch-path values like "clickhouse", "/clickhouse" or "/clickhouse/"
+// into "/clickhouse/", an empty path means the server root.
+func normalizeHTTPPath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "/"
+	}
+	return "/" + p + "/"
+}
+
+// newSessionID returns a random ClickHouse HTTP session id.
+func newSessionID() string {
+	return "clickhouse-dump-" + randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ExecuteInsert runs an INSERT ... FORMAT query passed in the URL with data streamed as the request body,
+// contentEncoding is set when the body is compressed.
+func (c *ClickHouseClient) ExecuteInsert(ctx context.Context, query string, data io.Reader, contentEncoding string) error {
+	params := url.Values{"query": {query}}
+	acceptEncoding := acceptEncoding(params, contentEncoding)
+	req, reqErr := c.newRequest(ctx, params, data)
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	resp, reqErr := c.client.Do(req)
+	if reqErr != nil {
+		return reqErr
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		respText := readResponseText(resp)
+		return fmt.Errorf("HTTP request POST %s..., failed with status code: %d, response: %s", firstNChars(query, 255), resp.StatusCode, string(respText))
+	}
+	_, err := io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// Helper to get first N characters of a string for logging.
+func firstNChars(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	// Find rune boundary near n
+	i := 0
+	for j := range s {
+		if i >= n {
+			return s[:j]
+		}
+		i++
+	}
+	return s // Should not happen if n < len(s)
+}
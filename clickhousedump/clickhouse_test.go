@@ -0,0 +1,236 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryURL(t *testing.T) {
+	for _, httpPath := range []string{"clickhouse", "/clickhouse", "/clickhouse/", "clickhouse/"} {
+		client := NewClickHouseClient(&Config{Host: "proxy", Port: 8443, HTTPPath: httpPath})
+		require.Equal(t, "http://proxy:8443/clickhouse/?enable_http_compression=1", client.queryURL(url.Values{"enable_http_compression": {"1"}}))
+	}
+	for _, httpPath := range []string{"", "/"} {
+		client := NewClickHouseClient(&Config{Host: "localhost", Port: 8123, HTTPPath: httpPath})
+		require.Equal(t, "http://localhost:8123/", client.queryURL(url.Values{}))
+	}
+	for _, host := range []string{"::1", "[::1]"} {
+		client := NewClickHouseClient(&Config{Host: host, Port: 8123})
+		require.Equal(t, "http://[::1]:8123/", client.queryURL(url.Values{}))
+	}
+	client := NewClickHouseClient(&Config{Host: "2001:db8::1", Port: 8443, Secure: true})
+	require.Equal(t, "https://[2001:db8::1]:8443/", client.queryURL(url.Values{}))
+
+	// --ch-database is added next to the other query parameters
+	client = NewClickHouseClient(&Config{Host: "localhost", Port: 8123, DefaultDatabase: "analytics"})
+	client.sessionID = "s1"
+	require.Equal(t, "http://localhost:8123/?database=analytics&enable_http_compression=1&session_id=s1", client.queryURL(url.Values{"enable_http_compression": {"1"}}))
+}
+
+func TestSetAuth(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://localhost:8123/", nil)
+	require.NoError(t, err)
+	NewClickHouseClient(&Config{User: "default", Password: "secret"}).setAuth(req)
+	user, password, ok := req.BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "default", user)
+	require.Equal(t, "secret", password)
+
+	req, err = http.NewRequest("POST", "https://cloud:8443/", nil)
+	require.NoError(t, err)
+	client := NewClickHouseClient(&Config{Host: "cloud", Port: 8443, User: "default", AccessToken: "jwt", Secure: true})
+	client.setAuth(req)
+	require.Equal(t, "Bearer jwt", req.Header.Get("Authorization"))
+	require.Equal(t, "https://cloud:8443/", client.queryURL(url.Values{}))
+}
+
+func TestNewRequest(t *testing.T) {
+	client := NewClickHouseClient(&Config{Host: "localhost", Port: 8123, QueryIDPrefix: "nightly"})
+	req, err := client.newRequest(context.Background(), url.Values{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "clickhouse-dump", req.Header.Get("User-Agent"))
+	require.Empty(t, req.URL.Query().Get("query_id"), "ClickHouse generates ids of queries outside tables")
+
+	client.config.UserAgent = "clickhouse-dump/1.2.3"
+	ctx := withQueryTable(context.Background(), "db.events")
+	var ids []string
+	for i := 0; i < 2; i++ {
+		req, err = client.newRequest(ctx, url.Values{}, nil)
+		require.NoError(t, err)
+		require.Equal(t, "clickhouse-dump/1.2.3", req.Header.Get("User-Agent"))
+		ids = append(ids, req.URL.Query().Get("query_id"))
+	}
+	require.Equal(t, []string{"nightly-" + client.runID + "-db.events-1", "nightly-" + client.runID + "-db.events-2"}, ids)
+	require.Len(t, client.runID, 8)
+
+	// --safe-mode settings are sent as parameters, the ones set by the query take precedence
+	ctx = withQuerySettings(context.Background(), map[string]string{"readonly": "2", "enable_http_compression": "0"})
+	req, err = client.newRequest(ctx, url.Values{"enable_http_compression": {"1"}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "2", req.URL.Query().Get("readonly"))
+	require.Equal(t, "1", req.URL.Query().Get("enable_http_compression"))
+}
+
+func TestHeaders(t *testing.T) {
+	headers, err := ParseHeaders([]string{"x-clickhouse-user=dump", " X-ClickHouse-Key = s=cret ", "X-Route=eu"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"X-Clickhouse-User": "dump", "X-Clickhouse-Key": "s=cret", "X-Route": "eu"}, headers)
+	for _, invalid := range []string{"X-Route", "=eu", "X Route=eu", "X-Route=eu\r\nHost: evil"} {
+		_, err = ParseHeaders([]string{invalid})
+		require.Error(t, err, invalid)
+	}
+
+	// Credential headers replace basic auth, other headers are sent along with it
+	client := NewClickHouseClient(&Config{Host: "localhost", Port: 8123, User: "default", Password: "secret", Headers: headers})
+	req, err := client.newRequest(context.Background(), url.Values{}, nil)
+	require.NoError(t, err)
+	_, _, ok := req.BasicAuth()
+	require.False(t, ok)
+	require.Equal(t, "dump", req.Header.Get("X-ClickHouse-User"))
+	require.Equal(t, "s=cret", req.Header.Get("X-ClickHouse-Key"))
+	require.Equal(t, "eu", req.Header.Get("X-Route"))
+
+	client = NewClickHouseClient(&Config{Host: "localhost", Port: 8123, User: "default", Password: "secret", Headers: map[string]string{"X-Route": "eu"}})
+	req, err = client.newRequest(context.Background(), url.Values{}, nil)
+	require.NoError(t, err)
+	user, _, ok := req.BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "default", user)
+	require.Equal(t, "eu", req.Header.Get("X-Route"))
+}
+
+func TestSafeModeSettings(t *testing.T) {
+	settings, err := SafeModeSettings(nil)
+	require.NoError(t, err)
+	require.Equal(t, DefaultSafeModeSettings, settings)
+
+	settings, err = SafeModeSettings([]string{"max_execution_time=0", " os_thread_priority = ", "max_threads=2"})
+	require.NoError(t, err)
+	require.Equal(t, "0", settings["max_execution_time"])
+	require.Equal(t, "2", settings["max_threads"])
+	require.NotContains(t, settings, "os_thread_priority")
+	require.Equal(t, "19", DefaultSafeModeSettings["os_thread_priority"], "defaults are not modified")
+
+	for _, invalid := range []string{"readonly", "=1", "max memory=1"} {
+		_, err = SafeModeSettings([]string{invalid})
+		require.Error(t, err, invalid)
+	}
+	require.Equal(t, "max_threads=2, readonly=2", formatSettings(map[string]string{"readonly": "2", "max_threads": "2"}))
+}
+
+func TestClientTimeouts(t *testing.T) {
+	transport := newTransport(&Config{ConnectTimeout: 3 * time.Second, ReadTimeout: time.Minute})
+	require.Equal(t, 3*time.Second, transport.TLSHandshakeTimeout)
+	require.Equal(t, time.Minute, transport.ResponseHeaderTimeout)
+
+	// The read timeout limits the wait for headers, not streaming the body
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query, _ := io.ReadAll(req.Body)
+		if strings.Contains(string(query), "slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		for i := 0; i < 3; i++ {
+			_, _ = io.WriteString(w, "row\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(server.Close)
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	client := NewClickHouseClient(&Config{Host: host, Port: port, ConnectTimeout: time.Second, ReadTimeout: 50 * time.Millisecond})
+
+	body, err := client.ExecuteQuery(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	require.Equal(t, "row\nrow\nrow\n", string(body))
+	_, err = client.ExecuteQuery(context.Background(), "SELECT slow")
+	require.ErrorContains(t, err, "timeout awaiting response headers")
+}
+
+func TestTooManyQueriesRetry(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, "Code: 202. DB::Exception: Too many simultaneous queries. Maximum: 1. (TOO_MANY_SIMULTANEOUS_QUERIES)")
+			return
+		}
+		_, _ = io.WriteString(w, "1\n")
+	}))
+	t.Cleanup(server.Close)
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	client := NewClickHouseClient(&Config{Host: host, Port: port, CHRetries: 3})
+	body, err := client.ExecuteQuery(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+	require.Equal(t, "1\n", string(body))
+	require.Equal(t, int32(3), requests.Load())
+
+	requests.Store(0)
+	client = NewClickHouseClient(&Config{Host: host, Port: port, CHRetries: 1})
+	_, err = client.ExecuteQuery(context.Background(), "SELECT 1")
+	require.ErrorContains(t, err, "TOO_MANY_SIMULTANEOUS_QUERIES")
+	require.Equal(t, int32(2), requests.Load())
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay := chRetryDelay(attempt)
+		require.LessOrEqual(t, delay, 30*time.Second)
+		require.GreaterOrEqual(t, delay, min(time.Second<<(attempt-1), 30*time.Second)/2)
+	}
+}
+
+func TestCompressedErrorResponse(t *testing.T) {
+	const message = "Code: 27. DB::Exception: Cannot parse input: expected '(' before: 'oops'. (CANNOT_PARSE_INPUT_ASSERTION_FAILED)"
+	var acceptEncodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		acceptEncodings = append(acceptEncodings, req.Header.Get("Accept-Encoding"))
+		w.Header().Set("X-ClickHouse-Exception-Code", "27")
+		if req.URL.Query().Get("enable_http_compression") == "1" && req.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusBadRequest)
+			gw := gzip.NewWriter(w)
+			_, _ = io.WriteString(gw, message)
+			_ = gw.Close()
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, message)
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	client := NewClickHouseClient(&Config{Host: host, Port: port})
+
+	var body bytes.Buffer
+	gw := gzip.NewWriter(&body)
+	_, _ = io.WriteString(gw, "INSERT INTO t VALUES oops")
+	require.NoError(t, gw.Close())
+	_, err = client.ExecuteQueryWithBody(context.Background(), bytes.NewReader(body.Bytes()), "gzip", "INSERT INTO t VALUES oops")
+	require.ErrorContains(t, err, message)
+	err = client.ExecuteInsert(context.Background(), "INSERT INTO t FORMAT Native", bytes.NewReader(body.Bytes()), "gzip")
+	require.ErrorContains(t, err, message)
+	_, err = client.ExecuteQueryWithBody(context.Background(), strings.NewReader("INSERT INTO t VALUES oops"), "", "INSERT INTO t VALUES oops")
+	require.ErrorContains(t, err, message)
+	require.Equal(t, []string{"gzip", "gzip"}, acceptEncodings[:2], "responses are requested compressed like the statements")
+}
@@ -0,0 +1,146 @@
+package clickhousedump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// commentsFileSuffix is the kind suffix of the comment files written with --dump-comments.
+const commentsFileSuffix = ".comments.sql"
+
+// commentlessEngines can't be altered with COMMENT COLUMN or MODIFY COMMENT, their comments are
+// only kept in the CREATE statement.
+var commentlessEngines = []string{"View", "MaterializedView", "LiveView", "WindowView", "Dictionary"}
+
+// isCommentsFile reports whether a listed file is a <db>/<table>.comments.sql file, compressed or not.
+func isCommentsFile(file string) bool {
+	return strings.HasSuffix(trimCompressionExt(file), commentsFileSuffix)
+}
+
+// columnComment is a commented column of system.columns.
+type columnComment struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+}
+
+// dumpComments writes the table and column comments of a table as ALTER statements into its
+// comments file, tables without comments get no file.
+func (d *Dumper) dumpComments(ctx context.Context, j tableDumpJob) error {
+	if slices.Contains(commentlessEngines, j.engine) {
+		return nil
+	}
+	query := fmt.Sprintf("SELECT comment FROM system.tables WHERE database=%s AND name=%s FORMAT JSONEachRow", quoteString(j.db), quoteString(j.table))
+	resp, err := d.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to read table comment: %w", err)
+	}
+	var table struct {
+		Comment string `json:"comment"`
+	}
+	if line := bytes.TrimSpace(resp); len(line) > 0 {
+		if err := json.Unmarshal(line, &table); err != nil {
+			return fmt.Errorf("failed to parse table comment: %w", err)
+		}
+	}
+
+	query = fmt.Sprintf("SELECT name, comment FROM system.columns WHERE database=%s AND table=%s AND comment != '' ORDER BY position FORMAT JSONEachRow", quoteString(j.db), quoteString(j.table))
+	resp, err = d.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to read column comments: %w", err)
+	}
+	var columns []columnComment
+	scanner := bufio.NewScanner(bytes.NewReader(resp))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var column columnComment
+		if err := json.Unmarshal(scanner.Bytes(), &column); err != nil {
+			return fmt.Errorf("failed to parse column comments: %w", err)
+		}
+		columns = append(columns, column)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse column comments: %w", err)
+	}
+
+	statements := commentStatements(j.db, j.table, table.Comment, columns)
+	if statements == "" {
+		d.debugf("No comments on %s.%s", j.db, j.table)
+		return nil
+	}
+	filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, d.layout.commentsFile(j.db, j.table))
+	d.debugf("Uploading %d column comments of %s.%s", len(columns), j.db, j.table)
+	return d.uploadSchema(filename, strings.NewReader(statements), "")
+}
+
+// commentStatements returns the ALTER statements restoring the comments of a table, one per line,
+// or "" when there are none.
+func commentStatements(db, table, tableComment string, columns []columnComment) string {
+	var b strings.Builder
+	if tableComment != "" {
+		_, _ = fmt.Fprintf(&b, "ALTER TABLE `%s`.`%s` MODIFY COMMENT %s;\n", db, table, quoteString(tableComment))
+	}
+	for _, column := range columns {
+		if column.Comment == "" {
+			continue
+		}
+		_, _ = fmt.Fprintf(&b, "ALTER TABLE `%s`.`%s` COMMENT COLUMN `%s` %s;\n", db, table, strings.ReplaceAll(column.Name, "`", "\\`"), quoteString(column.Comment))
+	}
+	return b.String()
+}
+
+// restoreComments executes the comment files after the table schemas were created, so comments
+// survive schemas rewritten on restore.
+func (r *Restorer) restoreComments(ctx context.Context, files []string) error {
+	var pending []string
+	for _, file := range files {
+		if r.state != nil && r.state.file(file).Done {
+			logging.Infof("Skipping comments %s, already restored by a previous run", file)
+			continue
+		}
+		pending = append(pending, file)
+	}
+	errs := r.forEachParallel(pending, r.config.schemaParallel(), func(file string) error {
+		reader, err := r.storage.Download(file)
+		if err != nil && r.skipDownloadError(file, err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download comments file: %w", err)
+		}
+		defer closeDownload(reader, file)
+		count := 0
+		err = scanStatements(reader, func(statement string) error {
+			count++
+			if _, execErr := r.client.ExecuteQuery(ctx, statement); execErr != nil {
+				return fmt.Errorf("failed to restore comment: %w", execErr)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if r.state != nil {
+			if err := r.state.record(file, restoreFileState{Done: true}); err != nil {
+				return err
+			}
+		}
+		db, table := r.layout.commentsTable(file)
+		r.debugf("Restored %d comments of %s.%s from %s", count, db, table, file)
+		return nil
+	})
+	if len(errs) > 0 {
+		logging.Errorf("%s", summarizeErrors(errs, len(pending), "comments files"))
+		return &PartialFailureError{Err: fmt.Errorf("failed during comment restoration: %w", errors.Join(errs...))}
+	}
+	logging.Infof("Restored comments of %d tables", len(pending))
+	return nil
+}
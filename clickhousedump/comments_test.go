@@ -0,0 +1,43 @@
+package clickhousedump
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommentStatements(t *testing.T) {
+	require.Equal(t, "", commentStatements("db", "t", "", nil))
+	require.Equal(t, "", commentStatements("db", "t", "", []columnComment{{Name: "id"}}))
+
+	statements := commentStatements("db", "t", "it's\nmultiline", []columnComment{
+		{Name: "id", Comment: "row id"},
+		{Name: "we`ird", Comment: `back\slash; 'quoted'`},
+	})
+	require.Equal(t, "ALTER TABLE `db`.`t` MODIFY COMMENT 'it\\'s\nmultiline';\n"+
+		"ALTER TABLE `db`.`t` COMMENT COLUMN `id` 'row id';\n"+
+		"ALTER TABLE `db`.`t` COMMENT COLUMN `we\\`ird` 'back\\\\slash; \\'quoted\\'';\n", statements)
+
+	// Restore splits the file back into the same statements
+	var scanned []string
+	require.NoError(t, scanStatements(strings.NewReader(statements), func(statement string) error {
+		scanned = append(scanned, statement)
+		return nil
+	}))
+	require.Len(t, scanned, 3)
+	require.Equal(t, "ALTER TABLE `db`.`t` COMMENT COLUMN `we\\`ird` 'back\\\\slash; \\'quoted\\'';", scanned[2])
+}
+
+func TestCommentsFile(t *testing.T) {
+	layout, err := newFileLayout("tables/{db}/{table}")
+	require.NoError(t, err)
+	require.Equal(t, "tables/db/t.comments.sql", layout.commentsFile("db", "t"))
+	db, table := layout.commentsTable("backups/b1/tables/db/t.comments.sql.gz")
+	require.Equal(t, "db", db)
+	require.Equal(t, "t", table)
+
+	require.True(t, isCommentsFile("backups/b1/db/t.comments.sql.zstd"))
+	require.False(t, isCommentsFile("backups/b1/db/t.comments.sql.data.sql"))
+	require.False(t, isFunctionFile("backups/b1/functions/t.comments.sql"))
+}
@@ -0,0 +1,302 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressFormatAuto picks the compression per dumped file: schema files are compressed
+// with gzip, data files with zstd when the table takes at least autoZstdMinBytes on disk.
+const CompressFormatAuto = "auto"
+
+// autoZstdMinBytes is the on-disk table size from which --compress-format=auto uses zstd,
+// zstd compresses large dumps much faster while gzip is as good for small files.
+const autoZstdMinBytes = 64 * 1024 * 1024
+
+// schemaCompression returns the --schema-compress-format of schema files, --compress-format by default.
+func (c *Config) schemaCompression() string {
+	if c.SchemaCompressFormat != "" {
+		return c.SchemaCompressFormat
+	}
+	return c.CompressFormat
+}
+
+// dataCompression returns the --data-compress-format of data files, --compress-format by default.
+func (c *Config) dataCompression() string {
+	if c.DataCompressFormat != "" {
+		return c.DataCompressFormat
+	}
+	return c.CompressFormat
+}
+
+// wireCompression returns the --wire-compress-format of dump queries, the format of the stored file by default.
+func (c *Config) wireCompression(compressFormat string) string {
+	if c.WireCompressFormat != "" {
+		return c.WireCompressFormat
+	}
+	return compressFormat
+}
+
+// queryStreaming runs a dump query for a file stored with compressFormat. A response compressed
+// with another --wire-compress-format is decompressed here, so Upload compresses it again.
+func (d *Dumper) queryStreaming(ctx context.Context, query, compressFormat string) (io.ReadCloser, string, error) {
+	body, contentEncoding, err := d.client.ExecuteQueryStreaming(ctx, query, d.config.wireCompression(compressFormat))
+	if err != nil || contentEncoding == "" || strings.EqualFold(contentEncoding, compressFormat) {
+		return body, contentEncoding, err
+	}
+	decoder, err := newResponseDecoder(body, contentEncoding)
+	if err != nil {
+		_ = body.Close()
+		return nil, "", err
+	}
+	d.debugf("Transcoding %s response to %s", contentEncoding, compressFormat)
+	return &decodedBody{ReadCloser: decoder, body: body}, "", nil
+}
+
+// decodedBody reads a decompressed response, Close closes the decoder and the response body.
+type decodedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	_ = b.ReadCloser.Close()
+	return b.body.Close()
+}
+
+// schemaCompressFormat returns the compression of database, table and function schema files.
+func (d *Dumper) schemaCompressFormat() string {
+	format := d.config.schemaCompression()
+	if strings.EqualFold(format, CompressFormatAuto) {
+		return "gzip"
+	}
+	return format
+}
+
+// dataCompressFormat returns the compression of the data files of a table.
+func (d *Dumper) dataCompressFormat(ctx context.Context, dbName, tableName string) (string, error) {
+	format := d.config.dataCompression()
+	if !strings.EqualFold(format, CompressFormatAuto) {
+		return format, nil
+	}
+	resp, err := d.client.ExecuteQuery(ctx, fmt.Sprintf("SELECT ifNull(total_bytes, 0) FROM system.tables WHERE database='%s' AND name='%s' FORMAT TSVRaw", dbName, tableName))
+	if err != nil {
+		return "", fmt.Errorf("failed to get size of %s.%s: %w", dbName, tableName, err)
+	}
+	totalBytes, err := strconv.ParseInt(strings.TrimSpace(string(resp)), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("can't parse size of %s.%s: %w", dbName, tableName, err)
+	}
+	format = autoCompressFormat(totalBytes)
+	d.debugf("Table %s.%s takes %d bytes, compressing its data with %s", dbName, tableName, totalBytes, format)
+	return format, nil
+}
+
+// adaptiveSampleSize is the prefix of a data file sampled by --adaptive-compression.
+const adaptiveSampleSize = 1024 * 1024
+
+// adaptiveMaxRatio is the compressed to plain size ratio of the sample above which
+// --adaptive-compression stores a data file uncompressed.
+const adaptiveMaxRatio = 0.9
+
+// sampleCompression reads a sample from the start of body and returns a reader of the whole body
+// and the compressed to plain size ratio of the sample. A body compressed by ClickHouse with
+// contentEncoding is measured by decompressing the sample, a plain body by compressing it with
+// the fastest level of compressFormat, which is close enough to tell incompressible data.
+func sampleCompression(body io.Reader, contentEncoding, compressFormat string) (io.Reader, float64, error) {
+	sample := make([]byte, adaptiveSampleSize)
+	n, err := io.ReadFull(body, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, err
+	}
+	sample = sample[:n]
+	whole := io.MultiReader(bytes.NewReader(sample), body)
+
+	var plainSize, compressedSize int
+	if contentEncoding != "" {
+		decoder, err := newResponseDecoder(bytes.NewReader(sample), contentEncoding)
+		if err != nil {
+			return nil, 0, err
+		}
+		decoded, err := io.Copy(io.Discard, decoder)
+		_ = decoder.Close()
+		// The sample usually ends in the middle of the compressed stream
+		if err != nil && decoded == 0 {
+			return nil, 0, err
+		}
+		plainSize, compressedSize = int(decoded), n
+	} else {
+		var compressed bytes.Buffer
+		var w io.WriteCloser
+		switch compressFormat {
+		case "gzip":
+			if w, err = gzip.NewWriterLevel(&compressed, gzip.BestSpeed); err != nil {
+				return nil, 0, err
+			}
+		default:
+			if w, err = zstd.NewWriter(&compressed, zstd.WithEncoderLevel(zstd.SpeedFastest)); err != nil {
+				return nil, 0, err
+			}
+		}
+		_, _ = w.Write(sample)
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+		plainSize, compressedSize = n, compressed.Len()
+	}
+	if plainSize == 0 {
+		return whole, 0, nil
+	}
+	return whole, float64(compressedSize) / float64(plainSize), nil
+}
+
+func autoCompressFormat(totalBytes int64) string {
+	if totalBytes >= autoZstdMinBytes {
+		return "zstd"
+	}
+	return "gzip"
+}
+
+// storedCompression returns the compression a file uploaded with contentEncoding and
+// compressFormat is stored with: gzip, zstd or none.
+func storedCompression(contentEncoding, compressFormat string) string {
+	compression := strings.ToLower(cmp.Or(contentEncoding, compressFormat))
+	if compression != "gzip" && compression != "zstd" {
+		return "none"
+	}
+	return compression
+}
+
+// fileCompression returns the compression of a listed file by its extension: gzip, zstd or none.
+func fileCompression(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(file, ".zstd"):
+		return "zstd"
+	}
+	return "none"
+}
+
+// manifestCompressions returns the compression the manifest records per file name.
+func manifestCompressions(manifest *Manifest) map[string]string {
+	recorded := make(map[string]string)
+	if manifest != nil {
+		for _, mf := range manifest.Files {
+			if mf.Compression != "" {
+				recorded[mf.Name] = mf.Compression
+			}
+		}
+	}
+	return recorded
+}
+
+// resetDecoding drops the compression records and zstd dictionaries kept by the storage, a storage
+// shared with NewRestorerWith still holds those of the backup restored before.
+func (r *Restorer) resetDecoding() {
+	if decoder, ok := r.storage.(storage.Decoder); ok {
+		decoder.ResetDecoding()
+	}
+}
+
+// recordFileCompressions makes downloads read the listed files by the compression the manifest
+// records for them, so files stay readable when renamed and uncompressed data is never mistaken
+// for a compressed stream. Files without record are read by their content and name.
+func (r *Restorer) recordFileCompressions(files []string, manifest *Manifest) {
+	recorded := manifestCompressions(manifest)
+	decoder, ok := r.storage.(storage.Decoder)
+	if len(recorded) == 0 || !ok {
+		return
+	}
+	count := 0
+	for _, file := range files {
+		if compression, ok := recorded[trimCompressionExt(r.backupRelPath(file))]; ok {
+			decoder.SetFileCompression(file, compression)
+			count++
+		}
+	}
+	r.debugf("Reading %d files by the compression recorded in the manifest", count)
+}
+
+// checkCompressFormat logs the compression of the schema and data files of a backup, recorded in
+// the manifest or inferred from their extensions, and warns when the compress format flags passed
+// to restore disagree. Restore decompresses every file by its record, magic number or extension
+// whatever the flags say, the warning points at the misconfiguration, e.g. a --compress-format
+// meant for --restore-compress-format. Uncompressed data files are expected, they may have been
+// stored so by --adaptive-compression.
+func (r *Restorer) checkCompressFormat(files []string, manifest *Manifest) {
+	recorded := manifestCompressions(manifest)
+	transparent := r.config.CompressionMode == storage.CompressionModeTransparent
+	if transparent && len(recorded) == 0 {
+		r.debugf("Backup files are stored with --compression-mode=transparent, their compression isn't visible in their names")
+		return
+	}
+	// expect returns the passed flag which sets the compression of a kind of files and its value
+	expect := func(flag, override string) (string, string) {
+		switch {
+		case override != "":
+			return flag, override
+		case r.config.CompressFormatSet:
+			return "--compress-format", r.config.CompressFormat
+		}
+		return "", ""
+	}
+	schemaFlag, schemaExpected := expect("--schema-compress-format", r.config.SchemaCompressFormat)
+	dataFlag, dataExpected := expect("--data-compress-format", r.config.DataCompressFormat)
+
+	counts := make(map[string]int)
+	mismatched := make(map[string]string) // flag to the compression of the files disagreeing with it
+	for _, file := range files {
+		compression, ok := recorded[trimCompressionExt(r.backupRelPath(file))]
+		if !ok {
+			if transparent {
+				continue
+			}
+			compression = fileCompression(file)
+		}
+		var flag, expected string
+		switch {
+		case isDatabaseFile(file) || isSchemaFile(file) || isCommentsFile(file):
+			flag, expected = schemaFlag, schemaExpected
+		case dataFileFormat(file) != "":
+			flag, expected = dataFlag, dataExpected
+			if expected != "" && compression == "none" {
+				expected = "none"
+			}
+		default:
+			continue
+		}
+		counts[compression]++
+		if expected != "" && expected != CompressFormatAuto && expected != compression {
+			mismatched[flag+"="+expected] = compression
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	formats := make([]string, 0, len(counts))
+	for compression, count := range counts {
+		formats = append(formats, fmt.Sprintf("%s (%d files)", compression, count))
+	}
+	sort.Strings(formats)
+	logging.Infof("Backup files are compressed with %s", strings.Join(formats, ", "))
+	flags := make([]string, 0, len(mismatched))
+	for flag := range mismatched {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	for _, flag := range flags {
+		logging.Warnf("%s doesn't match the backup, which has files compressed with %s. Restore decompresses files by their content and extension, the flag only applies to dumps; use --restore-compress-format to compress restored statements", flag, mismatched[flag])
+	}
+}
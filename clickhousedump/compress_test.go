@@ -0,0 +1,242 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+func TestAutoCompressFormat(t *testing.T) {
+	require.Equal(t, "gzip", autoCompressFormat(0))
+	require.Equal(t, "gzip", autoCompressFormat(autoZstdMinBytes-1))
+	require.Equal(t, "zstd", autoCompressFormat(autoZstdMinBytes))
+
+	d := &Dumper{config: &Config{CompressFormat: "Auto"}}
+	require.Equal(t, "gzip", d.schemaCompressFormat())
+	d.config.CompressFormat = "zstd"
+	require.Equal(t, "zstd", d.schemaCompressFormat())
+}
+
+func TestPerPhaseCompressFormat(t *testing.T) {
+	d := &Dumper{config: &Config{CompressFormat: "zstd", SchemaCompressFormat: "none"}}
+	require.Equal(t, "none", d.schemaCompressFormat())
+	format, err := d.dataCompressFormat(context.Background(), "db", "t")
+	require.NoError(t, err)
+	require.Equal(t, "zstd", format, "data files keep --compress-format")
+
+	d.config.SchemaCompressFormat = ""
+	d.config.DataCompressFormat = "gzip"
+	require.Equal(t, "zstd", d.schemaCompressFormat(), "schema files keep --compress-format")
+	format, err = d.dataCompressFormat(context.Background(), "db", "t")
+	require.NoError(t, err)
+	require.Equal(t, "gzip", format)
+
+	d.config.SchemaCompressFormat = CompressFormatAuto
+	require.Equal(t, "gzip", d.schemaCompressFormat())
+}
+
+func TestQueryStreamingWireCompressFormat(t *testing.T) {
+	const rows = "INSERT INTO `db`.`t` (`id`) VALUES (1), (2);\n"
+	d := &Dumper{config: &Config{WireCompressFormat: "zstd"}, client: newStreamingServer(t, rows, nil)}
+	for _, tc := range []struct {
+		compressFormat, contentEncoding string
+	}{
+		// Same format on the wire and at rest, passed through to Upload
+		{"zstd", "zstd"},
+		// Transcoded, Upload compresses the plain text with gzip
+		{"gzip", ""},
+		{"none", ""},
+	} {
+		body, contentEncoding, err := d.queryStreaming(context.Background(), "SELECT * FROM db.t", tc.compressFormat)
+		require.NoError(t, err)
+		require.Equal(t, tc.contentEncoding, contentEncoding, tc.compressFormat)
+		content, err := io.ReadAll(body)
+		require.NoError(t, err)
+		require.NoError(t, body.Close())
+		if contentEncoding == "" {
+			require.Equal(t, rows, string(content), tc.compressFormat)
+		}
+	}
+
+	d.config.WireCompressFormat = ""
+	require.Equal(t, "gzip", d.config.wireCompression("gzip"))
+	d.config.WireCompressFormat = "none"
+	body, contentEncoding, err := d.queryStreaming(context.Background(), "SELECT * FROM db.t", "gzip")
+	require.NoError(t, err)
+	require.Empty(t, contentEncoding)
+	require.NoError(t, body.Close())
+}
+
+func TestSampleCompression(t *testing.T) {
+	blobs := make([]byte, 3*adaptiveSampleSize)
+	_, err := rand.Read(blobs)
+	require.NoError(t, err)
+	text := []byte(strings.Repeat("INSERT INTO `db`.`t` (`id`, `name`) VALUES (1, 'name');\n", 50000))
+
+	for _, format := range []string{"gzip", "zstd"} {
+		whole, ratio, err := sampleCompression(bytes.NewReader(blobs), "", format)
+		require.NoError(t, err)
+		require.Greater(t, ratio, adaptiveMaxRatio, format)
+		content, err := io.ReadAll(whole)
+		require.NoError(t, err)
+		require.Equal(t, blobs, content, "the sample is put back")
+
+		_, ratio, err = sampleCompression(bytes.NewReader(text), "", format)
+		require.NoError(t, err)
+		require.Less(t, ratio, 0.1, format)
+	}
+
+	// Responses compressed by ClickHouse are measured on a decompressed sample
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	compressedBlobs := zw.EncodeAll(blobs, nil)
+	_, ratio, err := sampleCompression(bytes.NewReader(compressedBlobs), "zstd", "zstd")
+	require.NoError(t, err)
+	require.Greater(t, ratio, adaptiveMaxRatio)
+	_, ratio, err = sampleCompression(bytes.NewReader(zw.EncodeAll(text, nil)), "zstd", "zstd")
+	require.NoError(t, err)
+	require.Less(t, ratio, 0.1)
+
+	_, ratio, err = sampleCompression(bytes.NewReader(nil), "", "gzip")
+	require.NoError(t, err)
+	require.Zero(t, ratio)
+}
+
+func TestUploadDataAdaptiveCompression(t *testing.T) {
+	blobs := make([]byte, 2*adaptiveSampleSize)
+	_, err := rand.Read(blobs)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	d := &Dumper{
+		config:  &Config{AdaptiveCompression: true, BackupName: "adaptive", StorageConfig: map[string]string{"path": dir}, DataFormat: DataFormatNative},
+		client:  newStreamingServer(t, string(blobs), nil),
+		storage: fileStorage,
+	}
+	filename := filepath.Join(dir, "adaptive", "db", "t.data.native")
+	require.NoError(t, d.uploadData(context.Background(), "db", "t", "SELECT * FROM db.t FORMAT Native", filename, "zstd"))
+
+	// Stored without the .zstd extension, the content is the plain response
+	stored, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, blobs, stored)
+	require.Equal(t, []ManifestFile{{Name: "db/t.data.native", Format: DataFormatNative, Compression: "none"}}, d.files)
+}
+
+func TestCheckCompressFormat(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	files := []string{
+		"backups/b1/manifest.json",
+		"backups/b1/db.database.sql.gz",
+		"backups/b1/db/t.schema.sql.gz",
+		"backups/b1/db/t.data.sql.gz",
+		"backups/b1/db/small.data.sql",
+	}
+	manifest := &Manifest{Files: []ManifestFile{{Name: "db/small.data.sql", Format: DataFormatSQLInsert, Compression: "none"}}}
+	restore := func(config *Config) string {
+		buf.Reset()
+		config.StorageConfig = map[string]string{"path": "backups"}
+		config.BackupName = "b1"
+		r := &Restorer{config: config}
+		r.checkCompressFormat(files, manifest)
+		return buf.String()
+	}
+
+	// The default --compress-format isn't compared, it only applies to dumps
+	out := restore(&Config{CompressFormat: "zstd"})
+	require.Equal(t, "Backup files are compressed with gzip (3 files), none (1 files)\n", out)
+	// Data files stored uncompressed by --adaptive-compression match
+	out = restore(&Config{CompressFormat: "gzip", CompressFormatSet: true})
+	require.NotContains(t, out, "Warning")
+	out = restore(&Config{CompressFormat: "zstd", CompressFormatSet: true})
+	require.Contains(t, out, "Warning: --compress-format=zstd doesn't match the backup, which has files compressed with gzip")
+	out = restore(&Config{CompressFormat: "gzip", DataCompressFormat: "zstd"})
+	require.Contains(t, out, "Warning: --data-compress-format=zstd doesn't match the backup")
+	require.NotContains(t, out, "--schema-compress-format")
+	out = restore(&Config{CompressFormat: CompressFormatAuto, CompressFormatSet: true})
+	require.NotContains(t, out, "Warning")
+	// Names don't tell the compression of transparent backups, only the manifest does
+	out = restore(&Config{CompressFormat: "zstd", CompressFormatSet: true, CompressionMode: storage.CompressionModeTransparent})
+	require.Equal(t, "Backup files are compressed with none (1 files)\n", out)
+	manifest = nil
+	out = restore(&Config{CompressFormat: "zstd", CompressFormatSet: true, CompressionMode: storage.CompressionModeTransparent})
+	require.Empty(t, out)
+
+	// Recorded compressions win over the extensions of renamed files
+	manifest = &Manifest{Files: []ManifestFile{{Name: "db/t.schema.sql", Compression: "zstd"}, {Name: "db/t.data.sql", Compression: "zstd"}}}
+	out = restore(&Config{CompressFormat: "zstd", CompressFormatSet: true})
+	require.Contains(t, out, "Backup files are compressed with gzip (1 files), none (1 files), zstd (2 files)")
+}
+
+func TestManifestCompressionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	config := &Config{BackupName: "mixed", StorageConfig: map[string]string{"path": dir}, CompressLevel: 3}
+	d := &Dumper{config: config, storage: fileStorage}
+	prefix := filepath.Join(dir, "mixed")
+	schema := "CREATE TABLE db.t (id UInt64) ENGINE = MergeTree ORDER BY id"
+	data := strings.Repeat("INSERT INTO db.t VALUES (1);\n", 100)
+	// Uncompressed Native data of a tiny table starting like a zstd frame
+	tiny := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, "tiny"...)
+	require.NoError(t, d.upload(filepath.Join(prefix, "db", "t.schema.sql"), strings.NewReader(schema), "", "gzip", ManifestFile{}))
+	require.NoError(t, d.upload(filepath.Join(prefix, "db", "t.data.sql"), strings.NewReader(data), "", "zstd", ManifestFile{Format: DataFormatSQLInsert}))
+	require.NoError(t, d.upload(filepath.Join(prefix, "db", "tiny.data.native"), bytes.NewReader(tiny), "", "none", ManifestFile{Format: DataFormatNative}))
+	require.NoError(t, d.writeManifest())
+	require.ElementsMatch(t, []ManifestFile{
+		{Name: "db/t.schema.sql", Compression: "gzip"},
+		{Name: "db/t.data.sql", Format: DataFormatSQLInsert, Compression: "zstd"},
+		{Name: "db/tiny.data.native", Format: DataFormatNative, Compression: "none"},
+	}, d.files)
+
+	// Renamed without extension the files are still read by the manifest
+	require.NoError(t, os.Rename(filepath.Join(prefix, "db", "t.schema.sql.gz"), filepath.Join(prefix, "db", "t.schema.sql")))
+	files, err := fileStorage.List(prefix, true)
+	require.NoError(t, err)
+	manifestFile, found := findManifest(files, "mixed")
+	require.True(t, found)
+	manifest, err := readManifest(fileStorage, manifestFile)
+	require.NoError(t, err)
+	r := &Restorer{config: config, storage: fileStorage}
+	r.recordFileCompressions(files, manifest)
+	for name, want := range map[string]string{"t.schema.sql": schema, "t.data.sql.zstd": data, "tiny.data.native": string(tiny)} {
+		reader, err := fileStorage.Download(filepath.Join(prefix, "db", name))
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err, name)
+		require.NoError(t, reader.Close())
+		require.Equal(t, want, string(content), name)
+	}
+
+	// The records belong to this storage and this restore, another backup isn't read by them
+	otherStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	r.resetDecoding()
+	for _, s := range []storage.RemoteStorage{fileStorage, otherStorage} {
+		reader, err := s.Download(filepath.Join(prefix, "db", "tiny.data.native"))
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.Error(t, err, "without the record the zstd magic number is decompressed")
+		require.NoError(t, reader.Close())
+	}
+}
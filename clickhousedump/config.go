@@ -0,0 +1,205 @@
+// Package clickhousedump dumps ClickHouse databases and tables as SQL files into
+// remote storage and restores them back, it is the library behind the clickhouse-dump CLI.
+package clickhousedump
+
+import "time"
+
+// Config holds the ClickHouse connection, filtering and storage settings of a dump or restore.
+// StorageConfig keys are storage specific, e.g. "path", "bucket", "region", "endpoint".
+type Config struct {
+	Host                string
+	Port                int
+	User                string
+	Password            string
+	AccessToken         string // Sent as a bearer token instead of User and Password when set
+	Secure              bool   // Connect over HTTPS
+	HTTPPath            string
+	DefaultDatabase     string // Sent as the database parameter of every query, resolves unqualified table names
+	Databases           string
+	ExcludeDatabases    string
+	Tables              string
+	ExcludeTables       string
+	ExcludeColumns      string
+	DumpQueries         map[string]string // SELECT queries replacing SELECT * for "db.table" keys, see LoadDumpQueries
+	BatchSize           int
+	DataFormat          string
+	StorageType         string
+	StorageConfig       map[string]string
+	CompressFormat      string
+	CompressLevel       int
+	CompressionMode     string
+	BackupName          string
+	Debug               bool
+	Parallel            int
+	SchemaParallel      int // Database and table schema workers, 0 means Parallel
+	DataParallel        int // Table data workers, 0 means Parallel
+	TmpDir              string
+	RestoreMaxQuerySize int
+	ListRetries         int
+	SkipDataEngines     []string
+	ChunkRows           int
+	Mirrors             []MirrorConfig
+	TableTimeout        time.Duration
+	ContinueOnError     bool
+	FailIfExists        bool // Fail when the backup name already holds files
+	Overwrite           bool // Delete the files of the backup name before dumping
+	StripUUID           bool
+	IncludeFunctions    bool // Dump SQL user-defined functions into <backup>/functions
+	// IncludeNamedCollections dumps named collections with their secrets into <backup>/named_collections
+	IncludeNamedCollections bool
+	Freeze                  bool // ALTER TABLE FREEZE MergeTree tables before dumping data, experimental
+	Final                   bool // SELECT ... FINAL from Replacing, Collapsing and other merge-collapsing MergeTree tables
+	AllowSystem             bool // Dump the system and information_schema databases if the filters match them
+	ZstdDict                bool // Compress schema files with a zstd dictionary trained on them, requires zstd schema compression
+	ResumeRestore           bool
+	// TableOrder orders tables on dump and data files on restore: name, size or rows
+	TableOrder string
+	// PreDumpSQL, PostDumpSQL, PreRestoreSQL and PostRestoreSQL are hooks run around dump and
+	// restore, each is a path to an SQL file or inline statements separated by semicolons
+	PreDumpSQL       string
+	PostDumpSQL      string
+	PreRestoreSQL    string
+	PostRestoreSQL   string
+	IgnoreHookErrors bool
+	// RestoreCompressFormat compresses restored statements sent to ClickHouse and requests their
+	// responses in it: gzip, zstd or none, backup files are decompressed according to their own format
+	RestoreCompressFormat string
+	// SchemaCompressFormat and DataCompressFormat override CompressFormat for schema
+	// and data files, empty keeps CompressFormat
+	SchemaCompressFormat string
+	DataCompressFormat   string
+	// WireCompressFormat is the compression requested from ClickHouse for dump queries: gzip, zstd
+	// or none, empty requests the format of the stored file. Other formats are transcoded by the client
+	WireCompressFormat string
+	// UserAgent is sent with every ClickHouse and S3 request, "clickhouse-dump" when empty
+	UserAgent string
+	// QueryIDPrefix starts the query_id of table queries, followed by a run id, the table and
+	// a sequence number, so they can be found in system.query_log
+	QueryIDPrefix string
+	// Latest restores the most recent backup whose name contains BackupName and matches the
+	// BackupMatch regexp, unless a backup named exactly BackupName exists
+	Latest      bool
+	BackupMatch string
+	// StripSettings lists engine SETTINGS keys removed from restored schemas, e.g. settings unknown
+	// to an older server, StripAllSettings removes the whole engine SETTINGS clause
+	StripSettings    []string
+	StripAllSettings bool
+	// MinFreeSpace is the number of bytes which must stay free on the ClickHouse default disk and
+	// the temp dir after restore, checked before anything is restored, 0 disables the check
+	MinFreeSpace int64
+	// Consistent runs all dump queries in one ClickHouse HTTP session, which serializes them,
+	// Parallel, SchemaParallel and DataParallel are taken as 1
+	Consistent bool
+	// RestoreStatementParallel executes the statements of one SQLInsert data file on this many
+	// connections at a time, 0 or 1 executes them one by one. Incompatible with ResumeRestore
+	RestoreStatementParallel int
+	// AdaptiveCompression stores data files uncompressed when a sample of their data barely
+	// compresses, e.g. tables of already compressed blobs
+	AdaptiveCompression bool
+	// ConnectTimeout limits connecting to ClickHouse including the TLS handshake, ReadTimeout
+	// limits the wait for response headers, the body is streamed without a limit. 0 means no limit
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	// SkipFiles are globs of backup files left out of restore, matched against the path relative
+	// to the backup. SkipMissing skips files missing from storage or failing to download
+	SkipFiles   []string
+	SkipMissing bool
+	// VerifyUpload sends checksums with S3, OCI and azblob uploads, so corrupted uploads are
+	// rejected by the server instead of stored
+	VerifyUpload bool
+	// LiteralNames makes Databases, ExcludeDatabases, Tables and ExcludeTables comma-separated
+	// lists of exact names instead of regexps, for names like logs.2024
+	LiteralNames bool
+	// Layout is the path template of table files relative to the backup, see DefaultLayout.
+	// Restore uses the layout recorded in the manifest and Layout for backups without manifest
+	Layout string
+	// CHRetries is how many times a query rejected with TOO_MANY_SIMULTANEOUS_QUERIES or HTTP 503
+	// is sent again, with backoff or after the Retry-After of the server
+	CHRetries int
+	// LocalCache keeps a local copy of every uploaded file in this directory, PreferLocalCache
+	// makes restore read the local copy when it exists instead of downloading the file
+	LocalCache       string
+	PreferLocalCache bool
+	// MaxInflightBytes bounds the total_bytes of tables dumping data at once next to the
+	// --data-parallel table count, 0 means no limit
+	MaxInflightBytes int64
+	// SafeModeSettings are sent as URL parameters with the queries dumping the backup, not with
+	// the hooks, see DefaultSafeModeSettings. Nil without --safe-mode
+	SafeModeSettings map[string]string
+	// VerifySchema compares the create_table_query of restored tables with their schema files,
+	// differences are warnings, or fail the restore with VerifySchemaStrict
+	VerifySchema       bool
+	VerifySchemaStrict bool
+	// WaitReplicas is how long restore waits after the schemas for the distributed DDL queue to
+	// drain and Replicated databases to sync before restoring data, 0 doesn't wait
+	WaitReplicas time.Duration
+	// Archive stores the files of a backup in the single tar object <backup>.tar instead of
+	// one object per file
+	Archive bool
+	// DumpComments writes the table and column comments of every table into
+	// <table>.comments.sql as ALTER statements, restore applies them after the schemas
+	DumpComments bool
+	// CompressFormatSet is set when --compress-format was passed, restore warns when it
+	// disagrees with the compression of the backup files
+	CompressFormatSet bool
+	// RestoreAsyncInsert sends restored INSERT statements with async_insert=1 and
+	// wait_for_async_insert=1, so the server batches the rows of many small INSERTs
+	RestoreAsyncInsert bool
+	// FailFast cancels the running table dumps at the first failure instead of dumping the
+	// remaining tables
+	FailFast bool
+	// Only restores just these db.table tables, with their databases, instead of the whole backup
+	Only []string
+	// SchemaOnly restores schemas without data, with Only the schema files are fetched by name
+	// without listing the backup
+	SchemaOnly bool
+	// CreateBucket creates a missing s3, oci or gcs bucket before using it, azblob containers are
+	// always created
+	CreateBucket bool
+	// Headers are extra HTTP headers sent with every ClickHouse request, keyed by canonical name,
+	// see ParseHeaders. X-ClickHouse-User or X-ClickHouse-Key replace basic auth
+	Headers map[string]string
+	// SQLInsertOmitColumnNames dumps SQLInsert data without the column list, restoring it needs
+	// the same column order in the target table
+	SQLInsertOmitColumnNames bool
+	// SQLInsertUnquotedNames dumps SQLInsert column names without backquotes
+	SQLInsertUnquotedNames bool
+	// SQLInsertUseReplace dumps SQLInsert data as REPLACE INTO statements for MySQL-compatible
+	// targets, restore loads them as INSERT INTO
+	SQLInsertUseReplace bool
+	// VerifyAfterDump downloads every dumped file and reads it through the decompressor to EOF
+	// before the manifest is written, so truncated compressed files fail the dump
+	VerifyAfterDump bool
+	// ServerLocalRestore makes ClickHouse read the Native and Parquet data files of file storage
+	// from its own disk with the file table function instead of streaming them over HTTP
+	ServerLocalRestore bool
+}
+
+// schemaParallel and dataParallel are 1 with Consistent, ClickHouse rejects concurrent queries
+// of one session with SESSION_IS_LOCKED.
+func (c *Config) schemaParallel() int {
+	if c.Consistent {
+		return 1
+	}
+	if c.SchemaParallel > 0 {
+		return c.SchemaParallel
+	}
+	return max(c.Parallel, 1)
+}
+
+func (c *Config) dataParallel() int {
+	if c.Consistent {
+		return 1
+	}
+	if c.DataParallel > 0 {
+		return c.DataParallel
+	}
+	return max(c.Parallel, 1)
+}
+
+// MirrorConfig is an additional storage every dumped file is also written to,
+// StorageConfig uses the same keys as Config.StorageConfig.
+type MirrorConfig struct {
+	StorageType   string
+	StorageConfig map[string]string
+}
@@ -0,0 +1,20 @@
+package clickhousedump
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhaseParallel(t *testing.T) {
+	config := &Config{Parallel: 4}
+	require.Equal(t, 4, config.schemaParallel())
+	require.Equal(t, 4, config.dataParallel())
+
+	config.SchemaParallel = 16
+	config.DataParallel = 2
+	require.Equal(t, 16, config.schemaParallel())
+	require.Equal(t, 2, config.dataParallel())
+
+	require.Equal(t, 1, (&Config{}).schemaParallel(), "zero Parallel from library callers must not deadlock")
+}
@@ -0,0 +1,144 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const identPattern = "(`[^`]+`|\"[^\"]+\"|\\w+)"
+
+var (
+	// FROM db.t, JOIN t, TO db.t of views and materialized views
+	tableRefRe = regexp.MustCompile(`(?i)\b(?:FROM|JOIN|TO)\s+` + identPattern + `(?:\s*\.\s*` + identPattern + `)?`)
+	// dictGet('db.dict', ...) and the other dictGet* functions
+	dictGetRe = regexp.MustCompile(`(?i)\bdict\w*\s*\(\s*'([^']+)'`)
+	// SOURCE(CLICKHOUSE(... DB 'db' TABLE 't')) of dictionaries
+	dictSourceRe      = regexp.MustCompile(`(?is)\bSOURCE\s*\(\s*CLICKHOUSE\s*\((.*?)\)\s*\)`)
+	dictSourceDBRe    = regexp.MustCompile(`(?i)\bDB\s+'([^']+)'`)
+	dictSourceTableRe = regexp.MustCompile(`(?i)\bTABLE\s+'([^']+)'`)
+	// ENGINE = Distributed(cluster, db, table, ...) and ENGINE = Buffer(db, table, ...)
+	proxyEngineRe = regexp.MustCompile(`(?i)\bENGINE\s*=\s*(Distributed|Buffer)\s*\(([^)]*)\)`)
+)
+
+// schemaObject returns "db.table" of a schema file like ".../db/table.schema.sql.gz".
+func schemaObject(layout fileLayout, file string) string {
+	db, table := layout.schemaTable(file)
+	return db + "." + table
+}
+
+func unquoteIdent(ident string) string {
+	return strings.Trim(strings.TrimSpace(ident), "`\"'")
+}
+
+// schemaReferences returns the "db.table" objects a CREATE statement of an object in database db
+// refers to: view and materialized view sources and targets, dictionary sources, dictGet calls
+// and the tables behind Distributed and Buffer engines. Unknown names are harmless, callers only
+// keep references to objects they restore.
+func schemaReferences(db, stmt string) []string {
+	var refs []string
+	add := func(refDB, table string) {
+		if refDB == "" {
+			refDB = db
+		}
+		refs = append(refs, unquoteIdent(refDB)+"."+unquoteIdent(table))
+	}
+	for _, m := range tableRefRe.FindAllStringSubmatch(stmt, -1) {
+		if m[2] == "" {
+			add("", m[1])
+		} else {
+			add(m[1], m[2])
+		}
+	}
+	for _, m := range dictGetRe.FindAllStringSubmatch(stmt, -1) {
+		if refDB, table, ok := strings.Cut(m[1], "."); ok {
+			add(refDB, table)
+		} else {
+			add("", m[1])
+		}
+	}
+	for _, m := range dictSourceRe.FindAllStringSubmatch(stmt, -1) {
+		table := dictSourceTableRe.FindStringSubmatch(m[1])
+		if table == nil {
+			continue
+		}
+		refDB := ""
+		if dbMatch := dictSourceDBRe.FindStringSubmatch(m[1]); dbMatch != nil {
+			refDB = dbMatch[1]
+		}
+		add(refDB, table[1])
+	}
+	for _, m := range proxyEngineRe.FindAllStringSubmatch(stmt, -1) {
+		args := strings.Split(m[2], ",")
+		first := 0
+		if strings.EqualFold(m[1], "Distributed") {
+			first = 1
+		}
+		if len(args) > first+1 {
+			add(args[first], args[first+1])
+		}
+	}
+	return refs
+}
+
+// schemaLevels orders schema files by their references, every level only refers to objects
+// created by earlier levels, so the files of one level can be restored in parallel.
+// schemas maps schema files to their CREATE statements, a reference cycle is an error.
+func schemaLevels(layout fileLayout, schemas map[string]string) ([][]string, error) {
+	fileByObject := make(map[string]string, len(schemas))
+	for file := range schemas {
+		fileByObject[schemaObject(layout, file)] = file
+	}
+	dependsOn := make(map[string][]string, len(schemas))
+	dependents := make(map[string][]string, len(schemas))
+	for file, stmt := range schemas {
+		object := schemaObject(layout, file)
+		db, _, _ := strings.Cut(object, ".")
+		for _, ref := range schemaReferences(db, stmt) {
+			refFile, ok := fileByObject[ref]
+			if !ok || refFile == file || slices.Contains(dependsOn[file], refFile) {
+				continue
+			}
+			dependsOn[file] = append(dependsOn[file], refFile)
+			dependents[refFile] = append(dependents[refFile], file)
+		}
+	}
+
+	remaining := make(map[string]int, len(schemas))
+	var level []string
+	for file := range schemas {
+		remaining[file] = len(dependsOn[file])
+		if remaining[file] == 0 {
+			level = append(level, file)
+		}
+	}
+	var levels [][]string
+	ordered := 0
+	for len(level) > 0 {
+		slices.Sort(level)
+		levels = append(levels, level)
+		ordered += len(level)
+		var next []string
+		for _, file := range level {
+			for _, dependent := range dependents[file] {
+				remaining[dependent]--
+				if remaining[dependent] == 0 {
+					next = append(next, dependent)
+				}
+			}
+		}
+		level = next
+	}
+	if ordered < len(schemas) {
+		var cycle []string
+		for file, n := range remaining {
+			if n > 0 {
+				cycle = append(cycle, schemaObject(layout, file))
+			}
+		}
+		slices.Sort(cycle)
+		return nil, fmt.Errorf("schema references form a cycle, can't order %s", strings.Join(cycle, ", "))
+	}
+	return levels, nil
+}
@@ -0,0 +1,48 @@
+package clickhousedump
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaReferences(t *testing.T) {
+	require.ElementsMatch(t, []string{"db.events", "db.totals"},
+		schemaReferences("db", "CREATE MATERIALIZED VIEW db.mv TO db.totals (`id` UInt64) AS SELECT id FROM db.events"))
+	require.ElementsMatch(t, []string{"other.t", "db.users"},
+		schemaReferences("db", "CREATE VIEW db.v (`id` UInt64) AS SELECT id FROM `other`.`t` AS a LEFT JOIN users AS b USING (id)"))
+	require.ElementsMatch(t, []string{"db.users", "db.cities"},
+		schemaReferences("db", "CREATE DICTIONARY db.d (`id` UInt64, `city` String EXPRESSION dictGet('db.cities', 'name', city_id)) PRIMARY KEY id SOURCE(CLICKHOUSE(DB 'db' TABLE 'users')) LIFETIME(0) LAYOUT(FLAT())"))
+	require.ElementsMatch(t, []string{"db.events_local"},
+		schemaReferences("db", "CREATE TABLE db.events (`id` UInt64) ENGINE = Distributed('cluster', 'db', 'events_local', rand())"))
+	require.ElementsMatch(t, []string{"db.events"},
+		schemaReferences("db", "CREATE TABLE db.events_buffer (`id` UInt64) ENGINE = Buffer(db, events, 1, 10, 100, 10000, 1000000, 10000000, 100000000)"))
+}
+
+func TestSchemaLevels(t *testing.T) {
+	schemas := map[string]string{
+		"b/db/events.schema.sql.gz":      "CREATE TABLE db.events (`id` UInt64) ENGINE = MergeTree ORDER BY id",
+		"b/db/totals.schema.sql.gz":      "CREATE TABLE db.totals (`id` UInt64) ENGINE = SummingMergeTree ORDER BY id",
+		"b/db/mv.schema.sql.gz":          "CREATE MATERIALIZED VIEW db.mv TO db.totals (`id` UInt64) AS SELECT id FROM db.events",
+		"b/db/dict.schema.sql.gz":        "CREATE DICTIONARY db.dict (`id` UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(TABLE 'totals')) LIFETIME(0) LAYOUT(FLAT())",
+		"b/db/by_dict.schema.sql.gz":     "CREATE VIEW db.by_dict (`id` UInt64) AS SELECT dictGet('db.dict', 'id', number) AS id FROM numbers(10)",
+		"b/other/independent.schema.sql": "CREATE TABLE other.independent (`id` UInt64) ENGINE = Log",
+		"b/db/events_all.schema.sql.gz":  "CREATE TABLE db.events_all (`id` UInt64) ENGINE = Distributed('cluster', 'db', 'events', rand())",
+		"b/db/missing_source.schema.sql": "CREATE VIEW db.missing_source AS SELECT * FROM db.missing_source_table",
+		"b/db/from_system.schema.sql.gz": "CREATE VIEW db.from_system AS SELECT * FROM system.tables",
+	}
+	levels, err := schemaLevels(fileLayout{}, schemas)
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"b/db/events.schema.sql.gz", "b/db/from_system.schema.sql.gz", "b/db/missing_source.schema.sql", "b/db/totals.schema.sql.gz", "b/other/independent.schema.sql"},
+		{"b/db/dict.schema.sql.gz", "b/db/events_all.schema.sql.gz", "b/db/mv.schema.sql.gz"},
+		{"b/db/by_dict.schema.sql.gz"},
+	}, levels)
+
+	_, err = schemaLevels(fileLayout{}, map[string]string{
+		"b/db/a.schema.sql": "CREATE VIEW db.a AS SELECT * FROM db.b",
+		"b/db/b.schema.sql": "CREATE VIEW db.b AS SELECT * FROM db.a",
+		"b/db/c.schema.sql": "CREATE TABLE db.c (`id` UInt64) ENGINE = Log",
+	})
+	require.ErrorContains(t, err, "cycle, can't order db.a, db.b")
+}
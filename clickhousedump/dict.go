@@ -0,0 +1,131 @@
+package clickhousedump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/Slach/clickhouse-dump/logging"
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+// schemaDictFile is the zstd dictionary of the schema files of a backup dumped with --zstd-dict.
+const schemaDictFile = "schema.dict"
+
+const (
+	// schemaDictMaxSize limits the trained dictionary, schema files of one backup share
+	// engine clauses, settings and column types, which fit in a few KB.
+	schemaDictMaxSize = 64 * 1024
+	// schemaDictMinSamples is the number of tables from which a dictionary pays for itself.
+	schemaDictMinSamples = 8
+)
+
+// trainSchemaDict trains a zstd dictionary on the CREATE statements of the dumped tables and
+// stores it in the backup. With too few tables or a failed training the dump goes on without it.
+func (d *Dumper) trainSchemaDict(ctx context.Context) error {
+	query := fmt.Sprintf("SELECT create_table_query FROM system.tables WHERE %s SETTINGS format_display_secrets_in_show_and_select=1 FORMAT JSONEachRow", d.tablesWhere())
+	resp, err := d.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to read schema samples for --zstd-dict: %w", err)
+	}
+	var samples [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(resp))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var row struct {
+			CreateTableQuery string `json:"create_table_query"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("failed to parse schema samples for --zstd-dict: %w", err)
+		}
+		samples = append(samples, []byte(row.CreateTableQuery))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse schema samples for --zstd-dict: %w", err)
+	}
+	if len(samples) < schemaDictMinSamples {
+		logging.Infof("Only %d tables to dump, compressing schemas without a zstd dictionary", len(samples))
+		return nil
+	}
+
+	trained, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: schemaDictMaxSize,
+		HashBytes:   6,
+		ZstdLevel:   zstd.EncoderLevelFromZstd(d.config.CompressLevel),
+	})
+	if err != nil {
+		logging.Warnf("failed to train zstd dictionary on %d schemas, compressing schemas without it: %v", len(samples), err)
+		return nil
+	}
+	filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, schemaDictFile)
+	if err := d.upload(filename, bytes.NewReader(trained), "", "none", ManifestFile{}); err != nil {
+		return fmt.Errorf("failed to upload zstd dictionary: %w", err)
+	}
+	d.schemaDict = trained
+	logging.Infof("Trained a %d bytes zstd dictionary on %d schemas", len(trained), len(samples))
+	return nil
+}
+
+// uploadSchema stores a database, table or function schema file. With a trained dictionary the
+// plain body is compressed with it here and uploaded as pre-compressed zstd.
+func (d *Dumper) uploadSchema(filename string, body io.Reader, contentEncoding string) error {
+	if d.schemaDict == nil {
+		return d.upload(filename, body, contentEncoding, d.schemaCompressFormat(), ManifestFile{})
+	}
+	return d.upload(filename, compressWithDict(body, d.schemaDict, d.config.CompressLevel), "zstd", "zstd", ManifestFile{})
+}
+
+// compressWithDict returns a reader of body compressed with zstd and dictionary zstdDict.
+func compressWithDict(body io.Reader, zstdDict []byte, level int) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := zstd.NewWriter(pw, zstd.WithEncoderDict(zstdDict), zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		if err != nil {
+			_ = pw.CloseWithError(fmt.Errorf("failed to create zstd writer with dictionary: %w", err))
+			return
+		}
+		_, copyErr := io.Copy(zw, body)
+		closeErr := zw.Close()
+		if copyErr != nil {
+			_ = pw.CloseWithError(copyErr)
+			return
+		}
+		_ = pw.CloseWithError(closeErr)
+	}()
+	return pr
+}
+
+// loadSchemaDict registers the zstd dictionary of a backup dumped with --zstd-dict,
+// so the schema files compressed with it can be downloaded.
+func (r *Restorer) loadSchemaDict(files []string) error {
+	for _, file := range files {
+		if path.Base(file) != schemaDictFile {
+			continue
+		}
+		decoder, ok := r.storage.(storage.Decoder)
+		if !ok {
+			return fmt.Errorf("storage %T can't decompress with the zstd dictionary %s", r.storage, file)
+		}
+		reader, err := r.storage.Download(file)
+		if err != nil {
+			return fmt.Errorf("failed to download zstd dictionary %s: %w", file, err)
+		}
+		content, err := io.ReadAll(reader)
+		closeDownload(reader, file)
+		if err != nil {
+			return fmt.Errorf("failed to read zstd dictionary %s: %w", file, err)
+		}
+		if err := decoder.AddZstdDictionary(content); err != nil {
+			return fmt.Errorf("failed to load zstd dictionary %s: %w", file, err)
+		}
+		logging.Infof("Loaded zstd dictionary from %s", file)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+func TestCompressWithDictRestore(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 50; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("CREATE TABLE db.events_%d (`id` UInt64, `ts` DateTime64(3), `payload` String CODEC(ZSTD(3))) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/db/events_%d', '{replica}') PARTITION BY toYYYYMM(ts) ORDER BY (id, ts) SETTINGS index_granularity = 8192", i, i)))
+	}
+	trained, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: schemaDictMaxSize, HashBytes: 6})
+	require.NoError(t, err)
+
+	stmt := strings.Replace(string(samples[7]), "events_7", "events_new", 2)
+	compressed, err := io.ReadAll(compressWithDict(strings.NewReader(stmt), trained, 3))
+	require.NoError(t, err)
+	require.Less(t, len(compressed), len(stmt)/4, "the dictionary should cover most of a similar schema")
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "events_new.schema.sql.zstd"), compressed, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, schemaDictFile), trained, 0o644))
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+
+	r := &Restorer{config: &Config{}, storage: fileStorage}
+	require.NoError(t, r.loadSchemaDict([]string{"db/t.schema.sql.zstd", schemaDictFile}))
+	reader, err := fileStorage.Download("events_new.schema.sql.zstd")
+	require.NoError(t, err)
+	restored, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, stmt, string(restored))
+
+	// The dictionary is kept by this storage until the restore resets it
+	otherStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	r.resetDecoding()
+	for _, s := range []storage.RemoteStorage{fileStorage, otherStorage} {
+		reader, err := s.Download("events_new.schema.sql.zstd")
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.Error(t, err)
+		require.NoError(t, reader.Close())
+	}
+}
@@ -0,0 +1,238 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// schemaDefinition is a database or table CREATE statement read from a backup.
+type schemaDefinition struct {
+	stmt string // whitespace collapsed for display
+	key  string // tokens without whitespace and comments, for comparison
+}
+
+func newSchemaDefinition(stmt string) schemaDefinition {
+	stmt = strings.TrimSuffix(strings.TrimSpace(stripUUID(normalizeSchema(stmt))), ";")
+	return schemaDefinition{stmt: strings.Join(strings.Fields(stmt), " "), key: tokenKey(tokenizeSQL(stmt))}
+}
+
+func tokenKey(tokens []sqlToken) string {
+	texts := make([]string, len(tokens))
+	for i, t := range tokens {
+		texts[i] = t.text
+	}
+	return strings.Join(texts, " ")
+}
+
+// schemaColumn is an element of the column list of a CREATE statement: a column, index,
+// projection or constraint.
+type schemaColumn struct {
+	name string
+	def  string
+	key  string
+}
+
+// schemaColumns returns the column list of a table, view or dictionary statement and the key of
+// the statement without it, no columns for statements without a list like CREATE TABLE ... AS
+// other. The list is the first top-level parentheses before the ENGINE, AS, PRIMARY KEY or
+// SOURCE clause.
+func schemaColumns(stmt string) ([]schemaColumn, string) {
+	tokens := tokenizeSQL(stmt)
+	open := -1
+	for i, t := range tokens {
+		if t.isKeyword("ENGINE") || t.isKeyword("AS") || t.isKeyword("PRIMARY") || t.isKeyword("SOURCE") {
+			break
+		}
+		if t.depth == 0 && t.text == "(" {
+			open = i
+			break
+		}
+	}
+	if open < 0 {
+		return nil, tokenKey(tokens)
+	}
+	var columns []schemaColumn
+	start := open + 1
+	for i := open + 1; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.depth == 1 && t.text == "," || t.depth == 0 {
+			if element := tokens[start:i]; len(element) > 0 {
+				columns = append(columns, newSchemaColumn(stmt, element))
+			}
+			start = i + 1
+		}
+		if t.depth == 0 {
+			rest := append(append([]sqlToken{}, tokens[:open+1]...), tokens[i:]...)
+			return columns, tokenKey(rest)
+		}
+	}
+	return columns, tokenKey(tokens[:open+1])
+}
+
+func newSchemaColumn(stmt string, element []sqlToken) schemaColumn {
+	name := "column " + unquoteIdent(element[0].text)
+	for _, kw := range []string{"INDEX", "PROJECTION", "CONSTRAINT"} {
+		if strings.EqualFold(element[0].text, kw) && len(element) > 1 {
+			name = strings.ToLower(kw) + " " + unquoteIdent(element[1].text)
+			break
+		}
+	}
+	def := strings.Join(strings.Fields(stmt[element[0].start:element[len(element)-1].end]), " ")
+	return schemaColumn{name: name, def: def, key: tokenKey(element)}
+}
+
+// loadBackupSchemas reads the database and table schemas of r.config.BackupName by object,
+// "database db" or "table db.table".
+func (r *Restorer) loadBackupSchemas() (map[string]schemaDefinition, error) {
+	backupPrefix := path.Join(r.config.StorageConfig["path"], r.config.BackupName)
+	files, err := r.storage.List(backupPrefix, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup %s: %w", r.config.BackupName, err)
+	}
+	if len(files) == 0 {
+		return nil, &ConfigError{Err: fmt.Errorf("backup %s not found under %s", r.config.BackupName, r.config.StorageConfig["path"])}
+	}
+	var manifest *Manifest
+	if manifestFile, found := findManifest(files, r.config.BackupName); found {
+		if manifest, err = readManifest(r.storage, manifestFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.setLayout(manifest); err != nil {
+		return nil, err
+	}
+	r.resetDecoding()
+	defer r.resetDecoding()
+	if err := r.loadSchemaDict(files); err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]schemaDefinition)
+	for _, file := range files {
+		var object string
+		switch {
+		case isDatabaseFile(file) && !isFunctionFile(file) && !isNamedCollectionFile(file):
+			object = "database " + strings.TrimSuffix(path.Base(trimCompressionExt(file)), ".database.sql")
+		case isSchemaFile(file):
+			object = "table " + schemaObject(r.layout, file)
+		default:
+			continue
+		}
+		reader, err := r.storage.Download(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", file, err)
+		}
+		content, err := io.ReadAll(reader)
+		closeDownload(reader, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		schemas[object] = newSchemaDefinition(string(content))
+	}
+	logging.Infof("Read %d database and table schemas of backup %s", len(schemas), r.config.BackupName)
+	return schemas, nil
+}
+
+// DiffBackups compares the database and table schemas of backups a and b in the configured storage
+// and writes added, removed and changed objects to w, changed tables with their column differences.
+// Statements are compared ignoring whitespace, comments and UUIDs.
+func DiffBackups(config *Config, a, b string, w io.Writer) error {
+	s, err := newBackupStorage(config)
+	if err != nil {
+		return &ConnectionError{Err: fmt.Errorf("failed to initialize storage: %w", err)}
+	}
+	defer func() {
+		if closeErr := s.Close(); closeErr != nil {
+			logging.Warnf("failed to close storage connection: %v", closeErr)
+		}
+	}()
+
+	var schemas [2]map[string]schemaDefinition
+	for i, name := range []string{a, b} {
+		backupConfig := *config
+		backupConfig.BackupName = name
+		r := &Restorer{config: &backupConfig, storage: s}
+		if schemas[i], err = r.loadBackupSchemas(); err != nil {
+			return err
+		}
+	}
+	writeSchemaDiff(w, schemas[0], schemas[1])
+	return nil
+}
+
+// writeSchemaDiff writes "+" for objects only in b, "-" for objects only in a and "~" for changed ones.
+func writeSchemaDiff(w io.Writer, a, b map[string]schemaDefinition) {
+	objects := make([]string, 0, len(a)+len(b))
+	for object := range a {
+		objects = append(objects, object)
+	}
+	for object := range b {
+		if _, ok := a[object]; !ok {
+			objects = append(objects, object)
+		}
+	}
+	sort.Strings(objects)
+
+	changes := 0
+	for _, object := range objects {
+		before, inA := a[object]
+		after, inB := b[object]
+		switch {
+		case !inA:
+			_, _ = fmt.Fprintf(w, "+ %s\n", object)
+		case !inB:
+			_, _ = fmt.Fprintf(w, "- %s\n", object)
+		case before.key != after.key:
+			_, _ = fmt.Fprintf(w, "~ %s\n", object)
+			writeColumnDiff(w, before, after)
+		default:
+			continue
+		}
+		changes++
+	}
+	if changes == 0 {
+		_, _ = fmt.Fprintln(w, "No schema differences")
+	}
+}
+
+// writeColumnDiff writes the column differences of a changed statement, or both statements
+// when the difference is outside the column list, e.g. in the engine or its settings.
+func writeColumnDiff(w io.Writer, before, after schemaDefinition) {
+	columnsA, restA := schemaColumns(before.stmt)
+	columnsB, restB := schemaColumns(after.stmt)
+	byName := make(map[string]schemaColumn, len(columnsA))
+	for _, c := range columnsA {
+		byName[c.name] = c
+	}
+	seen := make(map[string]bool, len(columnsB))
+	columnsChanged := false
+	for _, c := range columnsB {
+		seen[c.name] = true
+		old, ok := byName[c.name]
+		switch {
+		case !ok:
+			_, _ = fmt.Fprintf(w, "    + %s\n", c.def)
+		case old.key != c.key:
+			_, _ = fmt.Fprintf(w, "    ~ %s -> %s\n", old.def, c.def)
+		default:
+			continue
+		}
+		columnsChanged = true
+	}
+	for _, c := range columnsA {
+		if !seen[c.name] {
+			_, _ = fmt.Fprintf(w, "    - %s\n", c.def)
+			columnsChanged = true
+		}
+	}
+	// Changes outside the column list, or only the order of columns changed
+	if !columnsChanged || restA != restB {
+		_, _ = fmt.Fprintf(w, "    - %s\n", before.stmt)
+		_, _ = fmt.Fprintf(w, "    + %s\n", after.stmt)
+	}
+}
@@ -0,0 +1,49 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBackups(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	write("a/shop.database.sql", "CREATE DATABASE shop ENGINE = Atomic")
+	write("a/shop/orders.schema.sql", "CREATE TABLE shop.orders UUID '11111111-1111-1111-1111-111111111111' (`id` UInt64, `status` UInt8, INDEX idx_status status TYPE set(0) GRANULARITY 1) ENGINE = MergeTree ORDER BY id")
+	write("a/shop/tmp.schema.sql", "CREATE TABLE shop.tmp (`id` UInt64) ENGINE = Memory")
+	write("a/shop/same.schema.sql", "CREATE TABLE shop.same (`id` UInt64)\nENGINE = MergeTree\nORDER BY id")
+	write("a/shop/engine.schema.sql", "CREATE TABLE shop.engine (`id` UInt64) ENGINE = MergeTree ORDER BY id")
+
+	write("b/shop.database.sql", "CREATE DATABASE shop ENGINE = Atomic")
+	write("b/audit.database.sql", "CREATE DATABASE audit ENGINE = Atomic")
+	write("b/shop/orders.schema.sql", "CREATE TABLE shop.orders UUID '22222222-2222-2222-2222-222222222222' (`id` UInt64, `status` LowCardinality(String), `discount` Decimal(9, 2)) ENGINE = MergeTree ORDER BY id")
+	write("b/shop/same.schema.sql", "CREATE TABLE shop.same (`id` UInt64) ENGINE = MergeTree ORDER BY id;")
+	write("b/shop/engine.schema.sql", "CREATE TABLE shop.engine (`id` UInt64) ENGINE = ReplacingMergeTree ORDER BY id")
+
+	config := &Config{StorageType: "file", StorageConfig: map[string]string{"path": dir}}
+	var out bytes.Buffer
+	require.NoError(t, DiffBackups(config, "a", "b", &out))
+	require.Equal(t, `+ database audit
+~ table shop.engine
+    - CREATE TABLE shop.engine (`+"`id`"+` UInt64) ENGINE = MergeTree ORDER BY id
+    + CREATE TABLE shop.engine (`+"`id`"+` UInt64) ENGINE = ReplacingMergeTree ORDER BY id
+~ table shop.orders
+    ~ `+"`status`"+` UInt8 -> `+"`status`"+` LowCardinality(String)
+    + `+"`discount`"+` Decimal(9, 2)
+    - INDEX idx_status status TYPE set(0) GRANULARITY 1
+- table shop.tmp
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, DiffBackups(config, "a", "a", &out))
+	require.Equal(t, "No schema differences\n", out.String())
+
+	require.Error(t, DiffBackups(config, "a", "missing", &out))
+}
@@ -0,0 +1,98 @@
+package clickhousedump
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// checkFreeSpace fails the restore before anything is written when the backup doesn't fit.
+// The ClickHouse default disk needs the whole backup size plus MinFreeSpace, the temp dir
+// needs room for the largest files buffered by parallel S3 downloads plus MinFreeSpace.
+func (r *Restorer) checkFreeSpace(ctx context.Context, files []string) error {
+	if r.config.MinFreeSpace <= 0 {
+		return nil
+	}
+	sizes := make([]int64, 0, len(files))
+	var total int64
+	for _, file := range files {
+		size, err := r.storage.Size(file)
+		if err != nil {
+			return fmt.Errorf("failed to get size of %s for free space check: %w", file, err)
+		}
+		sizes = append(sizes, size)
+		total += size
+	}
+	logging.Infof("Backup %s takes %d bytes in storage", r.config.BackupName, total)
+
+	resp, err := r.client.ExecuteQuery(ctx, "SELECT free_space FROM system.disks WHERE name='default' FORMAT TSVRaw")
+	if err != nil {
+		return fmt.Errorf("failed to get free space of ClickHouse default disk: %w", err)
+	}
+	if text := strings.TrimSpace(string(resp)); text != "" {
+		diskFree, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return fmt.Errorf("can't parse free space of ClickHouse default disk %q: %w", text, err)
+		}
+		if err := requireFreeSpace("ClickHouse default disk", diskFree, total, r.config.MinFreeSpace); err != nil {
+			return err
+		}
+	}
+
+	if !r.config.buffersDownloads() {
+		return nil
+	}
+	tmpDir := r.config.TmpDir
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	tmpFree, err := freeSpace(tmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to get free space of temp dir %s: %w", tmpDir, err)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] > sizes[j] })
+	var buffered int64
+	for _, size := range sizes[:min(len(sizes), max(r.config.Parallel, 1))] {
+		buffered += size
+	}
+	return requireFreeSpace("temp dir "+tmpDir, int64(tmpFree), buffered, r.config.MinFreeSpace)
+}
+
+func requireFreeSpace(where string, free, needed, minFree int64) error {
+	logging.Infof("Free space on %s: %d bytes, restore needs %d bytes plus --min-free-space %d", where, free, needed, minFree)
+	if free-needed < minFree {
+		return fmt.Errorf("not enough free space on %s: %d bytes free, %d bytes needed plus --min-free-space %d", where, free, needed, minFree)
+	}
+	return nil
+}
+
+// buffersDownloads reports whether downloads of the storage or one of its mirrors are buffered in TmpDir.
+func (c *Config) buffersDownloads() bool {
+	if buffersDownloads(c.StorageType, c.StorageConfig) {
+		return true
+	}
+	for _, mirror := range c.Mirrors {
+		if buffersDownloads(mirror.StorageType, mirror.StorageConfig) {
+			return true
+		}
+	}
+	return false
+}
+
+// buffersDownloads reports whether a storage downloads files into the temp dir before reading them,
+// s3 and oci always do, azblob does for large blobs with azblob_download_concurrency above 1.
+func buffersDownloads(storageType string, storageConfig map[string]string) bool {
+	switch storageType {
+	case "s3", "oci":
+		return true
+	case "azblob":
+		concurrency, _ := strconv.Atoi(storageConfig["azblob_download_concurrency"])
+		return concurrency > 1
+	}
+	return false
+}
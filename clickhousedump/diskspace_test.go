@@ -0,0 +1,58 @@
+package clickhousedump
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeSpace(t *testing.T) {
+	free, err := freeSpace(t.TempDir())
+	require.NoError(t, err)
+	require.Greater(t, free, uint64(0))
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	diskFree := "1000"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprintln(w, diskFree)
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "backup"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "backup", "db.database.sql"), make([]byte, 300), 0o644))
+	s, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	files, err := s.List("backup", true)
+	require.NoError(t, err)
+
+	config := &Config{Host: host, Port: port, StorageType: "file", MinFreeSpace: 500}
+	r := &Restorer{config: config, client: NewClickHouseClient(config), storage: s}
+	require.NoError(t, r.checkFreeSpace(context.Background(), files))
+
+	diskFree = "700"
+	require.ErrorContains(t, r.checkFreeSpace(context.Background(), files), "not enough free space on ClickHouse default disk")
+}
+
+func TestBuffersDownloads(t *testing.T) {
+	require.True(t, (&Config{StorageType: "s3"}).buffersDownloads())
+	require.False(t, (&Config{StorageType: "azblob", StorageConfig: map[string]string{"azblob_download_concurrency": "1"}}).buffersDownloads())
+	require.True(t, (&Config{StorageType: "azblob", StorageConfig: map[string]string{"azblob_download_concurrency": "8"}}).buffersDownloads())
+	require.True(t, (&Config{StorageType: "file", Mirrors: []MirrorConfig{{StorageType: "oci"}}}).buffersDownloads())
+	require.False(t, (&Config{StorageType: "sftp"}).buffersDownloads())
+}
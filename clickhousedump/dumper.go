@@ -0,0 +1,977 @@
+package clickhousedump
+
+import (
+	_ "bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+	"github.com/Slach/clickhouse-dump/storage"
+	"golang.org/x/sync/semaphore"
+)
+
+type Dumper struct {
+	config  *Config
+	client  *ClickHouseClient
+	storage storage.RemoteStorage
+	// ownsStorage is set when the Dumper created storage and Close closes it
+	ownsStorage bool
+	// archive is storage with --archive, finished at the end of Dump to report its upload
+	archive *storage.ArchiveStorage
+
+	filesMu sync.Mutex
+	files   []ManifestFile
+
+	schemaDict []byte // zstd dictionary of schema files, nil unless trained for --zstd-dict
+
+	frozenMu sync.Mutex
+	frozen   []ManifestFrozenTable // tables frozen with --freeze, unfrozen when the dump finishes
+
+	timer *phaseTimer
+
+	layout fileLayout
+
+	// inflight bounds the total_bytes of tables dumping data at once, nil without --max-inflight-bytes
+	inflight *semaphore.Weighted
+}
+
+// NewDumper creates a Dumper writing into the storage selected by config.StorageType,
+// Close should be called to release the storage connection.
+func NewDumper(config *Config) (*Dumper, error) {
+	layout, err := newFileLayout(config.Layout)
+	if err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+	s, err := newBackupStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	d := newDumper(config, NewClickHouseClient(config), s, layout)
+	d.ownsStorage = true
+	d.archive, _ = s.(*storage.ArchiveStorage)
+	return d, nil
+}
+
+// NewDumperWith creates a Dumper using a client and storage owned by the caller, so several
+// dumps and restores of one process share their connections. Close leaves s open, the storage
+// settings of config other than the path aren't used. A nil client is created from config.
+func NewDumperWith(config *Config, client *ClickHouseClient, s storage.RemoteStorage) (*Dumper, error) {
+	if s == nil {
+		return nil, &ConfigError{Err: fmt.Errorf("storage is required")}
+	}
+	if config.Archive {
+		return nil, &ConfigError{Err: fmt.Errorf("archive dumps need a storage created by NewDumper")}
+	}
+	layout, err := newFileLayout(config.Layout)
+	if err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+	if client == nil {
+		client = NewClickHouseClient(config)
+	}
+	return newDumper(config, client, s, layout), nil
+}
+
+func newDumper(config *Config, client *ClickHouseClient, s storage.RemoteStorage, layout fileLayout) *Dumper {
+	if config.Consistent {
+		// A session runs one query at a time, other users of a shared client keep their own
+		client = client.withSession(newSessionID())
+	}
+	d := &Dumper{
+		config:  config,
+		client:  client,
+		storage: s,
+		layout:  layout,
+	}
+	if config.MaxInflightBytes > 0 {
+		d.inflight = semaphore.NewWeighted(config.MaxInflightBytes)
+	}
+	return d
+}
+
+func (d *Dumper) GetDatabases(ctx context.Context) ([]string, error) {
+	where := make([]string, 0, 3)
+	if !d.config.AllowSystem {
+		where = append(where, "name NOT IN "+systemDatabasesList())
+	}
+	if d.config.Databases != "" {
+		where = append(where, d.nameFilter("name", d.config.Databases))
+	}
+	if d.config.ExcludeDatabases != "" {
+		where = append(where, "NOT "+d.nameFilter("name", d.config.ExcludeDatabases))
+	}
+	query := fmt.Sprintf(`
+		SELECT name 
+		FROM system.databases 
+		WHERE %s 
+		FORMAT TSVRaw`,
+		strings.Join(where, " AND "),
+	)
+
+	resp, err := d.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var databases []string
+	lines := strings.Split(strings.TrimSpace(string(resp)), "\n")
+	for _, line := range lines {
+		if line != "" {
+			databases = append(databases, line)
+		}
+	}
+
+	return databases, nil
+}
+
+func (d *Dumper) dumpDatabaseSchema(ctx context.Context, dbName string) error {
+	query := fmt.Sprintf("SHOW CREATE DATABASE `%s` SETTINGS format_display_secrets_in_show_and_select=1 FORMAT TSVRaw", dbName)
+	respBytes, err := d.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	// Only the statement head gets IF NOT EXISTS, the ENGINE clause with its arguments and settings is kept as is
+	createStmt := createDatabaseIfNotExists(string(respBytes))
+	engine := databaseEngine(createStmt)
+	d.debugf("Database %s uses engine %s", dbName, engine)
+	if engine == "Replicated" {
+		logging.Warnf("database %s uses the Replicated engine, restoring it with the same ZooKeeper path joins the replica group of the original database", dbName)
+	}
+
+	filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, d.layout.databaseFile(dbName))
+
+	// For database schema, always use manual compression since we modified the content.
+	// contentEncoding is empty, so client-side compression will be applied.
+	return d.uploadSchema(filename, strings.NewReader(createStmt), "")
+}
+
+// Dump writes database schemas, table schemas and data of the matched tables into
+// the backup named config.BackupName, finishing with the backup manifest.
+// Dump runs --pre-dump-sql, dumps the backup and runs --post-dump-sql. The post hook runs
+// even if the dump fails, so it can undo the pre hook, e.g. SYSTEM START MERGES. The hooks run
+// without the --safe-mode settings.
+func (d *Dumper) Dump(ctx context.Context) error {
+	if err := runHook(ctx, d.client, d.config, "pre-dump-sql", d.config.PreDumpSQL); err != nil {
+		return err
+	}
+	dumpErr := d.dump(withQuerySettings(ctx, d.config.SafeModeSettings))
+	if d.archive != nil {
+		if err := d.archive.Finish(); err != nil {
+			if dumpErr != nil {
+				logging.Errorf("%v", err)
+			} else {
+				dumpErr = err
+			}
+		}
+	}
+	if err := runHook(ctx, d.client, d.config, "post-dump-sql", d.config.PostDumpSQL); err != nil {
+		if dumpErr != nil {
+			logging.Errorf("%v", err)
+			return dumpErr
+		}
+		return err
+	}
+	return dumpErr
+}
+
+func (d *Dumper) dump(ctx context.Context) error {
+	d.timer = newPhaseTimer()
+	defer func() {
+		logging.Infof("Dump timing: %s", d.timer.summary())
+	}()
+	if d.config.Consistent {
+		logging.Infof("Consistent mode: tables are listed once and all queries run one at a time in ClickHouse session %s", d.client.sessionID)
+		logging.Warnf("ClickHouse has no snapshot across SELECT queries, rows written while the dump runs can make tables inconsistent with each other")
+	}
+	if len(d.config.SafeModeSettings) > 0 {
+		logging.Infof("Safe mode: dump queries run with %s", formatSettings(d.config.SafeModeSettings))
+	}
+	if err := d.checkExistingBackup(); err != nil {
+		return err
+	}
+	if d.config.ZstdDict {
+		if err := d.trainSchemaDict(ctx); err != nil {
+			return err
+		}
+	}
+	// First dump database schemas
+	stopSchema := d.timer.phase("schema")
+	databases, err := d.GetDatabases(ctx)
+	if err != nil {
+		return err
+	}
+
+	if errs := d.dumpDatabaseSchemas(ctx, databases); len(errs) > 0 {
+		logging.Errorf("%s", summarizeErrors(errs, len(databases), "databases"))
+		return &PartialFailureError{Err: errors.Join(errs...)}
+	}
+
+	// Functions and named collections are dumped before tables, as they are restored before tables
+	if d.config.IncludeFunctions {
+		if err := d.dumpFunctions(ctx); err != nil {
+			return err
+		}
+	}
+	if d.config.IncludeNamedCollections {
+		if err := d.dumpNamedCollections(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Then dump tables
+	dbTables, err := d.getTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	var jobs []tableDumpJob
+	totalTablesCount := 0
+	for db, tablesInDb := range dbTables {
+		for _, table := range tablesInDb {
+			jobs = append(jobs, tableDumpJob{db: db, table: table.name, engine: table.engine, bytes: table.bytes, rows: table.rows})
+			totalTablesCount++
+		}
+	}
+	sortTableJobs(jobs, d.config.TableOrder)
+	d.warnUnusedDumpQueries(jobs)
+
+	logging.Infof("Found %d tables across %d databases for dump. Schema parallelism: %d, data parallelism: %d", totalTablesCount, len(dbTables), d.config.schemaParallel(), d.config.dataParallel())
+
+	if totalTablesCount == 0 {
+		logging.Infof("No tables to dump.")
+		if err := d.verifyDumpedFiles(ctx); err != nil {
+			return err
+		}
+		return d.writeManifest()
+	}
+
+	// Schemas of all tables first, data is dumped only for tables whose schema succeeded
+	schemaDone, errs := d.dumpTablePhase(ctx, jobs, d.config.schemaParallel(), d.dumpTableSchema)
+	stopSchema()
+	var dataJobs []tableDumpJob
+	for _, j := range schemaDone {
+		if slices.Contains(d.config.SkipDataEngines, j.engine) {
+			logging.Infof("Successfully dumped schema of %s.%s, skipping data for %s engine", j.db, j.table, j.engine)
+			continue
+		}
+		dataJobs = append(dataJobs, j)
+	}
+	if d.config.FailFast && len(errs) > 0 {
+		logging.Warnf("--fail-fast: skipping the data of all tables after schema failures")
+		dataJobs = nil
+	}
+	if d.config.Freeze {
+		defer d.unfreezeTables(ctx)
+		stopFreeze := d.timer.phase("freeze")
+		if err := d.freezeTables(ctx, dataJobs); err != nil {
+			return err
+		}
+		stopFreeze()
+	}
+	stopData := d.timer.phase("data")
+	_, dataErrs := d.dumpTablePhase(ctx, dataJobs, d.config.dataParallel(), d.dumpTableData)
+	stopData()
+	errs = append(errs, dataErrs...)
+
+	// A backup with corrupted files gets no manifest, even with --continue-on-error
+	if verifyErr := d.verifyDumpedFiles(ctx); verifyErr != nil {
+		if len(errs) > 0 {
+			logging.Errorf("%s", summarizeErrors(errs, totalTablesCount, "tables"))
+		}
+		return errors.Join(append(errs, verifyErr)...)
+	}
+
+	if len(errs) > 0 {
+		logging.Errorf("%s", summarizeErrors(errs, totalTablesCount, "tables"))
+		if d.config.ContinueOnError {
+			failed := make([]ManifestFailedTable, 0, len(errs))
+			for _, err := range errs {
+				var ie *itemError
+				if errors.As(err, &ie) {
+					failed = append(failed, ManifestFailedTable{Table: ie.item, Error: ie.err.Error()})
+				}
+			}
+			if manifestErr := d.writeManifest(failed...); manifestErr != nil {
+				errs = append(errs, manifestErr)
+			} else {
+				logging.Infof("Manifest written with %d failed tables, the rest of the backup is restorable", len(failed))
+			}
+		}
+		return &PartialFailureError{Err: errors.Join(errs...)}
+	}
+
+	return d.writeManifest()
+}
+
+// checkExistingBackup applies --fail-if-exists and --overwrite when the backup name already holds files,
+// without either of them it only warns that the new dump is mixed into the old files.
+func (d *Dumper) checkExistingBackup() error {
+	if d.config.StorageType == "stdout" {
+		// Every dump writes a new stream
+		return nil
+	}
+	backupPrefix := path.Join(d.config.StorageConfig["path"], d.config.BackupName)
+	list := d.storage.List
+	if all, ok := d.storage.(storage.AllLister); ok {
+		// Files only on a mirror are found and deleted too, so no copy mixes old and new files
+		list = all.ListAll
+	}
+	listed, err := list(backupPrefix, true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		if d.config.FailIfExists || d.config.Overwrite {
+			return fmt.Errorf("can't check existing files of backup %s: %w", d.config.BackupName, err)
+		}
+		logging.Warnf("can't check existing files of backup %s: %v", d.config.BackupName, err)
+		return nil
+	}
+	// Object storages list by key prefix, so "daily/backup" also lists "daily/backup2/...",
+	// file storage returns names relative to the storage path
+	var existing []string
+	for _, name := range listed {
+		if hasPathPrefix(name, backupPrefix) || hasPathPrefix(name, d.config.BackupName) {
+			existing = append(existing, name)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	switch {
+	case d.config.FailIfExists:
+		return fmt.Errorf("backup %s already contains %d files, choose another name or use --overwrite", d.config.BackupName, len(existing))
+	case d.config.Overwrite:
+		logging.Infof("Deleting %d existing files of backup %s before dumping", len(existing), d.config.BackupName)
+		for _, name := range existing {
+			d.debugf("Deleting %s", name)
+			if err := d.storage.Delete(name); err != nil {
+				return fmt.Errorf("failed to clear backup %s: %w", d.config.BackupName, err)
+			}
+		}
+	default:
+		logging.Warnf("backup %s already contains %d files, new files overwrite them and files of tables missing from this dump stay, use --overwrite or --fail-if-exists", d.config.BackupName, len(existing))
+	}
+	return nil
+}
+
+// hasPathPrefix reports whether name is prefix itself or a path under it, ignoring leading slashes.
+func hasPathPrefix(name, prefix string) bool {
+	name = strings.TrimPrefix(name, "/")
+	prefix = strings.Trim(prefix, "/")
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// dumpDatabaseSchemas dumps database schemas with --schema-parallel workers.
+func (d *Dumper) dumpDatabaseSchemas(ctx context.Context, databases []string) []error {
+	sem := make(chan struct{}, d.config.schemaParallel())
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(databases))
+	for _, db := range databases {
+		wg.Add(1)
+		go func(db string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := d.dumpDatabaseSchema(ctx, db); err != nil {
+				errChan <- &itemError{item: db, err: err}
+			}
+		}(db)
+	}
+	wg.Wait()
+	close(errChan)
+
+	var errs []error
+	for errItem := range errChan {
+		errs = append(errs, errItem)
+		logging.Errorf("Error during database schema dump: %v", errItem)
+	}
+	return errs
+}
+
+type tableDumpJob struct {
+	db     string
+	table  string
+	engine string
+	bytes  int64 // total_bytes from system.tables, used by --table-order=size
+	rows   int64 // total_rows from system.tables, used by --table-order=rows
+}
+
+// errFailFast cancels the running jobs of a phase after the first failure with --fail-fast.
+var errFailFast = errors.New("canceled by --fail-fast after another table failed")
+
+// dumpTablePhase runs dump for every job with at most parallel jobs at a time, --table-timeout
+// limits each call. It returns the jobs which succeeded and the errors of the others. With
+// --fail-fast the first failure cancels the running jobs and no more jobs start, only the
+// failures which caused the cancellation are returned.
+func (d *Dumper) dumpTablePhase(ctx context.Context, jobs []tableDumpJob, parallel int, dump func(context.Context, tableDumpJob) error) ([]tableDumpJob, []error) {
+	var failFast context.CancelCauseFunc
+	if d.config.FailFast {
+		ctx, failFast = context.WithCancelCause(ctx)
+		defer failFast(nil)
+	}
+	sem := make(chan struct{}, parallel)
+	ctx = withPhaseSlots(ctx, sem)
+	var wg sync.WaitGroup
+	// Each goroutine sets only its own index
+	succeeded := make([]bool, len(jobs))
+	// At most one error per job
+	errChan := make(chan error, len(jobs))
+	var stopped atomic.Int64
+
+	for i, job := range jobs {
+		// Acquired before starting the goroutine, so jobs start in --table-order
+		sem <- struct{}{}
+		if failFast != nil && context.Cause(ctx) == errFailFast {
+			<-sem
+			stopped.Add(int64(len(jobs) - i))
+			break
+		}
+		wg.Add(1)
+		d.debugf("Acquired semaphore for %s.%s", job.db, job.table)
+		go func(i int, j tableDumpJob) {
+			defer wg.Done()
+			defer func() {
+				<-sem // Release semaphore
+				d.debugf("Released semaphore for %s.%s", j.db, j.table)
+			}()
+
+			tableCtx := withQueryTable(ctx, j.db+"."+j.table)
+			if dumpErr := d.withTableTimeout(tableCtx, func(ctx context.Context) error { return dump(ctx, j) }); dumpErr != nil {
+				if failFast != nil {
+					if context.Cause(ctx) == errFailFast {
+						stopped.Add(1)
+						return
+					}
+					failFast(errFailFast)
+				}
+				errChan <- &itemError{item: j.db + "." + j.table, err: dumpErr}
+				return
+			}
+			succeeded[i] = true
+		}(i, job)
+	}
+
+	wg.Wait()
+	close(errChan)
+	if n := stopped.Load(); n > 0 {
+		logging.Warnf("--fail-fast: stopped %d of %d tables after the first failure", n, len(jobs))
+	}
+
+	var done []tableDumpJob
+	for i, j := range jobs {
+		if succeeded[i] {
+			done = append(done, j)
+		}
+	}
+
+	var errs []error
+	for errItem := range errChan {
+		errs = append(errs, errItem)
+		logging.Errorf("Error during dump: %v", errItem) // Log all errors
+	}
+	return done, errs
+}
+
+type phaseSlotsKey struct{}
+
+// withPhaseSlots passes the semaphore of a dump phase to its jobs, a job holds one slot and may
+// take free ones for more queries, see dumpDataChunked.
+func withPhaseSlots(ctx context.Context, slots chan struct{}) context.Context {
+	return context.WithValue(ctx, phaseSlotsKey{}, slots)
+}
+
+// phaseSlots returns the semaphore of the dump phase of ctx, nil outside of a phase.
+func phaseSlots(ctx context.Context) chan struct{} {
+	slots, _ := ctx.Value(phaseSlotsKey{}).(chan struct{})
+	return slots
+}
+
+// withTableTimeout runs one phase of a table limited by --table-timeout, each phase gets the
+// whole limit.
+func (d *Dumper) withTableTimeout(ctx context.Context, dump func(context.Context) error) error {
+	if d.config.TableTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.config.TableTimeout)
+		defer cancel()
+	}
+	err := dump(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after --table-timeout=%s: %w", d.config.TableTimeout, err)
+	}
+	return err
+}
+
+func (d *Dumper) dumpTableSchema(ctx context.Context, j tableDumpJob) error {
+	d.debugf("Dumping schema for %s.%s", j.db, j.table)
+	if err := d.dumpSchema(ctx, j.db, j.table); err != nil {
+		return fmt.Errorf("failed to dump schema: %w", err)
+	}
+	if d.config.DumpComments {
+		if err := d.dumpComments(ctx, j); err != nil {
+			return fmt.Errorf("failed to dump comments: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *Dumper) dumpTableData(ctx context.Context, j tableDumpJob) error {
+	release, err := d.acquireInflight(ctx, j)
+	if err != nil {
+		return err
+	}
+	defer release()
+	d.debugf("Dumping data for %s.%s", j.db, j.table)
+	start := time.Now()
+	err = d.dumpData(ctx, j.db, j.table, j.engine)
+	d.timer.item(j.db+"."+j.table, time.Since(start))
+	if err != nil {
+		return fmt.Errorf("failed to dump data: %w", err)
+	}
+	logging.Infof("Successfully dumped %s.%s", j.db, j.table)
+	return nil
+}
+
+// acquireInflight waits until the table fits into --max-inflight-bytes next to the tables already
+// dumping data. Tables are weighed by their total_bytes, a table larger than the whole budget
+// waits until it runs alone. Waiting tables are served in order, so big tables aren't starved.
+func (d *Dumper) acquireInflight(ctx context.Context, j tableDumpJob) (func(), error) {
+	if d.inflight == nil {
+		return func() {}, nil
+	}
+	weight := min(max(j.bytes, 0), d.config.MaxInflightBytes)
+	if !d.inflight.TryAcquire(weight) {
+		d.debugf("Waiting for --max-inflight-bytes to dump %s.%s of %d bytes", j.db, j.table, j.bytes)
+		if err := d.inflight.Acquire(ctx, weight); err != nil {
+			return nil, fmt.Errorf("waiting for --max-inflight-bytes: %w", err)
+		}
+	}
+	return func() { d.inflight.Release(weight) }, nil
+}
+
+// upload stores a backup file compressed with compressFormat, unless contentEncoding reports
+// the body is already compressed, and records it for the manifest.
+func (d *Dumper) upload(filename string, body io.Reader, contentEncoding, compressFormat string, entry ManifestFile) error {
+	if err := d.storage.Upload(filename, body, compressFormat, d.config.CompressLevel, contentEncoding); err != nil {
+		return err
+	}
+	backupPrefix := path.Join(d.config.StorageConfig["path"], d.config.BackupName)
+	entry.Name = strings.TrimPrefix(strings.TrimPrefix(filename, backupPrefix), "/")
+	entry.Compression = storedCompression(contentEncoding, compressFormat)
+	d.filesMu.Lock()
+	d.files = append(d.files, entry)
+	d.filesMu.Unlock()
+	return nil
+}
+
+func (d *Dumper) writeManifest(failedTables ...ManifestFailedTable) error {
+	d.filesMu.Lock()
+	defer d.filesMu.Unlock()
+	d.frozenMu.Lock()
+	defer d.frozenMu.Unlock()
+	manifest := &Manifest{
+		BackupName:   d.config.BackupName,
+		CreatedAt:    time.Now().UTC(),
+		Files:        d.files,
+		FailedTables: failedTables,
+		FrozenTables: d.frozen,
+	}
+	if d.config.Layout != "" && d.config.Layout != DefaultLayout {
+		manifest.Layout = d.config.Layout
+	}
+	d.debugf("Writing manifest with %d files", len(manifest.Files))
+	return writeManifest(d.storage, d.config, manifest)
+}
+
+type tableInfo struct {
+	name   string
+	engine string
+	bytes  int64
+	rows   int64
+}
+
+// tablesWhere returns the system.tables condition of the --databases and --tables filters.
+func (d *Dumper) tablesWhere() string {
+	// Temporary tables belong to a session and system tables can't be restored,
+	// they are skipped whatever --databases and --exclude-databases match
+	where := make([]string, 0, 6)
+	where = append(where, "NOT is_temporary")
+	if !d.config.AllowSystem {
+		where = append(where, "database NOT IN "+systemDatabasesList())
+	}
+	if d.config.Databases != "" {
+		where = append(where, d.nameFilter("database", d.config.Databases))
+	}
+	if d.config.ExcludeDatabases != "" {
+		where = append(where, "NOT "+d.nameFilter("database", d.config.ExcludeDatabases))
+	}
+	if d.config.Tables != "" {
+		where = append(where, d.nameFilter("name", d.config.Tables))
+	}
+	if d.config.ExcludeTables != "" {
+		where = append(where, "NOT "+d.nameFilter("name", d.config.ExcludeTables))
+	}
+	return strings.Join(where, " AND ")
+}
+
+// nameFilter returns the condition of column for a --databases or --tables filter, a regexp
+// matched with match(), or with --literal-names a comma-separated list of exact names.
+func (d *Dumper) nameFilter(column, filter string) string {
+	if !d.config.LiteralNames {
+		return fmt.Sprintf("match(%s, '%s')", column, filter)
+	}
+	var names []string
+	for _, name := range strings.Split(filter, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, quoteString(name))
+		}
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(names, ", "))
+}
+
+// quoteString returns s as a ClickHouse string literal.
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// systemDatabases are the databases ClickHouse creates itself, dumped only with --allow-system.
+var systemDatabases = []string{"system", "INFORMATION_SCHEMA", "information_schema"}
+
+// systemDatabasesList returns systemDatabases as an SQL list for NOT IN.
+func systemDatabasesList() string {
+	return "('" + strings.Join(systemDatabases, "', '") + "')"
+}
+
+func (d *Dumper) getTables(ctx context.Context) (map[string][]tableInfo, error) {
+	query := fmt.Sprintf(`
+		SELECT 
+			database, 
+			name,
+			engine,
+			ifNull(total_bytes, 0),
+			ifNull(total_rows, 0)
+		FROM system.tables 
+		WHERE %s`, d.tablesWhere())
+
+	resp, err := d.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string][]tableInfo)
+	lines := strings.Split(strings.TrimSpace(string(resp)), "\n")
+	for _, line := range lines {
+		parts := strings.Split(line, "\t")
+		if len(parts) != 5 {
+			continue
+		}
+		db := parts[0]
+		// Sizes are only used for ordering, unknown sizes sort last
+		bytes, _ := strconv.ParseInt(parts[3], 10, 64)
+		rows, _ := strconv.ParseInt(parts[4], 10, 64)
+		tables[db] = append(tables[db], tableInfo{name: parts[1], engine: parts[2], bytes: bytes, rows: rows})
+	}
+
+	return tables, nil
+}
+
+func (d *Dumper) dumpSchema(ctx context.Context, dbName, tableName string) error {
+	query := fmt.Sprintf("SELECT create_table_query FROM system.tables WHERE database='%s' AND name='%s' SETTINGS format_display_secrets_in_show_and_select=1 FORMAT TSVRaw", dbName, tableName)
+	d.debugf("Schema query: %s", query)
+	compressFormat := d.schemaCompressFormat()
+	if d.schemaDict != nil {
+		// Compressed with the dictionary in uploadSchema
+		compressFormat = ""
+	}
+	body, contentEncoding, err := d.queryStreaming(ctx, query, compressFormat)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := body.Close(); closeErr != nil {
+			logging.Warnf("can't close dumpSchema reader body: %v", closeErr)
+		}
+	}()
+
+	filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, d.layout.schemaFile(dbName, tableName))
+
+	// Pass contentEncoding to Upload. If it's set, Upload will use it and ignore compressFormat/Level.
+	// Otherwise, Upload will use compressFormat/Level.
+	d.debugf("Uploading schema for %s.%s with contentEncoding: '%s', clientCompressFormat: '%s'", dbName, tableName, contentEncoding, compressFormat)
+	return d.uploadSchema(filename, body, contentEncoding)
+}
+
+func (d *Dumper) dumpData(ctx context.Context, dbName, tableName, engine string) error {
+	filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, d.layout.dataFile(dbName, tableName, d.config.DataFormat))
+	if override, ok := d.dumpQuery(dbName, tableName); ok {
+		// The subquery keeps SETTINGS of the override apart from the format settings,
+		// --exclude-columns and --chunk-rows don't apply
+		logging.Infof("Dumping %s.%s with the query from --dump-query-file", dbName, tableName)
+		compressFormat, err := d.dataCompressFormat(ctx, dbName, tableName)
+		if err != nil {
+			return err
+		}
+		query := fmt.Sprintf("SELECT * FROM (%s) %s", override, d.formatClause(dbName, tableName))
+		return d.uploadData(ctx, dbName, tableName, query, filename, compressFormat)
+	}
+	columns, err := d.getSelectColumns(ctx, dbName, tableName)
+	if err != nil {
+		return err
+	}
+	compressFormat, err := d.dataCompressFormat(ctx, dbName, tableName)
+	if err != nil {
+		return err
+	}
+	source := d.tableSource(dbName, tableName, engine)
+	if d.config.ChunkRows > 0 {
+		chunked, err := d.dumpDataChunked(ctx, dbName, tableName, source, columns, compressFormat)
+		if err != nil || chunked {
+			return err
+		}
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s %s", columns, source, d.formatClause(dbName, tableName))
+	return d.uploadData(ctx, dbName, tableName, query, filename, compressFormat)
+}
+
+// finalEngines lists the engines whose rows are collapsed at merge time, --final reads them with FINAL.
+var finalEngines = []string{"ReplacingMergeTree", "CollapsingMergeTree", "VersionedCollapsingMergeTree", "SummingMergeTree", "AggregatingMergeTree", "GraphiteMergeTree"}
+
+// tableSource returns the FROM clause of the data query, with FINAL when --final is set and engine supports it.
+func (d *Dumper) tableSource(dbName, tableName, engine string) string {
+	source := fmt.Sprintf("`%s`.`%s`", dbName, tableName)
+	if d.config.Final && supportsFinal(engine) {
+		source += " FINAL"
+	}
+	return source
+}
+
+// supportsFinal reports whether engine, or its Replicated or Shared variant, is in finalEngines.
+func supportsFinal(engine string) bool {
+	engine = strings.TrimPrefix(strings.TrimPrefix(engine, "Replicated"), "Shared")
+	return slices.Contains(finalEngines, engine)
+}
+
+// getSelectColumns returns the column list of the data query, "*" unless --exclude-columns
+// matches some columns of the table. MATERIALIZED, ALIAS and EPHEMERAL columns are never listed,
+// as with SELECT *, because they can't be inserted.
+func (d *Dumper) getSelectColumns(ctx context.Context, dbName, tableName string) (string, error) {
+	if d.config.ExcludeColumns == "" {
+		return "*", nil
+	}
+	query := fmt.Sprintf("SELECT name, match(concat(database, '.', table, '.', name), '%s') FROM system.columns WHERE database='%s' AND table='%s' AND default_kind NOT IN ('MATERIALIZED', 'ALIAS', 'EPHEMERAL') ORDER BY position FORMAT TSVRaw", d.config.ExcludeColumns, dbName, tableName)
+	resp, err := d.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return "", fmt.Errorf("failed to get columns: %w", err)
+	}
+	var columns, excluded []string
+	for _, line := range strings.Split(strings.TrimSpace(string(resp)), "\n") {
+		name, isExcluded, found := strings.Cut(line, "\t")
+		if !found {
+			continue
+		}
+		if isExcluded == "1" {
+			excluded = append(excluded, name)
+		} else {
+			columns = append(columns, "`"+strings.ReplaceAll(name, "`", "\\`")+"`")
+		}
+	}
+	if len(excluded) == 0 {
+		return "*", nil
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("--exclude-columns excludes all columns of %s.%s", dbName, tableName)
+	}
+	logging.Infof("Dumping %s.%s without columns: %s", dbName, tableName, strings.Join(excluded, ", "))
+	return strings.Join(columns, ", "), nil
+}
+
+// uploadData streams the result of a data query into filename.
+func (d *Dumper) uploadData(ctx context.Context, dbName, tableName, query, filename, compressFormat string) error {
+	d.debugf("Data query: %s", query)
+	body, contentEncoding, err := d.queryStreaming(ctx, query, compressFormat)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := body.Close(); closeErr != nil {
+			logging.Warnf("can't close dumpData reader body: %v", closeErr)
+		}
+	}()
+
+	// Pass contentEncoding to Upload. If it's set, Upload will use it and ignore compressFormat/Level.
+	// Otherwise, Upload will use compressFormat/Level.
+	entry := ManifestFile{Format: d.config.DataFormat}
+	var data io.Reader = body
+	if d.config.AdaptiveCompression && compressFormat != "" && compressFormat != "none" {
+		var ratio float64
+		if data, ratio, err = sampleCompression(body, contentEncoding, compressFormat); err != nil {
+			return fmt.Errorf("failed to sample data of %s.%s: %w", dbName, tableName, err)
+		}
+		if ratio > adaptiveMaxRatio {
+			logging.Infof("Data of %s.%s compresses to %.0f%% with %s, storing it uncompressed", dbName, tableName, ratio*100, compressFormat)
+			if contentEncoding != "" {
+				decoder, err := newResponseDecoder(data, contentEncoding)
+				if err != nil {
+					return err
+				}
+				defer func() { _ = decoder.Close() }()
+				data, contentEncoding = decoder, ""
+			}
+			compressFormat = "none"
+		}
+	}
+	d.debugf("Uploading data for %s.%s with contentEncoding: '%s', clientCompressFormat: '%s'", dbName, tableName, contentEncoding, compressFormat)
+	return d.upload(filename, data, contentEncoding, compressFormat, entry)
+}
+
+// unorderedTypeRe matches the column types which can't be used in ORDER BY anywhere in a type,
+// also wrapped like Nullable(JSON) or Array(Map(String, UInt64)). A table having any of them has
+// no deterministic row order for chunking. Tuple elements named like such a type match too, the
+// table is then dumped with a plain SELECT.
+var unorderedTypeRe = regexp.MustCompile(`(?:^|[(,\s])(?:Map|Object|JSON|AggregateFunction|Dynamic|Variant)\b`)
+
+// unorderedType reports whether a column of type typ can't be ordered.
+func unorderedType(typ string) bool {
+	return unorderedTypeRe.MatchString(typ)
+}
+
+// getChunkOrder returns the ORDER BY expression giving a total, repeatable row order for
+// the table (sorting key first, then every column as tie-breaker) and its row count.
+// An empty expression means the table has no deterministic order and can't be chunked.
+func (d *Dumper) getChunkOrder(ctx context.Context, dbName, tableName, source string) (string, int, error) {
+	sortingKey, err := d.client.ExecuteQuery(ctx, fmt.Sprintf("SELECT sorting_key FROM system.tables WHERE database='%s' AND name='%s' FORMAT TSVRaw", dbName, tableName))
+	if err != nil {
+		return "", 0, err
+	}
+	columnsResp, err := d.client.ExecuteQuery(ctx, fmt.Sprintf("SELECT name, type FROM system.columns WHERE database='%s' AND table='%s' ORDER BY position FORMAT TSVRaw", dbName, tableName))
+	if err != nil {
+		return "", 0, err
+	}
+
+	orderBy := make([]string, 0)
+	if key := strings.TrimSpace(string(sortingKey)); key != "" {
+		orderBy = append(orderBy, key)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(columnsResp)), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if unorderedType(parts[1]) {
+			d.debugf("Column %s.%s.%s has type %s which can't be ordered", dbName, tableName, parts[0], parts[1])
+			return "", 0, nil
+		}
+		orderBy = append(orderBy, fmt.Sprintf("`%s`", parts[0]))
+	}
+	if len(orderBy) == 0 {
+		return "", 0, nil
+	}
+
+	countResp, err := d.client.ExecuteQuery(ctx, fmt.Sprintf("SELECT count() FROM %s FORMAT TSVRaw", source))
+	if err != nil {
+		return "", 0, err
+	}
+	rows, err := strconv.Atoi(strings.TrimSpace(string(countResp)))
+	if err != nil {
+		return "", 0, fmt.Errorf("can't parse row count for %s.%s: %w", dbName, tableName, err)
+	}
+	return strings.Join(orderBy, ", "), rows, nil
+}
+
+// dumpDataChunked dumps a table larger than --chunk-rows as several LIMIT/OFFSET windows
+// over a total row order, each into its own <table>.chunkNNNNN.data.sql file. The first chunk
+// query runs in the slot of the table, more run in parallel only in free slots of the data phase,
+// so tables and chunks together stay within --parallel queries. Chunks are parts of the table,
+// they run under the --max-inflight-bytes weight the table holds. It returns false when the table is small enough for a single
+// query or has no deterministic order, so the caller falls back to a plain SELECT.
+// Windows are only consistent if the table isn't modified while the dump runs.
+func (d *Dumper) dumpDataChunked(ctx context.Context, dbName, tableName, source, columns, compressFormat string) (bool, error) {
+	orderBy, rows, err := d.getChunkOrder(ctx, dbName, tableName, source)
+	if err != nil {
+		return false, fmt.Errorf("failed to plan chunks: %w", err)
+	}
+	if orderBy == "" {
+		logging.Infof("Table %s.%s has no deterministic row order, dumping it without --chunk-rows", dbName, tableName)
+		return false, nil
+	}
+	if rows <= d.config.ChunkRows {
+		return false, nil
+	}
+
+	chunks := (rows + d.config.ChunkRows - 1) / d.config.ChunkRows
+	logging.Infof("Dumping %s.%s (%d rows) in %d chunks of %d rows", dbName, tableName, rows, chunks, d.config.ChunkRows)
+
+	pending := make(chan int, chunks)
+	for i := 0; i < chunks; i++ {
+		pending <- i
+	}
+	close(pending)
+	errChan := make(chan error, chunks)
+	dumpChunks := func() {
+		for chunk := range pending {
+			query := fmt.Sprintf("SELECT %s FROM %s ORDER BY %s LIMIT %d OFFSET %d %s", columns, source, orderBy, d.config.ChunkRows, chunk*d.config.ChunkRows, d.formatClause(dbName, tableName))
+			filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, d.layout.chunkFile(dbName, tableName, d.config.DataFormat, chunk))
+			if uploadErr := d.uploadData(ctx, dbName, tableName, query, filename, compressFormat); uploadErr != nil {
+				errChan <- fmt.Errorf("chunk %d: %w", chunk, uploadErr)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	if slots := phaseSlots(ctx); slots != nil {
+	borrow:
+		for i := 1; i < chunks; i++ {
+			select {
+			case slots <- struct{}{}:
+			default:
+				break borrow
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				dumpChunks()
+			}()
+		}
+	}
+	dumpChunks()
+	wg.Wait()
+	close(errChan)
+
+	var errs []error
+	for errItem := range errChan {
+		errs = append(errs, errItem)
+	}
+	return true, errors.Join(errs...)
+}
+
+// Close closes the storage created by NewDumper, further calls do nothing.
+func (d *Dumper) Close() error {
+	if d.storage == nil || !d.ownsStorage {
+		return nil
+	}
+	d.ownsStorage = false
+	return d.storage.Close()
+}
+
+func (d *Dumper) debugf(msg string, args ...interface{}) {
+	if d.config.Debug || logging.Enabled(logging.LevelDebug) {
+		if len(args) > 0 {
+			log.Printf(msg, args...)
+		} else {
+			log.Println(msg)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package clickhousedump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestCheckExistingBackup(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"nightly/db.database.sql", "nightly/db/t.schema.sql", "nightly2/db.database.sql"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("CREATE"), 0o644))
+	}
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	newDumper := func(backupName string) *Dumper {
+		return &Dumper{
+			config:  &Config{StorageType: "file", StorageConfig: map[string]string{"path": dir}, BackupName: backupName},
+			storage: fileStorage,
+		}
+	}
+
+	d := newDumper("nightly")
+	require.NoError(t, d.checkExistingBackup(), "without a policy existing files only produce a warning")
+
+	d.config.FailIfExists = true
+	require.ErrorContains(t, d.checkExistingBackup(), "backup nightly already contains 2 files")
+
+	d.config.FailIfExists = false
+	d.config.Overwrite = true
+	require.NoError(t, d.checkExistingBackup())
+	require.NoFileExists(t, filepath.Join(dir, "nightly/db.database.sql"))
+	require.NoFileExists(t, filepath.Join(dir, "nightly/db/t.schema.sql"))
+	require.FileExists(t, filepath.Join(dir, "nightly2/db.database.sql"))
+
+	missing := newDumper("missing")
+	missing.config.FailIfExists = true
+	require.NoError(t, missing.checkExistingBackup())
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	require.True(t, hasPathPrefix("daily/backup/db/t.schema.sql", "/daily/backup"))
+	require.True(t, hasPathPrefix("/daily/backup", "daily/backup/"))
+	require.False(t, hasPathPrefix("daily/backup2/db/t.schema.sql", "daily/backup"))
+	require.True(t, hasPathPrefix("backup/db/t.schema.sql", ""))
+}
+
+func TestTableSource(t *testing.T) {
+	d := &Dumper{config: &Config{}}
+	require.Equal(t, "`db`.`t`", d.tableSource("db", "t", "ReplacingMergeTree"), "FINAL only with --final")
+
+	d.config.Final = true
+	require.Equal(t, "`db`.`t` FINAL", d.tableSource("db", "t", "ReplacingMergeTree"))
+	require.Equal(t, "`db`.`t` FINAL", d.tableSource("db", "t", "ReplicatedCollapsingMergeTree"))
+	require.Equal(t, "`db`.`t` FINAL", d.tableSource("db", "t", "SharedVersionedCollapsingMergeTree"))
+	require.Equal(t, "`db`.`t`", d.tableSource("db", "t", "MergeTree"))
+	require.Equal(t, "`db`.`t`", d.tableSource("db", "t", "ReplicatedMergeTree"))
+	require.Equal(t, "`db`.`t`", d.tableSource("db", "t", "Log"))
+}
+
+func TestTablesWhereSkipsSystem(t *testing.T) {
+	d := &Dumper{config: &Config{Databases: ".*"}}
+	require.Equal(t, "NOT is_temporary AND database NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema') AND match(database, '.*')", d.tablesWhere(), "an empty --exclude-databases still skips system databases")
+
+	d.config.AllowSystem = true
+	d.config.ExcludeDatabases = "^default$"
+	require.Equal(t, "NOT is_temporary AND match(database, '.*') AND NOT match(database, '^default$')", d.tablesWhere())
+}
+
+func TestTablesWhereLiteralNames(t *testing.T) {
+	d := &Dumper{config: &Config{LiteralNames: true, Databases: "logs.2024, a+b,*", Tables: "events", ExcludeTables: "it's"}}
+	require.Equal(t, "NOT is_temporary AND database NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema') AND database IN ('logs.2024', 'a+b', '*') AND name IN ('events') AND NOT name IN ('it\\'s')", d.tablesWhere())
+
+	d.config.ExcludeDatabases = `back\slash`
+	require.Contains(t, d.tablesWhere(), `NOT database IN ('back\\slash')`)
+
+	d.config.LiteralNames = false
+	require.Contains(t, d.tablesWhere(), "match(database, 'logs.2024, a+b,*')")
+}
+
+func TestMaxInflightBytes(t *testing.T) {
+	config := &Config{MaxInflightBytes: 100}
+	d := &Dumper{config: config, inflight: semaphore.NewWeighted(config.MaxInflightBytes)}
+	jobs := []tableDumpJob{
+		{db: "db", table: "a", bytes: 60},
+		{db: "db", table: "b", bytes: 60},
+		{db: "db", table: "c", bytes: 30},
+		{db: "db", table: "huge", bytes: 1000},
+		{db: "db", table: "d", bytes: 10},
+	}
+	var mu sync.Mutex
+	var running, maxRunning int64
+	var hugeWithOthers bool
+	dump := func(ctx context.Context, j tableDumpJob) error {
+		release, err := d.acquireInflight(ctx, j)
+		if err != nil {
+			return err
+		}
+		defer release()
+		mu.Lock()
+		weight := min(j.bytes, config.MaxInflightBytes)
+		running += weight
+		maxRunning = max(maxRunning, running)
+		if j.table == "huge" && running != weight {
+			hugeWithOthers = true
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running -= weight
+		mu.Unlock()
+		return nil
+	}
+	done, errs := d.dumpTablePhase(context.Background(), jobs, len(jobs), dump)
+	require.Empty(t, errs)
+	require.Len(t, done, len(jobs))
+	require.LessOrEqual(t, maxRunning, config.MaxInflightBytes)
+	require.False(t, hugeWithOthers, "a table larger than the budget runs alone")
+}
+
+func TestDumpTablePhaseFailFast(t *testing.T) {
+	jobs := []tableDumpJob{{db: "db", table: "slow"}, {db: "db", table: "bad"}}
+	for i := 0; i < 8; i++ {
+		jobs = append(jobs, tableDumpJob{db: "db", table: fmt.Sprintf("t%d", i)})
+	}
+	var started atomic.Int64
+	dump := func(ctx context.Context, j tableDumpJob) error {
+		started.Add(1)
+		switch j.table {
+		case "bad":
+			return errors.New("boom")
+		case "slow":
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	d := &Dumper{config: &Config{FailFast: true}}
+	start := time.Now()
+	done, errs := d.dumpTablePhase(context.Background(), jobs, 2, dump)
+	require.Less(t, time.Since(start), 5*time.Second, "the running job is canceled")
+	require.Len(t, errs, 1, "only the failure causing the stop is reported")
+	require.ErrorContains(t, errs[0], "db.bad: boom")
+	require.Empty(t, done)
+	require.Equal(t, int64(2), started.Load(), "no job starts after the failure")
+
+	// Without --fail-fast every job runs
+	started.Store(0)
+	d = &Dumper{config: &Config{}}
+	jobs[0].table = "t-first"
+	done, errs = d.dumpTablePhase(context.Background(), jobs, 2, dump)
+	require.Len(t, errs, 1)
+	require.Len(t, done, len(jobs)-1)
+	require.Equal(t, int64(len(jobs)), started.Load())
+}
+
+// closeCountingStorage counts the Close calls of a storage.
+type closeCountingStorage struct {
+	storage.RemoteStorage
+	closes atomic.Int32
+}
+
+func (s *closeCountingStorage) Close() error {
+	s.closes.Add(1)
+	return s.RemoteStorage.Close()
+}
+
+func TestSharedClientAndStorage(t *testing.T) {
+	fileStorage, err := storage.NewFileStorage(t.TempDir(), false)
+	require.NoError(t, err)
+	shared := &closeCountingStorage{RemoteStorage: fileStorage}
+	config := &Config{Host: "localhost", Port: 8123, StorageType: "file", StorageConfig: map[string]string{"path": "/backups"}, Consistent: true}
+	client := NewClickHouseClient(config)
+
+	// Consistent dumps get their own session on the shared connections
+	d, err := NewDumperWith(config, client, shared)
+	require.NoError(t, err)
+	require.NotEmpty(t, d.client.sessionID)
+	require.Empty(t, client.sessionID)
+	require.Same(t, client.client, d.client.client)
+	require.NoError(t, d.Close())
+
+	r, err := NewRestorerWith(config, client, shared)
+	require.NoError(t, err)
+	require.Same(t, client, r.client)
+	require.NoError(t, r.Close())
+	require.Zero(t, shared.closes.Load(), "storages of the caller stay open")
+
+	_, err = NewDumperWith(config, client, nil)
+	require.ErrorAs(t, err, new(*ConfigError))
+	_, err = NewRestorerWith(&Config{Archive: true}, nil, shared)
+	require.ErrorAs(t, err, new(*ConfigError))
+
+	// Storages created by the constructors are closed once
+	owned := &closeCountingStorage{RemoteStorage: fileStorage}
+	d = newDumper(config, client, owned, fileLayout{})
+	d.ownsStorage = true
+	require.NoError(t, d.Close())
+	require.NoError(t, d.Close())
+	r = &Restorer{config: config, client: client, storage: owned, ownsStorage: true}
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close())
+	require.EqualValues(t, 2, owned.closes.Load())
+}
+
+func TestFormatClauseSQLInsertSettings(t *testing.T) {
+	d := &Dumper{config: &Config{DataFormat: DataFormatSQLInsert, BatchSize: 1000}}
+	require.Equal(t, "FORMAT SQLInsert SETTINGS output_format_sql_insert_max_batch_size=1000, output_format_sql_insert_table_name='`db`.`t`', "+
+		"output_format_sql_insert_include_column_names=1, output_format_sql_insert_quote_names=1, output_format_sql_insert_use_replace=0", d.formatClause("db", "t"))
+
+	d.config.SQLInsertOmitColumnNames = true
+	d.config.SQLInsertUnquotedNames = true
+	d.config.SQLInsertUseReplace = true
+	require.Contains(t, d.formatClause("db", "t"), "output_format_sql_insert_include_column_names=0, output_format_sql_insert_quote_names=0, output_format_sql_insert_use_replace=1")
+
+	d.config.DataFormat = DataFormatNative
+	require.Equal(t, "FORMAT Native", d.formatClause("db", "t"))
+
+	// ClickHouse has no REPLACE, restore inserts the rows
+	require.Equal(t, "INSERT INTO `db`.`t` (`id`) VALUES (1)", replaceToInsert("REPLACE INTO `db`.`t` (`id`) VALUES (1)"))
+	require.Equal(t, "INSERT INTO `db`.`t` VALUES (1)", replaceToInsert("\n replace  into `db`.`t` VALUES (1)"))
+	require.Equal(t, "INSERT INTO t VALUES ('REPLACE INTO')", replaceToInsert("INSERT INTO t VALUES ('REPLACE INTO')"))
+}
+
+// stubClickHouse starts a ClickHouse HTTP stub answering the queries in the request body with
+// handler and returns a file storage dump config connected to it.
+func stubClickHouse(t *testing.T, handler func(w http.ResponseWriter, req *http.Request, query string)) *Config {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		handler(w, req, string(body))
+	}))
+	t.Cleanup(server.Close)
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	return &Config{Host: host, Port: port, StorageType: "file", StorageConfig: map[string]string{"path": t.TempDir()}, BackupName: "backup1", CompressFormat: "none", DataFormat: DataFormatNative}
+}
+
+// answerDumpQuery answers the listing and schema queries of a dump of the MergeTree tables
+// shop.<tables>, it reports false for other queries like the data SELECTs.
+func answerDumpQuery(w http.ResponseWriter, query string, tables ...string) bool {
+	switch {
+	case strings.Contains(query, "FROM system.databases"):
+		_, _ = io.WriteString(w, "shop\n")
+	case strings.HasPrefix(query, "SHOW CREATE DATABASE"):
+		_, _ = io.WriteString(w, "CREATE DATABASE shop\nENGINE = Atomic")
+	case strings.Contains(query, "create_table_query"):
+		_, _ = io.WriteString(w, "CREATE TABLE shop.t (`id` UInt64) ENGINE = MergeTree ORDER BY id")
+	case strings.Contains(query, "ifNull(total_rows, 0)"):
+		for _, table := range tables {
+			_, _ = fmt.Fprintf(w, "shop\t%s\tMergeTree\t100\t10\n", table)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func TestUnorderedType(t *testing.T) {
+	for typ, unordered := range map[string]bool{
+		"UInt64":                                  false,
+		"Nullable(String)":                        false,
+		"Array(Tuple(a UInt8, b String))":         false,
+		"LowCardinality(Nullable(String))":        false,
+		"Enum8('JSON' = 1, 'Map' = 2)":            false,
+		"SimpleAggregateFunction(sum, UInt64)":    false,
+		"JSONString":                              false,
+		"Map(String, UInt64)":                     true,
+		"JSON":                                    true,
+		"JSON(max_dynamic_paths=10)":              true,
+		"Object('json')":                          true,
+		"Dynamic":                                 true,
+		"Variant(String, UInt64)":                 true,
+		"AggregateFunction(uniq, UInt64)":         true,
+		"Nullable(JSON)":                          true,
+		"Array(Map(String, UInt64))":              true,
+		"Tuple(a Dynamic)":                        true,
+		"Tuple(a UInt8, b Variant(String, Int8))": true,
+		"LowCardinality(Nullable(String)), Map":   true,
+	} {
+		require.Equal(t, unordered, unorderedType(typ), typ)
+	}
+}
+
+func TestDumpDataChunkedSharesPhaseSlots(t *testing.T) {
+	var mu sync.Mutex
+	var running, maxRunning int
+	config := stubClickHouse(t, func(w http.ResponseWriter, _ *http.Request, query string) {
+		switch {
+		case strings.Contains(query, "sorting_key"):
+			_, _ = io.WriteString(w, "id\n")
+		case strings.Contains(query, "system.columns"):
+			_, _ = io.WriteString(w, "id\tUInt64\nattrs\tNullable(String)\n")
+		case strings.Contains(query, "count()"):
+			_, _ = io.WriteString(w, "40\n")
+		case strings.Contains(query, " LIMIT "):
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			_, _ = io.WriteString(w, "rows")
+		default:
+			t.Errorf("unexpected query %s", query)
+		}
+	})
+	config.ChunkRows = 10
+	fileStorage, err := storage.NewFileStorage(config.StorageConfig["path"], false)
+	require.NoError(t, err)
+	d := newDumper(config, NewClickHouseClient(config), fileStorage, defaultFileLayout)
+	d.timer = newPhaseTimer()
+
+	// A single table takes the free slots of the phase for its chunks
+	jobs := []tableDumpJob{{db: "db", table: "a"}}
+	done, errs := d.dumpTablePhase(context.Background(), jobs, 3, d.dumpTableData)
+	require.Empty(t, errs)
+	require.Len(t, done, 1)
+	require.Equal(t, 3, maxRunning)
+	files, err := fileStorage.List("backup1", true)
+	require.NoError(t, err)
+	require.Len(t, files, 4)
+
+	// Tables and their chunks together stay within the limit of the phase
+	maxRunning = 0
+	jobs = []tableDumpJob{{db: "db", table: "b"}, {db: "db", table: "c"}, {db: "db", table: "d"}}
+	done, errs = d.dumpTablePhase(context.Background(), jobs, 2, d.dumpTableData)
+	require.Empty(t, errs)
+	require.Len(t, done, 3)
+	require.LessOrEqual(t, maxRunning, 2)
+	files, err = fileStorage.List("backup1", true)
+	require.NoError(t, err)
+	require.Len(t, files, 16)
+}
+
+func TestConsistentDumpSession(t *testing.T) {
+	var mu sync.Mutex
+	sessions := make(map[string]int)
+	var running, maxRunning int
+	config := stubClickHouse(t, func(w http.ResponseWriter, req *http.Request, query string) {
+		mu.Lock()
+		sessions[req.URL.Query().Get("session_id")]++
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		time.Sleep(5 * time.Millisecond)
+		if !answerDumpQuery(w, query, "a", "b", "c") {
+			_, _ = io.WriteString(w, "rows")
+		}
+	})
+	// A library caller leaving the parallelism of the config on
+	config.Consistent = true
+	config.Parallel = 4
+	config.DataParallel = 4
+	fileStorage, err := storage.NewFileStorage(config.StorageConfig["path"], false)
+	require.NoError(t, err)
+	d, err := NewDumperWith(config, nil, fileStorage)
+	require.NoError(t, err)
+	require.NoError(t, d.Dump(context.Background()))
+
+	require.Len(t, sessions, 1, "every dump query is sent in one session")
+	require.NotContains(t, sessions, "")
+	require.Greater(t, sessions[d.client.sessionID], 8)
+	require.Equal(t, 1, maxRunning, "queries of a session run one at a time")
+}
+
+func TestContinueOnError(t *testing.T) {
+	config := stubClickHouse(t, func(w http.ResponseWriter, _ *http.Request, query string) {
+		switch {
+		case answerDumpQuery(w, query, "a", "b", "c"):
+		case strings.Contains(query, "FROM `shop`.`b`"):
+			http.Error(w, "Code: 241. DB::Exception: Memory limit exceeded. (MEMORY_LIMIT_EXCEEDED)", http.StatusInternalServerError)
+		default:
+			_, _ = io.WriteString(w, "rows")
+		}
+	})
+	config.ContinueOnError = true
+	config.Parallel = 2
+	fileStorage, err := storage.NewFileStorage(config.StorageConfig["path"], false)
+	require.NoError(t, err)
+	d, err := NewDumperWith(config, nil, fileStorage)
+	require.NoError(t, err)
+
+	err = d.Dump(context.Background())
+	var partial *PartialFailureError
+	require.ErrorAs(t, err, &partial)
+	require.ErrorContains(t, err, "MEMORY_LIMIT_EXCEEDED")
+
+	files, err := fileStorage.List("backup1", true)
+	require.NoError(t, err)
+	require.Contains(t, files, "backup1/shop/a.data.native")
+	require.Contains(t, files, "backup1/shop/c.data.native")
+	require.NotContains(t, files, "backup1/shop/b.data.native")
+	manifestFile, found := findManifest(files, "backup1")
+	require.True(t, found, "--continue-on-error writes the manifest")
+	manifest, err := readManifest(fileStorage, manifestFile)
+	require.NoError(t, err)
+	require.Len(t, manifest.FailedTables, 1)
+	require.Equal(t, "shop.b", manifest.FailedTables[0].Table)
+	require.Contains(t, manifest.FailedTables[0].Error, "MEMORY_LIMIT_EXCEEDED")
+}
+
+func TestTableTimeout(t *testing.T) {
+	config := stubClickHouse(t, func(w http.ResponseWriter, req *http.Request, query string) {
+		switch {
+		case answerDumpQuery(w, query, "hung", "quick"):
+		case strings.Contains(query, "FROM `shop`.`hung`"):
+			// Never answers, until the client gives up
+			<-req.Context().Done()
+		default:
+			_, _ = io.WriteString(w, "rows")
+		}
+	})
+	config.TableTimeout = 200 * time.Millisecond
+	config.ContinueOnError = true
+	fileStorage, err := storage.NewFileStorage(config.StorageConfig["path"], false)
+	require.NoError(t, err)
+	d, err := NewDumperWith(config, nil, fileStorage)
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = d.Dump(context.Background())
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.ErrorAs(t, err, new(*PartialFailureError))
+	require.ErrorContains(t, err, "shop.hung")
+	require.ErrorContains(t, err, "timed out after --table-timeout=200ms")
+	files, err := fileStorage.List("backup1", true)
+	require.NoError(t, err)
+	require.Contains(t, files, "backup1/shop/quick.data.native")
+}
@@ -0,0 +1,88 @@
+package clickhousedump
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+var formatClauseRe = regexp.MustCompile(`(?i)\bFORMAT\s+\w+`)
+
+// LoadDumpQueries reads a --dump-query-file with one "db.table: SELECT ..." entry per line, empty
+// lines and lines starting with # are skipped. Every query must select from its own table.
+func LoadDumpQueries(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dump query file: %w", err)
+	}
+	queries := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		table, query, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected db.table: SELECT ...", filename, lineNum)
+		}
+		table = strings.TrimSpace(table)
+		query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+		if err := validateDumpQuery(table, query); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNum, err)
+		}
+		if _, exists := queries[table]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate query for %s", filename, lineNum, table)
+		}
+		queries[table] = query
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dump query file: %w", err)
+	}
+	return queries, nil
+}
+
+// validateDumpQuery checks that query is a SELECT from table, given as db.table, without a FORMAT
+// clause, as the dumper adds the format and the INSERT target of the table.
+func validateDumpQuery(table, query string) error {
+	db, name, found := strings.Cut(table, ".")
+	if !found || db == "" || name == "" {
+		return fmt.Errorf("invalid table %q, expected db.table", table)
+	}
+	if !strings.HasPrefix(strings.ToUpper(query), "SELECT") && !strings.HasPrefix(strings.ToUpper(query), "WITH") {
+		return fmt.Errorf("query for %s must be a SELECT", table)
+	}
+	if formatClauseRe.MatchString(query) {
+		return fmt.Errorf("query for %s must not contain a FORMAT clause", table)
+	}
+	fromRe := regexp.MustCompile(fmt.Sprintf("(?i)\\bFROM\\s+`?%s`?\\s*\\.\\s*`?%s`?(\\s|$|\\))", regexp.QuoteMeta(db), regexp.QuoteMeta(name)))
+	if !fromRe.MatchString(query) {
+		return fmt.Errorf("query for %s must select FROM %s", table, table)
+	}
+	return nil
+}
+
+// dumpQuery returns the query replacing SELECT * for a table from --dump-query-file, if any.
+func (d *Dumper) dumpQuery(dbName, tableName string) (string, bool) {
+	query, ok := d.config.DumpQueries[dbName+"."+tableName]
+	return query, ok
+}
+
+// warnUnusedDumpQueries warns about --dump-query-file tables which are not dumped, usually a typo.
+func (d *Dumper) warnUnusedDumpQueries(jobs []tableDumpJob) {
+	dumped := make(map[string]bool, len(jobs))
+	for _, j := range jobs {
+		dumped[j.db+"."+j.table] = true
+	}
+	for table := range d.config.DumpQueries {
+		if !dumped[table] {
+			logging.Warnf("--dump-query-file has a query for %s, which is not dumped", table)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package clickhousedump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadDumpQueries(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "queries.txt")
+	require.NoError(t, os.WriteFile(file, []byte(`# soft-deleted rows are not restored
+db.users: SELECT * FROM db.users WHERE deleted = 0;
+
+db.events: SELECT * FROM `+"`db`.`events`"+` WHERE ts >= '2024-01-01 00:00:00' SETTINGS max_threads = 2
+`), 0o644))
+	queries, err := LoadDumpQueries(file)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"db.users":  "SELECT * FROM db.users WHERE deleted = 0",
+		"db.events": "SELECT * FROM `db`.`events` WHERE ts >= '2024-01-01 00:00:00' SETTINGS max_threads = 2",
+	}, queries)
+
+	require.NoError(t, os.WriteFile(file, []byte("db.users: SELECT 1\n"), 0o644))
+	_, err = LoadDumpQueries(file)
+	require.ErrorContains(t, err, "queries.txt:1: query for db.users must select FROM db.users")
+}
+
+func TestValidateDumpQuery(t *testing.T) {
+	require.NoError(t, validateDumpQuery("db.t", "SELECT id, name FROM db.t WHERE id % 10 = 0"))
+	require.NoError(t, validateDumpQuery("db.t", "WITH 1 AS x SELECT * FROM (SELECT * FROM db.t) WHERE x"))
+	require.NoError(t, validateDumpQuery("db.t", "select * from db . t final"))
+	require.ErrorContains(t, validateDumpQuery("db.t", "SELECT * FROM db.t2"), "must select FROM db.t")
+	require.ErrorContains(t, validateDumpQuery("db.t", "SELECT * FROM other.t"), "must select FROM db.t")
+	require.ErrorContains(t, validateDumpQuery("db.t", "SELECT * FROM db.t FORMAT CSV"), "FORMAT")
+	require.ErrorContains(t, validateDumpQuery("db.t", "ALTER TABLE db.t DELETE WHERE 1"), "must be a SELECT")
+	require.ErrorContains(t, validateDumpQuery("t", "SELECT * FROM t"), "expected db.table")
+}
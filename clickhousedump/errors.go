@@ -0,0 +1,87 @@
+package clickhousedump
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// itemError records the failure of a single table or file, so all failures of a phase
+// can be returned together and summarized once every job has finished.
+type itemError struct {
+	item string
+	err  error
+}
+
+func (e *itemError) Error() string {
+	return fmt.Sprintf("%s: %v", e.item, e.err)
+}
+
+func (e *itemError) Unwrap() error {
+	return e.err
+}
+
+// rootCause returns the innermost wrapped error.
+func rootCause(err error) error {
+	for {
+		unwrapped := errors.Unwrap(err)
+		if unwrapped == nil {
+			return err
+		}
+		err = unwrapped
+	}
+}
+
+// summarizeErrors builds a one line summary like "3/42 tables failed: db.t1 (cause), db.t2 (cause)".
+func summarizeErrors(errs []error, total int, what string) string {
+	items := make([]string, 0, len(errs))
+	for _, err := range errs {
+		var ie *itemError
+		if errors.As(err, &ie) {
+			items = append(items, fmt.Sprintf("%s (%s)", ie.item, firstNChars(rootCause(ie.err).Error(), 100)))
+		} else {
+			items = append(items, firstNChars(err.Error(), 100))
+		}
+	}
+	return fmt.Sprintf("%d/%d %s failed: %s", len(errs), total, what, strings.Join(items, ", "))
+}
+
+// ConfigError is returned for invalid flags or settings, before anything is dumped or restored.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("configuration error: %v", e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectionError is returned when ClickHouse or the storage can't be reached.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// PartialFailureError is returned when some databases, tables or files of a phase failed,
+// Err joins the failures of every item.
+type PartialFailureError struct {
+	Err error
+}
+
+func (e *PartialFailureError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialFailureError) Unwrap() error {
+	return e.Err
+}
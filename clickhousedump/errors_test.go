@@ -0,0 +1,46 @@
+package clickhousedump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizeErrors(t *testing.T) {
+	errTimeout := fmt.Errorf("failed to dump data: %w", context.DeadlineExceeded)
+	errMissing := fmt.Errorf("failed to download: %w", &fs.PathError{Op: "open", Path: "db/t2.data.sql", Err: fs.ErrNotExist})
+	errSchema := errors.New("Code: 60. DB::Exception: Table db.t3 does not exist. (UNKNOWN_TABLE)")
+	errs := []error{
+		&itemError{item: "db.t1", err: errTimeout},
+		&itemError{item: "db.t2", err: errMissing},
+		&itemError{item: "db.t3", err: fmt.Errorf("failed to dump schema: %w", errSchema)},
+		errors.New("manifest upload failed"),
+	}
+	require.Equal(t, "4/42 tables failed: db.t1 (context deadline exceeded), db.t2 (file does not exist), "+
+		"db.t3 (Code: 60. DB::Exception: Table db.t3 does not exist. (UNKNOWN_TABLE)), manifest upload failed",
+		summarizeErrors(errs, 42, "tables"))
+
+	// Causes are cut to 100 characters
+	long := &itemError{item: "db.t4", err: errors.New(strings.Repeat("x", 150))}
+	require.Equal(t, "1/1 tables failed: db.t4 ("+strings.Repeat("x", 100)+")", summarizeErrors([]error{long}, 1, "tables"))
+
+	// The joined error keeps the cause of every table
+	joined := &PartialFailureError{Err: errors.Join(errs...)}
+	require.ErrorIs(t, joined, context.DeadlineExceeded)
+	require.ErrorIs(t, joined, fs.ErrNotExist)
+	require.ErrorIs(t, joined, errSchema)
+	var pathErr *fs.PathError
+	require.ErrorAs(t, joined, &pathErr)
+	require.Equal(t, "db/t2.data.sql", pathErr.Path)
+	var ie *itemError
+	require.ErrorAs(t, joined, &ie)
+	require.Equal(t, "db.t1", ie.item)
+	for _, line := range []string{"db.t1: failed to dump data: context deadline exceeded", "db.t2: failed to download", "db.t3: failed to dump schema", "manifest upload failed"} {
+		require.Contains(t, joined.Error(), line)
+	}
+}
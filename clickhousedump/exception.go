@@ -0,0 +1,191 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// exceptionTailSize is how much of the end of a response is kept to look for an exception,
+// enough for the message and the stack trace ClickHouse appends to it.
+const exceptionTailSize = 16 * 1024
+
+// exceptionRe matches an exception ClickHouse writes into a response after sending status 200.
+// It starts on its own line, values of SQLInsert and TSV rows can't, newlines in them are escaped.
+var exceptionRe = regexp.MustCompile(`(?:^|\n)(Code: \d+\. DB::Exception: [^\n]*)`)
+
+// exceptionMarker ends exceptions of servers writing them in the __exception__ block format.
+const exceptionMarker = "__exception__"
+
+// tailBuffer keeps the last exceptionTailSize bytes written to it.
+type tailBuffer struct {
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > exceptionTailSize {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-exceptionTailSize:]...)
+	}
+	return len(p), nil
+}
+
+// exception returns the exception at the end of the response, or "" if it ends normally.
+func (t *tailBuffer) exception() string {
+	tail := strings.TrimRight(string(t.buf), "\r\n")
+	matches := exceptionRe.FindAllStringSubmatchIndex(tail, -1)
+	if len(matches) > 0 {
+		last := matches[len(matches)-1]
+		return firstNChars(tail[last[2]:], 1024)
+	}
+	if strings.HasSuffix(tail, exceptionMarker) {
+		block := strings.TrimSuffix(tail, exceptionMarker)
+		if start := strings.LastIndex(block, exceptionMarker); start >= 0 {
+			block = block[start+len(exceptionMarker):]
+		}
+		return firstNChars(strings.TrimSpace(block), 1024)
+	}
+	return ""
+}
+
+// exceptionCheckReader passes a response body through and fails at its end if ClickHouse
+// wrote an exception into it after status 200, e.g. when a long SELECT fails midway.
+// Compressed bodies are decompressed on the side to find the exception in the plain text,
+// their raw tail is checked too in case the exception was appended uncompressed.
+type exceptionCheckReader struct {
+	body       io.ReadCloser
+	query      string
+	tail       *tailBuffer
+	rawTail    *tailBuffer
+	decoded    *io.PipeWriter
+	decodeDone chan struct{}
+	checkOnce  sync.Once
+	checkErr   error
+}
+
+func newExceptionCheckReader(body io.ReadCloser, contentEncoding, query string) *exceptionCheckReader {
+	r := &exceptionCheckReader{body: body, query: query, tail: &tailBuffer{}, rawTail: &tailBuffer{}}
+	if contentEncoding == "" {
+		r.rawTail = r.tail
+		return r
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	r.decoded = pipeWriter
+	r.decodeDone = make(chan struct{})
+	go func() {
+		defer close(r.decodeDone)
+		decoder, err := newResponseDecoder(pipeReader, contentEncoding)
+		if err == nil {
+			_, err = io.Copy(r.tail, decoder)
+			_ = decoder.Close()
+		}
+		// Unblock Read, the exception can't be looked for in a body which doesn't decompress
+		_ = pipeReader.CloseWithError(fmt.Errorf("can't decompress %s response: %v", contentEncoding, err))
+	}()
+	return r
+}
+
+// newResponseDecoder decompresses a response body with the given Content-Encoding.
+func newResponseDecoder(r io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(contentEncoding) {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %s", contentEncoding)
+}
+
+// readResponseText reads a whole response body decompressed by its Content-Encoding, so messages of
+// failed queries are logged as text. A read error is returned as the text.
+func readResponseText(resp *http.Response) []byte {
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []byte(err.Error())
+	}
+	return decodeResponse(raw, resp.Header.Get("Content-Encoding"))
+}
+
+// decodeResponse decompresses a read response body, bodies which don't decompress, e.g. cut
+// off or sent uncompressed despite their Content-Encoding, are returned as far as they decoded,
+// else as is.
+func decodeResponse(raw []byte, contentEncoding string) []byte {
+	if contentEncoding == "" || strings.EqualFold(contentEncoding, "identity") {
+		return raw
+	}
+	decoder, err := newResponseDecoder(bytes.NewReader(raw), contentEncoding)
+	if err != nil {
+		return raw
+	}
+	defer func() {
+		_ = decoder.Close()
+	}()
+	text, err := io.ReadAll(decoder)
+	if err != nil && len(text) == 0 {
+		return raw
+	}
+	return text
+}
+
+func (r *exceptionCheckReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		_, _ = r.rawTail.Write(p[:n])
+		if r.decoded != nil {
+			if _, writeErr := r.decoded.Write(p[:n]); writeErr != nil {
+				r.stopDecoding()
+			}
+		}
+	}
+	if err == io.EOF {
+		if checkErr := r.check(); checkErr != nil {
+			return n, checkErr
+		}
+	}
+	return n, err
+}
+
+// stopDecoding waits for the decompressing goroutine, afterwards the tail is safe to read.
+func (r *exceptionCheckReader) stopDecoding() {
+	if r.decoded == nil {
+		return
+	}
+	_ = r.decoded.Close()
+	<-r.decodeDone
+	r.decoded = nil
+}
+
+// check looks for an exception at the end of the fully read body.
+func (r *exceptionCheckReader) check() error {
+	r.checkOnce.Do(func() {
+		r.stopDecoding()
+		exception := r.tail.exception()
+		if exception == "" && r.rawTail != r.tail {
+			exception = r.rawTail.exception()
+		}
+		if exception != "" {
+			r.checkErr = fmt.Errorf("HTTP request POST %s... failed after status 200, ClickHouse wrote an exception into the response: %s", firstNChars(r.query, 255), exception)
+		}
+	})
+	return r.checkErr
+}
+
+func (r *exceptionCheckReader) Close() error {
+	if r.decoded != nil {
+		_ = r.decoded.CloseWithError(io.ErrClosedPipe)
+		<-r.decodeDone
+		r.decoded = nil
+	}
+	return r.body.Close()
+}
@@ -0,0 +1,99 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+const midQueryException = "Code: 241. DB::Exception: Memory limit (total) exceeded: would use 9.31 GiB. (MEMORY_LIMIT_EXCEEDED) (version 24.8.4.13 (official build))\n"
+
+// newStreamingServer answers every query with status 200 and body, compressed with the
+// requested Accept-Encoding like ClickHouse does with enable_http_compression=1.
+func newStreamingServer(t *testing.T, body string, header http.Header) *ClickHouseClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		var out io.Writer = w
+		var closer io.Closer
+		switch req.Header.Get("Accept-Encoding") {
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			out, closer = gz, gz
+		case "zstd":
+			w.Header().Set("Content-Encoding", "zstd")
+			zw, err := zstd.NewWriter(w)
+			require.NoError(t, err)
+			out, closer = zw, zw
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(out, body)
+		if closer != nil {
+			_ = closer.Close()
+		}
+	}))
+	t.Cleanup(server.Close)
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	return NewClickHouseClient(&Config{Host: host, Port: port})
+}
+
+// readResponse reads a streamed response fully and returns the plain text and the read error.
+func readResponse(t *testing.T, client *ClickHouseClient, compressFormat string) (string, error) {
+	body, contentEncoding, err := client.ExecuteQueryStreaming(context.Background(), "SELECT * FROM db.t FORMAT SQLInsert", compressFormat)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		require.NoError(t, body.Close())
+	}()
+	raw, readErr := io.ReadAll(body)
+	if contentEncoding == "" {
+		return string(raw), readErr
+	}
+	decoder, err := newResponseDecoder(bytes.NewReader(raw), contentEncoding)
+	require.NoError(t, err)
+	plain, err := io.ReadAll(decoder)
+	require.NoError(t, err)
+	return string(plain), readErr
+}
+
+func TestExecuteQueryStreamingDetectsException(t *testing.T) {
+	rows := strings.Repeat("INSERT INTO `db`.`t` (`id`, `s`) VALUES (1, 'a');\n", 2000)
+	for _, compressFormat := range []string{"", "gzip", "zstd"} {
+		client := newStreamingServer(t, rows+midQueryException, nil)
+		_, err := readResponse(t, client, compressFormat)
+		require.ErrorContains(t, err, "Code: 241. DB::Exception: Memory limit (total) exceeded", "compress format %q", compressFormat)
+		require.ErrorContains(t, err, "failed after status 200")
+
+		// Exception texts inside values are escaped and don't end the response on their own line
+		clean := rows + "INSERT INTO `db`.`t` (`id`, `s`) VALUES (2, 'x\\nCode: 241. DB::Exception: from query_log');\n"
+		client = newStreamingServer(t, clean, nil)
+		plain, err := readResponse(t, client, compressFormat)
+		require.NoError(t, err, "compress format %q", compressFormat)
+		require.Equal(t, clean, plain)
+	}
+
+	client := newStreamingServer(t, rows+"__exception__\nCode: 395. DB::Exception: Value passed to 'throwIf' function is non-zero. (FUNCTION_THROW_IF_VALUE_IS_NON_ZERO)\n__exception__\n", nil)
+	_, err := readResponse(t, client, "")
+	require.ErrorContains(t, err, "Code: 395. DB::Exception: Value passed to 'throwIf'")
+
+	client = newStreamingServer(t, "Code: 60. DB::Exception: Unknown table db.t. (UNKNOWN_TABLE)", http.Header{"X-Clickhouse-Exception-Code": {"60"}})
+	_, err = readResponse(t, client, "")
+	require.ErrorContains(t, err, "exception code: 60")
+	require.ErrorContains(t, err, "UNKNOWN_TABLE")
+}
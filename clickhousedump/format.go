@@ -0,0 +1,81 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Data formats supported by --data-format.
+const (
+	DataFormatSQLInsert = "SQLInsert"
+	DataFormatNative    = "Native"
+	DataFormatParquet   = "Parquet"
+)
+
+// dataFileSuffixes maps data formats to the suffix of their data files.
+var dataFileSuffixes = map[string]string{
+	DataFormatSQLInsert: ".data.sql",
+	DataFormatNative:    ".data.native",
+	DataFormatParquet:   ".data.parquet",
+}
+
+// NormalizeDataFormat returns the canonical name of a --data-format value.
+func NormalizeDataFormat(format string) (string, error) {
+	if format == "" {
+		return DataFormatSQLInsert, nil
+	}
+	for known := range dataFileSuffixes {
+		if strings.EqualFold(format, known) {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported data format %s, expected one of SQLInsert, Native, Parquet", format)
+}
+
+func dataFileSuffix(format string) string {
+	if suffix, ok := dataFileSuffixes[format]; ok {
+		return suffix
+	}
+	return dataFileSuffixes[DataFormatSQLInsert]
+}
+
+// dataFileFormat returns the data format of a listed backup file by its suffix, or "" for non-data files.
+func dataFileFormat(file string) string {
+	name := trimCompressionExt(file)
+	for format, suffix := range dataFileSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return format
+		}
+	}
+	return ""
+}
+
+var chunkSuffixRe = regexp.MustCompile(`\.chunk\d{5}$`)
+
+// formatClause returns the FORMAT part of a data dump query.
+func (d *Dumper) formatClause(dbName, tableName string) string {
+	if d.config.DataFormat == DataFormatSQLInsert || d.config.DataFormat == "" {
+		return fmt.Sprintf("FORMAT SQLInsert SETTINGS output_format_sql_insert_max_batch_size=%d, output_format_sql_insert_table_name='`%s`.`%s`', output_format_sql_insert_include_column_names=%d, output_format_sql_insert_quote_names=%d, output_format_sql_insert_use_replace=%d",
+			d.config.BatchSize, dbName, tableName, boolSetting(!d.config.SQLInsertOmitColumnNames), boolSetting(!d.config.SQLInsertUnquotedNames), boolSetting(d.config.SQLInsertUseReplace))
+	}
+	return "FORMAT " + d.config.DataFormat
+}
+
+func boolSetting(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// replaceStatementRe matches the REPLACE INTO of statements dumped with --sql-insert-use-replace.
+var replaceStatementRe = regexp.MustCompile(`(?i)^\s*REPLACE\s+INTO\b`)
+
+// replaceToInsert turns a REPLACE INTO statement into INSERT INTO, ClickHouse has no REPLACE.
+func replaceToInsert(statement string) string {
+	if loc := replaceStatementRe.FindStringIndex(statement); loc != nil {
+		return "INSERT INTO" + statement[loc[1]:]
+	}
+	return statement
+}
@@ -0,0 +1,78 @@
+package clickhousedump
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+var freezeNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// freezeName returns the FREEZE WITH NAME of a backup, ClickHouse creates shadow/<name> with it.
+func freezeName(backupName string) string {
+	return "clickhouse_dump_" + freezeNameRe.ReplaceAllString(backupName, "_")
+}
+
+// isMergeTree reports whether engine supports ALTER TABLE FREEZE.
+func isMergeTree(engine string) bool {
+	return strings.HasSuffix(engine, "MergeTree")
+}
+
+// freezeTables runs ALTER TABLE FREEZE for the MergeTree tables of jobs one after another, so the
+// snapshots of all tables are taken close together, and records the frozen parts for the manifest.
+// The dumped data is still read from the live tables with SELECT.
+func (d *Dumper) freezeTables(ctx context.Context, jobs []tableDumpJob) error {
+	name := freezeName(d.config.BackupName)
+	logging.Infof("Freezing MergeTree tables with name %s", name)
+	for _, j := range jobs {
+		if !isMergeTree(j.engine) {
+			d.debugf("Skipping freeze of %s.%s, %s doesn't support FREEZE", j.db, j.table, j.engine)
+			continue
+		}
+		frozenAt := time.Now().UTC()
+		resp, err := d.client.ExecuteQuery(ctx, fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE WITH NAME '%s' SETTINGS alter_partition_verbose_result=1", j.db, j.table, name))
+		if err != nil {
+			return fmt.Errorf("failed to freeze %s.%s: %w", j.db, j.table, err)
+		}
+		frozen := ManifestFrozenTable{Table: j.db + "." + j.table, FrozenAt: frozenAt, Parts: parseFrozenParts(resp)}
+		d.debugf("Froze %d parts of %s", len(frozen.Parts), frozen.Table)
+		d.frozenMu.Lock()
+		d.frozen = append(d.frozen, frozen)
+		d.frozenMu.Unlock()
+	}
+	return nil
+}
+
+// unfreezeTables removes the shadow copies made by freezeTables to free the disk, failures
+// are only logged because the dump itself is complete.
+func (d *Dumper) unfreezeTables(ctx context.Context) {
+	name := freezeName(d.config.BackupName)
+	d.frozenMu.Lock()
+	defer d.frozenMu.Unlock()
+	for _, frozen := range d.frozen {
+		db, table, _ := strings.Cut(frozen.Table, ".")
+		if _, err := d.client.ExecuteQuery(ctx, fmt.Sprintf("ALTER TABLE `%s`.`%s` UNFREEZE WITH NAME '%s'", db, table, name)); err != nil {
+			logging.Warnf("failed to unfreeze %s, remove shadow/%s on the server manually: %v", frozen.Table, name, err)
+			continue
+		}
+		d.debugf("Unfroze %s", frozen.Table)
+	}
+}
+
+// parseFrozenParts reads the alter_partition_verbose_result rows of ALTER TABLE FREEZE, with columns
+// command_type, partition_id, part_name, backup_name, backup_path and part_backup_path.
+func parseFrozenParts(resp []byte) []ManifestFrozenPart {
+	var parts []ManifestFrozenPart
+	for _, line := range strings.Split(strings.TrimSpace(string(resp)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 6 || !strings.HasPrefix(fields[0], "FREEZE") {
+			continue
+		}
+		parts = append(parts, ManifestFrozenPart{Name: fields[2], Path: fields[5]})
+	}
+	return parts
+}
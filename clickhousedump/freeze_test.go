@@ -0,0 +1,29 @@
+package clickhousedump
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreezeName(t *testing.T) {
+	require.Equal(t, "clickhouse_dump_nightly", freezeName("nightly"))
+	require.Equal(t, "clickhouse_dump_daily_2024-01-01_db", freezeName("daily/2024-01-01.db"))
+}
+
+func TestParseFrozenParts(t *testing.T) {
+	resp := "FREEZE ALL\t202401\t202401_1_1_0\tclickhouse_dump_nightly\t/var/lib/clickhouse/shadow/clickhouse_dump_nightly/\t/var/lib/clickhouse/shadow/clickhouse_dump_nightly/store/abc/abcdef/202401_1_1_0/\n" +
+		"FREEZE ALL\t202402\t202402_2_2_0\tclickhouse_dump_nightly\t/var/lib/clickhouse/shadow/clickhouse_dump_nightly/\t/var/lib/clickhouse/shadow/clickhouse_dump_nightly/store/abc/abcdef/202402_2_2_0/\n"
+	require.Equal(t, []ManifestFrozenPart{
+		{Name: "202401_1_1_0", Path: "/var/lib/clickhouse/shadow/clickhouse_dump_nightly/store/abc/abcdef/202401_1_1_0/"},
+		{Name: "202402_2_2_0", Path: "/var/lib/clickhouse/shadow/clickhouse_dump_nightly/store/abc/abcdef/202402_2_2_0/"},
+	}, parseFrozenParts([]byte(resp)))
+	require.Empty(t, parseFrozenParts(nil))
+}
+
+func TestIsMergeTree(t *testing.T) {
+	require.True(t, isMergeTree("MergeTree"))
+	require.True(t, isMergeTree("ReplicatedReplacingMergeTree"))
+	require.False(t, isMergeTree("Memory"))
+	require.False(t, isMergeTree("MaterializedView"))
+}
@@ -0,0 +1,109 @@
+package clickhousedump
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// functionsDir is the backup directory of user-defined function files, <backup>/functions/<name>.sql.
+const functionsDir = "functions"
+
+var createFunctionRe = regexp.MustCompile(`(?is)^\s*CREATE\s+(OR\s+REPLACE\s+)?FUNCTION\s+(IF\s+NOT\s+EXISTS\s+)?`)
+
+// createFunctionIfNotExists adds IF NOT EXISTS to a SHOW CREATE FUNCTION statement,
+// so restoring into a server which already has the function doesn't fail.
+func createFunctionIfNotExists(stmt string) string {
+	if !createFunctionRe.MatchString(stmt) {
+		return stmt
+	}
+	return createFunctionRe.ReplaceAllLiteralString(stmt, "CREATE FUNCTION IF NOT EXISTS ")
+}
+
+// isFunctionFile reports whether a listed backup file holds a user-defined function.
+func isFunctionFile(file string) bool {
+	return isGlobalObjectFile(file, functionsDir)
+}
+
+// isGlobalObjectFile reports whether a listed backup file is a <dir>/<name>.sql file of a global
+// object. Tables of a database named like dir share the directory but always have a .schema.sql,
+// .comments.sql or data suffix.
+func isGlobalObjectFile(file, dir string) bool {
+	name := trimCompressionExt(file)
+	if path.Base(path.Dir(name)) != dir || !strings.HasSuffix(name, ".sql") {
+		return false
+	}
+	return !strings.HasSuffix(name, ".schema.sql") && !isCommentsFile(file) && dataFileFormat(file) == ""
+}
+
+// dumpFunctions dumps every SQL user-defined function, they are global and not filtered by --databases.
+func (d *Dumper) dumpFunctions(ctx context.Context) error {
+	resp, err := d.client.ExecuteQuery(ctx, "SELECT name FROM system.functions WHERE origin = 'SQLUserDefined' ORDER BY name FORMAT TSVRaw")
+	if err != nil {
+		return fmt.Errorf("failed to list user-defined functions: %w", err)
+	}
+	var functions []string
+	for _, line := range strings.Split(strings.TrimSpace(string(resp)), "\n") {
+		if line != "" {
+			functions = append(functions, line)
+		}
+	}
+	logging.Infof("Found %d user-defined functions for dump", len(functions))
+
+	for _, name := range functions {
+		query := fmt.Sprintf("SHOW CREATE FUNCTION `%s` FORMAT TSVRaw", name)
+		stmt, err := d.client.ExecuteQuery(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to dump function %s: %w", name, err)
+		}
+		filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, functionsDir, name+".sql")
+		if err := d.uploadSchema(filename, strings.NewReader(createFunctionIfNotExists(string(stmt))), ""); err != nil {
+			return fmt.Errorf("failed to upload function %s: %w", name, err)
+		}
+		logging.Infof("Successfully dumped function %s", name)
+	}
+	return nil
+}
+
+// restoreGlobalObjects creates global objects like user-defined functions one at a time in name
+// order before any table, since table engines, defaults and views may refer to them.
+func (r *Restorer) restoreGlobalObjects(ctx context.Context, kind string, files []string) error {
+	sort.Strings(files)
+	for _, file := range files {
+		if r.state != nil && r.state.file(file).Done {
+			logging.Infof("Skipping %s %s, already restored by a previous run", kind, file)
+			continue
+		}
+		logging.Infof("Restoring %s from %s...", kind, file)
+		if err := r.restoreGlobalObject(ctx, kind, file); err != nil {
+			return err
+		}
+		if r.state != nil {
+			if err := r.state.record(file, restoreFileState{Done: true}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreGlobalObject downloads and executes one function or named collection file.
+func (r *Restorer) restoreGlobalObject(ctx context.Context, kind, file string) error {
+	reader, err := r.storage.Download(file)
+	if err != nil && r.skipDownloadError(file, err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s file %s: %w", kind, file, err)
+	}
+	defer closeDownload(reader, file)
+	if err := r.restoreSchema(ctx, reader); err != nil {
+		return fmt.Errorf("failed to restore %s from %s: %w", kind, file, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package clickhousedump
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateFunctionIfNotExists(t *testing.T) {
+	cases := map[string]string{
+		"CREATE FUNCTION linear AS (x, k, b) -> ((k * x) + b)":             "CREATE FUNCTION IF NOT EXISTS linear AS (x, k, b) -> ((k * x) + b)",
+		"CREATE FUNCTION IF NOT EXISTS linear AS x -> x":                   "CREATE FUNCTION IF NOT EXISTS linear AS x -> x",
+		"CREATE OR REPLACE FUNCTION linear AS x -> x":                      "CREATE FUNCTION IF NOT EXISTS linear AS x -> x",
+		"create function lower_case AS s -> concat('CREATE FUNCTION ', s)": "CREATE FUNCTION IF NOT EXISTS lower_case AS s -> concat('CREATE FUNCTION ', s)",
+	}
+	for stmt, expected := range cases {
+		require.Equal(t, expected, createFunctionIfNotExists(stmt), stmt)
+	}
+}
+
+func TestIsFunctionFile(t *testing.T) {
+	cases := map[string]bool{
+		"backup/functions/linear.sql":            true,
+		"backup/functions/linear.sql.gz":         true,
+		"backup/functions/mydatabase.sql.zstd":   true,
+		"backup/functions.database.sql":          false,
+		"backup/functions/t.schema.sql.gz":       false,
+		"backup/functions/t.data.sql.gz":         false,
+		"backup/functions/t.chunk00001.data.sql": false,
+		"backup/db/linear.sql":                   false,
+	}
+	for file, expected := range cases {
+		require.Equal(t, expected, isFunctionFile(file), file)
+	}
+}
+
+func TestCreateNamedCollectionIfNotExists(t *testing.T) {
+	cases := map[string]string{
+		"CREATE NAMED COLLECTION s3_conn AS url = 'https://s3/', access_key_id = 'key'": "CREATE NAMED COLLECTION IF NOT EXISTS s3_conn AS url = 'https://s3/', access_key_id = 'key'",
+		"CREATE NAMED COLLECTION IF NOT EXISTS s3_conn AS url = 'https://s3/'":          "CREATE NAMED COLLECTION IF NOT EXISTS s3_conn AS url = 'https://s3/'",
+		"create named collection s3_conn AS url = 'https://s3/'":                        "CREATE NAMED COLLECTION IF NOT EXISTS s3_conn AS url = 'https://s3/'",
+	}
+	for stmt, expected := range cases {
+		require.Equal(t, expected, createNamedCollectionIfNotExists(stmt), stmt)
+	}
+	require.True(t, isNamedCollectionFile("backup/named_collections/s3_conn.sql.gz"))
+	require.False(t, isNamedCollectionFile("backup/named_collections/t.schema.sql.gz"))
+	require.False(t, isNamedCollectionFile("backup/functions/linear.sql"))
+}
@@ -0,0 +1,54 @@
+package clickhousedump
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// hookStatements returns the statements of a hook value, which is either a path to an SQL file
+// or inline statements separated by semicolons.
+func hookStatements(value string) ([]string, error) {
+	sql := value
+	if info, err := os.Stat(value); err == nil && info.Mode().IsRegular() {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", value, err)
+		}
+		sql = string(data)
+	}
+	var statements []string
+	err := scanStatements(strings.NewReader(sql), func(statement string) error {
+		statements = append(statements, statement)
+		return nil
+	})
+	return statements, err
+}
+
+// runHook executes the statements of the --pre-dump-sql, --post-dump-sql, --pre-restore-sql
+// or --post-restore-sql hook name in order, stopping at the first failure unless
+// --ignore-hook-errors is set.
+func runHook(ctx context.Context, client *ClickHouseClient, config *Config, name, value string) error {
+	if value == "" {
+		return nil
+	}
+	statements, err := hookStatements(value)
+	if err != nil {
+		return fmt.Errorf("--%s: %w", name, err)
+	}
+	logging.Infof("Running --%s, %d statements", name, len(statements))
+	for i, statement := range statements {
+		logging.Debugf("--%s statement %d: %s", name, i+1, statement)
+		if _, err := client.ExecuteQuery(ctx, statement); err != nil {
+			if config.IgnoreHookErrors {
+				logging.Warnf("--%s statement %d failed, ignored: %v", name, i+1, err)
+				continue
+			}
+			return fmt.Errorf("--%s statement %d failed: %w", name, i+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package clickhousedump
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookStatements(t *testing.T) {
+	statements, err := hookStatements("SYSTEM STOP MERGES; SELECT ';'")
+	require.NoError(t, err)
+	require.Equal(t, []string{"SYSTEM STOP MERGES;", "SELECT ';'"}, statements)
+
+	file := filepath.Join(t.TempDir(), "grants.sql")
+	require.NoError(t, os.WriteFile(file, []byte("GRANT SELECT ON db.* TO reader;\nOPTIMIZE TABLE db.t FINAL;\n"), 0o644))
+	statements, err = hookStatements(file)
+	require.NoError(t, err)
+	require.Equal(t, []string{"GRANT SELECT ON db.* TO reader;", "OPTIMIZE TABLE db.t FINAL;"}, statements)
+}
+
+func TestRunHook(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		queries = append(queries, string(body))
+		if strings.Contains(string(body), "FAIL") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	config := &Config{Host: host, Port: port}
+	client := NewClickHouseClient(config)
+	hook := "SELECT 1; SELECT FAIL; SELECT 2"
+	require.ErrorContains(t, runHook(context.Background(), client, config, "post-restore-sql", hook), "--post-restore-sql statement 2 failed")
+	require.Len(t, queries, 2)
+
+	queries = nil
+	config.IgnoreHookErrors = true
+	require.NoError(t, runHook(context.Background(), client, config, "post-restore-sql", hook))
+	require.Len(t, queries, 3)
+}
@@ -0,0 +1,102 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// backupCandidate is a backup found in the storage listing by --latest.
+type backupCandidate struct {
+	name      string
+	createdAt time.Time // zero when the backup has no manifest
+}
+
+// resolveLatestBackup replaces a partial or empty --latest backup name with the most recent
+// backup containing it and matching --match. Backups are ordered by the created_at of their
+// manifest, backups without a manifest, e.g. interrupted dumps, come before them by name.
+// An existing backup with exactly the given name is restored as is.
+func (r *Restorer) resolveLatestBackup() error {
+	root := r.config.StorageConfig["path"]
+	if r.config.BackupName != "" {
+		files, err := r.storage.List(path.Join(root, r.config.BackupName), true)
+		if err == nil && len(files) > 0 {
+			r.debugf("Backup %s exists, --latest keeps it", r.config.BackupName)
+			return nil
+		}
+	}
+	var match *regexp.Regexp
+	if r.config.BackupMatch != "" {
+		var err error
+		if match, err = regexp.Compile(r.config.BackupMatch); err != nil {
+			return &ConfigError{Err: fmt.Errorf("invalid --match: %w", err)}
+		}
+	}
+
+	logging.Infof("Looking for the latest backup under %s", root)
+	files, err := r.storage.List(root, true)
+	if err != nil {
+		return fmt.Errorf("failed to list backups under %s: %w", root, err)
+	}
+	var matched []backupCandidate
+	for _, c := range r.backupCandidates(files) {
+		if strings.Contains(c.name, r.config.BackupName) && (match == nil || match.MatchString(c.name)) {
+			matched = append(matched, c)
+		}
+	}
+	if len(matched) == 0 {
+		return &ConfigError{Err: fmt.Errorf("no backup under %s matches name %q and --match %q", root, r.config.BackupName, r.config.BackupMatch)}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].createdAt.Equal(matched[j].createdAt) {
+			return matched[i].createdAt.Before(matched[j].createdAt)
+		}
+		return matched[i].name < matched[j].name
+	})
+	latest := matched[len(matched)-1]
+	if latest.createdAt.IsZero() {
+		logging.Infof("Resolved latest backup %s by name, it has no %s", latest.name, manifestFileName)
+	} else {
+		logging.Infof("Resolved latest backup %s created at %s", latest.name, latest.createdAt.Format(time.RFC3339))
+	}
+	r.config.BackupName = latest.name
+	return nil
+}
+
+// backupCandidates finds backups in a recursive listing of the storage root by their manifest,
+// or by their database files when the manifest is missing.
+func (r *Restorer) backupCandidates(files []string) []backupCandidate {
+	byDir := make(map[string]backupCandidate)
+	for _, file := range files {
+		dir := path.Dir(file)
+		switch {
+		case path.Base(file) == manifestFileName:
+			candidate := backupCandidate{name: path.Base(dir)}
+			manifest, err := readManifest(r.storage, file)
+			if err != nil {
+				logging.Warnf("can't read %s, ordering its backup by name: %v", file, err)
+			} else {
+				// The manifest keeps the full name of backups named with slashes
+				if manifest.BackupName != "" {
+					candidate.name = manifest.BackupName
+				}
+				candidate.createdAt = manifest.CreatedAt
+			}
+			byDir[dir] = candidate
+		case isDatabaseFile(file) && !isFunctionFile(file):
+			if _, ok := byDir[dir]; !ok {
+				byDir[dir] = backupCandidate{name: path.Base(dir)}
+			}
+		}
+	}
+	candidates := make([]backupCandidate, 0, len(byDir))
+	for _, c := range byDir {
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
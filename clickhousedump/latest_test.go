@@ -0,0 +1,63 @@
+package clickhousedump
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+func TestResolveLatestBackup(t *testing.T) {
+	dir := t.TempDir()
+	writeBackup := func(name string, createdAt time.Time) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, name), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, "db.database.sql"), []byte("CREATE DATABASE db"), 0o644))
+		if createdAt.IsZero() {
+			return
+		}
+		data, err := json.Marshal(&Manifest{BackupName: name, CreatedAt: createdAt})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, manifestFileName), data, 0o644))
+	}
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	writeBackup("nightly-2026-10-01", day)
+	writeBackup("nightly-2026-10-02", day.Add(24*time.Hour))
+	// Interrupted before the manifest was written, newest by name only
+	writeBackup("nightly-2026-10-03", time.Time{})
+	writeBackup("weekly-2026-09-28", day.Add(48*time.Hour))
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+
+	resolve := func(name, match string) (string, error) {
+		r := &Restorer{config: &Config{StorageConfig: map[string]string{"path": dir}, BackupName: name, BackupMatch: match, Latest: true}, storage: fileStorage}
+		err := r.resolveLatestBackup()
+		return r.config.BackupName, err
+	}
+	name, err := resolve("nightly", "")
+	require.NoError(t, err)
+	require.Equal(t, "nightly-2026-10-02", name)
+	name, err = resolve("", "")
+	require.NoError(t, err)
+	require.Equal(t, "weekly-2026-09-28", name)
+	name, err = resolve("", "^nightly-2026-10-0[13]$")
+	require.NoError(t, err)
+	require.Equal(t, "nightly-2026-10-01", name)
+	name, err = resolve("nightly-2026-10-03", "")
+	require.NoError(t, err)
+	require.Equal(t, "nightly-2026-10-03", name, "an exact name is kept")
+
+	_, err = resolve("monthly", "")
+	var configErr *ConfigError
+	require.ErrorAs(t, err, &configErr)
+
+	// Without manifests the name decides
+	require.NoError(t, os.Remove(filepath.Join(dir, "weekly-2026-09-28", manifestFileName)))
+	name, err = resolve("-2026-", "^weekly|10-03$")
+	require.NoError(t, err)
+	require.Equal(t, "weekly-2026-09-28", name)
+}
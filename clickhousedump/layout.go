@@ -0,0 +1,124 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DefaultLayout is the --layout of table files, relative to the backup.
+const DefaultLayout = "{db}/{table}"
+
+// fileLayout builds and parses backup file paths from a --layout template. Table files are the
+// expanded template followed by an optional chunk number and a kind suffix like .schema.sql or
+// .data.native, database files are <db>.database.sql in the backup root whatever the layout.
+// The zero value is DefaultLayout.
+type fileLayout struct {
+	template string
+	re       *regexp.Regexp
+}
+
+var defaultFileLayout, _ = newFileLayout(DefaultLayout)
+
+// ValidateLayout checks a --layout template.
+func ValidateLayout(template string) error {
+	_, err := newFileLayout(template)
+	return err
+}
+
+// newFileLayout parses template, which must contain {db} and {table} once, with {table} in the
+// last path element and {db} in a directory before it, so both can be parsed back from paths.
+func newFileLayout(template string) (fileLayout, error) {
+	if template == "" {
+		template = DefaultLayout
+	}
+	if strings.Count(template, "{db}") != 1 || strings.Count(template, "{table}") != 1 {
+		return fileLayout{}, fmt.Errorf("layout %q must contain {db} and {table} once", template)
+	}
+	elements := strings.Split(template, "/")
+	for _, element := range elements {
+		if element == "" || element == "." || element == ".." {
+			return fileLayout{}, fmt.Errorf("layout %q must be a relative path without empty, . or .. elements", template)
+		}
+	}
+	if strings.ContainsAny(strings.NewReplacer("{db}", "", "{table}", "").Replace(template), "{}") {
+		return fileLayout{}, fmt.Errorf("layout %q supports only the {db} and {table} placeholders", template)
+	}
+	last := elements[len(elements)-1]
+	if !strings.Contains(last, "{table}") || strings.Contains(last, "{db}") {
+		return fileLayout{}, fmt.Errorf("layout %q must have {table} in the last path element and {db} in a directory before it", template)
+	}
+
+	pattern := regexp.QuoteMeta(template)
+	pattern = strings.Replace(pattern, regexp.QuoteMeta("{db}"), `(?P<db>[^/]+)`, 1)
+	pattern = strings.Replace(pattern, regexp.QuoteMeta("{table}"), `(?P<table>[^/]+)`, 1)
+	re, err := regexp.Compile(`(?:^|/)` + pattern + `$`)
+	if err != nil {
+		return fileLayout{}, fmt.Errorf("invalid layout %q: %w", template, err)
+	}
+	return fileLayout{template: template, re: re}, nil
+}
+
+func (l fileLayout) orDefault() fileLayout {
+	if l.re == nil {
+		return defaultFileLayout
+	}
+	return l
+}
+
+// tablePath expands the layout for a table, without the kind suffix.
+func (l fileLayout) tablePath(db, table string) string {
+	return strings.NewReplacer("{db}", db, "{table}", table).Replace(l.orDefault().template)
+}
+
+// databaseFile returns the database schema file relative to the backup.
+func (l fileLayout) databaseFile(db string) string {
+	return db + ".database.sql"
+}
+
+// schemaFile returns the table schema file relative to the backup.
+func (l fileLayout) schemaFile(db, table string) string {
+	return l.tablePath(db, table) + ".schema.sql"
+}
+
+// commentsFile returns the table comments file written with --dump-comments relative to the backup.
+func (l fileLayout) commentsFile(db, table string) string {
+	return l.tablePath(db, table) + commentsFileSuffix
+}
+
+// dataFile returns the data file of a table relative to the backup.
+func (l fileLayout) dataFile(db, table, format string) string {
+	return l.tablePath(db, table) + dataFileSuffix(format)
+}
+
+// chunkFile returns the data file of one --chunk-rows chunk of a table relative to the backup.
+func (l fileLayout) chunkFile(db, table, format string, chunk int) string {
+	return fmt.Sprintf("%s.chunk%05d%s", l.tablePath(db, table), chunk, dataFileSuffix(format))
+}
+
+// schemaTable extracts database and table from a listed schema file like ".../db/table.schema.sql.gz".
+func (l fileLayout) schemaTable(file string) (string, string) {
+	return l.parse(strings.TrimSuffix(trimCompressionExt(file), ".schema.sql"))
+}
+
+// commentsTable extracts database and table from a listed comments file like ".../db/table.comments.sql.gz".
+func (l fileLayout) commentsTable(file string) (string, string) {
+	return l.parse(strings.TrimSuffix(trimCompressionExt(file), commentsFileSuffix))
+}
+
+// dataTable extracts database and table from a listed data file like ".../db/table.chunk00001.data.native.gz".
+func (l fileLayout) dataTable(file, format string) (string, string) {
+	name := strings.TrimSuffix(trimCompressionExt(file), dataFileSuffix(format))
+	return l.parse(chunkSuffixRe.ReplaceAllString(name, ""))
+}
+
+// parse matches the end of name against the layout, names which don't match, e.g. files of a
+// backup dumped with another layout, fall back to the default <db>/<table>.
+func (l fileLayout) parse(name string) (string, string) {
+	re := l.orDefault().re
+	if m := re.FindStringSubmatch(name); m != nil {
+		return m[re.SubexpIndex("db")], m[re.SubexpIndex("table")]
+	}
+	return path.Base(path.Dir(name)), path.Base(name)
+}
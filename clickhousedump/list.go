@@ -0,0 +1,60 @@
+package clickhousedump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// matchedTable is a table printed by ListTables with --json.
+type matchedTable struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Engine   string `json:"engine"`
+	Bytes    int64  `json:"total_bytes"`
+	Rows     int64  `json:"total_rows"`
+}
+
+// ListTables writes the databases and tables a dump with the --databases, --tables and --exclude-*
+// filters of config would include, one db.table per line, databases without matched tables as
+// db, or a JSON object with asJSON. It queries ClickHouse only, the storage isn't touched.
+func ListTables(ctx context.Context, config *Config, client *ClickHouseClient, w io.Writer, asJSON bool) error {
+	d := &Dumper{config: config, client: client}
+	databases, err := d.GetDatabases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list databases: %w", err)
+	}
+	dbTables, err := d.getTables(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list tables: %w", err)
+	}
+	sort.Strings(databases)
+	tables := make([]matchedTable, 0)
+	for _, db := range databases {
+		infos := dbTables[db]
+		sort.Slice(infos, func(i, j int) bool { return infos[i].name < infos[j].name })
+		for _, info := range infos {
+			tables = append(tables, matchedTable{Database: db, Table: info.name, Engine: info.engine, Bytes: info.bytes, Rows: info.rows})
+		}
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Databases []string       `json:"databases"`
+			Tables    []matchedTable `json:"tables"`
+		}{Databases: append(make([]string, 0, len(databases)), databases...), Tables: tables})
+	}
+	for _, db := range databases {
+		if len(dbTables[db]) == 0 {
+			_, _ = fmt.Fprintln(w, db)
+		}
+		for _, info := range dbTables[db] {
+			_, _ = fmt.Fprintf(w, "%s.%s\n", db, info.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListTables(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		query := string(body)
+		switch {
+		case strings.Contains(query, "system.databases"):
+			require.Contains(t, query, "match(name, '^shop')")
+			_, _ = io.WriteString(w, "shop_empty\nshop\n")
+		case strings.Contains(query, "system.tables"):
+			require.Contains(t, query, "NOT match(name, 'tmp')")
+			_, _ = io.WriteString(w, "shop\tusers\tMergeTree\t2048\t20\nshop\torders\tReplacingMergeTree\t1024\t10\n")
+		default:
+			t.Errorf("unexpected query %s", query)
+		}
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	config := &Config{Host: host, Port: port, Databases: "^shop", ExcludeTables: "tmp"}
+	client := NewClickHouseClient(config)
+
+	var out bytes.Buffer
+	require.NoError(t, ListTables(context.Background(), config, client, &out, false))
+	require.Equal(t, "shop.orders\nshop.users\nshop_empty\n", out.String())
+
+	out.Reset()
+	require.NoError(t, ListTables(context.Background(), config, client, &out, true))
+	require.JSONEq(t, `{
+		"databases": ["shop", "shop_empty"],
+		"tables": [
+			{"database": "shop", "table": "orders", "engine": "ReplacingMergeTree", "total_bytes": 1024, "total_rows": 10},
+			{"database": "shop", "table": "users", "engine": "MergeTree", "total_bytes": 2048, "total_rows": 20}
+		]
+	}`, out.String())
+}
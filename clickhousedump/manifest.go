@@ -0,0 +1,143 @@
+package clickhousedump
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+const manifestFileName = "manifest.json"
+
+// Manifest describes the content of a backup, it is written last by the dumper
+// so that restore can verify the storage listing is complete.
+type Manifest struct {
+	BackupName string         `json:"backup_name"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Files      []ManifestFile `json:"files"`
+	// FailedTables lists tables which failed with --continue-on-error, their files may be missing or partial
+	FailedTables []ManifestFailedTable `json:"failed_tables,omitempty"`
+	// FrozenTables lists the tables snapshotted with --freeze and the parts they had
+	FrozenTables []ManifestFrozenTable `json:"frozen_tables,omitempty"`
+	// Layout is the --layout of table files, empty for DefaultLayout
+	Layout string `json:"layout,omitempty"`
+}
+
+// ManifestFile is a single backup file, Name is relative to the backup prefix
+// and doesn't include the compression extension added by the storage.
+type ManifestFile struct {
+	Name string `json:"name"`
+	// Format is the --data-format of data files, empty for schema files
+	Format string `json:"format,omitempty"`
+	// Compression is the format the file was stored with: gzip, zstd or none. Restore reads the
+	// file by it instead of its name, backups of older versions record only "none" for data files
+	// which --adaptive-compression stored uncompressed
+	Compression string `json:"compression,omitempty"`
+}
+
+// ManifestFailedTable is a table which couldn't be dumped.
+type ManifestFailedTable struct {
+	Table string `json:"table"`
+	Error string `json:"error"`
+}
+
+// ManifestFrozenTable is a table frozen with ALTER TABLE FREEZE before its data was dumped.
+type ManifestFrozenTable struct {
+	Table    string               `json:"table"`
+	FrozenAt time.Time            `json:"frozen_at"`
+	Parts    []ManifestFrozenPart `json:"parts"`
+}
+
+// ManifestFrozenPart is a data part of a frozen table, Path is its copy in the server shadow directory.
+type ManifestFrozenPart struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+func manifestPath(config *Config) string {
+	return path.Join(config.StorageConfig["path"], config.BackupName, manifestFileName)
+}
+
+func writeManifest(s storage.RemoteStorage, config *Config, manifest *Manifest) error {
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Name < manifest.Files[j].Name
+	})
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	// Manifest is always stored uncompressed to be readable by humans and other tools
+	if err := s.Upload(manifestPath(config), strings.NewReader(string(data)), "none", 0, ""); err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	return nil
+}
+
+func readManifest(s storage.RemoteStorage, filename string) (*Manifest, error) {
+	reader, err := s.Download(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download manifest %s: %w", filename, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", filename, err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", filename, err)
+	}
+	return manifest, nil
+}
+
+// hasPathSuffix reports whether p ends with suffix at a path element boundary,
+// listings return keys relative to different roots depending on the storage.
+func hasPathSuffix(p, suffix string) bool {
+	p = strings.TrimPrefix(p, "/")
+	suffix = strings.TrimPrefix(suffix, "/")
+	return p == suffix || strings.HasSuffix(p, "/"+suffix)
+}
+
+// trimCompressionExt removes the extension added by client-side compression.
+func trimCompressionExt(name string) string {
+	for _, ext := range []string{".gz", ".zstd"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// findManifest returns the listed manifest file of the backup, if any.
+func findManifest(files []string, backupName string) (string, bool) {
+	for _, file := range files {
+		if hasPathSuffix(file, path.Join(backupName, manifestFileName)) {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// missingManifestFiles returns manifest entries which are absent from the listing.
+func missingManifestFiles(manifest *Manifest, files []string, backupName string) []string {
+	var missing []string
+	for _, mf := range manifest.Files {
+		want := path.Join(backupName, mf.Name)
+		found := false
+		for _, file := range files {
+			if hasPathSuffix(trimCompressionExt(file), want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, mf.Name)
+		}
+	}
+	return missing
+}
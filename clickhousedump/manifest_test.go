@@ -0,0 +1,71 @@
+package clickhousedump
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingManifestFiles(t *testing.T) {
+	manifest := &Manifest{
+		BackupName: "backup",
+		Files: []ManifestFile{
+			{Name: "db.database.sql"},
+			{Name: "db/t1.schema.sql"},
+			{Name: "db/t1.data.sql"},
+			{Name: "db/t2.schema.sql"},
+		},
+	}
+	files := []string{
+		"root/backup/db.database.sql.gz",
+		"root/backup/db/t1.schema.sql.gz",
+		"root/other_backup/db/t1.data.sql.gz",
+		"root/backup/db/t2.schema.sql",
+		"root/backup/manifest.json",
+	}
+	require.Equal(t, []string{"db/t1.data.sql"}, missingManifestFiles(manifest, files, "backup"))
+
+	name, found := findManifest(files, "backup")
+	require.True(t, found)
+	require.Equal(t, "root/backup/manifest.json", name)
+}
+
+func TestDataFileFormatAndTable(t *testing.T) {
+	require.Equal(t, DataFormatSQLInsert, dataFileFormat("backup/db/t.data.sql.gz"))
+	require.Equal(t, DataFormatNative, dataFileFormat("backup/db/t.chunk00002.data.native.zstd"))
+	require.Equal(t, DataFormatParquet, dataFileFormat("/root/backup/db/t.data.parquet"))
+	require.Equal(t, "", dataFileFormat("backup/db/t.schema.sql.gz"))
+
+	db, table := fileLayout{}.dataTable("backup/db/my.table.chunk00002.data.native.zstd", DataFormatNative)
+	require.Equal(t, "db", db)
+	require.Equal(t, "my.table", table)
+}
+
+func TestFileLayout(t *testing.T) {
+	var layout fileLayout
+	require.Equal(t, "db.database.sql", layout.databaseFile("db"))
+	require.Equal(t, "db/t.schema.sql", layout.schemaFile("db", "t"))
+	require.Equal(t, "db/t.data.native", layout.dataFile("db", "t", DataFormatNative))
+	require.Equal(t, "db/t.chunk00000.data.sql", layout.chunkFile("db", "t", DataFormatSQLInsert, 0))
+
+	layout, err := newFileLayout("tables/{db}/t_{table}")
+	require.NoError(t, err)
+	require.Equal(t, "tables/logs.2024/t_my.events.schema.sql", layout.schemaFile("logs.2024", "my.events"))
+	db, table := layout.schemaTable("root/backup/tables/logs.2024/t_my.events.schema.sql.gz")
+	require.Equal(t, "logs.2024", db)
+	require.Equal(t, "my.events", table)
+	db, table = layout.dataTable("root/backup/"+layout.chunkFile("logs.2024", "my.events", DataFormatParquet, 3)+".zstd", DataFormatParquet)
+	require.Equal(t, "logs.2024", db)
+	require.Equal(t, "my.events", table)
+
+	// Files of a backup dumped with the default layout still parse
+	db, table = layout.schemaTable("root/backup/db/t.schema.sql")
+	require.Equal(t, "db", db)
+	require.Equal(t, "t", table)
+
+	for _, invalid := range []string{"{table}", "{db}.{table}", "{table}/{db}", "{db}/{table}/{table}", "/{db}/{table}", "{db}//{table}", "../{db}/{table}", "{db}/{kind}/{table}"} {
+		require.Error(t, ValidateLayout(invalid), invalid)
+	}
+	require.NoError(t, ValidateLayout(""))
+	require.NoError(t, ValidateLayout("{db}-data/{table}.tbl"))
+}
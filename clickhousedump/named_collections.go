@@ -0,0 +1,71 @@
+package clickhousedump
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// namedCollectionsDir is the backup directory of named collection files, <backup>/named_collections/<name>.sql.
+const namedCollectionsDir = "named_collections"
+
+var createNamedCollectionRe = regexp.MustCompile(`(?is)^\s*CREATE\s+NAMED\s+COLLECTION\s+(IF\s+NOT\s+EXISTS\s+)?`)
+
+// createNamedCollectionIfNotExists adds IF NOT EXISTS to a SHOW CREATE NAMED COLLECTION statement,
+// so restoring into a server which already has the collection doesn't fail.
+func createNamedCollectionIfNotExists(stmt string) string {
+	if !createNamedCollectionRe.MatchString(stmt) {
+		return stmt
+	}
+	return createNamedCollectionRe.ReplaceAllLiteralString(stmt, "CREATE NAMED COLLECTION IF NOT EXISTS ")
+}
+
+// isNamedCollectionFile reports whether a listed backup file holds a named collection.
+func isNamedCollectionFile(file string) bool {
+	return isGlobalObjectFile(file, namedCollectionsDir)
+}
+
+// dumpNamedCollections dumps every named collection with its secrets, they are global and not
+// filtered by --databases. Servers without system.named_collections are skipped with a warning.
+func (d *Dumper) dumpNamedCollections(ctx context.Context) error {
+	resp, err := d.client.ExecuteQuery(ctx, "SELECT count() FROM system.tables WHERE database = 'system' AND name = 'named_collections' FORMAT TSVRaw")
+	if err != nil {
+		return fmt.Errorf("failed to check system.named_collections: %w", err)
+	}
+	if strings.TrimSpace(string(resp)) == "0" {
+		logging.Warnf("server has no system.named_collections, skipping --include-named-collections")
+		return nil
+	}
+	resp, err = d.client.ExecuteQuery(ctx, "SELECT name FROM system.named_collections ORDER BY name FORMAT TSVRaw")
+	if err != nil {
+		return fmt.Errorf("failed to list named collections: %w", err)
+	}
+	var collections []string
+	for _, line := range strings.Split(strings.TrimSpace(string(resp)), "\n") {
+		if line != "" {
+			collections = append(collections, line)
+		}
+	}
+	logging.Infof("Found %d named collections for dump", len(collections))
+
+	for _, name := range collections {
+		query := fmt.Sprintf("SHOW CREATE NAMED COLLECTION `%s` SETTINGS format_display_secrets_in_show_and_select=1 FORMAT TSVRaw", name)
+		stmt, err := d.client.ExecuteQuery(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to dump named collection %s: %w", name, err)
+		}
+		if strings.Contains(string(stmt), "[HIDDEN]") {
+			logging.Warnf("named collection %s is dumped with hidden values, enable display_secrets_in_show_and_select on the server and grant displaySecretsInShowAndSelect to dump them", name)
+		}
+		filename := path.Join(d.config.StorageConfig["path"], d.config.BackupName, namedCollectionsDir, name+".sql")
+		if err := d.uploadSchema(filename, strings.NewReader(createNamedCollectionIfNotExists(string(stmt))), ""); err != nil {
+			return fmt.Errorf("failed to upload named collection %s: %w", name, err)
+		}
+		logging.Infof("Successfully dumped named collection %s", name)
+	}
+	return nil
+}
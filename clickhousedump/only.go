@@ -0,0 +1,137 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// onlyTables returns the db.table names of --only and their databases.
+func (r *Restorer) onlyTables() (map[string]bool, map[string]bool) {
+	tables := make(map[string]bool, len(r.config.Only))
+	databases := make(map[string]bool)
+	for _, only := range r.config.Only {
+		db, _, _ := strings.Cut(only, ".")
+		tables[only] = true
+		databases[db] = true
+	}
+	return tables, databases
+}
+
+// filterRestoreFiles keeps the listed files --only and --schema-only restore: the schema,
+// comments and data files of the --only tables and the database files of their databases,
+// without data files with --schema-only. Other files like the manifest and the zstd dictionary
+// are kept, functions and named collections are skipped with --only. It fails when an --only
+// table has no schema file in the backup.
+func (r *Restorer) filterRestoreFiles(files []string) ([]string, error) {
+	tables, databases := r.onlyTables()
+	found := make(map[string]bool, len(tables))
+	kept := files[:0]
+	skipped := 0
+	for _, file := range files {
+		keep := true
+		switch {
+		case isFunctionFile(file) || isNamedCollectionFile(file):
+			keep = len(tables) == 0
+		case isDatabaseFile(file):
+			keep = len(tables) == 0 || databases[strings.TrimSuffix(path.Base(trimCompressionExt(file)), ".database.sql")]
+		case isSchemaFile(file):
+			object := schemaObject(r.layout, file)
+			found[object] = true
+			keep = len(tables) == 0 || tables[object]
+		case isCommentsFile(file):
+			db, table := r.layout.commentsTable(file)
+			keep = len(tables) == 0 || tables[db+"."+table]
+		default:
+			if format := dataFileFormat(file); format != "" {
+				db, table := r.layout.dataTable(file, format)
+				keep = !r.config.SchemaOnly && (len(tables) == 0 || tables[db+"."+table])
+			}
+		}
+		if !keep {
+			skipped++
+			continue
+		}
+		kept = append(kept, file)
+	}
+	var missing []string
+	for table := range tables {
+		if !found[table] {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, &ConfigError{Err: fmt.Errorf("--only tables not found in backup %s: %s", r.config.BackupName, strings.Join(missing, ", "))}
+	}
+	if skipped > 0 {
+		logging.Infof("Restoring %d files, skipping %d files left out by --only and --schema-only", len(kept), skipped)
+	}
+	return kept, nil
+}
+
+// fetchOnlyByName reports whether the files of --only --schema-only are looked up by name instead
+// of listing the backup. Archives and stdin streams can only be read whole.
+func (r *Restorer) fetchOnlyByName() bool {
+	return r.config.SchemaOnly && len(r.config.Only) > 0 && !r.config.Archive && r.config.StorageType != "stdin"
+}
+
+// findFile returns name as stored with or without a compression extension, "" when the storage
+// has no such file.
+func (r *Restorer) findFile(name string) string {
+	for _, candidate := range []string{name + ".gz", name + ".zstd", name} {
+		_, err := r.storage.Size(candidate)
+		if err == nil {
+			return candidate
+		}
+		r.debugf("%s not found: %v", candidate, err)
+	}
+	return ""
+}
+
+// onlySchemaFiles returns the files --only --schema-only restores by their names, so the
+// schema of a table is restored without listing a backup of thousands of files: the manifest
+// for the layout, the zstd dictionary, the database files and the schema and comments files of
+// the tables. It sets the layout.
+func (r *Restorer) onlySchemaFiles(backupPrefix string) ([]string, *Manifest, error) {
+	var manifest *Manifest
+	if manifestFile := r.findFile(path.Join(backupPrefix, manifestFileName)); manifestFile != "" {
+		var err error
+		if manifest, err = readManifest(r.storage, manifestFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := r.setLayout(manifest); err != nil {
+		return nil, nil, err
+	}
+
+	var files []string
+	if dict := r.findFile(path.Join(backupPrefix, schemaDictFile)); dict != "" {
+		files = append(files, dict)
+	}
+	seen := make(map[string]bool)
+	for _, only := range r.config.Only {
+		db, table, _ := strings.Cut(only, ".")
+		if !seen[db] {
+			seen[db] = true
+			if dbFile := r.findFile(path.Join(backupPrefix, r.layout.databaseFile(db))); dbFile != "" {
+				files = append(files, dbFile)
+			} else {
+				logging.Warnf("database file of %s not found in backup %s, the database must exist", db, r.config.BackupName)
+			}
+		}
+		schemaFile := r.findFile(path.Join(backupPrefix, r.layout.schemaFile(db, table)))
+		if schemaFile == "" {
+			return nil, nil, &ConfigError{Err: fmt.Errorf("schema of %s not found in backup %s", only, r.config.BackupName)}
+		}
+		files = append(files, schemaFile)
+		if commentsFile := r.findFile(path.Join(backupPrefix, r.layout.commentsFile(db, table))); commentsFile != "" {
+			files = append(files, commentsFile)
+		}
+	}
+	logging.Infof("Found %d files of the --only tables by name, without listing backup %s", len(files), r.config.BackupName)
+	return files, manifest, nil
+}
@@ -0,0 +1,82 @@
+package clickhousedump
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterRestoreFiles(t *testing.T) {
+	files := []string{
+		"backup/manifest.json",
+		"backup/functions/f.sql",
+		"backup/db.database.sql",
+		"backup/other.database.sql",
+		"backup/db/t.schema.sql.gz",
+		"backup/db/t.comments.sql",
+		"backup/db/t.data.sql.gz",
+		"backup/db/u.schema.sql",
+		"backup/db/u.data.sql",
+		"backup/other/v.schema.sql",
+	}
+	layout, err := newFileLayout(DefaultLayout)
+	require.NoError(t, err)
+
+	r := &Restorer{config: &Config{BackupName: "backup", Only: []string{"db.t"}}, layout: layout}
+	kept, err := r.filterRestoreFiles(append([]string{}, files...))
+	require.NoError(t, err)
+	require.Equal(t, []string{"backup/manifest.json", "backup/db.database.sql", "backup/db/t.schema.sql.gz", "backup/db/t.comments.sql", "backup/db/t.data.sql.gz"}, kept)
+
+	r.config = &Config{BackupName: "backup", SchemaOnly: true}
+	kept, err = r.filterRestoreFiles(append([]string{}, files...))
+	require.NoError(t, err)
+	require.NotContains(t, kept, "backup/db/t.data.sql.gz")
+	require.NotContains(t, kept, "backup/db/u.data.sql")
+	require.Contains(t, kept, "backup/functions/f.sql")
+	require.Len(t, kept, 8)
+
+	r.config = &Config{BackupName: "backup", Only: []string{"db.t", "db.missing", "nope.x"}}
+	_, err = r.filterRestoreFiles(append([]string{}, files...))
+	var configErr *ConfigError
+	require.ErrorAs(t, err, &configErr)
+	require.ErrorContains(t, err, "db.missing, nope.x")
+}
+
+// unlistableStorage fails every List, like a backup too large to list.
+type unlistableStorage struct {
+	storage.RemoteStorage
+}
+
+func (unlistableStorage) List(string, bool) ([]string, error) {
+	return nil, errors.New("listing not expected")
+}
+
+func TestOnlySchemaFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "backup", "db"), 0o755))
+	for _, name := range []string{"db.database.sql", "db/t.schema.sql.gz", "db/t.comments.sql", "db/t.data.sql.gz", "db/u.schema.sql"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "backup", name), []byte("-- "+name), 0o644))
+	}
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+
+	config := &Config{BackupName: "backup", Only: []string{"db.t", "db.u"}, SchemaOnly: true}
+	r := &Restorer{config: config, storage: unlistableStorage{fileStorage}}
+	require.True(t, r.fetchOnlyByName())
+	files, manifest, err := r.onlySchemaFiles("backup")
+	require.NoError(t, err)
+	require.Nil(t, manifest)
+	require.Equal(t, []string{"backup/db.database.sql", "backup/db/t.schema.sql.gz", "backup/db/t.comments.sql", "backup/db/u.schema.sql"}, files)
+
+	config.Only = []string{"db.missing"}
+	_, _, err = r.onlySchemaFiles("backup")
+	var configErr *ConfigError
+	require.ErrorAs(t, err, &configErr)
+
+	config.Archive = true
+	require.False(t, r.fetchOnlyByName(), "archives are read whole")
+}
@@ -0,0 +1,73 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Table orders supported by --table-order.
+const (
+	TableOrderName = "name"
+	TableOrderSize = "size"
+	TableOrderRows = "rows"
+)
+
+// NormalizeTableOrder returns the canonical name of a --table-order value.
+func NormalizeTableOrder(order string) (string, error) {
+	switch strings.ToLower(order) {
+	case "", TableOrderName:
+		return TableOrderName, nil
+	case TableOrderSize:
+		return TableOrderSize, nil
+	case TableOrderRows:
+		return TableOrderRows, nil
+	}
+	return "", fmt.Errorf("unsupported table order %s, expected one of name, size, rows", order)
+}
+
+// sortTableJobs orders jobs alphabetically by database and table, or largest first by
+// total bytes or rows, ties are broken by name.
+func sortTableJobs(jobs []tableDumpJob, order string) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		a, b := jobs[i], jobs[j]
+		switch order {
+		case TableOrderSize:
+			if a.bytes != b.bytes {
+				return a.bytes > b.bytes
+			}
+		case TableOrderRows:
+			if a.rows != b.rows {
+				return a.rows > b.rows
+			}
+		}
+		if a.db != b.db {
+			return a.db < b.db
+		}
+		return a.table < b.table
+	})
+}
+
+// sortDataFiles orders data files by name, or with --table-order=size and rows by the total size of
+// their table's files in storage, largest first. Backups don't record row counts, so rows uses sizes.
+func (r *Restorer) sortDataFiles(files []string, formats map[string]string) error {
+	sort.Strings(files)
+	if r.config.TableOrder != TableOrderSize && r.config.TableOrder != TableOrderRows {
+		return nil
+	}
+	tableBytes := make(map[string]int64)
+	for _, file := range files {
+		size, err := r.storage.Size(file)
+		if err != nil {
+			return fmt.Errorf("failed to get size of %s for --table-order: %w", file, err)
+		}
+		db, table := r.layout.dataTable(file, formats[file])
+		tableBytes[db+"."+table] += size
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		dbI, tableI := r.layout.dataTable(files[i], formats[files[i]])
+		dbJ, tableJ := r.layout.dataTable(files[j], formats[files[j]])
+		return tableBytes[dbI+"."+tableI] > tableBytes[dbJ+"."+tableJ]
+	})
+	return nil
+}
@@ -0,0 +1,80 @@
+package clickhousedump
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTableOrder(t *testing.T) {
+	for value, expected := range map[string]string{"": TableOrderName, "name": TableOrderName, "Size": TableOrderSize, "ROWS": TableOrderRows} {
+		order, err := NormalizeTableOrder(value)
+		require.NoError(t, err)
+		require.Equal(t, expected, order)
+	}
+	_, err := NormalizeTableOrder("random")
+	require.Error(t, err)
+}
+
+func TestSortTableJobs(t *testing.T) {
+	jobs := func() []tableDumpJob {
+		return []tableDumpJob{
+			{db: "b", table: "small", bytes: 10, rows: 1000},
+			{db: "a", table: "z", bytes: 500, rows: 5},
+			{db: "a", table: "y", bytes: 500, rows: 50},
+			{db: "c", table: "empty"},
+		}
+	}
+	names := func(jobs []tableDumpJob) []string {
+		var result []string
+		for _, j := range jobs {
+			result = append(result, j.db+"."+j.table)
+		}
+		return result
+	}
+	byName := jobs()
+	sortTableJobs(byName, TableOrderName)
+	require.Equal(t, []string{"a.y", "a.z", "b.small", "c.empty"}, names(byName))
+	bySize := jobs()
+	sortTableJobs(bySize, TableOrderSize)
+	require.Equal(t, []string{"a.y", "a.z", "b.small", "c.empty"}, names(bySize))
+	byRows := jobs()
+	sortTableJobs(byRows, TableOrderRows)
+	require.Equal(t, []string{"b.small", "a.y", "a.z", "c.empty"}, names(byRows))
+}
+
+func TestSortDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{
+		"backup/db/a.chunk00001.data.sql": 10,
+		"backup/db/a.chunk00002.data.sql": 10,
+		"backup/db/b.data.sql":            15,
+		"backup/db/c.data.sql":            5,
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o644))
+	}
+	s, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	files := []string{"backup/db/c.data.sql", "backup/db/b.data.sql", "backup/db/a.chunk00002.data.sql", "backup/db/a.chunk00001.data.sql"}
+	formats := map[string]string{}
+	for _, f := range files {
+		formats[f] = DataFormatSQLInsert
+	}
+
+	r := &Restorer{config: &Config{TableOrder: TableOrderName}, storage: s}
+	require.NoError(t, r.sortDataFiles(files, formats))
+	require.Equal(t, []string{"backup/db/a.chunk00001.data.sql", "backup/db/a.chunk00002.data.sql", "backup/db/b.data.sql", "backup/db/c.data.sql"}, files)
+
+	r.config.TableOrder = TableOrderSize
+	files[0], files[3] = files[3], files[0]
+	require.NoError(t, r.sortDataFiles(files, formats))
+	require.Equal(t, []string{"backup/db/a.chunk00001.data.sql", "backup/db/a.chunk00002.data.sql", "backup/db/b.data.sql", "backup/db/c.data.sql"}, files)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "backup/db/c.data.sql"), make([]byte, 100), 0o644))
+	require.NoError(t, r.sortDataFiles(files, formats))
+	require.Equal(t, []string{"backup/db/c.data.sql", "backup/db/a.chunk00001.data.sql", "backup/db/a.chunk00002.data.sql", "backup/db/b.data.sql"}, files)
+}
@@ -0,0 +1,256 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+// newRemoteStorage initializes the storage backend selected by config.StorageType,
+// wrapped into a mirror storage when config.Mirrors are set and into a cache storage
+// when config.LocalCache is set.
+func newRemoteStorage(config *Config) (storage.RemoteStorage, error) {
+	s, err := newMirroredStorage(config)
+	if err != nil || config.LocalCache == "" {
+		return s, err
+	}
+	cache, err := storage.NewCacheStorage(s, config.StorageConfig["path"], config.LocalCache, config.PreferLocalCache, config.Debug)
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+// NewStorage creates the storage selected by config.StorageType with its mirrors and local cache,
+// for NewDumperWith and NewRestorerWith. The caller closes it.
+func NewStorage(config *Config) (storage.RemoteStorage, error) {
+	return newRemoteStorage(config)
+}
+
+// newBackupStorage is newRemoteStorage wrapped into an archive storage with --archive, dumps
+// write config.BackupName into one tar object.
+func newBackupStorage(config *Config) (storage.RemoteStorage, error) {
+	s, err := newRemoteStorage(config)
+	if err != nil || !config.Archive {
+		return s, err
+	}
+	return storage.NewArchiveStorage(s, path.Join(config.StorageConfig["path"], config.BackupName), config.TmpDir, config.Debug)
+}
+
+func newMirroredStorage(config *Config) (storage.RemoteStorage, error) {
+	primary, err := newStorage(config, config.StorageType, config.StorageConfig)
+	if err != nil || len(config.Mirrors) == 0 {
+		return primary, err
+	}
+	targets := []storage.MirrorTarget{{Name: config.StorageType, Path: config.StorageConfig["path"], Storage: primary}}
+	for i, mirror := range config.Mirrors {
+		s, err := newStorage(config, mirror.StorageType, mirror.StorageConfig)
+		if err != nil {
+			for _, t := range targets {
+				_ = t.Storage.Close()
+			}
+			return nil, fmt.Errorf("failed to initialize mirror %d (%s): %w", i+1, mirror.StorageType, err)
+		}
+		targets = append(targets, storage.MirrorTarget{
+			Name:    fmt.Sprintf("mirror %d (%s)", i+1, mirror.StorageType),
+			Path:    mirror.StorageConfig["path"],
+			Storage: s,
+		})
+	}
+	return storage.NewMirrorStorage(config.StorageConfig["path"], targets, config.Debug)
+}
+
+// OCINamespace returns the tenancy namespace of oci storage, --oci-namespace or, for configs
+// written before it existed, --storage-account.
+func OCINamespace(storageConfig map[string]string) string {
+	if namespace := storageConfig["oci_namespace"]; namespace != "" {
+		return namespace
+	}
+	return storageConfig["account"]
+}
+
+// ociS3Config returns the endpoint and S3 options of the OCI Object Storage S3 compatibility API.
+// The endpoint is derived from the tenancy namespace and region unless set, path-style addressing
+// is always used, the compatibility API doesn't serve virtual-hosted buckets.
+func ociS3Config(config *Config, storageConfig map[string]string) (string, storage.S3Options, error) {
+	endpoint := storageConfig["endpoint"]
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.compat.objectstorage.%s.oraclecloud.com", OCINamespace(storageConfig), storageConfig["region"])
+	}
+	usePathStyle := true
+	s3Options := storage.S3Options{
+		TmpDir:          config.TmpDir,
+		CompressionMode: config.CompressionMode,
+		PathStyle:       &usePathStyle,
+		ContentType:     storageConfig["content_type"],
+		UserAgent:       config.userAgent(),
+		VerifyUpload:    config.VerifyUpload,
+		CreateBucket:    config.CreateBucket,
+	}
+	if err := parseS3Tuning(storageConfig, &s3Options); err != nil {
+		return "", storage.S3Options{}, err
+	}
+	return endpoint, s3Options, nil
+}
+
+func newStorage(config *Config, storageType string, storageConfig map[string]string) (storage.RemoteStorage, error) {
+	switch storageType {
+	case "file":
+		return storage.NewFileStorage(storageConfig["path"], config.Debug)
+	case "s3":
+		s3Options := storage.S3Options{
+			TmpDir:            config.TmpDir,
+			CompressionMode:   config.CompressionMode,
+			RequestPayer:      storageConfig["s3_request_payer"],
+			ContentType:       storageConfig["content_type"],
+			UserAgent:         config.userAgent(),
+			VerifyUpload:      config.VerifyUpload,
+			StorageClass:      storageConfig["s3_storage_class"],
+			CredentialProcess: storageConfig["s3_credential_process"],
+			CreateBucket:      config.CreateBucket,
+		}
+		if pathStyle := storageConfig["s3_path_style"]; pathStyle != "" {
+			usePathStyle, err := strconv.ParseBool(pathStyle)
+			if err != nil {
+				return nil, fmt.Errorf("invalid s3 path style value %q: %w", pathStyle, err)
+			}
+			s3Options.PathStyle = &usePathStyle
+		}
+		if err := parseS3Tuning(storageConfig, &s3Options); err != nil {
+			return nil, err
+		}
+		return storage.NewS3Storage(
+			storageConfig["bucket"],
+			storageConfig["region"],
+			storageConfig["account"],
+			storageConfig["key"],
+			storageConfig["endpoint"],
+			s3Options,
+			config.Debug,
+		)
+	case "oci":
+		endpoint, s3Options, err := ociS3Config(config, storageConfig)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewS3Storage(
+			storageConfig["bucket"],
+			storageConfig["region"],
+			storageConfig["oci_access_key"],
+			storageConfig["key"],
+			endpoint,
+			s3Options,
+			config.Debug,
+		)
+	case "gcs":
+		auth, err := storage.ResolveGCSAuth(storageConfig["gcs_auth"], storageConfig["key"])
+		if err != nil {
+			return nil, err
+		}
+		if auth != storage.GCSAuthHMAC {
+			return storage.NewGCSStorage(storageConfig["bucket"], storageConfig["endpoint"], auth, storageConfig["key"], config.CompressionMode, storageConfig["content_type"], config.CreateBucket, config.Debug)
+		}
+		// HMAC keys only work with the S3-compatible XML API, which rejects the SDK default checksums
+		endpoint := storageConfig["endpoint"]
+		if endpoint == "" {
+			endpoint = storage.GCSXMLEndpoint
+		}
+		region := storageConfig["region"]
+		if region == "" {
+			region = "auto"
+		}
+		if config.VerifyUpload {
+			logging.Warnf("--verify-upload is not supported with --gcs-auth=hmac, uploads to bucket %s are not verified", storageConfig["bucket"])
+		}
+		usePathStyle := true
+		s3Options := storage.S3Options{
+			TmpDir:               config.TmpDir,
+			CompressionMode:      config.CompressionMode,
+			PathStyle:            &usePathStyle,
+			ContentType:          storageConfig["content_type"],
+			UserAgent:            config.userAgent(),
+			ChecksumWhenRequired: true,
+			CreateBucket:         config.CreateBucket,
+		}
+		if err := parseS3Tuning(storageConfig, &s3Options); err != nil {
+			return nil, err
+		}
+		return storage.NewS3Storage(storageConfig["bucket"], region, storageConfig["account"], storageConfig["key"], endpoint, s3Options, config.Debug)
+	case "azblob":
+		azblobOptions := storage.AzBlobOptions{TmpDir: config.TmpDir, VerifyUpload: config.VerifyUpload}
+		if v := storageConfig["azblob_download_concurrency"]; v != "" {
+			concurrency, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid azblob download concurrency %q: %w", v, err)
+			}
+			azblobOptions.DownloadConcurrency = concurrency
+		}
+		return storage.NewAzBlobStorage(storageConfig["account"], storageConfig["key"], storageConfig["container"], storageConfig["endpoint"], config.CompressionMode, storageConfig["content_type"], storageConfig["azblob_tier"], azblobOptions, config.Debug)
+	case "sftp":
+		sftpOptions, err := parseSFTPOptions(storageConfig)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewSFTPStorage(storageConfig["host"], storageConfig["user"], storageConfig["password"], sftpOptions, config.Debug)
+	case "ftp":
+		return storage.NewFTPStorage(storageConfig["host"], storageConfig["user"], storageConfig["password"], config.Debug)
+	case "stdout":
+		return storage.NewStreamStorage(os.Stdout, nil, config.TmpDir, config.Debug)
+	case "stdin":
+		return storage.NewStreamStorage(nil, os.Stdin, config.TmpDir, config.Debug)
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", storageType)
+	}
+}
+
+// parseS3Tuning fills multipart part size and concurrency from the s3_* storage config keys.
+func parseS3Tuning(storageConfig map[string]string, s3Options *storage.S3Options) error {
+	if v := storageConfig["s3_part_size"]; v != "" {
+		partSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid s3 part size %q: %w", v, err)
+		}
+		s3Options.PartSize = partSize
+	}
+	if v := storageConfig["s3_upload_concurrency"]; v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid s3 upload concurrency %q: %w", v, err)
+		}
+		s3Options.UploadConcurrency = concurrency
+	}
+	if v := storageConfig["s3_download_concurrency"]; v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid s3 download concurrency %q: %w", v, err)
+		}
+		s3Options.DownloadConcurrency = concurrency
+	}
+	return nil
+}
+
+// parseSFTPOptions reads keepalive interval and concurrency from the sftp_* storage config keys.
+func parseSFTPOptions(storageConfig map[string]string) (storage.SFTPOptions, error) {
+	var sftpOptions storage.SFTPOptions
+	if v := storageConfig["sftp_keepalive_interval"]; v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return sftpOptions, fmt.Errorf("invalid sftp keepalive interval %q: %w", v, err)
+		}
+		sftpOptions.KeepAliveInterval = interval
+	}
+	if v := storageConfig["sftp_concurrency"]; v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil {
+			return sftpOptions, fmt.Errorf("invalid sftp concurrency %q: %w", v, err)
+		}
+		sftpOptions.Concurrency = concurrency
+	}
+	return sftpOptions, nil
+}
@@ -0,0 +1,66 @@
+package clickhousedump
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSFTPOptions(t *testing.T) {
+	sftpOptions, err := parseSFTPOptions(map[string]string{"sftp_keepalive_interval": "15s", "sftp_concurrency": "8"})
+	require.NoError(t, err)
+	require.Equal(t, storage.SFTPOptions{KeepAliveInterval: 15 * time.Second, Concurrency: 8}, sftpOptions)
+
+	// Mirror specs without sftp_* keys keep the defaults
+	sftpOptions, err = parseSFTPOptions(map[string]string{"host": "backup:22"})
+	require.NoError(t, err)
+	require.Equal(t, storage.SFTPOptions{}, sftpOptions)
+
+	_, err = parseSFTPOptions(map[string]string{"sftp_keepalive_interval": "30"})
+	require.ErrorContains(t, err, "invalid sftp keepalive interval")
+}
+
+func TestNewStorageGCSHMAC(t *testing.T) {
+	config := &Config{StorageType: "gcs"}
+	s, err := newStorage(config, "gcs", map[string]string{"bucket": "backups", "account": "GOOG1EXAMPLE", "key": "secret", "gcs_auth": "hmac"})
+	require.NoError(t, err)
+	require.IsType(t, &storage.S3Storage{}, s)
+
+	_, err = newStorage(config, "gcs", map[string]string{"bucket": "backups", "key": "/etc/gcs.json", "gcs_auth": "adc"})
+	require.ErrorContains(t, err, "doesn't use a storage key")
+}
+
+func TestOCIS3Config(t *testing.T) {
+	tests := []struct {
+		name          string
+		storageConfig map[string]string
+		endpoint      string
+	}{
+		{
+			name:          "derived from namespace and region",
+			storageConfig: map[string]string{"bucket": "backups", "oci_namespace": "axaxnpcrorw5", "region": "us-ashburn-1"},
+			endpoint:      "https://axaxnpcrorw5.compat.objectstorage.us-ashburn-1.oraclecloud.com",
+		},
+		{
+			name:          "namespace from storage-account",
+			storageConfig: map[string]string{"bucket": "backups", "account": "axaxnpcrorw5", "region": "eu-frankfurt-1"},
+			endpoint:      "https://axaxnpcrorw5.compat.objectstorage.eu-frankfurt-1.oraclecloud.com",
+		},
+		{
+			name:          "explicit endpoint",
+			storageConfig: map[string]string{"bucket": "backups", "oci_namespace": "ns", "region": "us-ashburn-1", "endpoint": "http://127.0.0.1:9000"},
+			endpoint:      "http://127.0.0.1:9000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, s3Options, err := ociS3Config(&Config{}, tt.storageConfig)
+			require.NoError(t, err)
+			require.Equal(t, tt.endpoint, endpoint)
+			require.NotNil(t, s3Options.PathStyle)
+			require.True(t, *s3Options.PathStyle, "the S3 compatibility API only serves path-style requests")
+		})
+	}
+}
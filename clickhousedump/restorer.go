@@ -0,0 +1,1188 @@
+package clickhousedump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Slach/clickhouse-dump/logging"
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Restorer struct {
+	config  *Config
+	client  *ClickHouseClient
+	storage storage.RemoteStorage
+	// ownsStorage is set when the Restorer created storage and closes it after Restore
+	ownsStorage bool
+	state       *restoreState // nil unless --resume-restore
+	timer       *phaseTimer
+	layout      fileLayout // of the restored backup, set from its manifest or --layout
+	// started is when Restore was called, --wait-replicas waits for the DDL queued since
+	started time.Time
+	// serverLocal is set when ClickHouse reads the data files itself, see --server-local-restore
+	serverLocal bool
+}
+
+// NewRestorer creates a new Restorer instance, initializing the necessary storage backend.
+func NewRestorer(config *Config) (*Restorer, error) {
+	s, err := newBackupStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Restorer{
+		config:      config,
+		client:      NewClickHouseClient(config),
+		storage:     s,
+		ownsStorage: true,
+	}, nil
+}
+
+// NewRestorerWith creates a Restorer using a client and storage owned by the caller, so several
+// dumps and restores of one process share their connections. Restore leaves s open, the storage
+// settings of config other than the path aren't used. A nil client is created from config.
+// Restores reset the compression records and zstd dictionaries s decodes with, restores sharing
+// s must not run at the same time.
+func NewRestorerWith(config *Config, client *ClickHouseClient, s storage.RemoteStorage) (*Restorer, error) {
+	if s == nil {
+		return nil, &ConfigError{Err: fmt.Errorf("storage is required")}
+	}
+	if config.Archive {
+		return nil, &ConfigError{Err: fmt.Errorf("archive restores need a storage created by NewRestorer")}
+	}
+	if client == nil {
+		client = NewClickHouseClient(config)
+	}
+	return &Restorer{config: config, client: client, storage: s}, nil
+}
+
+// Close closes the storage created by NewRestorer, Restore closes it when it returns, so Close is
+// only needed when Restore isn't called. Further calls do nothing.
+func (r *Restorer) Close() error {
+	if r.storage == nil || !r.ownsStorage {
+		return nil
+	}
+	r.ownsStorage = false
+	return r.storage.Close()
+}
+
+// Restore orchestrates the restoration process from remote storage.
+// A storage created by NewRestorer is closed when Restore returns.
+// Restore runs --pre-restore-sql, restores the backup and runs --post-restore-sql after
+// a successful restore.
+func (r *Restorer) Restore(ctx context.Context) error {
+	if r.storage == nil {
+		return fmt.Errorf("restorer storage is not initialized")
+	}
+	r.started = time.Now()
+	if err := runHook(ctx, r.client, r.config, "pre-restore-sql", r.config.PreRestoreSQL); err != nil {
+		return err
+	}
+	if err := r.restore(ctx); err != nil {
+		return err
+	}
+	return runHook(ctx, r.client, r.config, "post-restore-sql", r.config.PostRestoreSQL)
+}
+
+func (r *Restorer) restore(ctx context.Context) error {
+	// Ensure storage connection is closed eventually
+	defer func() {
+		if err := r.Close(); err != nil {
+			logging.Warnf("failed to close storage connection: %v", err)
+		}
+	}()
+	r.timer = newPhaseTimer()
+	defer func() {
+		logging.Infof("Restore timing: %s", r.timer.summary())
+	}()
+
+	if r.config.Latest {
+		if err := r.resolveLatestBackup(); err != nil {
+			return err
+		}
+	}
+
+	// --- Restore Databases ---
+	// Handle path joining properly - storage path may or may not end with /
+	backupPrefix := path.Join(r.config.StorageConfig["path"], r.config.BackupName)
+	logging.Infof("Listing storage items with prefix: %s (recursive)", backupPrefix)
+
+	var files []string
+	var manifest *Manifest
+	var err error
+	if r.fetchOnlyByName() {
+		files, manifest, err = r.onlySchemaFiles(backupPrefix)
+	} else {
+		files, manifest, err = r.listBackupFiles(ctx, backupPrefix)
+		if err == nil {
+			err = r.setLayout(manifest)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(r.config.SkipFiles) > 0 {
+		kept := files[:0]
+		for _, file := range files {
+			if r.skipFile(file) {
+				logging.Infof("Skipping %s, it matches --skip-file", file)
+				continue
+			}
+			kept = append(kept, file)
+		}
+		files = kept
+	}
+	if len(r.config.Only) > 0 || r.config.SchemaOnly {
+		if files, err = r.filterRestoreFiles(files); err != nil {
+			return err
+		}
+	}
+
+	if r.config.ResumeRestore {
+		statePath := restoreStatePath(r.config)
+		if r.state, err = loadRestoreState(statePath, r.config.BackupName); err != nil {
+			return err
+		}
+		logging.Infof("Resuming restore, progress is saved in %s", statePath)
+	}
+
+	logging.Infof("Total files listed under backup prefix: %d", len(files))
+	for _, f := range files {
+		logging.Debugf("  listed: %s", f)
+	}
+
+	if err := r.checkFreeSpace(ctx, files); err != nil {
+		return err
+	}
+
+	r.resetDecoding()
+	defer r.resetDecoding()
+	if err := r.loadSchemaDict(files); err != nil {
+		return err
+	}
+	r.checkCompressFormat(files, manifest)
+	r.recordFileCompressions(files, manifest)
+
+	kinds := r.classifyFiles(files, manifest)
+	dbFiles := kinds.databases
+	if len(dbFiles) == 0 {
+		logging.Warnf("no database SQL files found under prefix %s — databases will not be created before table restore", backupPrefix)
+	}
+	logging.Infof("Found %d database files to restore. Parallelism: %d", len(dbFiles), r.config.schemaParallel())
+	stopDatabase := r.timer.phase("database")
+	if len(dbFiles) > 0 {
+		semDb := make(chan struct{}, r.config.schemaParallel())
+		var wgDb sync.WaitGroup
+		errChanDb := make(chan error, len(dbFiles))
+
+		for _, dbFile := range dbFiles {
+			wgDb.Add(1)
+			go func(dbf string) {
+				defer wgDb.Done()
+				semDb <- struct{}{}
+				defer func() { <-semDb }()
+
+				logging.Infof("Restoring database from %s...", dbf)
+				reader, downloadErr := r.storage.Download(dbf)
+				if downloadErr != nil && r.skipDownloadError(dbf, downloadErr) {
+					return
+				}
+				if downloadErr != nil {
+					errChanDb <- &itemError{item: dbf, err: fmt.Errorf("failed to download database file: %w", downloadErr)}
+					return
+				}
+				defer closeDownload(reader, dbf)
+				if restoreErr := r.restoreSchema(ctx, reader); restoreErr != nil {
+					errChanDb <- &itemError{item: dbf, err: fmt.Errorf("failed to restore database: %w", restoreErr)}
+					return
+				}
+				logging.Infof("Successfully restored database from %s.", dbf)
+			}(dbFile)
+		}
+		wgDb.Wait()
+		close(errChanDb)
+
+		var databaseErrs []error
+		for errItem := range errChanDb {
+			databaseErrs = append(databaseErrs, errItem)
+			logging.Errorf("Error during database restoration: %v", errItem)
+		}
+		if len(databaseErrs) > 0 {
+			logging.Errorf("%s", summarizeErrors(databaseErrs, len(dbFiles), "database files"))
+			return &PartialFailureError{Err: fmt.Errorf("failed during database restoration: %w", errors.Join(databaseErrs...))}
+		}
+	}
+	stopDatabase()
+
+	// --- Restore Named Collections ---
+	// Dumped with --include-named-collections, table engines refer to them for credentials
+	namedCollectionFiles := kinds.namedCollections
+	if len(namedCollectionFiles) > 0 {
+		logging.Infof("Found %d named collection files to restore", len(namedCollectionFiles))
+		stopNamedCollections := r.timer.phase("named_collections")
+		if err := r.restoreGlobalObjects(ctx, "named collection", namedCollectionFiles); err != nil {
+			return fmt.Errorf("failed during named collection restoration: %w", err)
+		}
+		stopNamedCollections()
+	}
+
+	// --- Restore Functions ---
+	// Dumped with --include-functions, tables and views may call them
+	functionFiles := kinds.functions
+	if len(functionFiles) > 0 {
+		logging.Infof("Found %d function files to restore", len(functionFiles))
+		stopFunctions := r.timer.phase("functions")
+		if err := r.restoreGlobalObjects(ctx, "function", functionFiles); err != nil {
+			return fmt.Errorf("failed during function restoration: %w", err)
+		}
+		stopFunctions()
+	}
+
+	// --- Restore Tables (Schemas) ---
+	schemaFiles := kinds.schemas
+	logging.Infof("Found %d schema files to restore. Parallelism: %d", len(schemaFiles), r.config.schemaParallel())
+	stopSchema := r.timer.phase("schema")
+	if len(schemaFiles) > 0 {
+		if err := r.restoreSchemas(ctx, schemaFiles); err != nil {
+			return err
+		}
+	}
+	stopSchema()
+
+	// --- Restore Comments ---
+	// Dumped with --dump-comments, applied to the created tables whatever their CREATE became
+	if len(kinds.comments) > 0 {
+		logging.Infof("Found %d comments files to restore", len(kinds.comments))
+		stopComments := r.timer.phase("comments")
+		if err := r.restoreComments(ctx, kinds.comments); err != nil {
+			return err
+		}
+		stopComments()
+	}
+
+	// --- Wait for Replicas ---
+	// ON CLUSTER DDL of the hooks and Replicated databases reach the other replicas asynchronously
+	if r.config.WaitReplicas > 0 {
+		stopWait := r.timer.phase("wait_replicas")
+		if err := r.waitReplicas(ctx, kinds.databases); err != nil {
+			return err
+		}
+		stopWait()
+	}
+
+	// --- Restore Data ---
+	dataFiles, dataFormats := kinds.data, kinds.dataFormats
+	if err := r.sortDataFiles(dataFiles, dataFormats); err != nil {
+		return err
+	}
+
+	r.checkServerLocalRestore(ctx, dataFiles, dataFormats)
+	logging.Infof("Found %d data files to restore. Parallelism: %d", len(dataFiles), r.config.dataParallel())
+	stopData := r.timer.phase("data")
+	if len(dataFiles) > 0 {
+		semData := make(chan struct{}, r.config.dataParallel())
+		var wgData sync.WaitGroup
+		errChanData := make(chan error, len(dataFiles))
+
+		for _, dataFile := range dataFiles {
+			wgData.Add(1)
+			// Acquired before starting the goroutine, so files start in --table-order
+			semData <- struct{}{}
+			go func(df string) {
+				defer wgData.Done()
+				defer func() { <-semData }()
+
+				if r.state != nil && r.state.file(df).Done {
+					logging.Infof("Skipping data %s, already restored by a previous run", df)
+					return
+				}
+				logging.Infof("Restoring data from %s...", df)
+				start := time.Now()
+				defer func() {
+					db, table := r.layout.dataTable(df, dataFormats[df])
+					r.timer.item(db+"."+table, time.Since(start))
+				}()
+				db, table := r.layout.dataTable(df, dataFormats[df])
+				if r.serverLocalFile(dataFormats[df]) {
+					if _, sizeErr := r.storage.Size(df); sizeErr != nil && r.skipDownloadError(df, sizeErr) {
+						return
+					}
+					if restoreErr := r.restoreServerLocal(withQueryTable(ctx, db+"."+table), df, dataFormats[df]); restoreErr != nil {
+						errChanData <- &itemError{item: df, err: fmt.Errorf("failed to restore data on the server: %w", restoreErr)}
+						return
+					}
+				} else {
+					// Всегда запрашиваем распаковку на стороне клиента для файлов данных (через decompressStream в storage)
+					reader, downloadErr := r.storage.Download(df)
+					if downloadErr != nil && r.skipDownloadError(df, downloadErr) {
+						return
+					}
+					if downloadErr != nil {
+						errChanData <- &itemError{item: df, err: fmt.Errorf("failed to download data file: %w", downloadErr)}
+						return
+					}
+					defer closeDownload(reader, df)
+					if restoreErr := r.restoreData(withQueryTable(ctx, db+"."+table), reader, df, dataFormats[df]); restoreErr != nil {
+						errChanData <- &itemError{item: df, err: fmt.Errorf("failed to restore data: %w", restoreErr)}
+						return
+					}
+				}
+				if r.state != nil {
+					if stateErr := r.state.record(df, restoreFileState{Done: true}); stateErr != nil {
+						errChanData <- &itemError{item: df, err: stateErr}
+						return
+					}
+				}
+				logging.Infof("Successfully restored data from %s.", df)
+			}(dataFile)
+		}
+		wgData.Wait()
+		close(errChanData)
+
+		var dataErrs []error
+		for errItem := range errChanData {
+			dataErrs = append(dataErrs, errItem)
+			logging.Errorf("Error during data restoration: %v", errItem)
+		}
+		if len(dataErrs) > 0 {
+			logging.Errorf("%s", summarizeErrors(dataErrs, len(dataFiles), "data files"))
+			return &PartialFailureError{Err: fmt.Errorf("failed during data restoration: %w", errors.Join(dataErrs...))}
+		}
+	}
+	stopData()
+
+	if r.state != nil {
+		if err := r.state.remove(); err != nil {
+			logging.Warnf("failed to remove restore state: %v", err)
+		}
+	}
+	logging.Infof("Restore completed successfully.")
+	return nil
+}
+
+// backupFileKinds are the files of a backup listing by kind, in listing order.
+type backupFileKinds struct {
+	databases        []string
+	namedCollections []string
+	functions        []string
+	schemas          []string
+	comments         []string
+	data             []string
+	// dataFormats maps data files to their format
+	dataFormats map[string]string
+}
+
+// classifyFiles sorts the listed files of a backup by kind in a single pass, listings of huge
+// backups have tens of thousands of files. The manifest records the format of each data file,
+// older backups are recognized by file suffix.
+func (r *Restorer) classifyFiles(files []string, manifest *Manifest) backupFileKinds {
+	manifestFormats := make(map[string]string)
+	if manifest != nil {
+		for _, mf := range manifest.Files {
+			if mf.Format != "" {
+				manifestFormats[mf.Name] = mf.Format
+			}
+		}
+	}
+	kinds := backupFileKinds{dataFormats: make(map[string]string)}
+	for _, file := range files {
+		// Global objects come first, a function or collection named like x.database is no database
+		switch {
+		case isFunctionFile(file):
+			kinds.functions = append(kinds.functions, file)
+		case isNamedCollectionFile(file):
+			kinds.namedCollections = append(kinds.namedCollections, file)
+		case isDatabaseFile(file):
+			kinds.databases = append(kinds.databases, file)
+		case isSchemaFile(file):
+			kinds.schemas = append(kinds.schemas, file)
+		case isCommentsFile(file):
+			kinds.comments = append(kinds.comments, file)
+		default:
+			format := dataFileFormat(file)
+			if format == "" {
+				continue
+			}
+			// The manifest names files relative to the backup without compression extension
+			if manifestFormat, ok := manifestFormats[trimCompressionExt(r.backupRelPath(file))]; ok {
+				format = manifestFormat
+			}
+			kinds.data = append(kinds.data, file)
+			kinds.dataFormats[file] = format
+		}
+	}
+	return kinds
+}
+
+// isDatabaseFile reports whether a listed file is a <db>.database.sql schema, compressed or not.
+func isDatabaseFile(file string) bool {
+	return strings.HasSuffix(trimCompressionExt(file), ".database.sql")
+}
+
+// isSchemaFile reports whether a listed file is a <db>/<table>.schema.sql schema, compressed or not.
+func isSchemaFile(file string) bool {
+	return strings.HasSuffix(trimCompressionExt(file), ".schema.sql")
+}
+
+// restoreSchemas downloads all table schemas, then creates them level by level so views, materialized
+// views, dictionaries and Distributed tables are created after the objects they refer to.
+// With --verify-schema the created tables are compared with their schema files.
+func (r *Restorer) restoreSchemas(ctx context.Context, schemaFiles []string) error {
+	var pending []string
+	for _, sf := range schemaFiles {
+		if r.state != nil && r.state.file(sf).Done {
+			logging.Infof("Skipping schema %s, already restored by a previous run", sf)
+			continue
+		}
+		pending = append(pending, sf)
+	}
+
+	var schemasMu sync.Mutex
+	schemas := make(map[string]string, len(pending))
+	errs := r.forEachParallel(pending, r.config.schemaParallel(), func(sf string) error {
+		reader, downloadErr := r.storage.Download(sf)
+		if downloadErr != nil && r.skipDownloadError(sf, downloadErr) {
+			return nil
+		}
+		if downloadErr != nil {
+			return fmt.Errorf("failed to download schema file: %w", downloadErr)
+		}
+		defer closeDownload(reader, sf)
+		content, readErr := io.ReadAll(reader)
+		if readErr != nil {
+			return fmt.Errorf("failed to read schema content: %w", readErr)
+		}
+		schemasMu.Lock()
+		schemas[sf] = normalizeSchema(string(content))
+		schemasMu.Unlock()
+		return nil
+	})
+	if len(errs) > 0 {
+		logging.Errorf("%s", summarizeErrors(errs, len(pending), "schema files"))
+		return &PartialFailureError{Err: fmt.Errorf("failed during schema restoration: %w", errors.Join(errs...))}
+	}
+
+	levels, err := schemaLevels(r.layout, schemas)
+	if err != nil {
+		return fmt.Errorf("failed during schema restoration: %w", err)
+	}
+	for i, level := range levels {
+		logging.Infof("Restoring schema level %d/%d with %d objects", i+1, len(levels), len(level))
+		errs := r.forEachParallel(level, r.config.schemaParallel(), func(sf string) error {
+			logging.Infof("Restoring schema from %s...", sf)
+			if restoreErr := r.executeSchema(ctx, schemas[sf]); restoreErr != nil {
+				return fmt.Errorf("failed to restore schema: %w", restoreErr)
+			}
+			if r.state != nil {
+				if stateErr := r.state.record(sf, restoreFileState{Done: true}); stateErr != nil {
+					return stateErr
+				}
+			}
+			logging.Infof("Successfully restored schema from %s.", sf)
+			return nil
+		})
+		if len(errs) > 0 {
+			logging.Errorf("%s", summarizeErrors(errs, len(level), "schema files"))
+			return &PartialFailureError{Err: fmt.Errorf("failed during schema restoration: %w", errors.Join(errs...))}
+		}
+	}
+	if r.config.VerifySchema {
+		return r.verifySchemas(ctx, schemas)
+	}
+	return nil
+}
+
+// forEachParallel calls fn for every schema file with at most parallel calls at a time,
+// failures are logged and returned as itemErrors.
+func (r *Restorer) forEachParallel(items []string, parallel int, fn func(item string) error) []error {
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(items))
+	for _, item := range items {
+		wg.Add(1)
+		go func(item string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := fn(item); err != nil {
+				errChan <- &itemError{item: item, err: err}
+			}
+		}(item)
+	}
+	wg.Wait()
+	close(errChan)
+
+	var errs []error
+	for errItem := range errChan {
+		errs = append(errs, errItem)
+		logging.Errorf("Error during schema restoration: %v", errItem)
+	}
+	return errs
+}
+
+// closeDownload closes a reader returned by Download, which also removes the temp file of
+// buffered S3 and Azure downloads. Callers defer it right after a successful Download.
+func closeDownload(reader io.Closer, file string) {
+	if closeErr := reader.Close(); closeErr != nil {
+		logging.Warnf("failed to close reader of %s: %v", file, closeErr)
+	}
+}
+
+// backupRelPath returns a listed file relative to the backup, storages list files
+// under the storage path or relative to it.
+func (r *Restorer) backupRelPath(file string) string {
+	rel := strings.TrimPrefix(file, "/")
+	for _, prefix := range []string{path.Join(r.config.StorageConfig["path"], r.config.BackupName), r.config.BackupName} {
+		if cut, ok := strings.CutPrefix(rel, strings.TrimPrefix(prefix, "/")+"/"); ok {
+			return cut
+		}
+	}
+	// Mirror targets list files under their own path
+	if _, cut, ok := strings.Cut(rel, "/"+r.config.BackupName+"/"); ok {
+		return cut
+	}
+	return rel
+}
+
+// setLayout picks the layout of table files recorded in the manifest, backups without
+// manifest are read with --layout.
+func (r *Restorer) setLayout(manifest *Manifest) error {
+	template := r.config.Layout
+	if manifest != nil {
+		template = manifest.Layout
+		if r.config.Layout != "" && r.config.Layout != DefaultLayout && r.config.Layout != manifest.Layout {
+			logging.Warnf("--layout %s is ignored, the manifest records the layout the backup was dumped with", r.config.Layout)
+		}
+	}
+	layout, err := newFileLayout(template)
+	if err != nil {
+		return &ConfigError{Err: err}
+	}
+	if layout.template != DefaultLayout {
+		logging.Infof("Reading table files with layout %s", layout.template)
+	}
+	r.layout = layout
+	return nil
+}
+
+// skipFile reports whether a file matches a --skip-file glob. Globs are matched against the path
+// relative to the backup, with and without the compression extension, e.g. db/table.data.sql.
+func (r *Restorer) skipFile(file string) bool {
+	if len(r.config.SkipFiles) == 0 {
+		return false
+	}
+	rel := r.backupRelPath(file)
+	for _, pattern := range r.config.SkipFiles {
+		for _, name := range []string{rel, trimCompressionExt(rel)} {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipDownloadError reports whether a failed download is skipped with --skip-missing.
+func (r *Restorer) skipDownloadError(file string, err error) bool {
+	if !r.config.SkipMissing {
+		return false
+	}
+	logging.Warnf("Skipping %s, download failed: %v", file, err)
+	return true
+}
+
+// restoreSchema reads schema definition from the reader and executes it.
+func (r *Restorer) restoreSchema(ctx context.Context, reader io.Reader) error {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read schema content: %w", err)
+	}
+	return r.executeSchema(ctx, string(content))
+}
+
+// stripSetting reports whether an engine setting is removed by --strip-settings or --strip-all-settings.
+func (r *Restorer) stripSetting(key string) bool {
+	if r.config.StripAllSettings {
+		return true
+	}
+	for _, strip := range r.config.StripSettings {
+		if strings.EqualFold(strip, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// utf8BOM is the byte order mark some Windows editors write at the start of UTF-8 files.
+const utf8BOM = "\ufeff"
+
+// normalizeSchema strips a leading BOM and converts CRLF line endings to LF, the server fails to
+// parse schema files created or edited on Windows otherwise.
+func normalizeSchema(query string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(query, utf8BOM), "\r\n", "\n")
+}
+
+// isBlankStatement reports whether a statement has nothing to execute, only whitespace, comments
+// and semicolons, the server rejects it as an empty query.
+func isBlankStatement(stmt string) bool {
+	for _, t := range tokenizeSQL(stmt) {
+		if t.text != ";" {
+			return false
+		}
+	}
+	return true
+}
+
+// executeSchema executes a CREATE statement of a database or table schema file.
+func (r *Restorer) executeSchema(ctx context.Context, query string) error {
+	query = normalizeSchema(query)
+	if isBlankStatement(query) {
+		logging.Infof("Schema file is empty or only has comments, skipping.")
+		return nil
+	}
+	if r.config.StripUUID {
+		query = stripUUID(query)
+	}
+	if r.config.StripAllSettings || len(r.config.StripSettings) > 0 {
+		var removed []string
+		query, removed = stripSettings(query, r.stripSetting)
+		if len(removed) > 0 {
+			logging.Infof("Removed SETTINGS %s from schema query", strings.Join(removed, ", "))
+		}
+	}
+
+	logging.Infof("Executing schema query: %s...", strings.Split(query, "\n")[0]) // Log first line
+	if _, err := r.client.ExecuteQuery(ctx, query); err != nil {
+		return fmt.Errorf("failed to execute schema query: %w", err)
+	}
+	return nil
+}
+
+// restoreData restores a data file. SQLInsert files are split into statements respecting quotes
+// and executed one by one, Native and Parquet files are streamed as the body of a single INSERT.
+func (r *Restorer) restoreData(ctx context.Context, reader io.Reader, file, format string) error {
+	if format == DataFormatSQLInsert {
+		return r.executeStatementsFromStream(ctx, reader, file)
+	}
+	// Binary files bypass the statement splitter, their bytes are streamed as the INSERT body
+	dbName, tableName := r.layout.dataTable(file, format)
+	query := fmt.Sprintf("INSERT INTO `%s`.`%s` FORMAT %s", dbName, tableName, format)
+	compressFormat := strings.ToLower(r.config.RestoreCompressFormat)
+	if compressFormat != "gzip" && compressFormat != "zstd" {
+		r.debugf("Executing %s with %s body", query, file)
+		// The HTTP client closes ReadCloser bodies, the caller still owns the reader
+		return r.client.ExecuteInsert(ctx, query, io.NopCloser(reader), "")
+	}
+	r.debugf("Executing %s with %s body compressed with %s", query, file, compressFormat)
+	body := r.compressInsertBody(reader, compressFormat)
+	defer func() {
+		_ = body.Close()
+	}()
+	return r.client.ExecuteInsert(ctx, query, body, compressFormat)
+}
+
+// compressInsertBody compresses reader with --restore-compress-format while the request reads it.
+// Closing the returned reader stops the compressing goroutine if the request failed midway.
+func (r *Restorer) compressInsertBody(reader io.Reader, compressFormat string) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		var w io.WriteCloser
+		if compressFormat == "gzip" {
+			level := r.config.CompressLevel
+			if level < gzip.BestSpeed || level > gzip.BestCompression {
+				level = gzip.DefaultCompression
+			}
+			w, _ = gzip.NewWriterLevel(pipeWriter, level)
+		} else {
+			w, _ = zstd.NewWriter(pipeWriter, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(r.config.CompressLevel)))
+		}
+		_, err := io.Copy(w, reader)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		_ = pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader
+}
+
+// executeStatementsFromStream reads SQL statements separated by semicolons respecting quotes from the reader.
+// With --resume-restore the statements applied by a previous run are counted and skipped, which relies
+// on the deterministic statement order of SQLInsert files.
+func (r *Restorer) executeStatementsFromStream(ctx context.Context, reader io.Reader, file string) error {
+	if r.config.RestoreStatementParallel > 1 {
+		return r.executeStatementsParallel(ctx, reader, r.config.RestoreStatementParallel)
+	}
+	var statementCount, applied int
+	if r.state != nil {
+		if applied = r.state.file(file).Statements; applied > 0 {
+			logging.Infof("Resuming %s after %d statements applied by a previous run", file, applied)
+		}
+	}
+	err := scanStatements(reader, func(statement string) error {
+		statementCount++
+		if statementCount <= applied {
+			return nil
+		}
+		logging.Debugf("Executing statement %d...", statementCount)
+		if execErr := r.executeSingleStatement(ctx, statement); execErr != nil {
+			return fmt.Errorf("failed executing statement %d: %w", statementCount, execErr)
+		}
+		if r.state != nil {
+			return r.state.record(file, restoreFileState{Statements: statementCount})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logging.Infof("Finished processing stream, executed %d statements.", statementCount)
+	return nil
+}
+
+// errStatementFailed stops reading a data file once a statement executed in parallel failed.
+var errStatementFailed = errors.New("a statement failed")
+
+// executeStatementsParallel executes the statements read from the reader on parallel workers,
+// SQLInsert statements are independent INSERTs so their order doesn't matter. After the first
+// failure no more statements are read, statements already running finish and all failures are returned.
+func (r *Restorer) executeStatementsParallel(ctx context.Context, reader io.Reader, parallel int) error {
+	type numberedStatement struct {
+		number int
+		query  string
+	}
+	statements := make(chan numberedStatement, parallel)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var errsMu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for statement := range statements {
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+				logging.Debugf("Executing statement %d...", statement.number)
+				if err := r.executeSingleStatement(ctx, statement.query); err != nil {
+					errsMu.Lock()
+					errs = append(errs, fmt.Errorf("failed executing statement %d: %w", statement.number, err))
+					errsMu.Unlock()
+					failOnce.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
+
+	var statementCount int
+	scanErr := scanStatements(reader, func(statement string) error {
+		statementCount++
+		select {
+		case statements <- numberedStatement{number: statementCount, query: statement}:
+			return nil
+		case <-failed:
+			return errStatementFailed
+		}
+	})
+	close(statements)
+	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	logging.Infof("Finished processing stream, executed %d statements on %d connections.", statementCount, parallel)
+	return nil
+}
+
+// scanStatements splits the reader into statements on semicolons outside of quotes, backticks
+// and $tag$...$tag$ heredoc strings, and calls handle for each statement which isn't only
+// whitespace and comments. A leading UTF-8 BOM is skipped.
+func scanStatements(reader io.Reader, handle func(statement string) error) error {
+	bufReader := bufio.NewReader(reader)
+	if bom, err := bufReader.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		_, _ = bufReader.Discard(len(utf8BOM))
+	}
+	// Statements of only comments, e.g. a trailing comment after the last statement, are skipped,
+	// the first byte check keeps the tokenizer off the INSERTs of data files
+	emit := func(statement string) error {
+		if statement == "" || strings.IndexByte("-/;", statement[0]) >= 0 && isBlankStatement(statement) {
+			return nil
+		}
+		return handle(statement)
+	}
+	var statementBuilder strings.Builder
+	var inSingleQuotes, inDoubleQuotes, inBackticks bool
+	var escaped bool
+	// heredocTag is the "$tag$" delimiter of the heredoc being read, heredocStart is the
+	// position of its content; tagStart is the position of a "$" which may open a heredoc.
+	var heredocTag string
+	heredocStart, tagStart := 0, -1
+
+	for {
+		runeValue, _, err := bufReader.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				// End of file reached, process any remaining statement
+				return emit(strings.TrimSpace(statementBuilder.String()))
+			}
+			return fmt.Errorf("error reading data stream: %w", err) // Return other read errors
+		}
+
+		// Append the rune regardless of state first
+		statementBuilder.WriteRune(runeValue)
+
+		// State machine logic
+		if heredocTag != "" {
+			// Heredoc content is literal, only the closing tag ends it
+			if runeValue == '$' && strings.HasSuffix(statementBuilder.String()[heredocStart:], heredocTag) {
+				heredocTag = ""
+			}
+		} else if escaped {
+			// Previous character was escape, so this character is literal
+			escaped = false
+		} else if runeValue == '\\' {
+			// Current character is escape, next one is literal
+			escaped = true
+		} else if runeValue == '\'' && !inDoubleQuotes && !inBackticks {
+			inSingleQuotes = !inSingleQuotes
+		} else if runeValue == '"' && !inSingleQuotes && !inBackticks {
+			inDoubleQuotes = !inDoubleQuotes
+		} else if runeValue == '`' && !inSingleQuotes && !inDoubleQuotes {
+			inBackticks = !inBackticks
+		} else if runeValue == '$' && !inSingleQuotes && !inDoubleQuotes && !inBackticks {
+			current := statementBuilder.String()
+			if tagStart >= 0 {
+				// "$tag$" complete, heredoc content starts after it
+				heredocTag = current[tagStart:]
+				heredocStart = len(current)
+				tagStart = -1
+			} else if len(current) == 1 || !isIdentifierChar(current[len(current)-2]) {
+				tagStart = len(current) - 1
+			}
+		} else if runeValue == ';' && !inSingleQuotes && !inDoubleQuotes && !inBackticks {
+			// Statement terminator found outside quotes
+			if err := emit(strings.TrimSpace(statementBuilder.String())); err != nil {
+				return err
+			}
+			// Reset for the next statement
+			statementBuilder.Reset()
+			escaped = false // Reset escaped state for new statement
+			tagStart = -1
+		} else {
+			// Regular character, reset escaped if it wasn't consumed by a quote
+			escaped = false
+		}
+
+		// A "$" followed by anything but a tag identifier doesn't open a heredoc
+		if tagStart >= 0 && runeValue != '$' && (runeValue >= utf8.RuneSelf || !isIdentifierChar(byte(runeValue))) {
+			tagStart = -1
+		}
+	}
+}
+
+// defaultMaxQuerySize mirrors the ClickHouse server default for max_query_size and is used
+// to split statements rejected by the server when --restore-max-query-size is not set.
+const defaultMaxQuerySize = 262144
+
+// asyncInsertSettings are sent with restored INSERT statements with --restore-async-insert. The
+// server batches the rows of concurrent INSERTs, wait_for_async_insert=1 acknowledges an INSERT
+// only after its batch was written to the table, so failures still fail the statement.
+var asyncInsertSettings = map[string]string{
+	"async_insert":          "1",
+	"wait_for_async_insert": "1",
+}
+
+// isInsertStatement reports whether a statement read from a data file is an INSERT.
+func isInsertStatement(query string) bool {
+	return len(query) >= len("INSERT") && strings.EqualFold(query[:len("INSERT")], "INSERT")
+}
+
+// executeSingleStatement executes a single SQL statement, REPLACE INTO as INSERT INTO. INSERT
+// statements larger than --restore-max-query-size, or rejected by the server with "Max query size
+// exceeded", are split into several smaller INSERTs by their VALUES tuples.
+func (r *Restorer) executeSingleStatement(ctx context.Context, query string) error {
+	query = replaceToInsert(query)
+	if r.config.RestoreAsyncInsert && isInsertStatement(query) {
+		ctx = withQuerySettings(ctx, asyncInsertSettings)
+	}
+	if r.config.RestoreMaxQuerySize > 0 && len(query) > r.config.RestoreMaxQuerySize {
+		r.debugf("Statement length %d exceeds --restore-max-query-size=%d, splitting", len(query), r.config.RestoreMaxQuerySize)
+		return r.executeSplitStatement(ctx, query, r.config.RestoreMaxQuerySize)
+	}
+	err := r.executeStatement(ctx, query)
+	if err != nil && isMaxQuerySizeError(err) {
+		limit := r.config.RestoreMaxQuerySize
+		if limit <= 0 {
+			limit = defaultMaxQuerySize
+		}
+		logging.Infof("Statement length %d exceeds server max_query_size, retrying in chunks of at most %d bytes", len(query), limit)
+		return r.executeSplitStatement(ctx, query, limit)
+	}
+	return err
+}
+
+// executeSplitStatement splits an INSERT ... VALUES statement into chunks of at most maxSize bytes and executes them in order.
+func (r *Restorer) executeSplitStatement(ctx context.Context, query string, maxSize int) error {
+	chunks, err := splitInsertValues(query, maxSize)
+	if err != nil {
+		return fmt.Errorf("can't split statement %s...: %w", firstNChars(query, 255), err)
+	}
+	for i, chunk := range chunks {
+		r.debugf("Executing chunk %d/%d (length %d)", i+1, len(chunks), len(chunk))
+		if execErr := r.executeStatement(ctx, chunk); execErr != nil {
+			return fmt.Errorf("failed executing chunk %d/%d: %w", i+1, len(chunks), execErr)
+		}
+	}
+	return nil
+}
+
+// isMaxQuerySizeError reports whether err is the ClickHouse "Max query size exceeded" syntax error.
+func isMaxQuerySizeError(err error) bool {
+	return strings.Contains(err.Error(), "Max query size exceeded")
+}
+
+// splitInsertValues splits an `INSERT INTO ... VALUES (...), (...)` statement into several
+// statements with the same INSERT prefix, each at most maxSize bytes long where possible.
+// A single tuple larger than maxSize is returned in its own statement.
+func splitInsertValues(statement string, maxSize int) ([]string, error) {
+	statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+	valuesPos := findValuesKeyword(statement)
+	if valuesPos < 0 {
+		return nil, fmt.Errorf("statement is not an INSERT ... VALUES statement")
+	}
+	prefix := statement[:valuesPos+len("VALUES")]
+	tuples, err := splitValuesTuples(statement[valuesPos+len("VALUES"):])
+	if err != nil {
+		return nil, err
+	}
+	if len(tuples) == 0 {
+		return nil, fmt.Errorf("no VALUES tuples found")
+	}
+
+	var chunks []string
+	var chunk strings.Builder
+	for _, tuple := range tuples {
+		if chunk.Len() > 0 && len(prefix)+1+chunk.Len()+2+len(tuple) > maxSize {
+			chunks = append(chunks, prefix+" "+chunk.String())
+			chunk.Reset()
+		}
+		if chunk.Len() > 0 {
+			chunk.WriteString(", ")
+		}
+		chunk.WriteString(tuple)
+	}
+	if chunk.Len() > 0 {
+		chunks = append(chunks, prefix+" "+chunk.String())
+	}
+	return chunks, nil
+}
+
+// findValuesKeyword returns the position of the first VALUES keyword outside quotes and parentheses, or -1.
+func findValuesKeyword(statement string) int {
+	var inSingleQuotes, inDoubleQuotes, inBackticks, escaped bool
+	depth := 0
+	for i := 0; i < len(statement); i++ {
+		c := statement[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && (inSingleQuotes || inDoubleQuotes || inBackticks):
+			escaped = true
+		case c == '\'' && !inDoubleQuotes && !inBackticks:
+			inSingleQuotes = !inSingleQuotes
+		case c == '"' && !inSingleQuotes && !inBackticks:
+			inDoubleQuotes = !inDoubleQuotes
+		case c == '`' && !inSingleQuotes && !inDoubleQuotes:
+			inBackticks = !inBackticks
+		case inSingleQuotes || inDoubleQuotes || inBackticks:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == 'V' || c == 'v') && i+len("VALUES") <= len(statement) &&
+			strings.EqualFold(statement[i:i+len("VALUES")], "VALUES") &&
+			(i == 0 || !isIdentifierChar(statement[i-1])) &&
+			(i+len("VALUES") == len(statement) || !isIdentifierChar(statement[i+len("VALUES")])):
+			return i
+		}
+	}
+	return -1
+}
+
+// splitValuesTuples splits the part of an INSERT statement following VALUES into individual top-level tuples.
+func splitValuesTuples(values string) ([]string, error) {
+	var tuples []string
+	var inSingleQuotes, inDoubleQuotes, inBackticks, escaped bool
+	depth := 0
+	start := -1
+	for i := 0; i < len(values); i++ {
+		c := values[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && (inSingleQuotes || inDoubleQuotes || inBackticks):
+			escaped = true
+		case c == '\'' && !inDoubleQuotes && !inBackticks:
+			inSingleQuotes = !inSingleQuotes
+		case c == '"' && !inSingleQuotes && !inBackticks:
+			inDoubleQuotes = !inDoubleQuotes
+		case c == '`' && !inSingleQuotes && !inDoubleQuotes:
+			inBackticks = !inBackticks
+		case inSingleQuotes || inDoubleQuotes || inBackticks:
+		case c == '(':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses at position %d", i)
+			}
+			if depth == 0 {
+				tuples = append(tuples, values[start:i+1])
+				start = -1
+			}
+		case depth == 0 && c != ',' && c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			return nil, fmt.Errorf("unexpected character %q outside of tuple at position %d", c, i)
+		}
+	}
+	if depth != 0 || inSingleQuotes || inDoubleQuotes || inBackticks {
+		return nil, fmt.Errorf("unterminated tuple in VALUES")
+	}
+	return tuples, nil
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// executeStatement executes a single SQL statement, compressed with --restore-compress-format before sending.
+// The format is independent of the backup files, which are decompressed by their extension or Content-Encoding.
+func (r *Restorer) executeStatement(ctx context.Context, query string) error {
+	var err error
+	compressFormat := strings.ToLower(r.config.RestoreCompressFormat)
+
+	if compressFormat == "gzip" || compressFormat == "zstd" {
+		var compressedBody bytes.Buffer
+		var contentEncoding string
+		originalLength := len(query)
+
+		if compressFormat == "gzip" {
+			level := r.config.CompressLevel
+			if level < gzip.BestSpeed || level > gzip.BestCompression {
+				level = gzip.DefaultCompression
+			}
+			gw, _ := gzip.NewWriterLevel(&compressedBody, level)
+			_, copyErr := io.WriteString(gw, query)
+			closeErr := gw.Close()
+			if copyErr != nil {
+				return fmt.Errorf("failed to write query to gzip writer: %w", copyErr)
+			}
+			if closeErr != nil {
+				return fmt.Errorf("failed to close gzip writer: %w", closeErr)
+			}
+			contentEncoding = "gzip"
+		} else { // zstd
+			zstdLevel := zstd.EncoderLevelFromZstd(r.config.CompressLevel)
+			zw, _ := zstd.NewWriter(&compressedBody, zstd.WithEncoderLevel(zstdLevel))
+			_, copyErr := io.WriteString(zw, query)
+			closeErr := zw.Close()
+			if copyErr != nil {
+				return fmt.Errorf("failed to write query to zstd writer: %w", copyErr)
+			}
+			if closeErr != nil {
+				return fmt.Errorf("failed to close zstd writer: %w", closeErr)
+			}
+			contentEncoding = "zstd"
+		}
+
+		logging.Debugf("Executing statement compressed with %s (original length %d, compressed length %d)...", contentEncoding, originalLength, compressedBody.Len())
+		_, err = r.client.ExecuteQueryWithBody(ctx, bytes.NewReader(compressedBody.Bytes()), contentEncoding, query)
+
+	} else {
+		_, err = r.client.ExecuteQuery(ctx, query)
+	}
+
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// listBackupFiles lists the backup and, when a manifest is present, repeats the
+// listing with backoff until every file from the manifest is visible. Some S3-compatible
+// stores are eventually consistent and may return an incomplete listing right after a dump.
+func (r *Restorer) listBackupFiles(ctx context.Context, backupPrefix string) ([]string, *Manifest, error) {
+	var manifest *Manifest
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		files, err := r.storage.List(backupPrefix, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list files in storage with prefix %s: %w", backupPrefix, err)
+		}
+		if manifest == nil {
+			manifestFile, found := findManifest(files, r.config.BackupName)
+			if !found {
+				r.debugf("No %s found under %s, skipping listing consistency check", manifestFileName, backupPrefix)
+				return files, nil, nil
+			}
+			if manifest, err = readManifest(r.storage, manifestFile); err != nil {
+				return nil, nil, err
+			}
+			for _, failed := range manifest.FailedTables {
+				logging.Warnf("table %s failed during dump and may be missing or incomplete: %s", failed.Table, failed.Error)
+			}
+		}
+		var missing []string
+		for _, name := range missingManifestFiles(manifest, files, r.config.BackupName) {
+			if !r.skipFile(name) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) == 0 {
+			return files, manifest, nil
+		}
+		if attempt >= r.config.ListRetries && r.config.SkipMissing {
+			logging.Warnf("%d files from manifest are missing in storage listing of %s, skipping them: %s", len(missing), backupPrefix, strings.Join(missing, ", "))
+			return files, manifest, nil
+		}
+		if attempt >= r.config.ListRetries {
+			return nil, nil, fmt.Errorf("%d files from manifest are missing in storage listing of %s after %d retries: %s", len(missing), backupPrefix, r.config.ListRetries, strings.Join(missing, ", "))
+		}
+		logging.Infof("Storage listing of %s is missing %d files from manifest, retrying in %s (%d/%d)", backupPrefix, len(missing), delay, attempt+1, r.config.ListRetries)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (r *Restorer) debugf(msg string, args ...interface{}) {
+	if r.config.Debug || logging.Enabled(logging.LevelDebug) {
+		if len(args) > 0 {
+			log.Printf(msg, args...)
+		} else {
+			log.Println(msg)
+		}
+	}
+}
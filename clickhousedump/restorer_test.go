@@ -0,0 +1,483 @@
+package clickhousedump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Slach/clickhouse-dump/storage"
+)
+
+func TestSplitInsertValues(t *testing.T) {
+	statement := "INSERT INTO `db`.`t` (`id`, `name`) VALUES (1, 'a,b'), (2, 'it\\'s (x)'), (3, ['c', 'd']), (4, 'values');"
+
+	chunks, err := splitInsertValues(statement, 60)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"INSERT INTO `db`.`t` (`id`, `name`) VALUES (1, 'a,b')",
+		"INSERT INTO `db`.`t` (`id`, `name`) VALUES (2, 'it\\'s (x)')",
+		"INSERT INTO `db`.`t` (`id`, `name`) VALUES (3, ['c', 'd'])",
+		"INSERT INTO `db`.`t` (`id`, `name`) VALUES (4, 'values')",
+	}, chunks)
+
+	chunks, err = splitInsertValues(statement, 1024)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"INSERT INTO `db`.`t` (`id`, `name`) VALUES (1, 'a,b'), (2, 'it\\'s (x)'), (3, ['c', 'd']), (4, 'values')",
+	}, chunks)
+
+	_, err = splitInsertValues("CREATE TABLE t (id UInt32) ENGINE=Memory", 10)
+	require.Error(t, err)
+
+	_, err = splitInsertValues("INSERT INTO t VALUES (1, 'unterminated)", 10)
+	require.Error(t, err)
+}
+
+func TestScanStatementsHeredoc(t *testing.T) {
+	input := "INSERT INTO t VALUES (1, $$ ; ' \" $$);\n" +
+		"INSERT INTO t VALUES (2, $tag$ a;b $$ ' $tag$), (3, 'x;y');\n" +
+		"SELECT $1 + price$ FROM t;\n" +
+		"CREATE VIEW v AS SELECT $body$ \\ ; ` $body$ AS s"
+
+	var statements []string
+	err := scanStatements(strings.NewReader(input), func(statement string) error {
+		statements = append(statements, statement)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"INSERT INTO t VALUES (1, $$ ; ' \" $$);",
+		"INSERT INTO t VALUES (2, $tag$ a;b $$ ' $tag$), (3, 'x;y');",
+		"SELECT $1 + price$ FROM t;",
+		"CREATE VIEW v AS SELECT $body$ \\ ; ` $body$ AS s",
+	}, statements)
+}
+
+func TestRestoreSchemaBOMAndCRLF(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		queries = append(queries, req.URL.Query().Get("query")+string(body))
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	config := &Config{Host: host, Port: port}
+	r := &Restorer{config: config, client: NewClickHouseClient(config)}
+
+	schema := "\ufeffCREATE TABLE db.t\r\n(\r\n    `id` UInt64\r\n)\r\nENGINE = Memory\r\n"
+	require.NoError(t, r.restoreSchema(context.Background(), strings.NewReader(schema)))
+	require.Equal(t, []string{"CREATE TABLE db.t\n(\n    `id` UInt64\n)\nENGINE = Memory\n"}, queries)
+
+	// Files of only whitespace and comments are skipped without a query
+	for _, blank := range []string{"", "\ufeff\r\n", "-- dropped table\r\n/* kept for history */\r\n;\r\n"} {
+		require.NoError(t, r.restoreSchema(context.Background(), strings.NewReader(blank)), blank)
+	}
+	require.Len(t, queries, 1)
+
+	var statements []string
+	require.NoError(t, scanStatements(strings.NewReader("\ufeffINSERT INTO t VALUES ('a\r\nb');\r\n-- end of dump\r\n"), func(statement string) error {
+		statements = append(statements, statement)
+		return nil
+	}))
+	require.Equal(t, []string{"INSERT INTO t VALUES ('a\r\nb');"}, statements, "line breaks inside values are data and kept")
+}
+
+func TestExecuteStatementRestoreCompressFormat(t *testing.T) {
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encodings = append(encodings, req.Header.Get("Content-Encoding"))
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	// The dump format of the backup doesn't leak into restore requests
+	config := &Config{Host: host, Port: port, CompressFormat: "gzip", CompressLevel: 6}
+	r := &Restorer{config: config, client: NewClickHouseClient(config)}
+	require.NoError(t, r.executeStatement(context.Background(), "INSERT INTO t VALUES (1)"))
+	config.RestoreCompressFormat = "zstd"
+	require.NoError(t, r.executeStatement(context.Background(), "INSERT INTO t VALUES (2)"))
+	require.Equal(t, []string{"", "zstd"}, encodings)
+}
+
+func TestBackupFileKinds(t *testing.T) {
+	for _, file := range []string{"backup/db.database.sql", "backup/db.database.sql.gz", "backup/db.database.sql.zstd"} {
+		require.True(t, isDatabaseFile(file), file)
+		require.False(t, isSchemaFile(file), file)
+	}
+	for _, file := range []string{"backup/db/t.schema.sql", "backup/db/t.schema.sql.gz"} {
+		require.True(t, isSchemaFile(file), file)
+		require.False(t, isDatabaseFile(file), file)
+	}
+	// Data files of tables named like schema files stay data files without a compression extension
+	for _, file := range []string{"backup/db/database.sql.data.sql", "backup/db/t.schema.sql.data.native", "backup/manifest.json"} {
+		require.False(t, isDatabaseFile(file), file)
+		require.False(t, isSchemaFile(file), file)
+	}
+
+	config := &Config{StorageConfig: map[string]string{"path": "backups"}, BackupName: "b1"}
+	r := &Restorer{config: config}
+	manifest := &Manifest{Files: []ManifestFile{{Name: "db/t.data.native", Format: DataFormatNative}}}
+	kinds := r.classifyFiles([]string{
+		"backups/b1/manifest.json",
+		"backups/b1/db.database.sql",
+		"backups/b1/functions/f.database.sql",
+		"backups/b1/named_collections/creds.sql.gz",
+		"backups/b1/db/t.schema.sql.gz",
+		"backups/b1/db/t.comments.sql.gz",
+		"backups/b1/functions/t.comments.sql",
+		"backups/b1/db/t.data.native.zstd",
+		"backups/b1/db/u.chunk00001.data.sql",
+	}, manifest)
+	require.Equal(t, []string{"backups/b1/db.database.sql"}, kinds.databases)
+	require.Equal(t, []string{"backups/b1/functions/f.database.sql"}, kinds.functions)
+	require.Equal(t, []string{"backups/b1/named_collections/creds.sql.gz"}, kinds.namedCollections)
+	require.Equal(t, []string{"backups/b1/db/t.schema.sql.gz"}, kinds.schemas)
+	require.Equal(t, []string{"backups/b1/db/t.comments.sql.gz", "backups/b1/functions/t.comments.sql"}, kinds.comments)
+	require.Equal(t, []string{"backups/b1/db/t.data.native.zstd", "backups/b1/db/u.chunk00001.data.sql"}, kinds.data)
+	require.Equal(t, map[string]string{"backups/b1/db/t.data.native.zstd": DataFormatNative, "backups/b1/db/u.chunk00001.data.sql": DataFormatSQLInsert}, kinds.dataFormats)
+}
+
+func TestBackupFileKindsDottedNames(t *testing.T) {
+	// Kind suffixes in database and table names don't change the kind, only the end of the path counts
+	layout := fileLayout{}
+	var files []string
+	for _, ext := range []string{"", ".gz", ".zstd"} {
+		files = append(files, "backups/b1/"+layout.databaseFile("my.data")+ext)
+		for _, table := range []string{"my.data", "weird.schema", "x.database"} {
+			files = append(files,
+				"backups/b1/"+layout.schemaFile("my.data", table)+ext,
+				"backups/b1/"+layout.commentsFile("my.data", table)+ext,
+				"backups/b1/"+layout.dataFile("my.data", table, DataFormatSQLInsert)+ext,
+				"backups/b1/"+layout.chunkFile("my.data", table, DataFormatNative, 1)+ext,
+			)
+		}
+	}
+	r := &Restorer{config: &Config{StorageConfig: map[string]string{"path": "backups"}, BackupName: "b1"}}
+	kinds := r.classifyFiles(files, nil)
+	require.Len(t, kinds.databases, 3)
+	require.Len(t, kinds.schemas, 9)
+	require.Len(t, kinds.comments, 9)
+	require.Len(t, kinds.data, 18)
+	for _, file := range kinds.databases {
+		require.Equal(t, "my.data", strings.TrimSuffix(path.Base(trimCompressionExt(file)), ".database.sql"), file)
+	}
+	tables := make(map[string]int)
+	for _, file := range kinds.schemas {
+		tables[schemaObject(layout, file)]++
+	}
+	for _, file := range kinds.comments {
+		db, table := layout.commentsTable(file)
+		tables[db+"."+table]++
+	}
+	for _, file := range kinds.data {
+		db, table := layout.dataTable(file, kinds.dataFormats[file])
+		tables[db+"."+table]++
+	}
+	require.Equal(t, map[string]int{"my.data.my.data": 12, "my.data.weird.schema": 12, "my.data.x.database": 12}, tables)
+	require.Equal(t, DataFormatSQLInsert, kinds.dataFormats["backups/b1/my.data/weird.schema.data.sql"])
+	require.Equal(t, DataFormatNative, kinds.dataFormats["backups/b1/my.data/my.data.chunk00001.data.native.zstd"])
+}
+
+func BenchmarkClassifyFiles(b *testing.B) {
+	config := &Config{StorageConfig: map[string]string{"path": "backups"}, BackupName: "b1"}
+	r := &Restorer{config: config}
+	files := make([]string, 0, 50000)
+	manifest := &Manifest{}
+	for i := 0; len(files) < cap(files); i++ {
+		db := fmt.Sprintf("db%03d", i%100)
+		if i < 100 {
+			files = append(files, "backups/b1/"+db+".database.sql")
+		}
+		table := fmt.Sprintf("%s/t%05d", db, i)
+		files = append(files, "backups/b1/"+table+".schema.sql.gz", "backups/b1/"+table+".data.native.zstd")
+		manifest.Files = append(manifest.Files, ManifestFile{Name: table + ".data.native", Format: DataFormatNative})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kinds := r.classifyFiles(files, manifest)
+		require.Len(b, kinds.data, len(manifest.Files))
+	}
+}
+
+// bufferingStorage downloads into temp files removed on Close, like the S3 and Azure storages.
+type bufferingStorage struct {
+	storage.RemoteStorage
+	tmpDir string
+}
+
+type tempFileReader struct {
+	io.Reader
+	close func() error
+}
+
+func (r *tempFileReader) Close() error { return r.close() }
+
+func (s *bufferingStorage) Download(filename string) (io.ReadCloser, error) {
+	reader, err := s.RemoteStorage.Download(filename)
+	if err != nil {
+		return nil, err
+	}
+	tempFile, err := os.CreateTemp(s.tmpDir, "download-*")
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	return &tempFileReader{Reader: reader, close: func() error {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return reader.Close()
+	}}, nil
+}
+
+func TestRestoreClosesDownloadsOnError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Code: 62. DB::Exception: Syntax error", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "db"), 0o755))
+	// Not gzip at all, reading the schema fails after the download succeeded
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "db", "broken.schema.sql.gz"), []byte("CREATE TABLE"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "db", "t.schema.sql"), []byte("CREATE TABLE db.t ("), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "f.sql"), []byte("CREATE FUNCTION f AS"), 0o644))
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+
+	tmpDir := t.TempDir()
+	config := &Config{Host: host, Port: port}
+	r := &Restorer{config: config, client: NewClickHouseClient(config), storage: &bufferingStorage{RemoteStorage: fileStorage, tmpDir: tmpDir}}
+	require.Error(t, r.restoreSchemas(context.Background(), []string{"db/broken.schema.sql.gz"}))
+	require.Error(t, r.restoreSchemas(context.Background(), []string{"db/t.schema.sql"}))
+	require.Error(t, r.restoreGlobalObjects(context.Background(), "function", []string{"f.sql"}))
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "every downloaded reader is closed")
+}
+
+// newSlowInsertServer answers every statement after delay, failing the ones containing fail,
+// and reports the statements it received and the most it executed at once.
+func newSlowInsertServer(tb testing.TB, delay time.Duration, fail string) (*Config, func() ([]string, int)) {
+	var mu sync.Mutex
+	var received []string
+	var running, maxRunning int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		received = append(received, string(body))
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		time.Sleep(delay)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if fail != "" && strings.Contains(string(body), fail) {
+			http.Error(w, "Code: 53. DB::Exception: Type mismatch", http.StatusBadRequest)
+		}
+	}))
+	tb.Cleanup(server.Close)
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(tb, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(tb, err)
+	return &Config{Host: host, Port: port, RestoreCompressFormat: "none"}, func() ([]string, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...), maxRunning
+	}
+}
+
+func insertStatements(n int) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&sb, "INSERT INTO `db`.`t` VALUES (%d);\n", i)
+	}
+	return sb.String()
+}
+
+func TestExecuteStatementsParallel(t *testing.T) {
+	config, stats := newSlowInsertServer(t, 20*time.Millisecond, "")
+	config.RestoreStatementParallel = 4
+	r := &Restorer{config: config, client: NewClickHouseClient(config)}
+	start := time.Now()
+	require.NoError(t, r.executeStatementsFromStream(context.Background(), strings.NewReader(insertStatements(40)), "db/t.data.sql"))
+	elapsed := time.Since(start)
+	received, maxRunning := stats()
+	require.Len(t, received, 40)
+	require.Equal(t, 4, maxRunning)
+	require.Less(t, elapsed, 40*20*time.Millisecond/2, "4 connections are faster than one")
+
+	// Failures of all connections are reported, no more statements are sent after them
+	config, stats = newSlowInsertServer(t, 20*time.Millisecond, "(1")
+	config.RestoreStatementParallel = 4
+	r = &Restorer{config: config, client: NewClickHouseClient(config)}
+	err := r.executeStatementsFromStream(context.Background(), strings.NewReader(insertStatements(40)), "db/t.data.sql")
+	require.ErrorContains(t, err, "failed executing statement 1:")
+	require.ErrorContains(t, err, "Type mismatch")
+	received, _ = stats()
+	require.Less(t, len(received), 40)
+}
+
+func TestRestoreAsyncInsert(t *testing.T) {
+	var params []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		params = append(params, req.URL.Query())
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	config := &Config{Host: host, Port: port, RestoreAsyncInsert: true}
+	r := &Restorer{config: config, client: NewClickHouseClient(config)}
+	require.NoError(t, r.executeStatementsFromStream(context.Background(), strings.NewReader(insertStatements(2)), "db/t.data.sql"))
+	require.Len(t, params, 2)
+	for _, p := range params {
+		require.Equal(t, "1", p.Get("async_insert"))
+		require.Equal(t, "1", p.Get("wait_for_async_insert"))
+	}
+
+	// DDL is sent without the settings
+	params = nil
+	require.NoError(t, r.executeSchema(context.Background(), "CREATE TABLE db.t (id UInt64) ENGINE = Memory"))
+	require.NoError(t, r.executeSingleStatement(context.Background(), "ALTER TABLE db.t COMMENT COLUMN id 'x'"))
+	require.Len(t, params, 2)
+	for _, p := range params {
+		require.False(t, p.Has("async_insert"))
+	}
+
+	config.RestoreAsyncInsert = false
+	params = nil
+	require.NoError(t, r.executeStatementsFromStream(context.Background(), strings.NewReader(insertStatements(1)), "db/t.data.sql"))
+	require.Len(t, params, 1)
+	require.False(t, params[0].Has("async_insert"))
+}
+
+func BenchmarkExecuteStatementsParallel(b *testing.B) {
+	statements := insertStatements(200)
+	for _, parallel := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			config, _ := newSlowInsertServer(b, time.Millisecond, "")
+			config.RestoreStatementParallel = parallel
+			r := &Restorer{config: config, client: NewClickHouseClient(config)}
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, r.executeStatementsFromStream(context.Background(), strings.NewReader(statements), "db/t.data.sql"))
+			}
+		})
+	}
+}
+
+func TestRestoreDataBinary(t *testing.T) {
+	var query, contentEncoding string
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query = req.URL.Query().Get("query")
+		contentEncoding = req.Header.Get("Content-Encoding")
+		var body io.Reader = req.Body
+		switch contentEncoding {
+		case "gzip":
+			gr, err := gzip.NewReader(req.Body)
+			require.NoError(t, err)
+			body = gr
+		case "zstd":
+			zr, err := zstd.NewReader(req.Body)
+			require.NoError(t, err)
+			defer zr.Close()
+			body = zr
+		}
+		received, _ = io.ReadAll(body)
+	}))
+	t.Cleanup(server.Close)
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	// Semicolons and quotes in binary data must not reach the statement splitter
+	native := []byte("\x02\x01id\x06UInt32;\x00\x00'\";\n\xff")
+	for _, compressFormat := range []string{"none", "gzip", "zstd"} {
+		config := &Config{Host: host, Port: port, RestoreCompressFormat: compressFormat}
+		r := &Restorer{config: config, client: NewClickHouseClient(config)}
+		require.NoError(t, r.restoreData(context.Background(), bytes.NewReader(native), "backup/db/t.chunk00001.data.native.zstd", DataFormatNative))
+		require.Equal(t, "INSERT INTO `db`.`t` FORMAT Native", query)
+		require.Equal(t, native, received, compressFormat)
+		if compressFormat == "none" {
+			require.Empty(t, contentEncoding)
+		} else {
+			require.Equal(t, compressFormat, contentEncoding)
+		}
+	}
+}
+
+func TestSkipFilesAndMissing(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	config := &Config{StorageConfig: map[string]string{"path": dir}, BackupName: "b"}
+	manifest := &Manifest{BackupName: "b", Files: []ManifestFile{
+		{Name: "db.database.sql"},
+		{Name: "db/t.schema.sql"},
+		{Name: "db/bad.schema.sql"},
+		{Name: "db/bad.data.sql"},
+	}}
+	require.NoError(t, writeManifest(fileStorage, config, manifest))
+	for _, name := range []string{"db.database.sql", "db/t.schema.sql.gz", "db/bad.schema.sql"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "b", "db"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "b", name), []byte("CREATE"), 0o644))
+	}
+	r := &Restorer{config: config, storage: fileStorage}
+	backupPrefix := path.Join(dir, "b")
+
+	_, _, err = r.listBackupFiles(context.Background(), backupPrefix)
+	require.ErrorContains(t, err, "db/bad.data.sql")
+
+	// Skipped files are not missing
+	config.SkipFiles = []string{"db/bad.*"}
+	files, _, err := r.listBackupFiles(context.Background(), backupPrefix)
+	require.NoError(t, err)
+	require.True(t, r.skipFile(filepath.Join(dir, "b", "db", "bad.schema.sql")))
+	require.False(t, r.skipFile(filepath.Join(dir, "b", "db", "t.schema.sql.gz")))
+	require.Contains(t, files, "b/db/t.schema.sql.gz")
+	require.True(t, r.skipFile("b/db/bad.schema.sql"))
+
+	// Globs match with and without the compression extension
+	config.SkipFiles = []string{"*/*.schema.sql"}
+	require.True(t, r.skipFile(filepath.Join(dir, "b", "db", "t.schema.sql.gz")))
+	require.False(t, r.skipFile(filepath.Join(dir, "b", "db.database.sql")))
+
+	config.SkipFiles = nil
+	config.SkipMissing = true
+	_, _, err = r.listBackupFiles(context.Background(), backupPrefix)
+	require.NoError(t, err)
+	require.True(t, r.skipDownloadError("db/bad.data.sql", fmt.Errorf("not found")))
+}
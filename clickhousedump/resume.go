@@ -0,0 +1,98 @@
+package clickhousedump
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// restoreState is the local progress of a --resume-restore run, saved after every applied
+// statement so an interrupted restore can skip what the previous run already inserted.
+type restoreState struct {
+	mu         sync.Mutex
+	path       string
+	BackupName string                      `json:"backup_name"`
+	Files      map[string]restoreFileState `json:"files"`
+}
+
+// restoreFileState records the statements applied from a backup file, Done is set once the
+// whole file is restored. Statements only apply to SQLInsert data files.
+type restoreFileState struct {
+	Statements int  `json:"statements,omitempty"`
+	Done       bool `json:"done,omitempty"`
+}
+
+var stateFileNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// restoreStatePath returns the state file of restoring config.BackupName into config.Host,
+// kept in --tmp-dir or the system temp dir.
+func restoreStatePath(config *Config) string {
+	dir := config.TmpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := fmt.Sprintf("clickhouse-dump-restore-%s-%s-%d.json", config.BackupName, config.Host, config.Port)
+	return filepath.Join(dir, stateFileNameRe.ReplaceAllString(name, "_"))
+}
+
+// loadRestoreState reads the state file at statePath, a missing file starts a new state.
+func loadRestoreState(statePath, backupName string) (*restoreState, error) {
+	state := &restoreState{path: statePath, BackupName: backupName, Files: make(map[string]restoreFileState)}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read restore state %s: %w", statePath, err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse restore state %s: %w", statePath, err)
+	}
+	if state.BackupName != backupName {
+		return nil, fmt.Errorf("restore state %s belongs to backup %s, not %s", statePath, state.BackupName, backupName)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]restoreFileState)
+	}
+	return state, nil
+}
+
+func (s *restoreState) file(name string) restoreFileState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Files[name]
+}
+
+// record stores the progress of file name and saves the state file through a rename,
+// so a crash never leaves a truncated state behind.
+func (s *restoreState) record(name string, fileState restoreFileState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[name] = fileState
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode restore state: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write restore state %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to save restore state %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// remove deletes the state file after a completed restore.
+func (s *restoreState) remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package clickhousedump
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreStateRoundTrip(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	state, err := loadRestoreState(statePath, "nightly")
+	require.NoError(t, err)
+	require.Empty(t, state.Files)
+
+	require.NoError(t, state.record("nightly/db/t.schema.sql.gz", restoreFileState{Done: true}))
+	require.NoError(t, state.record("nightly/db/t.data.sql.gz", restoreFileState{Statements: 3}))
+
+	loaded, err := loadRestoreState(statePath, "nightly")
+	require.NoError(t, err)
+	require.True(t, loaded.file("nightly/db/t.schema.sql.gz").Done)
+	require.Equal(t, 3, loaded.file("nightly/db/t.data.sql.gz").Statements)
+
+	_, err = loadRestoreState(statePath, "weekly")
+	require.ErrorContains(t, err, "belongs to backup nightly")
+
+	require.NoError(t, loaded.remove())
+	require.NoError(t, loaded.remove())
+}
+
+func TestExecuteStatementsFromStreamResume(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		mu.Lock()
+		queries = append(queries, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	config := &Config{Host: host, Port: port, BackupName: "nightly", CompressFormat: "none"}
+	state, err := loadRestoreState(filepath.Join(t.TempDir(), "state.json"), "nightly")
+	require.NoError(t, err)
+	require.NoError(t, state.record("db/t.data.sql", restoreFileState{Statements: 2}))
+	r := &Restorer{config: config, client: NewClickHouseClient(config), state: state}
+
+	stream := "INSERT INTO t VALUES (1);\nINSERT INTO t VALUES (2);\nINSERT INTO t VALUES (3);\nINSERT INTO t VALUES (4);\n"
+	require.NoError(t, r.executeStatementsFromStream(context.Background(), strings.NewReader(stream), "db/t.data.sql"))
+	require.Len(t, queries, 2)
+	require.Contains(t, queries[0], "(3)")
+	require.Contains(t, queries[1], "(4)")
+	require.Equal(t, 4, state.file("db/t.data.sql").Statements)
+}
@@ -0,0 +1,53 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultSafeModeSettings are the settings --safe-mode sends with dump queries. readonly=2
+// rejects writes but still allows the settings the dump queries set themselves, readonly=1
+// would reject them. A higher priority value runs queries after the ones of the workload.
+var DefaultSafeModeSettings = map[string]string{
+	"readonly":           "2",
+	"max_memory_usage":   "4294967296",
+	"max_execution_time": "3600",
+	"priority":           "10",
+	"os_thread_priority": "19",
+}
+
+var settingNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SafeModeSettings returns DefaultSafeModeSettings with the --safe-setting key=value overrides
+// applied, an empty value removes the setting, e.g. os_thread_priority for servers without it.
+func SafeModeSettings(overrides []string) (map[string]string, error) {
+	settings := make(map[string]string, len(DefaultSafeModeSettings))
+	for key, value := range DefaultSafeModeSettings {
+		settings[key] = value
+	}
+	for _, override := range overrides {
+		key, value, ok := strings.Cut(override, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || !settingNameRe.MatchString(key) {
+			return nil, fmt.Errorf("invalid setting %q, expected key=value", override)
+		}
+		if value == "" {
+			delete(settings, key)
+			continue
+		}
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+// formatSettings returns settings as key=value pairs sorted by key, for logging.
+func formatSettings(settings map[string]string) string {
+	pairs := make([]string, 0, len(settings))
+	for key, value := range settings {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,161 @@
+package clickhousedump
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	createDatabaseRe = regexp.MustCompile(`(?is)^\s*CREATE\s+DATABASE\s+(IF\s+NOT\s+EXISTS\s+)?`)
+	databaseEngineRe = regexp.MustCompile(`(?i)\sENGINE\s*=\s*(\w+)`)
+	uuidClauseRe     = regexp.MustCompile(`(?i)(\s+TO\s+INNER)?\s+UUID\s+'[0-9a-f-]{36}'`)
+)
+
+// createDatabaseIfNotExists adds IF NOT EXISTS to a SHOW CREATE DATABASE statement,
+// the rest of the statement including the ENGINE clause and its arguments is kept as is.
+func createDatabaseIfNotExists(stmt string) string {
+	if !createDatabaseRe.MatchString(stmt) {
+		return stmt
+	}
+	return createDatabaseRe.ReplaceAllLiteralString(stmt, "CREATE DATABASE IF NOT EXISTS ")
+}
+
+// databaseEngine returns the engine name of a CREATE DATABASE statement, or "" if it has no ENGINE clause.
+func databaseEngine(stmt string) string {
+	if m := databaseEngineRe.FindStringSubmatch(stmt); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// stripUUID removes UUID '...' and TO INNER UUID '...' clauses from a CREATE statement, so
+// ClickHouse generates new UUIDs instead of reusing ones which can collide on the target server.
+// Only the statement head before the column list is rewritten, so UUID literals in defaults stay.
+func stripUUID(stmt string) string {
+	head, rest := stmt, ""
+	if i := strings.Index(stmt, "("); i >= 0 {
+		head, rest = stmt[:i], stmt[i:]
+	}
+	return uuidClauseRe.ReplaceAllLiteralString(head, "") + rest
+}
+
+// sqlToken is a word, quoted literal, quoted identifier or punctuation character of a statement,
+// depth is the number of parentheses and brackets around it.
+type sqlToken struct {
+	text       string
+	start, end int
+	depth      int
+}
+
+// isKeyword reports whether the token is the unquoted keyword kw at the top level of the statement.
+func (t sqlToken) isKeyword(kw string) bool {
+	return t.depth == 0 && strings.EqualFold(t.text, kw)
+}
+
+// tokenizeSQL splits a statement into tokens, skipping whitespace and comments. Quoted literals
+// and identifiers are single tokens, so keywords and commas inside them are not seen.
+func tokenizeSQL(stmt string) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+	for i := 0; i < len(stmt); {
+		c := stmt[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(stmt[i:], "--"):
+			for i < len(stmt) && stmt[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(stmt[i:], "/*"):
+			if end := strings.Index(stmt[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(stmt)
+			}
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(stmt) && stmt[end] != c {
+				if stmt[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(stmt))
+			tokens = append(tokens, sqlToken{text: stmt[i:end], start: i, end: end, depth: depth})
+			i = end
+		case isIdentifierChar(c):
+			end := i
+			for end < len(stmt) && (isIdentifierChar(stmt[end]) || stmt[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, sqlToken{text: stmt[i:end], start: i, end: end, depth: depth})
+			i = end
+		default:
+			if c == ')' || c == ']' {
+				depth--
+			}
+			tokens = append(tokens, sqlToken{text: stmt[i : i+1], start: i, end: i + 1, depth: depth})
+			if c == '(' || c == '[' {
+				depth++
+			}
+			i++
+		}
+	}
+	return tokens
+}
+
+// stripSettings removes the keys for which strip returns true from the SETTINGS clause of the
+// table or database ENGINE of a CREATE statement, and the clause itself when no key is left.
+// Column settings, dictionary settings and SETTINGS of the SELECT of a view are kept.
+// It returns the statement and the removed keys.
+func stripSettings(stmt string, strip func(key string) bool) (string, []string) {
+	tokens := tokenizeSQL(stmt)
+	clause := -1
+	for i, engineSeen := 0, false; i < len(tokens) && clause < 0; i++ {
+		switch {
+		case tokens[i].isKeyword("ENGINE"):
+			engineSeen = true
+		case tokens[i].isKeyword("AS") || tokens[i].isKeyword("COMMENT"):
+			// The SELECT of a view or the comment follow the engine settings
+			if engineSeen {
+				return stmt, nil
+			}
+		case tokens[i].isKeyword("SETTINGS") && engineSeen:
+			clause = i
+		}
+	}
+	if clause < 0 {
+		return stmt, nil
+	}
+
+	var kept, removed []string
+	clauseEnd := clause + 1
+	for itemStart := clause + 1; itemStart < len(tokens); {
+		itemEnd := itemStart
+		for itemEnd < len(tokens) && !(tokens[itemEnd].depth == 0 && (tokens[itemEnd].text == "," || tokens[itemEnd].text == ";" ||
+			tokens[itemEnd].isKeyword("AS") || tokens[itemEnd].isKeyword("COMMENT"))) {
+			itemEnd++
+		}
+		if itemEnd > itemStart {
+			key := strings.Trim(tokens[itemStart].text, "`\"")
+			if strip(key) {
+				removed = append(removed, key)
+			} else {
+				kept = append(kept, stmt[tokens[itemStart].start:tokens[itemEnd-1].end])
+			}
+			clauseEnd = itemEnd
+		}
+		if itemEnd == len(tokens) || tokens[itemEnd].text != "," {
+			break
+		}
+		itemStart = itemEnd + 1
+	}
+	if len(removed) == 0 {
+		return stmt, nil
+	}
+	head, tail := stmt[:tokens[clause].start], stmt[tokens[clauseEnd-1].end:]
+	if len(kept) == 0 {
+		return strings.TrimRight(head, " \t\r\n") + tail, removed
+	}
+	return head + "SETTINGS " + strings.Join(kept, ", ") + tail, removed
+}
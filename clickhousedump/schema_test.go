@@ -0,0 +1,135 @@
+package clickhousedump
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateDatabaseIfNotExists(t *testing.T) {
+	cases := map[string]struct {
+		stmt     string
+		expected string
+		engine   string
+	}{
+		"atomic": {
+			stmt:     "CREATE DATABASE db\nENGINE = Atomic\n",
+			expected: "CREATE DATABASE IF NOT EXISTS db\nENGINE = Atomic\n",
+			engine:   "Atomic",
+		},
+		"atomic with uuid": {
+			stmt:     "CREATE DATABASE db UUID 'a3a5f0d2-1b2c-4d5e-8f90-123456789abc'\nENGINE = Atomic\n",
+			expected: "CREATE DATABASE IF NOT EXISTS db UUID 'a3a5f0d2-1b2c-4d5e-8f90-123456789abc'\nENGINE = Atomic\n",
+			engine:   "Atomic",
+		},
+		"replicated": {
+			stmt:     "CREATE DATABASE repl\nENGINE = Replicated('/clickhouse/databases/repl', '{shard}', '{replica}')\nSETTINGS cluster_secret = 'CREATE DATABASE secret'\n",
+			expected: "CREATE DATABASE IF NOT EXISTS repl\nENGINE = Replicated('/clickhouse/databases/repl', '{shard}', '{replica}')\nSETTINGS cluster_secret = 'CREATE DATABASE secret'\n",
+			engine:   "Replicated",
+		},
+		"lazy": {
+			stmt:     "CREATE DATABASE lazy\nENGINE = Lazy(3600)\n",
+			expected: "CREATE DATABASE IF NOT EXISTS lazy\nENGINE = Lazy(3600)\n",
+			engine:   "Lazy",
+		},
+		"already if not exists": {
+			stmt:     "CREATE DATABASE IF NOT EXISTS db ENGINE = Ordinary",
+			expected: "CREATE DATABASE IF NOT EXISTS db ENGINE = Ordinary",
+			engine:   "Ordinary",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expected, createDatabaseIfNotExists(tc.stmt))
+			require.Equal(t, tc.engine, databaseEngine(tc.stmt))
+		})
+	}
+}
+
+func TestStripUUID(t *testing.T) {
+	cases := map[string]struct {
+		stmt     string
+		expected string
+	}{
+		"database": {
+			stmt:     "CREATE DATABASE IF NOT EXISTS db UUID 'a3a5f0d2-1b2c-4d5e-8f90-123456789abc'\nENGINE = Atomic\n",
+			expected: "CREATE DATABASE IF NOT EXISTS db\nENGINE = Atomic\n",
+		},
+		"table keeps uuid defaults": {
+			stmt:     "CREATE TABLE db.t UUID 'a3a5f0d2-1b2c-4d5e-8f90-123456789abc' (`id` UUID DEFAULT 'b3a5f0d2-1b2c-4d5e-8f90-123456789abc') ENGINE = MergeTree ORDER BY id",
+			expected: "CREATE TABLE db.t (`id` UUID DEFAULT 'b3a5f0d2-1b2c-4d5e-8f90-123456789abc') ENGINE = MergeTree ORDER BY id",
+		},
+		"materialized view with inner table": {
+			stmt:     "CREATE MATERIALIZED VIEW db.mv UUID 'a3a5f0d2-1b2c-4d5e-8f90-123456789abc' TO INNER UUID 'c3a5f0d2-1b2c-4d5e-8f90-123456789abc' (`id` UInt64) ENGINE = MergeTree ORDER BY id AS SELECT id FROM db.t",
+			expected: "CREATE MATERIALIZED VIEW db.mv (`id` UInt64) ENGINE = MergeTree ORDER BY id AS SELECT id FROM db.t",
+		},
+		"without uuid": {
+			stmt:     "CREATE TABLE db.t (`id` UInt64) ENGINE = Log",
+			expected: "CREATE TABLE db.t (`id` UInt64) ENGINE = Log",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expected, stripUUID(tc.stmt))
+		})
+	}
+}
+
+func TestStripSettings(t *testing.T) {
+	strip := func(key string) bool { return key == "cache_populated_by_fetch" || key == "storage_policy" }
+	cases := map[string]struct {
+		stmt     string
+		expected string
+		removed  []string
+	}{
+		"middle key": {
+			stmt:     "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192, cache_populated_by_fetch = 1, min_bytes_for_wide_part = 0",
+			expected: "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192, min_bytes_for_wide_part = 0",
+			removed:  []string{"cache_populated_by_fetch"},
+		},
+		"only key drops the clause, comment stays": {
+			stmt:     "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS cache_populated_by_fetch = 1 COMMENT 'SETTINGS storage_policy = 1, x'",
+			expected: "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id COMMENT 'SETTINGS storage_policy = 1, x'",
+			removed:  []string{"cache_populated_by_fetch"},
+		},
+		"string values with commas": {
+			stmt:     "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'hot,cold', index_granularity = 8192",
+			expected: "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192",
+			removed:  []string{"storage_policy"},
+		},
+		"column settings and codecs are kept": {
+			stmt:     "CREATE TABLE db.t (`id` UInt64, `s` String CODEC(ZSTD(1)) SETTINGS (storage_policy = 1)) ENGINE = ReplicatedMergeTree('/clickhouse/{shard}', '{replica}') ORDER BY id SETTINGS storage_policy = 'default'",
+			expected: "CREATE TABLE db.t (`id` UInt64, `s` String CODEC(ZSTD(1)) SETTINGS (storage_policy = 1)) ENGINE = ReplicatedMergeTree('/clickhouse/{shard}', '{replica}') ORDER BY id",
+			removed:  []string{"storage_policy"},
+		},
+		"materialized view select settings are kept": {
+			stmt:     "CREATE MATERIALIZED VIEW db.mv (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS cache_populated_by_fetch = 1, index_granularity = 8192 AS SELECT id FROM db.t SETTINGS storage_policy = 1",
+			expected: "CREATE MATERIALIZED VIEW db.mv (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192 AS SELECT id FROM db.t SETTINGS storage_policy = 1",
+			removed:  []string{"cache_populated_by_fetch"},
+		},
+		"view without engine": {
+			stmt:     "CREATE VIEW db.v (`id` UInt64) AS SELECT id FROM db.t SETTINGS storage_policy = 1",
+			expected: "CREATE VIEW db.v (`id` UInt64) AS SELECT id FROM db.t SETTINGS storage_policy = 1",
+		},
+		"database": {
+			stmt:     "CREATE DATABASE db\nENGINE = Replicated('/clickhouse/db', '{shard}', '{replica}')\nSETTINGS cache_populated_by_fetch = 1\n",
+			expected: "CREATE DATABASE db\nENGINE = Replicated('/clickhouse/db', '{shard}', '{replica}')\n",
+			removed:  []string{"cache_populated_by_fetch"},
+		},
+		"no settings": {
+			stmt:     "CREATE TABLE db.t (`id` UInt64) ENGINE = Log",
+			expected: "CREATE TABLE db.t (`id` UInt64) ENGINE = Log",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			stmt, removed := stripSettings(tc.stmt, strip)
+			require.Equal(t, tc.expected, stmt)
+			require.Equal(t, tc.removed, removed)
+		})
+	}
+
+	stmt, removed := stripSettings("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192, `storage_policy` = 'default';", func(string) bool { return true })
+	require.Equal(t, "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id;", stmt)
+	require.Equal(t, []string{"index_granularity", "storage_policy"}, removed)
+}
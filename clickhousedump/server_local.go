@@ -0,0 +1,112 @@
+package clickhousedump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// serverLocalFile reports whether ClickHouse reads a data file itself with --server-local-restore.
+// SQLInsert files keep the statement restore, their statements are split, rewritten and resumed
+// one by one and no input format of the server reads them.
+func (r *Restorer) serverLocalFile(format string) bool {
+	return r.serverLocal && (format == DataFormatNative || format == DataFormatParquet)
+}
+
+// serverLocalPath returns the absolute path of a file storage file, the path ClickHouse opens.
+func (r *Restorer) serverLocalPath(file string) (string, error) {
+	base := r.config.StorageConfig["path"]
+	if !strings.HasPrefix(file, base) {
+		file = filepath.Join(base, file)
+	}
+	return filepath.Abs(file)
+}
+
+// checkServerLocalRestore sets whether data files are read by ClickHouse with
+// --server-local-restore. The server must see the storage path under the same absolute path and
+// be allowed to read it with the file table function: inside its user_files_path, with the FILE
+// grant. The columns of the first Native or Parquet data file are read as a probe, when that
+// fails a warning is logged and all data is streamed over HTTP. Files aren't retried over HTTP
+// one by one, an INSERT failing midway may have written rows already.
+func (r *Restorer) checkServerLocalRestore(ctx context.Context, dataFiles []string, dataFormats map[string]string) {
+	r.serverLocal = false
+	if !r.config.ServerLocalRestore {
+		return
+	}
+	for _, file := range dataFiles {
+		format := dataFormats[file]
+		if format != DataFormatNative && format != DataFormatParquet {
+			continue
+		}
+		if _, err := r.serverLocalColumns(ctx, file, format); err != nil {
+			logging.Warnf("--server-local-restore disabled, ClickHouse can't read %s: %v. Data is streamed over HTTP, the storage path must be inside the user_files_path of the server and readable with the FILE grant", file, err)
+			return
+		}
+		r.serverLocal = true
+		logging.Infof("Native and Parquet data files are read by ClickHouse from %s", r.config.StorageConfig["path"])
+		return
+	}
+	logging.Infof("--server-local-restore reads Native and Parquet data files only, restoring the data over HTTP")
+}
+
+// serverLocalColumns returns the column names of a data file as ClickHouse reads it.
+func (r *Restorer) serverLocalColumns(ctx context.Context, file, format string) ([]string, error) {
+	localPath, err := r.serverLocalPath(file)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("DESCRIBE TABLE file(%s, %s) FORMAT JSONEachRow", quoteString(localPath), quoteString(format))
+	resp, err := r.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	scanner := bufio.NewScanner(bytes.NewReader(resp))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var column struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &column); err != nil {
+			return nil, fmt.Errorf("failed to parse columns: %w", err)
+		}
+		columns = append(columns, column.Name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse columns: %w", err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns in %s", localPath)
+	}
+	return columns, nil
+}
+
+// restoreServerLocal inserts a data file with INSERT ... SELECT FROM file(), ClickHouse reads it
+// from its disk and decompresses it by the .gz or .zstd extension. Columns are inserted by name
+// like the HTTP restore, columns left out of the dump with --exclude-columns get their defaults.
+func (r *Restorer) restoreServerLocal(ctx context.Context, file, format string) error {
+	columns, err := r.serverLocalColumns(ctx, file, format)
+	if err != nil {
+		return fmt.Errorf("failed to read columns: %w", err)
+	}
+	localPath, err := r.serverLocalPath(file)
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = "`" + strings.ReplaceAll(column, "`", "\\`") + "`"
+	}
+	dbName, tableName := r.layout.dataTable(file, format)
+	list := strings.Join(quoted, ", ")
+	query := fmt.Sprintf("INSERT INTO `%s`.`%s` (%s) SELECT %s FROM file(%s, %s)", dbName, tableName, list, list, quoteString(localPath), quoteString(format))
+	r.debugf("Executing %s", query)
+	_, err = r.client.ExecuteQuery(ctx, query)
+	return err
+}
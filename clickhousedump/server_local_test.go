@@ -0,0 +1,71 @@
+package clickhousedump
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerLocalRestore(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	var inserts []string
+	readable := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		query := string(body)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(query, "DESCRIBE TABLE file("):
+			require.Contains(t, query, "'"+filepath.Join(dir, "backup1/shop/users.data.native.zstd")+"'")
+			if !readable {
+				http.Error(w, "Code: 291. DB::Exception: File is not inside /var/lib/clickhouse/user_files. (DATABASE_ACCESS_DENIED)", http.StatusForbidden)
+				return
+			}
+			_, _ = io.WriteString(w, `{"name":"id","type":"UInt64"}`+"\n"+`{"name":"na`+"`"+`me","type":"String"}`+"\n")
+		case strings.HasPrefix(query, "INSERT INTO"):
+			inserts = append(inserts, query)
+		default:
+			t.Errorf("unexpected query %s", query)
+		}
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	config := &Config{Host: host, Port: port, ServerLocalRestore: true, StorageConfig: map[string]string{"path": dir}}
+	r := &Restorer{config: config, client: NewClickHouseClient(config)}
+
+	dataFiles := []string{"backup1/shop/orders.data.sql.gz", "backup1/shop/users.data.native.zstd"}
+	dataFormats := map[string]string{dataFiles[0]: DataFormatSQLInsert, dataFiles[1]: DataFormatNative}
+	r.checkServerLocalRestore(context.Background(), dataFiles, dataFormats)
+	require.True(t, r.serverLocal)
+	require.False(t, r.serverLocalFile(DataFormatSQLInsert), "SQLInsert files are restored over HTTP")
+	require.True(t, r.serverLocalFile(DataFormatNative))
+
+	require.NoError(t, r.restoreServerLocal(context.Background(), dataFiles[1], DataFormatNative))
+	require.Equal(t, []string{
+		"INSERT INTO `shop`.`users` (`id`, `na\\`me`) SELECT `id`, `na\\`me` FROM file('" + filepath.Join(dir, "backup1/shop/users.data.native.zstd") + "', 'Native')",
+	}, inserts)
+
+	// The server can't read the storage path, the data is streamed over HTTP
+	readable = false
+	r.checkServerLocalRestore(context.Background(), dataFiles, dataFormats)
+	require.False(t, r.serverLocal)
+	require.False(t, r.serverLocalFile(DataFormatNative))
+
+	// Backups without Native or Parquet files aren't probed
+	r.checkServerLocalRestore(context.Background(), dataFiles[:1], dataFormats)
+	require.False(t, r.serverLocal)
+}
@@ -0,0 +1,91 @@
+package clickhousedump
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slowestItemsInSummary is the number of slowest tables listed in the timing summary.
+const slowestItemsInSummary = 5
+
+type phaseDuration struct {
+	name     string
+	duration time.Duration
+}
+
+// phaseTimer records the wall-clock time of dump and restore phases and of the tables
+// processed in them, it is safe for use by parallel workers.
+type phaseTimer struct {
+	start time.Time
+
+	mu     sync.Mutex
+	phases []phaseDuration
+	items  map[string]time.Duration
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now(), items: make(map[string]time.Duration)}
+}
+
+// phase starts timing the named phase, the returned function stops it.
+func (t *phaseTimer) phase(name string) func() {
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.phases = append(t.phases, phaseDuration{name: name, duration: time.Since(start)})
+	}
+}
+
+// item adds the time spent on item, e.g. a table, times of several files of one table add up.
+func (t *phaseTimer) item(name string, duration time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.items[name] += duration
+}
+
+// summary returns the phase times and the total like "schema: 4s, data: 5m12s, total: 5m18s",
+// followed by the slowest tables.
+func (t *phaseTimer) summary() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, 0, len(t.phases)+1)
+	for _, p := range t.phases {
+		parts = append(parts, fmt.Sprintf("%s: %s", p.name, roundDuration(p.duration)))
+	}
+	parts = append(parts, fmt.Sprintf("total: %s", roundDuration(time.Since(t.start))))
+	result := strings.Join(parts, ", ")
+
+	names := make([]string, 0, len(t.items))
+	for name := range t.items {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if t.items[names[i]] != t.items[names[j]] {
+			return t.items[names[i]] > t.items[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > slowestItemsInSummary {
+		names = names[:slowestItemsInSummary]
+	}
+	if len(names) > 0 {
+		slowest := make([]string, 0, len(names))
+		for _, name := range names {
+			slowest = append(slowest, fmt.Sprintf("%s %s", name, roundDuration(t.items[name])))
+		}
+		result += "; slowest tables: " + strings.Join(slowest, ", ")
+	}
+	return result
+}
+
+// roundDuration rounds to seconds, or to milliseconds below one second.
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
@@ -0,0 +1,28 @@
+package clickhousedump
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhaseTimerSummary(t *testing.T) {
+	timer := newPhaseTimer()
+	timer.start = time.Now().Add(-318 * time.Second)
+	timer.phases = []phaseDuration{{name: "schema", duration: 4200 * time.Millisecond}, {name: "data", duration: 312 * time.Second}}
+	for i, name := range []string{"db.a", "db.b", "db.c", "db.d", "db.e", "db.f"} {
+		timer.item(name, time.Duration(i+1)*time.Second)
+	}
+	timer.item("db.a", 10*time.Second)
+	require.Equal(t, "schema: 4s, data: 5m12s, total: 5m18s; slowest tables: db.a 11s, db.f 6s, db.e 5s, db.d 4s, db.c 3s", timer.summary())
+}
+
+func TestPhaseTimerPhase(t *testing.T) {
+	timer := newPhaseTimer()
+	stop := timer.phase("schema")
+	stop()
+	require.Len(t, timer.phases, 1)
+	require.Equal(t, "schema", timer.phases[0].name)
+	require.Regexp(t, `^schema: \S+, total: \S+$`, timer.summary())
+}
@@ -0,0 +1,46 @@
+package clickhousedump
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Slach/clickhouse-dump/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyDumpedFiles(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage, err := storage.NewFileStorage(dir, false)
+	require.NoError(t, err)
+	config := &Config{StorageType: "file", StorageConfig: map[string]string{"path": ""}, BackupName: "b1", Parallel: 2, VerifyAfterDump: true, CompressLevel: 3}
+	d := &Dumper{config: config, storage: fileStorage, timer: newPhaseTimer()}
+	content := strings.Repeat("INSERT INTO `db`.`t` VALUES (1, 'row');\n", 10000)
+	for _, file := range []struct{ name, format string }{
+		{"db/t.data.sql", "gzip"},
+		{"db/u.data.sql", "zstd"},
+		{"db/t.schema.sql", "none"},
+	} {
+		require.NoError(t, d.upload("b1/"+file.name, strings.NewReader(content), "", file.format, ManifestFile{}))
+	}
+	require.NoError(t, d.verifyDumpedFiles(context.Background()))
+
+	// Truncated compressed streams fail the verification and are named
+	for _, name := range []string{"t.data.sql.gz", "u.data.sql.zstd"} {
+		stored := filepath.Join(dir, "b1", "db", name)
+		data, err := os.ReadFile(stored)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(stored, data[:len(data)/2], 0o644))
+	}
+	err = d.verifyDumpedFiles(context.Background())
+	var partial *PartialFailureError
+	require.ErrorAs(t, err, &partial)
+	require.ErrorContains(t, err, "b1/db/t.data.sql.gz")
+	require.ErrorContains(t, err, "b1/db/u.data.sql.zstd")
+	require.NotContains(t, err.Error(), "t.schema.sql")
+
+	config.VerifyAfterDump = false
+	require.NoError(t, d.verifyDumpedFiles(context.Background()))
+}
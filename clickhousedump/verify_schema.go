@@ -0,0 +1,88 @@
+package clickhousedump
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// verifySchemas compares the create_table_query of the restored tables with their schema files,
+// ignoring whitespace, comments and UUIDs, see --verify-schema. Differences, e.g. settings removed
+// by --strip-settings or engines rewritten by an older server, are logged as warnings and
+// returned as an error with --verify-schema-strict. schemas maps schema files to their content.
+func (r *Restorer) verifySchemas(ctx context.Context, schemas map[string]string) error {
+	if len(schemas) == 0 {
+		return nil
+	}
+	expected := make(map[string]schemaDefinition, len(schemas))
+	databases := make(map[string]bool)
+	for sf, content := range schemas {
+		db, table := r.layout.schemaTable(sf)
+		expected[db+"."+table] = newSchemaDefinition(content)
+		databases[db] = true
+	}
+	quoted := make([]string, 0, len(databases))
+	for db := range databases {
+		quoted = append(quoted, quoteString(db))
+	}
+	sort.Strings(quoted)
+
+	query := fmt.Sprintf("SELECT database, name, create_table_query FROM system.tables WHERE database IN (%s) SETTINGS format_display_secrets_in_show_and_select=1 FORMAT JSONEachRow", strings.Join(quoted, ", "))
+	resp, err := r.client.ExecuteQuery(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to read restored schemas for --verify-schema: %w", err)
+	}
+	live := make(map[string]schemaDefinition)
+	scanner := bufio.NewScanner(bytes.NewReader(resp))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var row struct {
+			Database         string `json:"database"`
+			Name             string `json:"name"`
+			CreateTableQuery string `json:"create_table_query"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("failed to parse restored schemas for --verify-schema: %w", err)
+		}
+		live[row.Database+"."+row.Name] = newSchemaDefinition(row.CreateTableQuery)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse restored schemas for --verify-schema: %w", err)
+	}
+
+	tables := make([]string, 0, len(expected))
+	for table := range expected {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	var mismatched []string
+	for _, table := range tables {
+		want := expected[table]
+		got, ok := live[table]
+		switch {
+		case !ok:
+			logging.Warnf("--verify-schema: table %s is missing after restore", table)
+		case got.key != want.key:
+			var diff strings.Builder
+			writeColumnDiff(&diff, want, got)
+			logging.Warnf("--verify-schema: restored schema of %s differs from the backup:\n%s", table, strings.TrimRight(diff.String(), "\n"))
+		default:
+			continue
+		}
+		mismatched = append(mismatched, table)
+	}
+	if len(mismatched) == 0 {
+		logging.Infof("--verify-schema: %d restored schemas match the backup", len(tables))
+		return nil
+	}
+	if r.config.VerifySchemaStrict {
+		return &PartialFailureError{Err: fmt.Errorf("%d of %d restored schemas differ from the backup: %s", len(mismatched), len(tables), strings.Join(mismatched, ", "))}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package clickhousedump
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySchemas(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		queries = append(queries, string(body))
+		_, _ = io.WriteString(w, "{\"database\":\"db\",\"name\":\"same\",\"create_table_query\":\"CREATE TABLE db.same UUID '11111111-1111-1111-1111-111111111111' (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192\"}\n")
+		_, _ = io.WriteString(w, "{\"database\":\"db\",\"name\":\"stripped\",\"create_table_query\":\"CREATE TABLE db.stripped (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192\"}\n")
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	config := &Config{Host: host, Port: port}
+	r := &Restorer{config: config, client: NewClickHouseClient(config)}
+	schemas := map[string]string{
+		"backups/b1/db/same.schema.sql":     "CREATE TABLE db.same\n(\n    `id` UInt64\n)\nENGINE = MergeTree\nORDER BY id\nSETTINGS index_granularity = 8192",
+		"backups/b1/db/stripped.schema.sql": "CREATE TABLE db.stripped (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192, storage_policy = 'tiered'",
+		"backups/b1/db/missing.schema.sql":  "CREATE TABLE db.missing (id UInt64) ENGINE = Log",
+	}
+
+	// Whitespace and UUIDs are ignored, differences are warnings by default
+	require.NoError(t, r.verifySchemas(context.Background(), schemas))
+	require.Len(t, queries, 1)
+	require.Contains(t, queries[0], "WHERE database IN ('db')")
+
+	config.VerifySchemaStrict = true
+	err = r.verifySchemas(context.Background(), schemas)
+	var partial *PartialFailureError
+	require.True(t, errors.As(err, &partial))
+	require.Contains(t, err.Error(), "2 of 3 restored schemas differ from the backup: db.missing, db.stripped")
+
+	delete(schemas, "backups/b1/db/stripped.schema.sql")
+	delete(schemas, "backups/b1/db/missing.schema.sql")
+	require.NoError(t, r.verifySchemas(context.Background(), schemas))
+}
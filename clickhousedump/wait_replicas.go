@@ -0,0 +1,83 @@
+package clickhousedump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// waitReplicasPollInterval is how often the distributed DDL queue is polled by --wait-replicas.
+var waitReplicasPollInterval = time.Second
+
+// waitReplicas waits up to --wait-replicas until the ON CLUSTER queries queued since Restore
+// started, e.g. by --pre-restore-sql, are finished on all hosts and the restored Replicated
+// databases have applied their DDL on this replica, so data inserted next, e.g. through
+// Distributed tables, doesn't reach replicas which don't have the tables yet.
+func (r *Restorer) waitReplicas(ctx context.Context, dbFiles []string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.config.WaitReplicas)
+	defer cancel()
+	logging.Infof("Waiting up to %s for the distributed DDL queue and Replicated databases", r.config.WaitReplicas)
+	if err := r.waitDistributedDDL(ctx); err != nil {
+		return err
+	}
+
+	quoted := make([]string, 0, len(dbFiles))
+	for _, file := range dbFiles {
+		quoted = append(quoted, quoteString(strings.TrimSuffix(path.Base(trimCompressionExt(file)), ".database.sql")))
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	resp, err := r.client.ExecuteQuery(ctx, fmt.Sprintf("SELECT name FROM system.databases WHERE engine = 'Replicated' AND name IN (%s) ORDER BY name FORMAT TSVRaw", strings.Join(quoted, ", ")))
+	if err != nil {
+		return fmt.Errorf("--wait-replicas: failed to list Replicated databases: %w", err)
+	}
+	for _, db := range strings.Fields(string(resp)) {
+		r.debugf("Syncing Replicated database %s", db)
+		if _, err := r.client.ExecuteQuery(ctx, fmt.Sprintf("SYSTEM SYNC DATABASE REPLICA `%s`", db)); err != nil {
+			return r.waitReplicasError(ctx, fmt.Errorf("SYSTEM SYNC DATABASE REPLICA %s failed: %w", db, err))
+		}
+	}
+	return nil
+}
+
+// waitDistributedDDL polls system.distributed_ddl_queue until the entries created since Restore
+// started are finished on every host.
+func (r *Restorer) waitDistributedDDL(ctx context.Context) error {
+	for {
+		// Measured on the server, so clock skew doesn't matter
+		since := int64(time.Since(r.started).Seconds()) + 1
+		resp, err := r.client.ExecuteQuery(ctx, fmt.Sprintf("SELECT count() FROM system.distributed_ddl_queue WHERE status != 'Finished' AND query_create_time >= now() - INTERVAL %d SECOND FORMAT TSVRaw", since))
+		if err != nil {
+			return r.waitReplicasError(ctx, fmt.Errorf("failed to read system.distributed_ddl_queue: %w", err))
+		}
+		pending, err := strconv.Atoi(strings.TrimSpace(string(resp)))
+		if err != nil {
+			return fmt.Errorf("--wait-replicas: unexpected system.distributed_ddl_queue count %q: %w", resp, err)
+		}
+		if pending == 0 {
+			return nil
+		}
+		r.debugf("%d distributed DDL queue entries are not finished yet", pending)
+		select {
+		case <-ctx.Done():
+			return r.waitReplicasError(ctx, fmt.Errorf("%d distributed DDL queue entries are not finished", pending))
+		case <-time.After(waitReplicasPollInterval):
+		}
+	}
+}
+
+// waitReplicasError names the timeout when ctx expired, queries cancelled by it fail with
+// unrelated errors.
+func (r *Restorer) waitReplicasError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("--wait-replicas: replicas are not in sync after %s: %w", r.config.WaitReplicas, err)
+	}
+	return fmt.Errorf("--wait-replicas: %w", err)
+}
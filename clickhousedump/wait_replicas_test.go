@@ -0,0 +1,59 @@
+package clickhousedump
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitReplicas(t *testing.T) {
+	waitReplicasPollInterval = 10 * time.Millisecond
+	var pending atomic.Int32
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		query := string(body)
+		switch {
+		case strings.Contains(query, "system.distributed_ddl_queue"):
+			require.Contains(t, query, "query_create_time >= now() - INTERVAL")
+			_, _ = io.WriteString(w, strconv.Itoa(int(max(pending.Add(-1), 0))))
+			return
+		case strings.Contains(query, "system.databases"):
+			require.Contains(t, query, "name IN ('db1', 'db2')")
+			_, _ = io.WriteString(w, "db2\n")
+		}
+		queries = append(queries, query)
+	}))
+	defer server.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	config := &Config{Host: host, Port: port, WaitReplicas: time.Minute}
+	r := &Restorer{config: config, client: NewClickHouseClient(config), started: time.Now()}
+	dbFiles := []string{"backups/b1/db1.database.sql", "backups/b1/db2.database.sql.gz"}
+
+	// Polls until the queue drains, then syncs the Replicated databases only
+	pending.Store(3)
+	require.NoError(t, r.waitReplicas(context.Background(), dbFiles))
+	require.Equal(t, []string{
+		"SELECT name FROM system.databases WHERE engine = 'Replicated' AND name IN ('db1', 'db2') ORDER BY name FORMAT TSVRaw",
+		"SYSTEM SYNC DATABASE REPLICA `db2`",
+	}, queries)
+
+	// A queue which doesn't drain in time fails the restore
+	config.WaitReplicas = 50 * time.Millisecond
+	pending.Store(1000)
+	err = r.waitReplicas(context.Background(), dbFiles)
+	require.ErrorContains(t, err, "--wait-replicas: replicas are not in sync after 50ms")
+}
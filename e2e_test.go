@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/Slach/clickhouse-dump/storage"
 
+	"github.com/klauspost/compress/gzip"
 	"github.com/moby/moby/api/types/container"
 	"github.com/moby/moby/api/types/network"
 	"github.com/stretchr/testify/require"
@@ -95,6 +97,1368 @@ func TestE2E(t *testing.T) {
 	}
 }
 
+// TestE2ERestoreMaxQuerySize dumps a table with a batch size large enough to put all rows
+// into one INSERT and checks that restore splits it when the statement exceeds --restore-max-query-size.
+func TestE2ERestoreMaxQuerySize(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE IF NOT EXISTS big_batch_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE big_batch_db.wide (id UInt32, payload String) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO big_batch_db.wide SELECT number, repeat('x', 100) FROM numbers(20000)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	tempDir := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^big_batch_db$",
+		"--batch-size=10000000",
+		"--compress-format=gzip",
+		"--restore-max-query-size=65536",
+		"--storage-type=file",
+		"--storage-path=" + tempDir,
+	}
+
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "big_batch")))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE big_batch_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "big_batch")))
+
+	count, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(id) FROM big_batch_db.wide")
+	require.NoError(t, err)
+	require.Equal(t, "20000\t199990000\n", count)
+}
+
+// TestE2EChunkedDump checks that the union of --chunk-rows chunks equals the full table,
+// including duplicate rows in a table without a sorting key.
+func TestE2EChunkedDump(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE IF NOT EXISTS chunk_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE chunk_db.log_table (id UInt32, name String) ENGINE = Log"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO chunk_db.log_table SELECT number % 700, toString(number % 7) FROM numbers(1000)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE chunk_db.mt_table (id UInt32, name String) ENGINE = MergeTree() ORDER BY name"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO chunk_db.mt_table SELECT number, toString(number % 3) FROM numbers(1000)"))
+
+	checksumQuery := "SELECT count(), sum(cityHash64(*)) FROM chunk_db.%s"
+	expected := map[string]string{}
+	for _, table := range []string{"log_table", "mt_table"} {
+		expected[table], err = executeTestQueryWithResult(ctx, t, clickhouseContainer, fmt.Sprintf(checksumQuery, table))
+		require.NoError(t, err)
+	}
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	tempDir := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^chunk_db$",
+		"--chunk-rows=300",
+		"--parallel=2",
+		"--storage-type=file",
+		"--storage-path=" + tempDir,
+	}
+
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "chunked")))
+
+	fileStorage, err := storage.NewFileStorage(tempDir, false)
+	require.NoError(t, err)
+	files, err := fileStorage.List("chunked", true)
+	require.NoError(t, err)
+	chunkFiles := 0
+	for _, file := range files {
+		if strings.Contains(file, ".chunk") {
+			chunkFiles++
+		}
+	}
+	require.Equal(t, 8, chunkFiles, "expected 4 chunks per table, got files %v", files)
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE chunk_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "chunked")))
+
+	for table, checksum := range expected {
+		restored, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, fmt.Sprintf(checksumQuery, table))
+		require.NoError(t, err)
+		require.Equal(t, checksum, restored, "table %s differs after chunked dump and restore", table)
+	}
+}
+
+// TestE2ESkipDataEngines checks that tables with --skip-data-engines engines are dumped as schema only.
+func TestE2ESkipDataEngines(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE IF NOT EXISTS engines_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE engines_db.local (id UInt32) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO engines_db.local SELECT number FROM numbers(100)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE engines_db.dist AS engines_db.local ENGINE = Distributed('default', 'engines_db', 'local')"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE VIEW engines_db.v AS SELECT id FROM engines_db.local"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	tempDir := t.TempDir()
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, []string{
+		"clickhouse-dump", "dump",
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^engines_db$",
+		"--storage-type=file",
+		"--storage-path=" + tempDir,
+		"engines",
+	}))
+
+	fileStorage, err := storage.NewFileStorage(tempDir, false)
+	require.NoError(t, err)
+	files, err := fileStorage.List("engines", true)
+	require.NoError(t, err)
+	var dataFiles, schemaFiles []string
+	for _, file := range files {
+		if strings.Contains(file, ".data.sql") {
+			dataFiles = append(dataFiles, file)
+		} else if strings.Contains(file, ".schema.sql") {
+			schemaFiles = append(schemaFiles, file)
+		}
+	}
+	require.Len(t, schemaFiles, 3, "expected schema of every table, got files %v", files)
+	require.Len(t, dataFiles, 1, "expected data of the MergeTree table only, got files %v", files)
+	require.Contains(t, dataFiles[0], "local.data.sql")
+}
+
+// TestE2EExcludeColumns checks that --exclude-columns columns are left out of the data and get defaults on restore.
+func TestE2EExcludeColumns(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE IF NOT EXISTS columns_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE columns_db.events (id UInt32, payload String DEFAULT 'dropped', doubled UInt64 MATERIALIZED id * 2) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO columns_db.events (id, payload) SELECT number, repeat('x', 100) FROM numbers(100)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^columns_db$",
+		"--exclude-columns=^columns_db.events.payload$",
+		"--storage-type=file",
+		"--storage-path=" + t.TempDir(),
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "columns")))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE columns_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "columns")))
+
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(id), uniqExact(payload), any(payload), sum(doubled) FROM columns_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "100\t4950\t1\tdropped\t9900\n", result)
+}
+
+// TestE2EFTPDownloadEarlyClose checks that closing an FTP download before EOF releases the connection.
+func TestE2EFTPDownloadEarlyClose(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ftpContainer, err := startFTPContainer(ctx, t, fmt.Sprintf("ftp-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start FTP container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, ftpContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, FTP container continue running."))
+		}
+	}()
+	ftpHost, err := ftpContainer.Host(ctx)
+	require.NoError(t, err, "Failed to get FTP host")
+	ftpPort, err := ftpContainer.MappedPort(ctx, "21/tcp")
+	require.NoError(t, err, "Failed to get FTP port")
+
+	ftpStorage, err := storage.NewFTPStorage(ftpHost+":"+ftpPort.Port(), "testuser", "testpass", false)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, ftpStorage.Close())
+	}()
+
+	content := strings.Repeat("INSERT INTO t VALUES (1, 'early close');\n", 200000)
+	require.NoError(t, ftpStorage.Upload("early_close/t.data.sql", strings.NewReader(content), "gzip", 1, ""))
+
+	compressed := "early_close/t.data.sql.gz"
+	reader, err := ftpStorage.Download(compressed)
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+
+	closed := make(chan error, 1)
+	go func() { closed <- reader.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(30 * time.Second):
+		t.Fatal("closing a partially read FTP download blocked")
+	}
+
+	files, err := ftpStorage.List("early_close", true)
+	require.NoError(t, err, "FTP connection is not reusable after early close")
+	require.Equal(t, []string{compressed}, files)
+
+	reader, err = ftpStorage.Download(compressed)
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, content, string(data))
+}
+
+// TestE2EDataFormats checks dump and restore with Native and Parquet data files.
+func TestE2EDataFormats(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	for _, format := range []string{"Native", "Parquet"} {
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE IF NOT EXISTS format_db"))
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE format_db.wide (id UInt64, name String, tags Array(String), price Decimal(18, 4), created DateTime) ENGINE = MergeTree() ORDER BY id"))
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO format_db.wide SELECT number, concat('name; ', toString(number)), [toString(number % 3)], number / 7, toDateTime('2024-01-01 00:00:00') + number FROM numbers(5000)"))
+		expected, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(cityHash64(*)) FROM format_db.wide")
+		require.NoError(t, err)
+
+		tempDir := t.TempDir()
+		flags := []string{
+			"--host=" + host,
+			"--port=" + port.Port(),
+			"--databases=^format_db$",
+			"--data-format=" + format,
+			"--chunk-rows=2000",
+			"--storage-type=file",
+			"--storage-path=" + tempDir,
+		}
+		app := newCLIApp()
+		require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "formats")))
+
+		fileStorage, err := storage.NewFileStorage(tempDir, false)
+		require.NoError(t, err)
+		files, err := fileStorage.List("formats", true)
+		require.NoError(t, err)
+		suffix := ".data." + strings.ToLower(format)
+		dataFiles := 0
+		for _, file := range files {
+			if strings.Contains(file, suffix) {
+				dataFiles++
+			}
+		}
+		require.Equal(t, 3, dataFiles, "expected 3 %s chunks, got files %v", format, files)
+
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE format_db SYNC"))
+		require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "formats")))
+
+		restored, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(cityHash64(*)) FROM format_db.wide")
+		require.NoError(t, err)
+		require.Equal(t, expected, restored, "format_db.wide differs after %s dump and restore", format)
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE format_db SYNC"))
+	}
+}
+
+// BenchmarkE2ES3PartSize compares multipart upload throughput to MinIO at different --s3-part-size values.
+func BenchmarkE2ES3PartSize(b *testing.B) {
+	ctx := context.Background()
+	minioContainer, err := startMinioContainer(ctx, fmt.Sprintf("minio-%s-%d", b.Name(), time.Now().UnixNano()))
+	require.NoError(b, err, "Failed to start Minio container")
+	defer func() {
+		require.NoError(b, minioContainer.Terminate(ctx))
+	}()
+	minioHost, err := minioContainer.Host(ctx)
+	require.NoError(b, err, "Failed to get Minio host")
+	minioPort, err := minioContainer.MappedPort(ctx, "9000/tcp")
+	require.NoError(b, err, "Failed to get Minio port")
+
+	const fileSize = 128 * 1024 * 1024
+	data := make([]byte, fileSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for _, partSize := range []int64{5, 16, 64} {
+		b.Run(fmt.Sprintf("part_size_%dMB", partSize), func(b *testing.B) {
+			s3Storage, err := storage.NewS3Storage("clickhouse", "us-east-1", "minio_secret", "minio_secret", "http://"+minioHost+":"+minioPort.Port(), storage.S3Options{
+				PartSize:          partSize * 1024 * 1024,
+				UploadConcurrency: 5,
+			}, false)
+			require.NoError(b, err)
+			defer func() {
+				require.NoError(b, s3Storage.Close())
+			}()
+			b.SetBytes(fileSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := s3Storage.Upload(fmt.Sprintf("bench/part_size_%d/%d.bin", partSize, i), bytes.NewReader(data), "none", 0, "")
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// TestE2EDatabaseEngines checks that Atomic and Lazy databases are restored with their ENGINE clause,
+// Replicated needs Keeper and is covered by TestCreateDatabaseIfNotExists only.
+func TestE2EDatabaseEngines(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE engines_atomic ENGINE = Atomic"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE engines_lazy ENGINE = Lazy(3600)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE engines_atomic.t (id UInt32) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE engines_lazy.t (id UInt32) ENGINE = Log"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO engines_atomic.t SELECT number FROM numbers(10)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO engines_lazy.t SELECT number FROM numbers(10)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^engines_",
+		"--storage-type=file",
+		"--storage-path=" + t.TempDir(),
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "engines")))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE engines_atomic SYNC"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE engines_lazy SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--strip-uuid"}, flags...), "engines")))
+
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT name, engine_full FROM system.databases WHERE name LIKE 'engines_%' ORDER BY name")
+	require.NoError(t, err)
+	require.Equal(t, "engines_atomic\tAtomic\nengines_lazy\tLazy(3600)\n", result)
+	result, err = executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT (SELECT count() FROM engines_atomic.t), (SELECT count() FROM engines_lazy.t)")
+	require.NoError(t, err)
+	require.Equal(t, "10\t10\n", result)
+}
+
+func TestE2EIncludeFunctions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE FUNCTION udf_linear AS (x, k, b) -> k * x + b"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE udf_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE udf_db.t (id UInt32, y UInt32 DEFAULT udf_linear(id, 2, 1)) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE VIEW udf_db.v AS SELECT udf_linear(id, 3, 0) AS z FROM udf_db.t"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO udf_db.t (id) SELECT number FROM numbers(10)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^udf_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--include-functions"}, flags...), "udf")))
+	require.FileExists(t, filepath.Join(storagePath, "udf", "functions", "udf_linear.sql.gz"))
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE udf_db SYNC"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP FUNCTION udf_linear"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "udf")))
+
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT sum(y), (SELECT sum(z) FROM udf_db.v) FROM udf_db.t")
+	require.NoError(t, err)
+	require.Equal(t, "100\t135\n", result)
+}
+
+func TestE2ESQLHooks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE hooks_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE hooks_db.t (id UInt32) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO hooks_db.t SELECT number FROM numbers(10)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^hooks_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump",
+		"--pre-dump-sql=SYSTEM STOP MERGES hooks_db.t; CREATE TABLE default.hook_log (event String) ENGINE = Memory",
+		"--post-dump-sql=SYSTEM START MERGES hooks_db.t; INSERT INTO default.hook_log VALUES ('dumped')",
+	}, flags...), "hooks")))
+
+	hookFile := filepath.Join(t.TempDir(), "post_restore.sql")
+	require.NoError(t, os.WriteFile(hookFile, []byte("OPTIMIZE TABLE hooks_db.t FINAL;\nINSERT INTO default.hook_log VALUES ('restored');\n"), 0o644))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE hooks_db SYNC"))
+	require.Error(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--pre-restore-sql=SELECT throwIf(1)"}, flags...), "hooks")))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--pre-restore-sql=SELECT throwIf(1)", "--ignore-hook-errors", "--post-restore-sql=" + hookFile}, flags...), "hooks")))
+
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT (SELECT count() FROM hooks_db.t), groupArray(event) FROM (SELECT event FROM default.hook_log ORDER BY event)")
+	require.NoError(t, err)
+	require.Equal(t, "10\t['dumped','restored']\n", result)
+}
+
+func TestE2EFreeze(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE freeze_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE freeze_db.t (id UInt32) ENGINE = MergeTree() ORDER BY id PARTITION BY id % 2"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE freeze_db.m (id UInt32) ENGINE = Memory"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO freeze_db.t SELECT number FROM numbers(10)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO freeze_db.m SELECT number FROM numbers(5)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^freeze_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--freeze"}, flags...), "frozen")))
+
+	manifest, err := os.ReadFile(filepath.Join(storagePath, "frozen", "manifest.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(manifest), `"table": "freeze_db.t"`)
+	require.NotContains(t, string(manifest), `"table": "freeze_db.m"`)
+	require.Equal(t, 2, strings.Count(string(manifest), "shadow/clickhouse_dump_frozen/"))
+
+	// UNFREEZE removed the shadow copy, so freezing with the same name works again
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--freeze", "--overwrite"}, flags...), "frozen")))
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE freeze_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "frozen")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT (SELECT count() FROM freeze_db.t), (SELECT count() FROM freeze_db.m)")
+	require.NoError(t, err)
+	require.Equal(t, "10\t5\n", result)
+}
+
+func TestE2EDumpQueryFile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE dq_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE dq_db.users (id UInt32, deleted UInt8) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO dq_db.users SELECT number, number % 3 = 0 FROM numbers(30)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	queryFile := filepath.Join(t.TempDir(), "queries.txt")
+	require.NoError(t, os.WriteFile(queryFile, []byte("dq_db.users: SELECT * FROM dq_db.users WHERE deleted = 0 SETTINGS max_threads = 1\n"), 0o644))
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^dq_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--dump-query-file=" + queryFile}, flags...), "filtered")))
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE dq_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "filtered")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(deleted) FROM dq_db.users")
+	require.NoError(t, err)
+	require.Equal(t, "20\t0\n", result)
+}
+
+func TestE2EUncompressedRoundTrip(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE plain_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE plain_db.events (id UInt32, name String) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO plain_db.events SELECT number, toString(number) FROM numbers(1000)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^plain_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--compress-format=none"}, flags...), "plain")))
+
+	// Files are stored without a compression extension
+	for _, name := range []string{"plain_db.database.sql", "plain_db/events.schema.sql", "plain_db/events.data.sql"} {
+		_, err := os.Stat(filepath.Join(storagePath, "plain", name))
+		require.NoError(t, err, "expected uncompressed file %s", name)
+	}
+	data, err := os.ReadFile(filepath.Join(storagePath, "plain", "plain_db", "events.data.sql"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "INSERT INTO")
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE plain_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "plain")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(id) FROM plain_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "1000\t499500\n", result)
+}
+
+func TestE2EFinal(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE final_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE final_db.versions (id UInt32, version UInt32) ENGINE = ReplacingMergeTree(version) ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "SYSTEM STOP MERGES final_db.versions"))
+	// Every insert creates its own part, the duplicates of id stay until a merge
+	for version := 1; version <= 3; version++ {
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, fmt.Sprintf("INSERT INTO final_db.versions SELECT number, %d FROM numbers(10)", version)))
+	}
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^final_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--final"}, flags...), "merged")))
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE final_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "merged")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), min(version) FROM final_db.versions")
+	require.NoError(t, err)
+	require.Equal(t, "10\t3\n", result)
+}
+
+func TestE2EPerPhaseCompressFormat(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE mixed_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE mixed_db.events (id UInt32, name String) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO mixed_db.events SELECT number, toString(number) FROM numbers(1000)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^mixed_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--schema-compress-format=none", "--data-compress-format=zstd"}, flags...), "mixed")))
+
+	// Schemas stay readable, data is compressed
+	for _, name := range []string{"mixed_db.database.sql", "mixed_db/events.schema.sql", "mixed_db/events.data.sql.zstd"} {
+		_, err := os.Stat(filepath.Join(storagePath, "mixed", name))
+		require.NoError(t, err, "expected file %s", name)
+	}
+	schema, err := os.ReadFile(filepath.Join(storagePath, "mixed", "mixed_db", "events.schema.sql"))
+	require.NoError(t, err)
+	require.Contains(t, string(schema), "CREATE TABLE")
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE mixed_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "mixed")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(id) FROM mixed_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "1000\t499500\n", result)
+}
+
+func TestE2ECheck(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, []string{"clickhouse-dump", "check", "--host=" + host, "--port=" + port.Port(), "--storage-type=file", "--storage-path=" + storagePath}))
+	entries, err := os.ReadDir(storagePath)
+	require.NoError(t, err)
+	require.Empty(t, entries, "check deletes its test object")
+
+	notDir := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(notDir, []byte("x"), 0o644))
+	err = app.Run(ctx, []string{"clickhouse-dump", "check", "--host=" + host, "--port=" + port.Port(), "--storage-type=file", "--storage-path=" + notDir})
+	require.ErrorContains(t, err, "storage check failed")
+	require.Equal(t, exitConnection, exitCode(err))
+}
+
+func TestE2EWireCompressFormat(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE wire_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE wire_db.events (id UInt32, name String) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO wire_db.events SELECT number, toString(number) FROM numbers(1000)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^wire_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--wire-compress-format=zstd", "--compress-format=gzip"}, flags...), "wire")))
+
+	// zstd on the wire, gzip at rest
+	data, err := os.ReadFile(filepath.Join(storagePath, "wire", "wire_db", "events.data.sql.gz"))
+	require.NoError(t, err)
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gzipReader)
+	require.NoError(t, err)
+	require.Contains(t, string(plain), "INSERT INTO")
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE wire_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "wire")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(id) FROM wire_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "1000\t499500\n", result)
+}
+
+func TestE2ERestoreLatest(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE latest_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE latest_db.events (id UInt32) ENGINE = MergeTree() ORDER BY id"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^latest_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	// The older backup has the larger name, the manifest decides
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO latest_db.events SELECT number FROM numbers(10)"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "nightly-b")))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO latest_db.events SELECT number FROM numbers(10, 90)"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "nightly-a")))
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE latest_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--latest"}, flags...), "nightly")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count() FROM latest_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "100\n", result)
+
+	err = app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--latest", "--match=^weekly"}, flags...), "nightly"))
+	require.Equal(t, exitConfigError, exitCode(err))
+}
+
+func TestE2EStripSettings(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE settings_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE settings_db.events (id UInt32) ENGINE = MergeTree() ORDER BY id SETTINGS index_granularity = 4096, min_bytes_for_wide_part = 0"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO settings_db.events SELECT number FROM numbers(100)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^settings_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "settings")))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE settings_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--strip-settings=min_bytes_for_wide_part"}, flags...), "settings")))
+
+	createQuery, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT create_table_query FROM system.tables WHERE database = 'settings_db' AND name = 'events'")
+	require.NoError(t, err)
+	require.Contains(t, createQuery, "index_granularity = 4096")
+	require.NotContains(t, createQuery, "min_bytes_for_wide_part")
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count() FROM settings_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "100\n", result)
+}
+
+func TestE2EAdaptiveCompression(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE adaptive_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE adaptive_db.blobs (id UInt32, payload String) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO adaptive_db.blobs SELECT number, randomString(4096) FROM numbers(1000)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE adaptive_db.events (id UInt32, name String) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO adaptive_db.events SELECT number, 'event' FROM numbers(100000)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^adaptive_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--adaptive-compression", "--data-format=Native", "--compress-format=zstd"}, flags...), "adaptive")))
+
+	// Random payloads are stored as is, compressible data is still compressed
+	require.FileExists(t, filepath.Join(storagePath, "adaptive", "adaptive_db", "blobs.data.native"))
+	require.FileExists(t, filepath.Join(storagePath, "adaptive", "adaptive_db", "events.data.native.zstd"))
+	manifest, err := os.ReadFile(filepath.Join(storagePath, "adaptive", "manifest.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(manifest), `"compression": "none"`)
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE adaptive_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "adaptive")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(length(payload)) FROM adaptive_db.blobs")
+	require.NoError(t, err)
+	require.Equal(t, "1000\t4096000\n", result)
+	result, err = executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count() FROM adaptive_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "100000\n", result)
+}
+
+func TestE2ESkipFile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE skip_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE skip_db.good (id UInt32) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO skip_db.good SELECT number FROM numbers(100)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE skip_db.bad (id UInt32) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO skip_db.bad SELECT number FROM numbers(100)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^skip_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+		"--list-retries=0",
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--compress-format=gzip"}, flags...), "skip")))
+	require.NoError(t, os.Remove(filepath.Join(storagePath, "skip", "skip_db", "bad.data.sql.gz")))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE skip_db SYNC"))
+
+	// The removed file is missing from the manifest
+	err = app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "skip"))
+	require.ErrorContains(t, err, "skip_db/bad.data.sql")
+
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--skip-file=skip_db/bad.*"}, flags...), "skip")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count() FROM skip_db.good")
+	require.NoError(t, err)
+	require.Equal(t, "100\n", result)
+	result, err = executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count() FROM system.tables WHERE database = 'skip_db' AND name = 'bad'")
+	require.NoError(t, err)
+	require.Equal(t, "0\n", result)
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE skip_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore", "--skip-missing"}, flags...), "skip")))
+	result, err = executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count() FROM skip_db.bad")
+	require.NoError(t, err)
+	require.Equal(t, "0\n", result)
+}
+
+func TestE2ELiteralNames(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	for _, db := range []string{"logs.2024", "logs_2024", "a+b", "aab", "x*", "xxx"} {
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, fmt.Sprintf("CREATE DATABASE `%s`", db)))
+		require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, fmt.Sprintf("CREATE TABLE `%s`.events (id UInt32) ENGINE = MergeTree() ORDER BY id", db)))
+	}
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, []string{
+		"clickhouse-dump", "dump",
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--literal-names",
+		"--databases=logs.2024,a+b,x*",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+		"literal",
+	}))
+
+	// Only the exact names are dumped, not what the names match as regexps
+	for _, db := range []string{"logs.2024", "a+b", "x*"} {
+		require.FileExists(t, filepath.Join(storagePath, "literal", db, "events.schema.sql.gz"), db)
+	}
+	for _, db := range []string{"logs_2024", "aab", "xxx"} {
+		require.NoDirExists(t, filepath.Join(storagePath, "literal", db), db)
+	}
+}
+
+func TestE2ELayout(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE `layout.db`"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE `layout.db`.`my.events` (id UInt32) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO `layout.db`.`my.events` SELECT number FROM numbers(1000)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^layout\\.db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+		"--compress-format=none",
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--layout=tables/{db}/{table}", "--chunk-rows=400"}, flags...), "layout")))
+	for _, name := range []string{"layout.db.database.sql", "tables/layout.db/my.events.schema.sql", "tables/layout.db/my.events.chunk00000.data.sql", "tables/layout.db/my.events.chunk00002.data.sql"} {
+		require.FileExists(t, filepath.Join(storagePath, "layout", name))
+	}
+
+	// Restore reads the layout from the manifest
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE `layout.db` SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "layout")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(id) FROM `layout.db`.`my.events`")
+	require.NoError(t, err)
+	require.Equal(t, "1000\t499500\n", result)
+}
+
+func TestE2EIncludeNamedCollections(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE NAMED COLLECTION nc_url AS url = 'http://localhost:8123/?query=SELECT+1', format = 'TSV'"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE nc_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE nc_db.t (x UInt8) ENGINE = URL(nc_url)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^nc_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--include-named-collections"}, flags...), "nc")))
+	require.FileExists(t, filepath.Join(storagePath, "nc", "named_collections", "nc_url.sql.gz"))
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE nc_db SYNC"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP NAMED COLLECTION nc_url"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "nc")))
+
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT name FROM system.named_collections WHERE name = 'nc_url'")
+	require.NoError(t, err)
+	require.Equal(t, "nc_url\n", result)
+	result, err = executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count() FROM system.tables WHERE database = 'nc_db' AND name = 't'")
+	require.NoError(t, err)
+	require.Equal(t, "1\n", result)
+}
+func TestE2EArchive(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE archive_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE archive_db.t1 (id UInt64, s String) ENGINE = MergeTree ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE archive_db.t2 (id UInt64) ENGINE = MergeTree ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO archive_db.t1 SELECT number, toString(number) FROM numbers(1000)"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO archive_db.t2 SELECT number FROM numbers(500)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^archive_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+		"--archive",
+		"--tmp-dir=" + t.TempDir(),
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump"}, flags...), "archived")))
+	entries, err := os.ReadDir(storagePath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "the backup is a single object")
+	require.Equal(t, "archived.tar", entries[0].Name())
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE archive_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "archived")))
+
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT (SELECT count() FROM archive_db.t1), (SELECT count() FROM archive_db.t2)")
+	require.NoError(t, err)
+	require.Equal(t, "1000\t500\n", result)
+}
+
+func TestE2EDumpComments(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE comments_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE comments_db.t1 (id UInt64 COMMENT 'row id', s String COMMENT 'it''s a name') ENGINE = MergeTree ORDER BY id COMMENT 'orders'"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE comments_db.t2 (id UInt64) ENGINE = MergeTree ORDER BY id"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^comments_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+		"--compress-format=none",
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--dump-comments"}, flags...), "commented")))
+	content, err := os.ReadFile(filepath.Join(storagePath, "commented", "comments_db", "t1.comments.sql"))
+	require.NoError(t, err)
+	require.Contains(t, string(content), "MODIFY COMMENT 'orders'")
+	require.Contains(t, string(content), "COMMENT COLUMN `s` 'it\\'s a name'")
+	_, err = os.Stat(filepath.Join(storagePath, "commented", "comments_db", "t2.comments.sql"))
+	require.True(t, os.IsNotExist(err), "tables without comments get no comments file")
+
+	// Comments are restored even when the schema lost them
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE comments_db SYNC"))
+	schemaFile := filepath.Join(storagePath, "commented", "comments_db", "t1.schema.sql")
+	require.NoError(t, os.WriteFile(schemaFile, []byte("CREATE TABLE comments_db.t1 (id UInt64, s String) ENGINE = MergeTree ORDER BY id"), 0644))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "commented")))
+
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT name, comment FROM system.columns WHERE database = 'comments_db' AND table = 't1' ORDER BY position")
+	require.NoError(t, err)
+	require.Equal(t, "id\trow id\ns\tit\\'s a name\n", result)
+	result, err = executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT comment FROM system.tables WHERE database = 'comments_db' AND name = 't1'")
+	require.NoError(t, err)
+	require.Equal(t, "orders\n", result)
+}
+
+func TestE2ECreateBucket(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	minioContainer, err := startMinioContainer(ctx, fmt.Sprintf("minio-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start Minio container")
+	defer func() {
+		require.NoError(t, minioContainer.Terminate(ctx))
+	}()
+	gcsContainer, err := startFakeGCSContainer(ctx, fmt.Sprintf("fakegcs-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start fake GCS container")
+	defer func() {
+		require.NoError(t, gcsContainer.Terminate(ctx))
+	}()
+
+	minioHost, err := minioContainer.Host(ctx)
+	require.NoError(t, err)
+	minioPort, err := minioContainer.MappedPort(ctx, "9000/tcp")
+	require.NoError(t, err)
+	minioEndpoint := "http://" + minioHost + ":" + minioPort.Port()
+	gcsHost, err := gcsContainer.Host(ctx)
+	require.NoError(t, err)
+	gcsPort, err := gcsContainer.MappedPort(ctx, "4443/tcp")
+	require.NoError(t, err)
+	gcsEndpoint := "http://" + gcsHost + ":" + gcsPort.Port()
+
+	newStorages := map[string]func(createBucket bool) (storage.RemoteStorage, error){
+		"s3": func(createBucket bool) (storage.RemoteStorage, error) {
+			return storage.NewS3Storage("created", "us-east-1", "minio_secret", "minio_secret", minioEndpoint, storage.S3Options{CreateBucket: createBucket}, false)
+		},
+		"gcs": func(createBucket bool) (storage.RemoteStorage, error) {
+			return storage.NewGCSStorage("created", gcsEndpoint, storage.GCSAuthNone, "", storage.CompressionModeExtension, "", createBucket, false)
+		},
+	}
+	for name, newStorage := range newStorages {
+		t.Run(name, func(t *testing.T) {
+			s, err := newStorage(false)
+			if err == nil {
+				err = s.Upload("backup/db.database.sql", strings.NewReader("CREATE DATABASE db"), "none", 0, "")
+				require.NoError(t, s.Close())
+			}
+			require.Error(t, err, "the bucket doesn't exist without --create-bucket")
+
+			// The second run finds the bucket it created
+			for range 2 {
+				s, err = newStorage(true)
+				require.NoError(t, err)
+				require.NoError(t, s.Upload("backup/db.database.sql", strings.NewReader("CREATE DATABASE db"), "none", 0, ""))
+				size, err := s.Size("backup/db.database.sql")
+				require.NoError(t, err)
+				require.Equal(t, int64(len("CREATE DATABASE db")), size)
+				require.NoError(t, s.Close())
+			}
+		})
+	}
+}
+
+func TestE2ESQLInsertSettings(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	clickhouseContainer, err := startClickHouseContainer(ctx, fmt.Sprintf("clickhouse-%s-%d", t.Name(), time.Now().UnixNano()))
+	require.NoError(t, err, "Failed to start ClickHouse container")
+	defer func() {
+		if !t.Failed() {
+			require.NoError(t, clickhouseContainer.Terminate(ctx))
+		} else {
+			t.Log(logFailMessage("Test failed, ClickHouse container continue running."))
+		}
+	}()
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE DATABASE insert_db"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "CREATE TABLE insert_db.events (id UInt32, name Nullable(String)) ENGINE = MergeTree() ORDER BY id"))
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "INSERT INTO insert_db.events SELECT number, if(number % 2, NULL, toString(number)) FROM numbers(100)"))
+
+	host, err := clickhouseContainer.Host(ctx)
+	require.NoError(t, err)
+	port, err := clickhouseContainer.MappedPort(ctx, "8123/tcp")
+	require.NoError(t, err)
+
+	storagePath := t.TempDir()
+	flags := []string{
+		"--host=" + host,
+		"--port=" + port.Port(),
+		"--databases=^insert_db$",
+		"--storage-type=file",
+		"--storage-path=" + storagePath,
+		"--compress-format=none",
+	}
+	app := newCLIApp()
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--sql-insert-column-names=false", "--sql-insert-use-replace"}, flags...), "replace")))
+	data, err := os.ReadFile(filepath.Join(storagePath, "replace", "insert_db", "events.data.sql"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "REPLACE INTO `insert_db`.`events` VALUES (0, '0')")
+	require.Contains(t, string(data), "(1, NULL)")
+
+	require.NoError(t, executeTestQuery(ctx, t, clickhouseContainer, "DROP DATABASE insert_db SYNC"))
+	require.NoError(t, app.Run(ctx, append(append([]string{"clickhouse-dump", "restore"}, flags...), "replace")))
+	result, err := executeTestQueryWithResult(ctx, t, clickhouseContainer, "SELECT count(), sum(id), countIf(name IS NULL) FROM insert_db.events")
+	require.NoError(t, err)
+	require.Equal(t, "100\t4950\t50\n", result)
+
+	err = app.Run(ctx, append(append([]string{"clickhouse-dump", "dump", "--data-format=Native", "--sql-insert-use-replace"}, flags...), "native"))
+	require.ErrorContains(t, err, "--sql-insert-use-replace requires --data-format=SQLInsert")
+	require.Equal(t, exitConfigError, exitCode(err))
+}
+
 func runMainTestScenario(ctx context.Context, t *testing.T, clickhouseContainer testcontainers.Container, storageFlags map[string]string, testCase string, backupName string) {
 	// Clear any existing tables first
 	require.NoError(t, clearTestTables(ctx, t, clickhouseContainer))
@@ -254,7 +1618,7 @@ func runMainTestScenario(ctx context.Context, t *testing.T, clickhouseContainer
 		t.Fatalf("unknown test case: %s", testCase)
 	}
 
-	compressionFormat := []string{"gzip", "zstd"}[uint(time.Now().Nanosecond()%2)]
+	compressionFormat := []string{"gzip", "zstd", "auto"}[uint(time.Now().Nanosecond()%3)]
 
 	// Build args from test case and storage flags
 	flags := []string{
@@ -0,0 +1,87 @@
+// Package logging filters the standard logger output of clickhouse-dump by level,
+// messages keep going through the log package, so its flags and output apply.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the minimum severity of logged messages.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]Level{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+var currentLevel atomic.Int32
+
+func init() {
+	currentLevel.Store(int32(LevelInfo))
+}
+
+// ParseLevel parses a --log-level value, "warning" is accepted as "warn".
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		name = "warn"
+	}
+	if level, ok := levelNames[name]; ok {
+		return level, nil
+	}
+	return LevelInfo, fmt.Errorf("unsupported log level %q, expected one of debug, info, warn, error", name)
+}
+
+// SetLevel sets the minimum level of logged messages, LevelInfo by default.
+func SetLevel(level Level) {
+	currentLevel.Store(int32(level))
+}
+
+// Enabled reports whether messages of level are logged.
+func Enabled(level Level) bool {
+	return level >= Level(currentLevel.Load())
+}
+
+func output(level Level, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
+	}
+	// Skip output and the exported helper, so log.Lshortfile points at the caller
+	_ = log.Output(3, msg)
+}
+
+// Debugf logs a message only useful when investigating problems.
+func Debugf(format string, args ...interface{}) {
+	output(LevelDebug, format, args...)
+}
+
+// Infof logs progress of a dump or restore.
+func Infof(format string, args ...interface{}) {
+	output(LevelInfo, format, args...)
+}
+
+// Warnf logs a problem which doesn't stop the dump or restore, prefixed with "Warning: ".
+func Warnf(format string, args ...interface{}) {
+	output(LevelWarn, "Warning: "+format, args...)
+}
+
+// Errorf logs a failure.
+func Errorf(format string, args ...interface{}) {
+	output(LevelError, format, args...)
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		SetLevel(LevelInfo)
+	}()
+
+	level, err := ParseLevel("WARNING")
+	require.NoError(t, err)
+	require.Equal(t, LevelWarn, level)
+	SetLevel(level)
+	Debugf("debug %d", 1)
+	Infof("info %d", 2)
+	Warnf("warn %d", 3)
+	Errorf("error %d", 4)
+	require.Equal(t, "Warning: warn 3\nerror 4\n", buf.String())
+
+	_, err = ParseLevel("verbose")
+	require.Error(t, err)
+}
@@ -2,11 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Slach/clickhouse-dump/clickhousedump"
+	"github.com/Slach/clickhouse-dump/logging"
+	"github.com/Slach/clickhouse-dump/storage"
 	"github.com/urfave/cli/v3"
 )
 
@@ -54,6 +63,61 @@ func newCLIApp() *cli.Command {
 				Sources:  cli.EnvVars("CLICKHOUSE_PASSWORD"),
 				Required: false, // Often provided via env var
 			},
+			&cli.StringFlag{
+				Name:    "ch-path",
+				Value:   "/",
+				Usage:   "ClickHouse HTTP interface URL path, for servers behind a reverse proxy like http://host/clickhouse/",
+				Sources: cli.EnvVars("CLICKHOUSE_PATH"),
+			},
+			&cli.StringFlag{
+				Name:    "ch-database",
+				Usage:   "Default database of the ClickHouse session, sent as the 'database' parameter of every query. Unqualified table names in SQL hooks resolve to it, useful when access to the 'default' database is restricted",
+				Sources: cli.EnvVars("CLICKHOUSE_DATABASE"),
+			},
+			&cli.StringFlag{
+				Name:    "ch-access-token",
+				Usage:   "Access token sent as 'Authorization: Bearer <token>' instead of --user and --password, e.g. for ClickHouse Cloud together with --secure",
+				Sources: cli.EnvVars("CLICKHOUSE_ACCESS_TOKEN"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "ch-header",
+				Usage:   "Extra HTTP header sent with every ClickHouse request as key=value, repeatable, e.g. X-ClickHouse-User=dump and X-ClickHouse-Key=secret instead of --user and --password, or a routing header of a gateway",
+				Sources: cli.EnvVars("CLICKHOUSE_HEADER"),
+			},
+			&cli.BoolFlag{
+				Name:    "secure",
+				Usage:   "Connect to ClickHouse over HTTPS, --port defaults to 8443",
+				Sources: cli.EnvVars("CLICKHOUSE_SECURE"),
+			},
+			&cli.DurationFlag{
+				Name:    "connect-timeout",
+				Value:   10 * time.Second,
+				Usage:   "Maximum time to connect to ClickHouse including the TLS handshake, 0 means no limit",
+				Sources: cli.EnvVars("CLICKHOUSE_CONNECT_TIMEOUT"),
+			},
+			&cli.DurationFlag{
+				Name:    "read-timeout",
+				Value:   0,
+				Usage:   "Maximum time to wait for the response headers of a ClickHouse query, streaming the response body is not limited, 0 means no limit",
+				Sources: cli.EnvVars("CLICKHOUSE_READ_TIMEOUT"),
+			},
+			&cli.IntFlag{
+				Name:    "ch-retries",
+				Value:   3,
+				Usage:   "How many times to retry queries rejected by ClickHouse with TOO_MANY_SIMULTANEOUS_QUERIES or HTTP 503",
+				Sources: cli.EnvVars("CLICKHOUSE_RETRIES"),
+			},
+			&cli.StringFlag{
+				Name:    "user-agent",
+				Usage:   "User-Agent of ClickHouse and S3 requests, clickhouse-dump/<version> by default",
+				Sources: cli.EnvVars("USER_AGENT"),
+			},
+			&cli.StringFlag{
+				Name:    "query-id-prefix",
+				Value:   "clickhouse-dump",
+				Usage:   "Prefix of the query_id of table queries, followed by a run id, the table and a sequence number, e.g. clickhouse-dump-1a2b3c4d-db.table-7, to find them in system.query_log",
+				Sources: cli.EnvVars("QUERY_ID_PREFIX"),
+			},
 			&cli.StringFlag{
 				Name:    "databases",
 				Aliases: []string{"d"},
@@ -67,6 +131,11 @@ func newCLIApp() *cli.Command {
 				Usage:   "Regexp pattern for databases to exclude",
 				Sources: cli.EnvVars("EXCLUDE_DATABASES"),
 			},
+			&cli.BoolFlag{
+				Name:    "allow-system",
+				Usage:   "Dump the system, INFORMATION_SCHEMA and information_schema databases when --databases and --exclude-databases match them, they are skipped otherwise even with an empty --exclude-databases (dump only)",
+				Sources: cli.EnvVars("ALLOW_SYSTEM"),
+			},
 			&cli.StringFlag{
 				Name:    "tables",
 				Aliases: []string{"t"},
@@ -80,6 +149,28 @@ func newCLIApp() *cli.Command {
 				Usage:   "Regexp pattern for tables to exclude",
 				Sources: cli.EnvVars("EXCLUDE_TABLES"),
 			},
+			&cli.StringFlag{
+				Name:    "layout",
+				Value:   clickhousedump.DefaultLayout,
+				Usage:   "Path template of table files relative to the backup with {db} and {table} placeholders, e.g. 'tables/{db}/{table}', followed by .schema.sql or .data.<format>. Restore reads the layout from manifest.json and uses this option for backups without manifest",
+				Sources: cli.EnvVars("LAYOUT"),
+			},
+			&cli.BoolFlag{
+				Name:    "literal-names",
+				Usage:   "Treat --databases, --exclude-databases, --tables and --exclude-tables as comma-separated lists of exact names instead of regexps, e.g. for a database named logs.2024. Unset filters match all databases and tables, system databases are still skipped without --allow-system",
+				Sources: cli.EnvVars("LITERAL_NAMES"),
+			},
+			&cli.StringFlag{
+				Name:    "exclude-columns",
+				Value:   "",
+				Usage:   "Regexp pattern for columns to exclude from data dumps, matched against database.table.column (dump only)",
+				Sources: cli.EnvVars("EXCLUDE_COLUMNS"),
+			},
+			&cli.StringFlag{
+				Name:    "dump-query-file",
+				Usage:   "File with 'db.table: SELECT ... FROM db.table WHERE ...' lines replacing SELECT * for the data of these tables (dump only)",
+				Sources: cli.EnvVars("DUMP_QUERY_FILE"),
+			},
 			// Dump Specific Flags (can be moved to dump command if needed)
 			&cli.IntFlag{
 				Name:    "batch-size",
@@ -87,33 +178,365 @@ func newCLIApp() *cli.Command {
 				Usage:   "Batch size for SQL Insert statements (dump only)",
 				Sources: cli.EnvVars("BATCH_SIZE"),
 			},
+			&cli.IntFlag{
+				Name:    "chunk-rows",
+				Value:   0,
+				Usage:   "Dump tables with more rows than this as parallel LIMIT/OFFSET chunks over a deterministic order, 0 disables chunking (dump only)",
+				Sources: cli.EnvVars("CHUNK_ROWS"),
+			},
+			&cli.StringFlag{
+				Name:    "data-format",
+				Value:   "SQLInsert",
+				Usage:   "Format of data files: SQLInsert, Native or Parquet, restore detects the format of each file (dump only)",
+				Sources: cli.EnvVars("DATA_FORMAT"),
+			},
+			&cli.BoolFlag{
+				Name:    "sql-insert-column-names",
+				Value:   true,
+				Usage:   "Name the columns in SQLInsert statements, so restore doesn't depend on the column order of the target table (dump only)",
+				Sources: cli.EnvVars("SQL_INSERT_COLUMN_NAMES"),
+			},
+			&cli.BoolFlag{
+				Name:    "sql-insert-quote-names",
+				Value:   true,
+				Usage:   "Quote the column names of SQLInsert statements with backquotes (dump only)",
+				Sources: cli.EnvVars("SQL_INSERT_QUOTE_NAMES"),
+			},
+			&cli.BoolFlag{
+				Name:    "sql-insert-use-replace",
+				Usage:   "Write SQLInsert data as REPLACE INTO statements for MySQL-compatible targets, restore loads them as INSERT INTO (dump only)",
+				Sources: cli.EnvVars("SQL_INSERT_USE_REPLACE"),
+			},
+			&cli.StringFlag{
+				Name:    "skip-data-engines",
+				Value:   "Distributed,Merge,Null,View,MaterializedView,Dictionary",
+				Usage:   "Comma-separated table engines to dump schema only without data, empty value dumps data of all tables (dump only)",
+				Sources: cli.EnvVars("SKIP_DATA_ENGINES"),
+			},
+			&cli.DurationFlag{
+				Name:    "table-timeout",
+				Value:   0,
+				Usage:   "Maximum time per phase for a single table, e.g. 30m: the schema and the data of a table are limited separately, so a table can take up to twice the limit. 0 means no limit (dump only)",
+				Sources: cli.EnvVars("TABLE_TIMEOUT"),
+			},
+			&cli.BoolFlag{
+				Name:    "fail-fast",
+				Usage:   "Cancel the running table dumps and skip the remaining tables at the first failure, instead of dumping all tables and reporting every failure at the end (dump only)",
+				Sources: cli.EnvVars("FAIL_FAST"),
+			},
+			&cli.BoolFlag{
+				Name:    "continue-on-error",
+				Usage:   "Write the manifest with failed tables recorded when some tables fail, the dump still exits with an error (dump only)",
+				Sources: cli.EnvVars("CONTINUE_ON_ERROR"),
+			},
+			&cli.BoolFlag{
+				Name:    "fail-if-exists",
+				Usage:   "Fail when the backup name already contains files instead of writing into it (dump only)",
+				Sources: cli.EnvVars("FAIL_IF_EXISTS"),
+			},
+			&cli.BoolFlag{
+				Name:    "overwrite",
+				Usage:   "Delete the existing files of the backup name before dumping (dump only)",
+				Sources: cli.EnvVars("OVERWRITE"),
+			},
+			&cli.BoolFlag{
+				Name:    "include-functions",
+				Usage:   "Dump SQL user-defined functions, they are restored before tables (dump only)",
+				Sources: cli.EnvVars("INCLUDE_FUNCTIONS"),
+			},
+			&cli.BoolFlag{
+				Name:    "include-named-collections",
+				Usage:   "Dump named collections including their secrets, they are restored before tables (dump only)",
+				Sources: cli.EnvVars("INCLUDE_NAMED_COLLECTIONS"),
+			},
+			&cli.BoolFlag{
+				Name:    "dump-comments",
+				Usage:   "Also dump table and column comments as ALTER TABLE ... MODIFY COMMENT and COMMENT COLUMN statements into <table>.comments.sql, restore applies them after the schemas (dump only)",
+				Sources: cli.EnvVars("DUMP_COMMENTS"),
+			},
+			&cli.BoolFlag{
+				Name:    "consistent",
+				Usage:   "Run all dump queries one at a time in a single ClickHouse session after listing tables once, implies --parallel=1. ClickHouse can't snapshot several tables, see README (dump only)",
+				Sources: cli.EnvVars("CONSISTENT"),
+			},
+			&cli.BoolFlag{
+				Name:    "freeze",
+				Usage:   "Experimental: ALTER TABLE FREEZE MergeTree tables before dumping their data and record the frozen parts in manifest.json, UNFREEZE when done. Data is still read from the live tables (dump only)",
+				Sources: cli.EnvVars("FREEZE"),
+			},
+			&cli.BoolFlag{
+				Name:    "safe-mode",
+				Usage:   "Run dump queries with readonly=2, max_memory_usage=4294967296, max_execution_time=3600, priority=10 and os_thread_priority=19 to limit the impact on a production server, hooks are not affected (dump only)",
+				Sources: cli.EnvVars("SAFE_MODE"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "safe-setting",
+				Usage:   "Override or add a --safe-mode setting as key=value, an empty value removes it, e.g. os_thread_priority= for servers without it, repeatable (dump only)",
+				Sources: cli.EnvVars("SAFE_SETTING"),
+			},
+			&cli.BoolFlag{
+				Name:    "final",
+				Usage:   "Read Replacing, Collapsing, VersionedCollapsing, Summing, Aggregating and Graphite MergeTree tables with SELECT ... FINAL, so the dump holds the merged rows. FINAL merges at query time and is slower on big tables (dump only)",
+				Sources: cli.EnvVars("FINAL"),
+			},
 			&cli.StringFlag{
 				Name:    "compress-format",
 				Value:   "gzip",
-				Usage:   "Compression format: gzip, zstd, or none (dump only)",
+				Usage:   "Compression format: gzip, zstd, none, or auto (gzip for schemas, zstd for data of tables from 64MB on disk) (dump only)",
 				Sources: cli.EnvVars("COMPRESS_FORMAT"),
 			},
+			&cli.StringFlag{
+				Name:    "schema-compress-format",
+				Usage:   "Compression format of database, table and function schema files: gzip, zstd, none or auto, --compress-format by default (dump only)",
+				Sources: cli.EnvVars("SCHEMA_COMPRESS_FORMAT"),
+			},
+			&cli.StringFlag{
+				Name:    "data-compress-format",
+				Usage:   "Compression format of data files: gzip, zstd, none or auto, --compress-format by default (dump only)",
+				Sources: cli.EnvVars("DATA_COMPRESS_FORMAT"),
+			},
+			&cli.StringFlag{
+				Name:    "wire-compress-format",
+				Usage:   "Compression requested from ClickHouse for dump queries: gzip, zstd or none, the format of the stored file by default. A different format is decompressed and compressed again by clickhouse-dump, which costs client CPU (dump only)",
+				Sources: cli.EnvVars("WIRE_COMPRESS_FORMAT"),
+			},
 			&cli.IntFlag{
 				Name:    "compress-level",
 				Value:   6, // Default for gzip
-				Usage:   "Compression level (gzip: 1-9, zstd: 1-22) (dump only)",
+				Usage:   "Compression level (gzip: 1-9, zstd: 1-22), 0 stores gzip data uncompressed and uses the fastest zstd level (dump only)",
 				Sources: cli.EnvVars("COMPRESS_LEVEL"),
 			},
+			&cli.BoolFlag{
+				Name:    "zstd-dict",
+				Usage:   "Compress database, table and function schemas with a zstd dictionary trained on the dumped tables and stored as schema.dict in the backup, requires zstd schema files from --compress-format or --schema-compress-format (dump only)",
+				Sources: cli.EnvVars("ZSTD_DICT"),
+			},
+			&cli.BoolFlag{
+				Name:    "adaptive-compression",
+				Usage:   "Sample the first 1MB of every data file and store the file uncompressed when compression would save less than 10%, e.g. for tables of already compressed blobs (dump only)",
+				Sources: cli.EnvVars("ADAPTIVE_COMPRESSION"),
+			},
+			&cli.BoolFlag{
+				Name:    "verify-upload",
+				Usage:   "Send checksums with s3, oci and azblob uploads so the storage rejects corrupted uploads, buffers up to one part or block per upload (dump only)",
+				Sources: cli.EnvVars("VERIFY_UPLOAD"),
+			},
+			&cli.BoolFlag{
+				Name:    "verify-after-dump",
+				Usage:   "Download every dumped file and read it through the decompressor to EOF before writing the manifest, with --parallel workers, so truncated compressed files fail the dump. Reads the whole backup back (dump only)",
+				Sources: cli.EnvVars("VERIFY_AFTER_DUMP"),
+			},
+			&cli.BoolFlag{
+				Name:    "create-bucket",
+				Usage:   "Create the s3, oci or gcs bucket when it doesn't exist, ignoring buckets already owned by the credentials, off by default so the credentials don't need permission to create buckets",
+				Sources: cli.EnvVars("CREATE_BUCKET"),
+			},
+			&cli.StringFlag{
+				Name:    "compression-mode",
+				Value:   "extension",
+				Usage:   "How compressed files are stored: extension (append .gz/.zstd) or transparent (keep .sql name, set Content-Encoding metadata; s3, oci, gcs, azblob only)",
+				Sources: cli.EnvVars("COMPRESSION_MODE"),
+			},
+			&cli.StringFlag{
+				Name:    "log-level",
+				Value:   "info",
+				Usage:   "Log level: debug, info, warn or error",
+				Sources: cli.EnvVars("LOG_LEVEL"),
+			},
 			&cli.BoolFlag{
 				Name:    "debug",
-				Usage:   "Enable debug logging",
+				Usage:   "Enable debug logging, same as --log-level=debug",
 				Sources: cli.EnvVars("DEBUG"),
 			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "Log errors only, same as --log-level=error",
+				Sources: cli.EnvVars("QUIET"),
+			},
 			&cli.IntFlag{
 				Name:    "parallel",
 				Value:   1,
 				Usage:   "Number of parallel table processing operations",
 				Sources: cli.EnvVars("PARALLEL"),
 			},
+			&cli.IntFlag{
+				Name:    "schema-parallel",
+				Usage:   "Number of parallel database and table schema operations, 0 means --parallel",
+				Sources: cli.EnvVars("SCHEMA_PARALLEL"),
+			},
+			&cli.IntFlag{
+				Name:    "data-parallel",
+				Usage:   "Number of parallel table data operations, 0 means --parallel",
+				Sources: cli.EnvVars("DATA_PARALLEL"),
+			},
+			&cli.Int64Flag{
+				Name:    "max-inflight-bytes",
+				Value:   0,
+				Usage:   "Maximum total size of the tables dumping data at once by system.tables total_bytes, next to the --data-parallel table count, 0 means no limit (dump only)",
+				Sources: cli.EnvVars("MAX_INFLIGHT_BYTES"),
+			},
+			&cli.StringFlag{
+				Name:    "table-order",
+				Value:   "name",
+				Usage:   "Order in which tables are dumped and data files restored: name (alphabetical), size or rows (largest first)",
+				Sources: cli.EnvVars("TABLE_ORDER"),
+			},
+			&cli.IntFlag{
+				Name:    "restore-max-query-size",
+				Value:   0,
+				Usage:   "Split restored INSERT statements longer than this many bytes into smaller ones, 0 splits only when the server reports max_query_size exceeded (restore only)",
+				Sources: cli.EnvVars("RESTORE_MAX_QUERY_SIZE"),
+			},
+			&cli.IntFlag{
+				Name:    "restore-statement-parallel",
+				Value:   1,
+				Usage:   "Execute the INSERT statements of one SQLInsert data file on this many connections at a time, speeds up backups with a few huge tables. Can't be combined with --resume-restore (restore only)",
+				Sources: cli.EnvVars("RESTORE_STATEMENT_PARALLEL"),
+			},
+			&cli.BoolFlag{
+				Name:    "restore-async-insert",
+				Usage:   "Send the INSERT statements of SQLInsert data files with async_insert=1 and wait_for_async_insert=1, the server batches the rows of many small INSERTs. Statements are still acknowledged only after their rows are written (restore only)",
+				Sources: cli.EnvVars("RESTORE_ASYNC_INSERT"),
+			},
+			&cli.StringFlag{
+				Name:    "restore-compress-format",
+				Value:   "none",
+				Usage:   "Compression of restored statements sent to ClickHouse: gzip, zstd, or none, responses and error messages are requested in the same format. Backup files are decompressed by their own format (restore only)",
+				Sources: cli.EnvVars("RESTORE_COMPRESS_FORMAT"),
+			},
+			&cli.BoolFlag{
+				Name:    "server-local-restore",
+				Usage:   "With file storage on the ClickHouse host, insert Native and Parquet data files with INSERT ... SELECT FROM file() so the server reads them from its disk instead of receiving them over HTTP. The storage path must be readable by the server under the same absolute path, inside its user_files_path, with the FILE grant, otherwise the data is streamed over HTTP (restore only)",
+				Sources: cli.EnvVars("SERVER_LOCAL_RESTORE"),
+			},
+			&cli.Int64Flag{
+				Name:    "min-free-space",
+				Value:   0,
+				Usage:   "Check before restoring that the ClickHouse default disk and --tmp-dir keep this many bytes free after the backup is loaded, 0 disables the check (restore only)",
+				Sources: cli.EnvVars("MIN_FREE_SPACE"),
+			},
+			&cli.IntFlag{
+				Name:    "list-retries",
+				Value:   3,
+				Usage:   "How many times to repeat the storage listing with backoff when it misses files from the backup manifest (restore only)",
+				Sources: cli.EnvVars("LIST_RETRIES"),
+			},
+			&cli.BoolFlag{
+				Name:    "strip-uuid",
+				Usage:   "Remove UUID '...' clauses from database and table schemas, so ClickHouse assigns new UUIDs on the target server (restore only)",
+				Sources: cli.EnvVars("STRIP_UUID"),
+			},
+			&cli.StringFlag{
+				Name:    "strip-settings",
+				Usage:   "Comma-separated table and database engine SETTINGS keys to remove from schemas before executing them, e.g. settings unknown to an older server (restore only)",
+				Sources: cli.EnvVars("STRIP_SETTINGS"),
+			},
+			&cli.BoolFlag{
+				Name:    "strip-all-settings",
+				Usage:   "Remove the whole engine SETTINGS clause from table and database schemas before executing them (restore only)",
+				Sources: cli.EnvVars("STRIP_ALL_SETTINGS"),
+			},
+			&cli.BoolFlag{
+				Name:    "verify-schema",
+				Usage:   "After restoring table schemas, compare the create_table_query of every restored table with its schema file ignoring whitespace and UUIDs, and warn about differences, e.g. settings removed by --strip-settings (restore only)",
+				Sources: cli.EnvVars("VERIFY_SCHEMA"),
+			},
+			&cli.BoolFlag{
+				Name:    "verify-schema-strict",
+				Usage:   "Fail the restore when --verify-schema finds differences instead of warning (restore only)",
+				Sources: cli.EnvVars("VERIFY_SCHEMA_STRICT"),
+			},
+			&cli.DurationFlag{
+				Name:    "wait-replicas",
+				Value:   0,
+				Usage:   "After restoring schemas, wait up to this long for the ON CLUSTER queries in system.distributed_ddl_queue to finish on all hosts and for restored Replicated databases to sync before restoring data, 0 doesn't wait (restore only)",
+				Sources: cli.EnvVars("WAIT_REPLICAS"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "skip-file",
+				Usage:   "Glob of backup files to leave out, matched against the path relative to the backup with or without the compression extension, e.g. 'db/broken.*', repeatable (restore only)",
+				Sources: cli.EnvVars("SKIP_FILE"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "only",
+				Usage:   "Restore only this db.table with its database instead of the whole backup, repeatable (restore only)",
+				Sources: cli.EnvVars("ONLY"),
+			},
+			&cli.BoolFlag{
+				Name:    "schema-only",
+				Usage:   "Restore schemas without data, with --only the schema files are fetched by name without listing the backup (restore only)",
+				Sources: cli.EnvVars("SCHEMA_ONLY"),
+			},
+			&cli.BoolFlag{
+				Name:    "skip-missing",
+				Usage:   "Skip files listed in the manifest but missing from storage and files failing to download, with a warning, instead of failing the restore (restore only)",
+				Sources: cli.EnvVars("SKIP_MISSING"),
+			},
+			&cli.BoolFlag{
+				Name:    "resume-restore",
+				Usage:   "Save restore progress in --tmp-dir and skip files and SQLInsert statements already applied by an interrupted run of the same restore (restore only)",
+				Sources: cli.EnvVars("RESUME_RESTORE"),
+			},
+			&cli.BoolFlag{
+				Name:    "latest",
+				Usage:   "Restore the most recent backup whose name contains the given backup name, or the most recent of all without a name, ordered by manifest.json created_at and then by name. A backup with exactly the given name is restored as is (restore only)",
+				Sources: cli.EnvVars("LATEST"),
+			},
+			&cli.StringFlag{
+				Name:    "match",
+				Usage:   "Regexp which backup names considered by --latest must match (restore only)",
+				Sources: cli.EnvVars("MATCH"),
+			},
+			&cli.StringFlag{
+				Name:    "pre-dump-sql",
+				Usage:   "SQL file path or inline statements separated by semicolons to run before the dump, e.g. 'SYSTEM STOP MERGES' (dump only)",
+				Sources: cli.EnvVars("PRE_DUMP_SQL"),
+			},
+			&cli.StringFlag{
+				Name:    "post-dump-sql",
+				Usage:   "SQL file path or inline statements to run after the dump, also when it fails (dump only)",
+				Sources: cli.EnvVars("POST_DUMP_SQL"),
+			},
+			&cli.StringFlag{
+				Name:    "pre-restore-sql",
+				Usage:   "SQL file path or inline statements to run before the restore (restore only)",
+				Sources: cli.EnvVars("PRE_RESTORE_SQL"),
+			},
+			&cli.StringFlag{
+				Name:    "post-restore-sql",
+				Usage:   "SQL file path or inline statements to run after a successful restore, e.g. OPTIMIZE TABLE or GRANT (restore only)",
+				Sources: cli.EnvVars("POST_RESTORE_SQL"),
+			},
+			&cli.BoolFlag{
+				Name:    "ignore-hook-errors",
+				Usage:   "Log failed --pre-*-sql and --post-*-sql statements and continue instead of aborting",
+				Sources: cli.EnvVars("IGNORE_HOOK_ERRORS"),
+			},
+			&cli.StringFlag{
+				Name:    "tmp-dir",
+				Usage:   "Directory for temporary files (S3 buffered downloads), defaults to the system temp dir",
+				Sources: cli.EnvVars("TMP_DIR"),
+			},
+			&cli.BoolFlag{
+				Name:    "archive",
+				Usage:   "Store the backup as the single object <backup>.tar instead of one object per file, fewer requests for high-latency storages. Files are spooled in --tmp-dir while they are added, restore extracts the archive into --tmp-dir",
+				Sources: cli.EnvVars("ARCHIVE"),
+			},
+			&cli.StringFlag{
+				Name:    "local-cache",
+				Usage:   "Keep a local copy of every file uploaded to the storage in this directory",
+				Sources: cli.EnvVars("LOCAL_CACHE"),
+			},
+			&cli.BoolFlag{
+				Name:    "prefer-local-cache",
+				Usage:   "Read files from the --local-cache copy when it exists instead of downloading them (restore only)",
+				Sources: cli.EnvVars("PREFER_LOCAL_CACHE"),
+			},
 			// Storage Common Flags
 			&cli.StringFlag{
 				Name:     "storage-type",
-				Usage:    "Storage backend type: file, s3, gcs, azblob, sftp, ftp",
+				Usage:    "Storage backend type: file, s3, oci, gcs, azblob, sftp, ftp, stdout (dump only), stdin (restore only)",
 				Sources:  cli.EnvVars("STORAGE_TYPE"),
 				Required: true, // Required for both dump and restore
 			},
@@ -125,17 +548,17 @@ func newCLIApp() *cli.Command {
 			},
 			&cli.StringFlag{
 				Name:    "storage-region",
-				Usage:   "S3 region",
+				Usage:   "S3/OCI region",
 				Sources: cli.EnvVars("STORAGE_REGION"),
 			},
 			&cli.StringFlag{
 				Name:    "storage-account",
-				Usage:   "Storage account name/access key (S3: access key ID, Azure: account name)",
+				Usage:   "Storage account name/access key (S3: access key ID, Azure: account name, GCS: HMAC access ID). Also read from AWS_ACCESS_KEY_ID, for OCI it is taken as the tenancy namespace only when --oci-namespace isn't set",
 				Sources: cli.EnvVars("AWS_ACCESS_KEY_ID", "STORAGE_ACCOUNT"),
 			},
 			&cli.StringFlag{
 				Name:    "storage-key",
-				Usage:   "Storage secret key (S3: secret access key, Azure: account key, GCS: path to credentials JSON)",
+				Usage:   "Storage secret key (S3: secret access key, Azure: account key, GCS: path to credentials JSON or HMAC secret, see --gcs-auth)",
 				Sources: cli.EnvVars("AWS_SECRET_ACCESS_KEY", "STORAGE_KEY"),
 			},
 			&cli.StringFlag{
@@ -143,6 +566,75 @@ func newCLIApp() *cli.Command {
 				Usage:   "Custom endpoint URL (S3: for MinIO/etc, GCS: for fake-gcs-server, Azure: for Azurite)",
 				Sources: cli.EnvVars("STORAGE_ENDPOINT"),
 			},
+			&cli.BoolFlag{
+				Name:    "s3-path-style",
+				Usage:   "Use S3 path-style addressing (true) or virtual-hosted style (false), by default path-style is used only for non-AWS endpoints",
+				Sources: cli.EnvVars("S3_PATH_STYLE"),
+			},
+			&cli.StringFlag{
+				Name:    "s3-request-payer",
+				Usage:   "Set to 'requester' to access S3 requester-pays buckets",
+				Sources: cli.EnvVars("S3_REQUEST_PAYER"),
+			},
+			&cli.StringFlag{
+				Name:    "gcs-auth",
+				Usage:   "GCS authentication: adc (Application Default Credentials), file (--storage-key is a credentials JSON path), hmac (--storage-account and --storage-key are HMAC keys, used through the S3-compatible API) or none (anonymous). By default file when --storage-key is set, none otherwise",
+				Sources: cli.EnvVars("GCS_AUTH"),
+			},
+			&cli.StringFlag{
+				Name:    "s3-storage-class",
+				Usage:   "S3 storage class of uploaded objects, e.g. STANDARD_IA, INTELLIGENT_TIERING, GLACIER or DEEP_ARCHIVE, by default the bucket default. GLACIER and DEEP_ARCHIVE objects must be restored before restore (dump only)",
+				Sources: cli.EnvVars("S3_STORAGE_CLASS"),
+			},
+			&cli.StringFlag{
+				Name:    "s3-credential-process",
+				Usage:   "Command printing S3 credentials as JSON with Version 1, AccessKeyId, SecretAccessKey, SessionToken and Expiration, like credential_process of the AWS CLI. It runs through the shell at startup and again before the credentials expire, instead of --storage-account and --storage-key",
+				Sources: cli.EnvVars("S3_CREDENTIAL_PROCESS"),
+			},
+			&cli.Int64Flag{
+				Name:    "s3-part-size",
+				Value:   16 * 1024 * 1024,
+				Usage:   "S3 multipart part size in bytes, minimum 5242880 (5MB). Also limits the largest file to 10000 parts",
+				Sources: cli.EnvVars("S3_PART_SIZE"),
+			},
+			&cli.IntFlag{
+				Name:    "s3-upload-concurrency",
+				Value:   5,
+				Usage:   "Number of S3 multipart parts uploaded in parallel per file (dump only)",
+				Sources: cli.EnvVars("S3_UPLOAD_CONCURRENCY"),
+			},
+			&cli.IntFlag{
+				Name:    "s3-download-concurrency",
+				Value:   5,
+				Usage:   "Number of S3 parts downloaded in parallel per file for buffered downloads (restore only)",
+				Sources: cli.EnvVars("S3_DOWNLOAD_CONCURRENCY"),
+			},
+			&cli.StringFlag{
+				Name:    "storage-content-type",
+				Usage:   "Content-Type of uploaded objects (s3, oci, gcs, azblob), by default detected from the file name: application/sql, application/gzip, application/zstd (dump only)",
+				Sources: cli.EnvVars("STORAGE_CONTENT_TYPE"),
+			},
+			&cli.StringFlag{
+				Name:    "azblob-tier",
+				Usage:   "Azure Blob access tier of uploaded blobs: Hot, Cool or Archive, by default the account default tier. Archived blobs must be rehydrated before restore (dump only)",
+				Sources: cli.EnvVars("AZBLOB_TIER"),
+			},
+			&cli.IntFlag{
+				Name:    "azblob-download-concurrency",
+				Value:   1,
+				Usage:   "Number of ranges downloaded in parallel per Azure blob, blobs from 64MB on are downloaded into --tmp-dir first when above 1. 1 streams every blob with one request (restore only)",
+				Sources: cli.EnvVars("AZBLOB_DOWNLOAD_CONCURRENCY"),
+			},
+			&cli.StringFlag{
+				Name:    "oci-access-key",
+				Usage:   "OCI customer secret key access key ID, the secret is passed with --storage-key and the namespace with --oci-namespace",
+				Sources: cli.EnvVars("OCI_ACCESS_KEY_ID"),
+			},
+			&cli.StringFlag{
+				Name:    "oci-namespace",
+				Usage:   "OCI tenancy namespace of the bucket, part of the S3 compatibility endpoint",
+				Sources: cli.EnvVars("OCI_NAMESPACE"),
+			},
 			&cli.StringFlag{
 				Name:    "storage-container",
 				Usage:   "Azure Blob Storage container name",
@@ -163,25 +655,77 @@ func newCLIApp() *cli.Command {
 				Usage:   "SFTP/FTP password",
 				Sources: cli.EnvVars("STORAGE_PASSWORD"),
 			},
+			&cli.DurationFlag{
+				Name:    "sftp-keepalive-interval",
+				Value:   30 * time.Second,
+				Usage:   "Interval of SSH keepalive requests on SFTP connections, 0 disables them",
+				Sources: cli.EnvVars("SFTP_KEEPALIVE_INTERVAL"),
+			},
+			&cli.IntFlag{
+				Name:    "sftp-concurrency",
+				Value:   64,
+				Usage:   "Number of concurrent SFTP read and write requests per file",
+				Sources: cli.EnvVars("SFTP_CONCURRENCY"),
+			},
 			&cli.StringFlag{
 				Name:    "storage-path",
 				Usage:   "Base path in storage for dump/restore files",
 				Value:   "",
 				Sources: cli.EnvVars("STORAGE_PATH"),
 			},
+			&cli.StringSliceFlag{
+				Name:    "mirror-storage",
+				Usage:   "Additional storage to write every dumped file to, repeatable, e.g. 'sftp?host=backup:22&user=dump&password=secret&path=/backups', keys are path, bucket, region, account, key, endpoint, container, host, user, password, s3_path_style, s3_request_payer, s3_storage_class, s3_credential_process, gcs_auth, s3_part_size, s3_upload_concurrency, s3_download_concurrency, oci_access_key, oci_namespace, content_type, azblob_tier, azblob_download_concurrency, sftp_keepalive_interval, sftp_concurrency. Restore reads from the first reachable storage",
+				Sources: cli.EnvVars("MIRROR_STORAGE"),
+			},
 		},
 		Commands: []*cli.Command{
 			{
 				Name:      "dump",
 				Usage:     "Dump ClickHouse tables schema and data to remote storage",
 				Action:    RunDumper,
-				ArgsUsage: "BACKUP_NAME",
+				ArgsUsage: "[BACKUP_NAME]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "Backup name, same as the BACKUP_NAME argument. Without both, a name like auto-20240601-120000 is generated and printed to stdout after the dump",
+					},
+				},
 			},
 			{
 				Name:      "restore",
 				Usage:     "Restore ClickHouse tables from remote storage",
 				Action:    RunRestorer,
 				ArgsUsage: "BACKUP_NAME",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "from",
+						Usage: "Backup name, same as the BACKUP_NAME argument",
+					},
+				},
+			},
+			{
+				Name:   "check",
+				Usage:  "Check the ClickHouse connection and version, and write, read and delete a test object in the storage",
+				Action: RunCheck,
+			},
+			{
+				Name:      "diff",
+				Usage:     "Compare the database and table schemas of two backups in the storage and print added, removed and changed tables with their column differences",
+				Action:    RunDiff,
+				ArgsUsage: "BACKUP_A BACKUP_B",
+			},
+			{
+				Name:    "list-tables",
+				Aliases: []string{"list-matched"},
+				Usage:   "Print the databases and tables matched by --databases, --tables and --exclude-* on the server, one db.table per line, without dumping",
+				Action:  RunListTables,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the matched databases and tables with their engines and sizes as JSON",
+					},
+				},
 			},
 		},
 	}
@@ -197,85 +741,200 @@ func main() {
 
 	err := app.Run(context.Background(), os.Args)
 	if err != nil {
-		log.Fatal(err) // Use log.Fatal to print error and exit(1)
+		log.Print(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// Exit codes of the CLI, documented in README.
+const (
+	exitError          = 1
+	exitConfigError    = 2
+	exitConnection     = 3
+	exitPartialFailure = 4
+)
+
+// exitCode maps the typed errors of RunDumper and RunRestorer to exit codes, any other error exits with 1.
+func exitCode(err error) int {
+	var configErr *clickhousedump.ConfigError
+	var connectionErr *clickhousedump.ConnectionError
+	var partialErr *clickhousedump.PartialFailureError
+	switch {
+	case errors.As(err, &configErr):
+		return exitConfigError
+	case errors.As(err, &connectionErr):
+		return exitConnection
+	case errors.As(err, &partialErr):
+		return exitPartialFailure
+	default:
+		return exitError
+	}
+}
+
+// backupNameArg returns the BACKUP_NAME argument or the value of flagName, "" when neither is set.
+func backupNameArg(cmd *cli.Command, flagName string) (string, error) {
+	arg, flag := cmd.Args().First(), cmd.String(flagName)
+	if arg != "" && flag != "" && arg != flag {
+		return "", fmt.Errorf("backup name %s conflicts with --%s=%s", arg, flagName, flag)
+	}
+	if arg != "" {
+		return arg, nil
 	}
+	return flag, nil
+}
+
+// defaultBackupName returns the name of a dump started without a backup name.
+func defaultBackupName(now time.Time) string {
+	return "auto-" + now.UTC().Format("20060102-150405")
 }
 
 func RunDumper(ctx context.Context, cmd *cli.Command) error {
-	if cmd.Args().Len() == 0 {
-		return fmt.Errorf("backup name is required as argument")
+	backupName, err := backupNameArg(cmd, "to")
+	if err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
+	generatedName := backupName == ""
+	if generatedName {
+		backupName = defaultBackupName(time.Now())
+		logging.Infof("No backup name given, dumping into %s", backupName)
 	}
-	backupName := cmd.Args().First()
 
 	config, err := getConfig(cmd)
 	if err != nil {
-		return fmt.Errorf("configuration error: %w", err)
+		return &clickhousedump.ConfigError{Err: err}
 	}
 	config.BackupName = backupName
 
 	// Create ClickHouse client to check version
-	client := NewClickHouseClient(config)
-	if err := checkClickHouseVersion(client); err != nil {
+	client := clickhousedump.NewClickHouseClient(config)
+	if err := checkClickHouseVersion(ctx, client); err != nil {
 		return err
 	}
+	if err := expandConfigPlaceholders(ctx, config, client, time.Now()); err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
 
-	dumper, err := NewDumper(config)
+	dumper, err := clickhousedump.NewDumper(config)
 	if err != nil {
-		return fmt.Errorf("failed to initialize dumper: %w", err)
+		return &clickhousedump.ConnectionError{Err: fmt.Errorf("failed to initialize dumper: %w", err)}
 	}
 	defer func() {
 		if closeErr := dumper.Close(); closeErr != nil {
-			log.Printf("Warning: failed to close dumper storage connection: %v", closeErr)
+			logging.Warnf("failed to close dumper storage connection: %v", closeErr)
 		}
 	}()
-	log.Println("Starting dump process...")
-	err = dumper.Dump()
-	if err == nil {
-		log.Println("Dump completed successfully.")
-	} else {
-		log.Printf("Dump failed: %v", err)
+	logging.Infof("Starting dump process...")
+	err = dumper.Dump(ctx)
+	if err != nil {
+		logging.Errorf("Dump failed: %v", err)
+		return err
 	}
-	return err
+	logging.Infof("Dump completed successfully.")
+	// Scripts capture the generated name from the last stdout line, the stdout storage owns stdout itself
+	if generatedName && config.StorageType != "stdout" {
+		fmt.Println(config.BackupName)
+	}
+	return nil
 }
 
 func RunRestorer(ctx context.Context, cmd *cli.Command) error {
-	if cmd.Args().Len() == 0 {
-		return fmt.Errorf("backup name is required as argument")
+	backupName, err := backupNameArg(cmd, "from")
+	if err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
+	if backupName == "" && !cmd.Bool("latest") {
+		return &clickhousedump.ConfigError{Err: fmt.Errorf("backup name is required as argument or --from, or use --latest")}
 	}
-	backupName := cmd.Args().First()
 
 	config, err := getConfig(cmd)
 	if err != nil {
-		return fmt.Errorf("configuration error: %w", err)
+		return &clickhousedump.ConfigError{Err: err}
 	}
 	config.BackupName = backupName
 
 	// Create ClickHouse client to check version
-	client := NewClickHouseClient(config)
-	if err := checkClickHouseVersion(client); err != nil {
+	client := clickhousedump.NewClickHouseClient(config)
+	if err := checkClickHouseVersion(ctx, client); err != nil {
 		return err
 	}
+	if err := expandConfigPlaceholders(ctx, config, client, time.Now()); err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
 
-	restorer, err := NewRestorer(config)
+	restorer, err := clickhousedump.NewRestorer(config)
 	if err != nil {
-		return fmt.Errorf("failed to initialize restorer: %w", err)
+		return &clickhousedump.ConnectionError{Err: fmt.Errorf("failed to initialize restorer: %w", err)}
 	}
-	log.Println("Starting restore process...")
-	err = restorer.Restore()
+	logging.Infof("Starting restore process...")
+	err = restorer.Restore(ctx)
 	// Restore() already logs success/failure details, just return error status
 	return err
 }
 
+// RunCheck checks the ClickHouse connection and the storage, failing on the first step which doesn't work.
+func RunCheck(ctx context.Context, cmd *cli.Command) error {
+	config, err := getConfig(cmd)
+	if err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
+
+	client := clickhousedump.NewClickHouseClient(config)
+	start := time.Now()
+	if err := checkClickHouseVersion(ctx, client); err != nil {
+		return err
+	}
+	logging.Infof("ClickHouse check: connection and version OK in %s", time.Since(start).Round(time.Microsecond))
+	if err := expandConfigPlaceholders(ctx, config, client, time.Now()); err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
+
+	if err := clickhousedump.CheckStorage(config); err != nil {
+		return &clickhousedump.ConnectionError{Err: err}
+	}
+	logging.Infof("All checks passed")
+	return nil
+}
+
+// RunDiff prints the schema differences between two backups, it reads the storage only.
+func RunDiff(ctx context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 2 {
+		return &clickhousedump.ConfigError{Err: fmt.Errorf("diff requires two backup names, got %d arguments", cmd.Args().Len())}
+	}
+	config, err := getConfig(cmd)
+	if err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
+	// Only {cluster} in the storage path queries ClickHouse
+	if err := expandConfigPlaceholders(ctx, config, clickhousedump.NewClickHouseClient(config), time.Now()); err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
+	return clickhousedump.DiffBackups(config, cmd.Args().Get(0), cmd.Args().Get(1), os.Stdout)
+}
+
+// RunListTables prints the databases and tables a dump would include, it queries ClickHouse only.
+func RunListTables(ctx context.Context, cmd *cli.Command) error {
+	config, err := getConfig(cmd)
+	if err != nil {
+		return &clickhousedump.ConfigError{Err: err}
+	}
+
+	client := clickhousedump.NewClickHouseClient(config)
+	if err := checkClickHouseVersion(ctx, client); err != nil {
+		return err
+	}
+	return clickhousedump.ListTables(ctx, config, client, os.Stdout, cmd.Bool("json"))
+}
+
 // checkClickHouseVersion verifies that the ClickHouse server is at least version 24.10
-func checkClickHouseVersion(client *ClickHouseClient) error {
+func checkClickHouseVersion(ctx context.Context, client *clickhousedump.ClickHouseClient) error {
 	query := "SELECT version()"
-	respBytes, err := client.ExecuteQuery(query)
+	respBytes, err := client.ExecuteQuery(ctx, query)
 	if err != nil {
-		return fmt.Errorf("failed to check ClickHouse version: %w", err)
+		return &clickhousedump.ConnectionError{Err: fmt.Errorf("failed to check ClickHouse version: %w", err)}
 	}
 
 	version := strings.TrimSpace(string(respBytes))
-	log.Printf("Connected to ClickHouse version: %s", version)
+	logging.Infof("Connected to ClickHouse version: %s", version)
 
 	// Extract major and minor version numbers
 	parts := strings.Split(version, ".")
@@ -300,78 +959,572 @@ func checkClickHouseVersion(client *ClickHouseClient) error {
 	return nil
 }
 
+var placeholderRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// expandPlaceholders replaces {name} placeholders in value, unknown names are an error to catch typos.
+func expandPlaceholders(value string, values map[string]string) (string, error) {
+	var unknown []string
+	expanded := placeholderRe.ReplaceAllStringFunc(value, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if v, ok := values[name]; ok {
+			return v
+		}
+		unknown = append(unknown, placeholder)
+		return placeholder
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown placeholder %s in %q, supported are {date}, {datetime}, {host}, {cluster}", strings.Join(unknown, ", "), value)
+	}
+	return expanded, nil
+}
+
+// expandConfigPlaceholders expands placeholders in --storage-path, --mirror-storage paths and the backup name.
+// {date} and {datetime} use UTC, {host} is --host and {cluster} is the 'cluster' macro of the server.
+func expandConfigPlaceholders(ctx context.Context, config *clickhousedump.Config, client *clickhousedump.ClickHouseClient, now time.Time) error {
+	templates := []string{config.StorageConfig["path"], config.BackupName}
+	for _, mirror := range config.Mirrors {
+		templates = append(templates, mirror.StorageConfig["path"])
+	}
+	if !placeholderRe.MatchString(strings.Join(templates, "")) {
+		return nil
+	}
+	now = now.UTC()
+	values := map[string]string{
+		"date":     now.Format("2006-01-02"),
+		"datetime": now.Format("2006-01-02T15-04-05"),
+		"host":     config.Host,
+	}
+	if strings.Contains(strings.Join(templates, ""), "{cluster}") {
+		resp, err := client.ExecuteQuery(ctx, "SELECT getMacro('cluster')")
+		if err != nil {
+			return fmt.Errorf("{cluster} requires the 'cluster' macro in the ClickHouse server config: %w", err)
+		}
+		values["cluster"] = strings.TrimSpace(string(resp))
+	}
+
+	var err error
+	if config.StorageConfig["path"], err = expandPlaceholders(config.StorageConfig["path"], values); err != nil {
+		return err
+	}
+	if config.BackupName, err = expandPlaceholders(config.BackupName, values); err != nil {
+		return err
+	}
+	for i := range config.Mirrors {
+		if config.Mirrors[i].StorageConfig["path"], err = expandPlaceholders(config.Mirrors[i].StorageConfig["path"], values); err != nil {
+			return err
+		}
+	}
+	logging.Infof("Using storage path %q and backup name %q", config.StorageConfig["path"], config.BackupName)
+	return nil
+}
+
 // getConfig extracts configuration from command line context, including storage details.
-func getConfig(cmd *cli.Command) (*Config, error) {
+func getConfig(cmd *cli.Command) (*clickhousedump.Config, error) {
+	logLevel, err := logging.ParseLevel(cmd.String("log-level"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --log-level: %w", err)
+	}
+	if cmd.Bool("debug") && cmd.Bool("quiet") {
+		return nil, fmt.Errorf("--debug and --quiet can't be used together")
+	}
+	if cmd.Bool("debug") {
+		logLevel = logging.LevelDebug
+	}
+	if cmd.Bool("quiet") {
+		logLevel = logging.LevelError
+	}
+	logging.SetLevel(logLevel)
+
 	// Basic ClickHouse config
-	config := &Config{
+	config := &clickhousedump.Config{
 		Host:             cmd.String("host"),
 		Port:             cmd.Int("port"),
 		User:             cmd.String("user"),
 		Password:         cmd.String("password"),
+		HTTPPath:         cmd.String("ch-path"),
+		DefaultDatabase:  cmd.String("ch-database"),
+		AccessToken:      cmd.String("ch-access-token"),
+		Secure:           cmd.Bool("secure"),
 		Databases:        cmd.String("databases"),
 		ExcludeDatabases: cmd.String("exclude-databases"),
 		Tables:           cmd.String("tables"),
 		ExcludeTables:    cmd.String("exclude-tables"),
+		ExcludeColumns:   cmd.String("exclude-columns"),
 		BatchSize:        cmd.Int("batch-size"),
-		CompressFormat:   cmd.String("compress-format"),
+		CompressFormat:   strings.ToLower(cmd.String("compress-format")),
 		CompressLevel:    cmd.Int("compress-level"),
+		CompressionMode:  strings.ToLower(cmd.String("compression-mode")),
 		StorageType:      strings.ToLower(cmd.String("storage-type")),
 		StorageConfig: map[string]string{
-			"host":      cmd.String("storage-host"),
-			"user":      cmd.String("storage-user"),
-			"password":  cmd.String("storage-password"),
-			"path":      cmd.String("storage-path"),
-			"bucket":    cmd.String("storage-bucket"),
-			"region":    cmd.String("storage-region"),
-			"account":   cmd.String("storage-account"),
-			"key":       cmd.String("storage-key"),
-			"endpoint":  cmd.String("storage-endpoint"),
-			"container": cmd.String("storage-container"),
+			"host":                    cmd.String("storage-host"),
+			"user":                    cmd.String("storage-user"),
+			"password":                cmd.String("storage-password"),
+			"path":                    cmd.String("storage-path"),
+			"bucket":                  cmd.String("storage-bucket"),
+			"region":                  cmd.String("storage-region"),
+			"account":                 cmd.String("storage-account"),
+			"key":                     cmd.String("storage-key"),
+			"endpoint":                cmd.String("storage-endpoint"),
+			"container":               cmd.String("storage-container"),
+			"s3_request_payer":        cmd.String("s3-request-payer"),
+			"s3_storage_class":        cmd.String("s3-storage-class"),
+			"s3_credential_process":   cmd.String("s3-credential-process"),
+			"gcs_auth":                cmd.String("gcs-auth"),
+			"s3_part_size":            strconv.FormatInt(cmd.Int64("s3-part-size"), 10),
+			"s3_upload_concurrency":   strconv.Itoa(cmd.Int("s3-upload-concurrency")),
+			"s3_download_concurrency": strconv.Itoa(cmd.Int("s3-download-concurrency")),
+			"oci_access_key":          cmd.String("oci-access-key"),
+			"oci_namespace":           cmd.String("oci-namespace"),
+			"content_type":            cmd.String("storage-content-type"),
+			"azblob_tier":             cmd.String("azblob-tier"),
+			"sftp_keepalive_interval": cmd.Duration("sftp-keepalive-interval").String(),
+			"sftp_concurrency":        strconv.Itoa(cmd.Int("sftp-concurrency")),
 		},
-		Debug:    cmd.Bool("debug"),
-		Parallel: cmd.Int("parallel"),
+		Debug:               logLevel == logging.LevelDebug,
+		Parallel:            cmd.Int("parallel"),
+		SchemaParallel:      cmd.Int("schema-parallel"),
+		DataParallel:        cmd.Int("data-parallel"),
+		TmpDir:              cmd.String("tmp-dir"),
+		RestoreMaxQuerySize: cmd.Int("restore-max-query-size"),
+		ListRetries:         cmd.Int("list-retries"),
+		ChunkRows:           cmd.Int("chunk-rows"),
+		TableTimeout:        cmd.Duration("table-timeout"),
+		ContinueOnError:     cmd.Bool("continue-on-error"),
+		FailIfExists:        cmd.Bool("fail-if-exists"),
+		Overwrite:           cmd.Bool("overwrite"),
+		StripUUID:           cmd.Bool("strip-uuid"),
+		IncludeFunctions:    cmd.Bool("include-functions"),
+		ZstdDict:            cmd.Bool("zstd-dict"),
+		ResumeRestore:       cmd.Bool("resume-restore"),
+		Consistent:          cmd.Bool("consistent"),
+	}
+
+	for _, engine := range strings.Split(cmd.String("skip-data-engines"), ",") {
+		if engine = strings.TrimSpace(engine); engine != "" {
+			config.SkipDataEngines = append(config.SkipDataEngines, engine)
+		}
+	}
+	for _, setting := range strings.Split(cmd.String("strip-settings"), ",") {
+		if setting = strings.TrimSpace(setting); setting != "" {
+			config.StripSettings = append(config.StripSettings, setting)
+		}
+	}
+	config.StripAllSettings = cmd.Bool("strip-all-settings")
+	config.VerifySchema = cmd.Bool("verify-schema")
+	config.VerifySchemaStrict = cmd.Bool("verify-schema-strict")
+	if config.VerifySchemaStrict && !config.VerifySchema {
+		return nil, fmt.Errorf("--verify-schema-strict requires --verify-schema")
+	}
+	config.WaitReplicas = cmd.Duration("wait-replicas")
+	if config.WaitReplicas < 0 {
+		return nil, fmt.Errorf("--wait-replicas must not be negative")
+	}
+	for _, pattern := range cmd.StringSlice("skip-file") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --skip-file %q: %w", pattern, err)
+		}
+		config.SkipFiles = append(config.SkipFiles, pattern)
+	}
+	config.SkipMissing = cmd.Bool("skip-missing")
+	for _, only := range cmd.StringSlice("only") {
+		if db, table, ok := strings.Cut(only, "."); !ok || db == "" || table == "" {
+			return nil, fmt.Errorf("invalid --only %q, expected db.table", only)
+		}
+		config.Only = append(config.Only, only)
+	}
+	config.SchemaOnly = cmd.Bool("schema-only")
+
+	dataFormat, err := clickhousedump.NormalizeDataFormat(cmd.String("data-format"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --data-format: %w", err)
+	}
+	config.DataFormat = dataFormat
+	config.SQLInsertOmitColumnNames = !cmd.Bool("sql-insert-column-names")
+	config.SQLInsertUnquotedNames = !cmd.Bool("sql-insert-quote-names")
+	config.SQLInsertUseReplace = cmd.Bool("sql-insert-use-replace")
+	if dataFormat != clickhousedump.DataFormatSQLInsert {
+		for _, flag := range []string{"sql-insert-column-names", "sql-insert-quote-names", "sql-insert-use-replace"} {
+			if cmd.IsSet(flag) {
+				return nil, fmt.Errorf("--%s requires --data-format=SQLInsert", flag)
+			}
+		}
+	}
+	if config.SQLInsertOmitColumnNames && config.ExcludeColumns != "" {
+		return nil, fmt.Errorf("--exclude-columns requires --sql-insert-column-names, restore inserts only the dumped columns")
+	}
+	if config.SQLInsertOmitColumnNames && config.SQLInsertUnquotedNames {
+		logging.Warnf("--sql-insert-quote-names=false has no effect with --sql-insert-column-names=false")
+	}
+
+	if config.ChunkRows < 0 {
+		return nil, fmt.Errorf("--chunk-rows must not be negative")
+	}
+
+	if config.RestoreMaxQuerySize < 0 {
+		return nil, fmt.Errorf("--restore-max-query-size must not be negative")
+	}
+	config.RestoreStatementParallel = cmd.Int("restore-statement-parallel")
+	config.RestoreAsyncInsert = cmd.Bool("restore-async-insert")
+	config.FailFast = cmd.Bool("fail-fast")
+	if config.FailFast && config.ContinueOnError {
+		return nil, fmt.Errorf("--fail-fast can't be used with --continue-on-error, the manifest would miss the stopped tables")
+	}
+	if config.RestoreStatementParallel < 1 {
+		return nil, fmt.Errorf("--restore-statement-parallel must be at least 1, got %d", config.RestoreStatementParallel)
+	}
+	if config.RestoreStatementParallel > 1 && config.ResumeRestore {
+		return nil, fmt.Errorf("--restore-statement-parallel can't be combined with --resume-restore, statements finishing out of order can't be resumed")
+	}
+
+	if config.ListRetries < 0 {
+		return nil, fmt.Errorf("--list-retries must not be negative")
+	}
+
+	if config.Secure && !cmd.IsSet("port") {
+		config.Port = 8443
+	}
+	if config.AccessToken != "" && !config.Secure {
+		logging.Warnf("--ch-access-token is sent over plain HTTP, use --secure unless a TLS proxy is in between")
+	}
+	if config.Headers, err = clickhousedump.ParseHeaders(cmd.StringSlice("ch-header")); err != nil {
+		return nil, fmt.Errorf("invalid --ch-header: %w", err)
+	}
+	if _, ok := config.Headers["X-Clickhouse-Key"]; ok && !config.Secure {
+		logging.Warnf("--ch-header X-ClickHouse-Key is sent over plain HTTP, use --secure unless a TLS proxy is in between")
+	}
+	_, headerUser := config.Headers["X-Clickhouse-User"]
+	_, headerKey := config.Headers["X-Clickhouse-Key"]
+	if config.AccessToken != "" && (headerUser || headerKey) {
+		return nil, fmt.Errorf("--ch-access-token can't be used together with the X-ClickHouse-User and X-ClickHouse-Key headers of --ch-header")
+	}
+
+	if config.FailIfExists && config.Overwrite {
+		return nil, fmt.Errorf("--fail-if-exists and --overwrite can't be used together")
+	}
+
+	if config.TableTimeout < 0 {
+		return nil, fmt.Errorf("--table-timeout must not be negative")
 	}
 
 	if config.Parallel < 1 {
 		return nil, fmt.Errorf("--parallel must be at least 1")
 	}
 
-	if config.ExcludeDatabases == "" {
+	if config.SchemaParallel < 0 || config.DataParallel < 0 {
+		return nil, fmt.Errorf("--schema-parallel and --data-parallel must not be negative")
+	}
+
+	if config.Consistent && (config.Parallel > 1 || config.SchemaParallel > 1 || config.DataParallel > 1) {
+		logging.Warnf("--consistent runs queries in a single ClickHouse session one at a time, ignoring --parallel=%d, --schema-parallel=%d and --data-parallel=%d", config.Parallel, config.SchemaParallel, config.DataParallel)
+		config.Parallel = 1
+		config.SchemaParallel = 1
+		config.DataParallel = 1
+	}
+
+	if config.TmpDir != "" {
+		if err := checkWritableDir(config.TmpDir); err != nil {
+			return nil, fmt.Errorf("--tmp-dir %s is not usable: %w", config.TmpDir, err)
+		}
+	}
+
+	if cmd.IsSet("s3-path-style") {
+		config.StorageConfig["s3_path_style"] = strconv.FormatBool(cmd.Bool("s3-path-style"))
+	}
+	if partSize := cmd.Int64("s3-part-size"); partSize < storage.S3MinPartSize {
+		return nil, fmt.Errorf("--s3-part-size must be at least %d bytes, got %d", storage.S3MinPartSize, partSize)
+	}
+	if cmd.Int("s3-upload-concurrency") < 1 || cmd.Int("s3-download-concurrency") < 1 {
+		return nil, fmt.Errorf("--s3-upload-concurrency and --s3-download-concurrency must be at least 1")
+	}
+	if cmd.Int("azblob-download-concurrency") < 1 {
+		return nil, fmt.Errorf("--azblob-download-concurrency must be at least 1")
+	}
+	config.StorageConfig["azblob_download_concurrency"] = strconv.Itoa(cmd.Int("azblob-download-concurrency"))
+	if cmd.Duration("sftp-keepalive-interval") < 0 || cmd.Int("sftp-concurrency") < 1 {
+		return nil, fmt.Errorf("--sftp-keepalive-interval can't be negative and --sftp-concurrency must be at least 1")
+	}
+
+	config.CompressFormatSet = cmd.IsSet("compress-format")
+	config.SchemaCompressFormat = strings.ToLower(cmd.String("schema-compress-format"))
+	config.DataCompressFormat = strings.ToLower(cmd.String("data-compress-format"))
+	config.WireCompressFormat = strings.ToLower(cmd.String("wire-compress-format"))
+	switch config.CompressFormat {
+	case "gzip", "zstd", "none", clickhousedump.CompressFormatAuto:
+	default:
+		return nil, fmt.Errorf("unsupported --compress-format: %s, expected gzip, zstd, none or auto", config.CompressFormat)
+	}
+	for _, override := range []struct{ flag, format string }{
+		{"schema-compress-format", config.SchemaCompressFormat},
+		{"data-compress-format", config.DataCompressFormat},
+	} {
+		switch override.format {
+		case "", "gzip", "zstd", "none", clickhousedump.CompressFormatAuto:
+		default:
+			return nil, fmt.Errorf("unsupported --%s: %s, expected gzip, zstd, none or auto", override.flag, override.format)
+		}
+	}
+	switch config.WireCompressFormat {
+	case "", "gzip", "zstd", "none":
+	default:
+		return nil, fmt.Errorf("unsupported --wire-compress-format: %s, expected gzip, zstd or none", config.WireCompressFormat)
+	}
+	config.RestoreCompressFormat = strings.ToLower(cmd.String("restore-compress-format"))
+	config.MinFreeSpace = cmd.Int64("min-free-space")
+	config.Freeze = cmd.Bool("freeze")
+	if cmd.Bool("safe-mode") {
+		if config.Freeze {
+			return nil, fmt.Errorf("--safe-mode can't be used with --freeze, readonly rejects ALTER TABLE FREEZE")
+		}
+		if config.SafeModeSettings, err = clickhousedump.SafeModeSettings(cmd.StringSlice("safe-setting")); err != nil {
+			return nil, fmt.Errorf("invalid --safe-setting: %w", err)
+		}
+	} else if len(cmd.StringSlice("safe-setting")) > 0 {
+		return nil, fmt.Errorf("--safe-setting requires --safe-mode")
+	}
+	config.Final = cmd.Bool("final")
+	config.AllowSystem = cmd.Bool("allow-system")
+	config.UserAgent = cmd.String("user-agent")
+	if config.UserAgent == "" {
+		config.UserAgent = "clickhouse-dump/" + version
+	}
+	config.QueryIDPrefix = cmd.String("query-id-prefix")
+	config.IncludeNamedCollections = cmd.Bool("include-named-collections")
+	config.DumpComments = cmd.Bool("dump-comments")
+	config.MaxInflightBytes = cmd.Int64("max-inflight-bytes")
+	if config.MaxInflightBytes < 0 {
+		return nil, fmt.Errorf("--max-inflight-bytes must not be negative")
+	}
+	config.LocalCache = cmd.String("local-cache")
+	config.PreferLocalCache = cmd.Bool("prefer-local-cache")
+	if config.PreferLocalCache && config.LocalCache == "" {
+		return nil, fmt.Errorf("--prefer-local-cache requires --local-cache")
+	}
+	config.ConnectTimeout = cmd.Duration("connect-timeout")
+	config.ReadTimeout = cmd.Duration("read-timeout")
+	if config.ConnectTimeout < 0 || config.ReadTimeout < 0 {
+		return nil, fmt.Errorf("--connect-timeout and --read-timeout must not be negative")
+	}
+	config.CHRetries = cmd.Int("ch-retries")
+	if config.CHRetries < 0 {
+		return nil, fmt.Errorf("--ch-retries must not be negative")
+	}
+	config.AdaptiveCompression = cmd.Bool("adaptive-compression")
+	config.VerifyUpload = cmd.Bool("verify-upload")
+	config.CreateBucket = cmd.Bool("create-bucket")
+	config.Latest = cmd.Bool("latest")
+	config.BackupMatch = cmd.String("match")
+	if _, err := regexp.Compile(config.BackupMatch); err != nil {
+		return nil, fmt.Errorf("invalid --match: %w", err)
+	}
+	if config.BackupMatch != "" && !config.Latest {
+		return nil, fmt.Errorf("--match requires --latest")
+	}
+	config.Archive = cmd.Bool("archive")
+	if config.Archive && (config.StorageType == "stdout" || config.StorageType == "stdin") {
+		return nil, fmt.Errorf("--archive can't be used with %s storage, it is a single stream already", config.StorageType)
+	}
+	if config.Archive && config.Latest {
+		return nil, fmt.Errorf("--latest can't be used with --archive, archived backups are found by their exact name")
+	}
+	config.VerifyAfterDump = cmd.Bool("verify-after-dump")
+	if config.VerifyAfterDump && (config.StorageType == "stdout" || config.Archive) {
+		return nil, fmt.Errorf("--verify-after-dump can't read back stdout streams and --archive backups")
+	}
+	config.ServerLocalRestore = cmd.Bool("server-local-restore")
+	if config.ServerLocalRestore && (config.StorageType != "file" || config.Archive) {
+		return nil, fmt.Errorf("--server-local-restore requires file storage without --archive, got %s", config.StorageType)
+	}
+	if dumpQueryFile := cmd.String("dump-query-file"); dumpQueryFile != "" {
+		if config.DumpQueries, err = clickhousedump.LoadDumpQueries(dumpQueryFile); err != nil {
+			return nil, fmt.Errorf("invalid --dump-query-file: %w", err)
+		}
+	}
+	tableOrder, err := clickhousedump.NormalizeTableOrder(cmd.String("table-order"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --table-order: %w", err)
+	}
+	config.TableOrder = tableOrder
+	config.PreDumpSQL = cmd.String("pre-dump-sql")
+	config.PostDumpSQL = cmd.String("post-dump-sql")
+	config.PreRestoreSQL = cmd.String("pre-restore-sql")
+	config.PostRestoreSQL = cmd.String("post-restore-sql")
+	config.IgnoreHookErrors = cmd.Bool("ignore-hook-errors")
+	if config.MinFreeSpace < 0 {
+		return nil, fmt.Errorf("--min-free-space must not be negative, got %d", config.MinFreeSpace)
+	}
+	switch config.RestoreCompressFormat {
+	case "gzip", "zstd", "none":
+	default:
+		return nil, fmt.Errorf("unsupported --restore-compress-format: %s, expected gzip, zstd or none", config.RestoreCompressFormat)
+	}
+	schemaFormat := config.SchemaCompressFormat
+	if schemaFormat == "" {
+		schemaFormat = config.CompressFormat
+	}
+	if config.ZstdDict && schemaFormat != "zstd" {
+		return nil, fmt.Errorf("--zstd-dict requires zstd schema files, --compress-format=zstd or --schema-compress-format=zstd, got %s", schemaFormat)
+	}
+
+	switch config.CompressionMode {
+	case storage.CompressionModeExtension:
+	case storage.CompressionModeTransparent:
+		if !supportsContentEncoding(config.StorageType) {
+			return nil, fmt.Errorf("--compression-mode=transparent requires a storage type with Content-Encoding metadata (s3, oci, gcs, azblob), got %s", config.StorageType)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported --compression-mode: %s", config.CompressionMode)
+	}
+
+	config.Layout = cmd.String("layout")
+	if err := clickhousedump.ValidateLayout(config.Layout); err != nil {
+		return nil, fmt.Errorf("invalid --layout: %w", err)
+	}
+	config.LiteralNames = cmd.Bool("literal-names")
+	if config.LiteralNames {
+		// The regexp defaults would be taken as names
+		if !cmd.IsSet("databases") {
+			config.Databases = ""
+		}
+		if !cmd.IsSet("tables") {
+			config.Tables = ""
+		}
+		if !cmd.IsSet("exclude-databases") {
+			config.ExcludeDatabases = ""
+		}
+	} else if config.ExcludeDatabases == "" && !cmd.IsSet("exclude-databases") && !config.AllowSystem {
+		// An explicitly empty --exclude-databases excludes nothing, system databases are still
+		// skipped without --allow-system
 		config.ExcludeDatabases = "^system$|^INFORMATION_SCHEMA$|^information_schema$"
 	}
-	// Populate StorageConfig based on StorageType
-	switch config.StorageType {
+	if err := validateStorageConfig(config.StorageType, config.StorageConfig); err != nil {
+		return nil, err
+	}
+
+	for _, spec := range cmd.StringSlice("mirror-storage") {
+		mirror, err := parseMirrorStorage(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --mirror-storage %q: %w", spec, err)
+		}
+		if err := validateStorageConfig(mirror.StorageType, mirror.StorageConfig); err != nil {
+			return nil, fmt.Errorf("invalid --mirror-storage %q: %w", spec, err)
+		}
+		if config.CompressionMode == storage.CompressionModeTransparent && !supportsContentEncoding(mirror.StorageType) {
+			return nil, fmt.Errorf("--compression-mode=transparent requires mirror storage types with Content-Encoding metadata (s3, oci, gcs, azblob), got %s", mirror.StorageType)
+		}
+		config.Mirrors = append(config.Mirrors, mirror)
+	}
+
+	// Basic validation for ClickHouse connection details (optional, depends on requirements)
+	if config.Host == "" {
+		return nil, fmt.Errorf("clickhouse host is required")
+	}
+
+	return config, nil
+}
+
+// checkWritableDir verifies that dir exists, is a directory and that a file can be created in it.
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	probe, err := os.CreateTemp(dir, ".clickhouse-dump-probe-*")
+	if err != nil {
+		return err
+	}
+	probeName := probe.Name()
+	if closeErr := probe.Close(); closeErr != nil {
+		_ = os.Remove(probeName)
+		return closeErr
+	}
+	return os.Remove(probeName)
+}
+
+// validateStorageConfig checks that storage options required by storageType are set.
+func validateStorageConfig(storageType string, storageConfig map[string]string) error {
+	switch storageType {
 	case "file":
 		// For file storage, path is required and treated as local directory
-		if config.StorageConfig["path"] == "" {
-			return nil, fmt.Errorf("storage-path is required for file storage type")
+		if storageConfig["path"] == "" {
+			return fmt.Errorf("storage-path is required for file storage type")
 		}
 	case "s3":
-		if config.StorageConfig["bucket"] == "" {
-			return nil, fmt.Errorf("storage-bucket is required for s3 storage type")
+		if storageConfig["bucket"] == "" {
+			return fmt.Errorf("storage-bucket is required for s3 storage type")
+		}
+		if payer := storageConfig["s3_request_payer"]; payer != "" && payer != "requester" {
+			return fmt.Errorf("--s3-request-payer must be empty or 'requester', got %s", payer)
+		}
+		if storageConfig["s3_credential_process"] != "" && (storageConfig["account"] != "" || storageConfig["key"] != "") {
+			return fmt.Errorf("--s3-credential-process can't be used with storage-account and storage-key")
+		}
+	case "oci":
+		if storageConfig["bucket"] == "" || clickhousedump.OCINamespace(storageConfig) == "" || storageConfig["region"] == "" {
+			return fmt.Errorf("storage-bucket, oci-namespace and storage-region are required for oci storage type")
+		}
+		if storageConfig["oci_access_key"] == "" || storageConfig["key"] == "" {
+			return fmt.Errorf("oci-access-key and storage-key are required for oci storage type")
 		}
 	case "gcs":
-		if config.StorageConfig["bucket"] == "" {
-			return nil, fmt.Errorf("storage-bucket is required for gcs storage type")
+		if storageConfig["bucket"] == "" {
+			return fmt.Errorf("storage-bucket is required for gcs storage type")
+		}
+		auth, err := storage.ResolveGCSAuth(storageConfig["gcs_auth"], storageConfig["key"])
+		if err != nil {
+			return fmt.Errorf("invalid --gcs-auth: %w", err)
+		}
+		if auth == storage.GCSAuthHMAC && storageConfig["account"] == "" {
+			return fmt.Errorf("storage-account (HMAC access ID) is required for gcs storage type with --gcs-auth=hmac")
 		}
 	case "azblob":
-		if config.StorageConfig["account"] == "" || config.StorageConfig["key"] == "" || config.StorageConfig["container"] == "" {
-			return nil, fmt.Errorf("storage-account, storage-key, and storage-container are required for azblob storage type")
+		if storageConfig["account"] == "" || storageConfig["key"] == "" || storageConfig["container"] == "" {
+			return fmt.Errorf("storage-account, storage-key, and storage-container are required for azblob storage type")
+		}
+		switch strings.ToLower(storageConfig["azblob_tier"]) {
+		case "", "hot", "cool", "archive":
+		default:
+			return fmt.Errorf("--azblob-tier must be Hot, Cool or Archive, got %s", storageConfig["azblob_tier"])
 		}
 	case "sftp", "ftp":
-		if config.StorageConfig["host"] == "" || config.StorageConfig["user"] == "" {
-			return nil, fmt.Errorf("storage-host and storage-user are required for %s storage type", config.StorageType)
+		if storageConfig["host"] == "" || storageConfig["user"] == "" {
+			return fmt.Errorf("storage-host and storage-user are required for %s storage type", storageType)
 		}
+	case "stdout", "stdin":
+		// Single framed stream on the standard output (dump) or input (restore), no options
 	case "":
-		return nil, fmt.Errorf("storage-type must be specified")
+		return fmt.Errorf("storage-type must be specified")
 	default:
-		return nil, fmt.Errorf("unsupported storage-type: %s", config.StorageType)
+		return fmt.Errorf("unsupported storage-type: %s", storageType)
 	}
+	return nil
+}
 
-	// Basic validation for ClickHouse connection details (optional, depends on requirements)
-	if config.Host == "" {
-		return nil, fmt.Errorf("clickhouse host is required")
+// supportsContentEncoding reports whether storageType keeps Content-Encoding metadata for --compression-mode=transparent.
+func supportsContentEncoding(storageType string) bool {
+	switch storageType {
+	case "s3", "oci", "gcs", "azblob":
+		return true
 	}
+	return false
+}
 
-	return config, nil
+// parseMirrorStorage parses a --mirror-storage value like "sftp?host=backup:22&user=dump&path=/backups",
+// the query keys are the storage config keys of the primary storage flags.
+func parseMirrorStorage(spec string) (clickhousedump.MirrorConfig, error) {
+	storageType, query, _ := strings.Cut(spec, "?")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return clickhousedump.MirrorConfig{}, err
+	}
+	mirror := clickhousedump.MirrorConfig{
+		StorageType:   strings.ToLower(storageType),
+		StorageConfig: make(map[string]string, len(values)),
+	}
+	for key, value := range values {
+		mirror.StorageConfig[key] = value[len(value)-1]
+	}
+	return mirror, nil
 }
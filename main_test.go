@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/clickhousedump"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v3"
+)
+
+func TestExpandConfigPlaceholders(t *testing.T) {
+	config := &clickhousedump.Config{
+		Host:          "ch1",
+		BackupName:    "{host}-{datetime}",
+		StorageConfig: map[string]string{"path": "backups/{date}"},
+		Mirrors:       []clickhousedump.MirrorConfig{{StorageType: "file", StorageConfig: map[string]string{"path": "/mnt/{date}"}}},
+	}
+	now := time.Date(2024, 6, 1, 23, 30, 5, 0, time.FixedZone("UTC+3", 3*60*60))
+	require.NoError(t, expandConfigPlaceholders(context.Background(), config, nil, now))
+	require.Equal(t, "backups/2024-06-01", config.StorageConfig["path"])
+	require.Equal(t, "ch1-2024-06-01T20-30-05", config.BackupName)
+	require.Equal(t, "/mnt/2024-06-01", config.Mirrors[0].StorageConfig["path"])
+
+	_, err := expandPlaceholders("backups/{dat}", map[string]string{"date": "2024-06-01"})
+	require.ErrorContains(t, err, "unknown placeholder {dat}")
+}
+
+func TestExitCode(t *testing.T) {
+	require.Equal(t, exitConfigError, exitCode(&clickhousedump.ConfigError{Err: errors.New("invalid --log-level")}))
+	require.Equal(t, exitConnection, exitCode(fmt.Errorf("dump: %w", &clickhousedump.ConnectionError{Err: errors.New("connection refused")})))
+	require.Equal(t, exitPartialFailure, exitCode(&clickhousedump.PartialFailureError{Err: errors.New("db.t: timeout")}))
+	require.Equal(t, exitError, exitCode(errors.New("unsupported ClickHouse version")))
+}
+
+func TestDefaultBackupName(t *testing.T) {
+	now := time.Date(2024, 6, 1, 15, 0, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+	require.Equal(t, "auto-20240601-120000", defaultBackupName(now))
+}
+
+func TestBackupNameArg(t *testing.T) {
+	run := func(args ...string) (string, error) {
+		var name string
+		var nameErr error
+		cmd := &cli.Command{
+			Name:  "dump",
+			Flags: []cli.Flag{&cli.StringFlag{Name: "to"}},
+			Action: func(ctx context.Context, cmd *cli.Command) error {
+				name, nameErr = backupNameArg(cmd, "to")
+				return nil
+			},
+		}
+		require.NoError(t, cmd.Run(context.Background(), append([]string{"dump"}, args...)))
+		return name, nameErr
+	}
+
+	name, err := run("nightly")
+	require.NoError(t, err)
+	require.Equal(t, "nightly", name)
+	name, err = run("--to", "nightly")
+	require.NoError(t, err)
+	require.Equal(t, "nightly", name)
+	name, err = run()
+	require.NoError(t, err)
+	require.Empty(t, name)
+	_, err = run("--to", "weekly", "nightly")
+	require.ErrorContains(t, err, "conflicts with --to=weekly")
+}
+
+func TestValidateStorageConfigOCI(t *testing.T) {
+	valid := map[string]string{"bucket": "backups", "oci_namespace": "ns", "region": "us-ashburn-1", "oci_access_key": "id", "key": "secret"}
+	tests := []struct {
+		name    string
+		without string
+		err     string
+	}{
+		{name: "valid"},
+		{name: "bucket", without: "bucket", err: "storage-bucket, oci-namespace and storage-region are required"},
+		{name: "namespace", without: "oci_namespace", err: "storage-bucket, oci-namespace and storage-region are required"},
+		{name: "region", without: "region", err: "storage-bucket, oci-namespace and storage-region are required"},
+		{name: "access key", without: "oci_access_key", err: "oci-access-key and storage-key are required"},
+		{name: "secret key", without: "key", err: "oci-access-key and storage-key are required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageConfig := make(map[string]string, len(valid))
+			for k, v := range valid {
+				storageConfig[k] = v
+			}
+			delete(storageConfig, tt.without)
+			err := validateStorageConfig("oci", storageConfig)
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	// --storage-account still works as the namespace
+	delete(valid, "oci_namespace")
+	valid["account"] = "ns"
+	require.NoError(t, validateStorageConfig("oci", valid))
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, checkWritableDir(dir))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "the probe file is removed")
+
+	require.ErrorIs(t, checkWritableDir(filepath.Join(dir, "missing")), os.ErrNotExist)
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+	require.ErrorContains(t, checkWritableDir(file), "not a directory")
+
+	readOnly := filepath.Join(dir, "read-only")
+	require.NoError(t, os.Mkdir(readOnly, 0o555))
+	t.Cleanup(func() { _ = os.Chmod(readOnly, 0o755) })
+	if os.Geteuid() == 0 {
+		t.Skip("root writes into read-only directories")
+	}
+	require.ErrorIs(t, checkWritableDir(readOnly), os.ErrPermission)
+}
+
+func TestGetConfigExcludeDatabases(t *testing.T) {
+	run := func(args ...string) *clickhousedump.Config {
+		var config *clickhousedump.Config
+		app := newCLIApp()
+		for _, command := range app.Commands {
+			if command.Name == "dump" {
+				command.Action = func(ctx context.Context, cmd *cli.Command) error {
+					var err error
+					config, err = getConfig(cmd)
+					return err
+				}
+			}
+		}
+		args = append([]string{"clickhouse-dump", "--storage-type", "file", "--storage-path", t.TempDir()}, args...)
+		require.NoError(t, app.Run(context.Background(), append(args, "dump", "b1")))
+		return config
+	}
+
+	require.Equal(t, "^system$|^INFORMATION_SCHEMA$|^information_schema$", run().ExcludeDatabases)
+	// With --allow-system an empty exclude matches nothing, without it system databases are
+	// skipped by the dump queries whatever the exclude
+	config := run("--allow-system", "--exclude-databases=")
+	require.True(t, config.AllowSystem)
+	require.Empty(t, config.ExcludeDatabases)
+	config = run("--exclude-databases=")
+	require.False(t, config.AllowSystem)
+	require.Empty(t, config.ExcludeDatabases)
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// ArchiveExt is the extension of backup archives, a backup <path>/<name> is stored as the
+// single object <path>/<name>.tar.
+const ArchiveExt = ".tar"
+
+// errArchiveAborted ends the archive upload when a file couldn't be added to it.
+var errArchiveAborted = errors.New("archive upload aborted, a file couldn't be added")
+
+// ArchiveStorage implements RemoteStorage over another storage and bundles the files of a backup
+// into one tar object, entries are named relative to the backup and keep their compression
+// extension. Dumps spool every file into tmpDir to learn its size for the tar header, then append
+// it to the archive streamed into a single Upload. Restores download the archive of the listed
+// backup once and spool its entries into tmpDir, like StreamStorage.
+type ArchiveStorage struct {
+	remote RemoteStorage
+	prefix string // backup written by Upload, path.Join(storage path, backup name)
+	tmpDir string
+	debug  bool
+
+	mu        sync.Mutex
+	tw        *tar.Writer
+	pipe      *io.PipeWriter
+	uploadErr chan error
+	failed    bool
+	spoolDir  string
+	archives  map[string]bool   // archives spooled by List, by backup prefix
+	files     map[string]string // listed file names to spooled files
+	decoding
+}
+
+// debugf logs only if debug is enabled
+func (a *ArchiveStorage) debugf(format string, args ...interface{}) {
+	if a.debug || logging.Enabled(logging.LevelDebug) {
+		log.Printf("[archive:debug] "+format, args...)
+	}
+}
+
+// NewArchiveStorage creates an ArchiveStorage writing the backup prefix into prefix+ArchiveExt.
+func NewArchiveStorage(remote RemoteStorage, prefix, tmpDir string, debug bool) (*ArchiveStorage, error) {
+	if !debug && os.Getenv("LOG_LEVEL") == "debug" {
+		debug = true
+	}
+	return &ArchiveStorage{
+		remote:   remote,
+		prefix:   strings.TrimSuffix(prefix, "/"),
+		tmpDir:   tmpDir,
+		debug:    debug,
+		archives: make(map[string]bool),
+		files:    make(map[string]string),
+	}, nil
+}
+
+// Upload compresses filename into a temporary file, then appends it to the archive. Files are
+// compressed in parallel, appending is serialized because the archive is sequential.
+func (a *ArchiveStorage) Upload(filename string, reader io.Reader, compressFormat string, compressLevel int, contentEncoding string) error {
+	name, ok := strings.CutPrefix(strings.TrimPrefix(filename, "/"), strings.TrimPrefix(a.prefix, "/")+"/")
+	if !ok {
+		return fmt.Errorf("%s is outside of the archived backup %s", filename, a.prefix)
+	}
+	finalReader := reader
+	if contentEncoding != "" {
+		name += extensionForEncoding(contentEncoding)
+	} else {
+		var ext string
+		finalReader, ext = compressStream(reader, compressFormat, compressLevel)
+		name += ext
+	}
+	tmp, err := os.CreateTemp(a.tmpDir, "clickhouse-dump-archive-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", filename, err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	size, err := io.Copy(tmp, finalReader)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind temporary file of %s: %w", filename, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.failed {
+		return fmt.Errorf("can't add %s, writing the archive failed before", filename)
+	}
+	if a.tw == nil {
+		a.start()
+	}
+	a.debugf("Adding %s to %s%s, %d bytes", name, a.prefix, ArchiveExt, size)
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return a.fail(fmt.Errorf("failed to add %s to archive: %w", filename, err))
+	}
+	if _, err := io.Copy(a.tw, tmp); err != nil {
+		return a.fail(fmt.Errorf("failed to add %s to archive: %w", filename, err))
+	}
+	return nil
+}
+
+// start begins the upload of the archive, the tar stream is piped into a single Upload.
+func (a *ArchiveStorage) start() {
+	pipeReader, pipeWriter := io.Pipe()
+	a.pipe = pipeWriter
+	a.tw = tar.NewWriter(pipeWriter)
+	a.uploadErr = make(chan error, 1)
+	go func() {
+		err := a.remote.Upload(a.prefix+ArchiveExt, pipeReader, "none", 0, "")
+		// Unblocks writes to the pipe when the upload failed early
+		_ = pipeReader.CloseWithError(err)
+		a.uploadErr <- err
+	}()
+}
+
+// fail aborts the archive upload, so a partly written archive is never stored as complete.
+func (a *ArchiveStorage) fail(err error) error {
+	a.failed = true
+	_ = a.pipe.CloseWithError(errArchiveAborted)
+	return err
+}
+
+// List downloads and spools the archive of prefix on first call and returns its files.
+func (a *ArchiveStorage) List(prefix string, recursive bool) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !a.archives[prefix] {
+		if err := a.spool(prefix); err != nil {
+			return nil, err
+		}
+		a.archives[prefix] = true
+	}
+	var result []string
+	for name := range a.files {
+		if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			continue
+		}
+		if !recursive && strings.Contains(strings.TrimPrefix(name, prefix+"/"), "/") {
+			continue
+		}
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// spool extracts the entries of prefix+ArchiveExt into the spool directory, a missing archive
+// lists nothing.
+func (a *ArchiveStorage) spool(prefix string) error {
+	archive := prefix + ArchiveExt
+	listed, err := a.remote.List(archive, true)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to list %s: %w", archive, err)
+	}
+	found := false
+	for _, name := range listed {
+		if path.Base(name) == path.Base(archive) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		a.debugf("Archive %s not found", archive)
+		return nil
+	}
+	if a.spoolDir == "" {
+		if a.spoolDir, err = os.MkdirTemp(a.tmpDir, "clickhouse-dump-archive-*"); err != nil {
+			return fmt.Errorf("failed to create archive spool directory: %w", err)
+		}
+	}
+	reader, err := a.remote.Download(archive)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", archive, err)
+	}
+	defer func() {
+		if closeErr := reader.Close(); closeErr != nil {
+			logging.Warnf("can't close %s: %v", archive, closeErr)
+		}
+	}()
+	tr := tar.NewReader(reader)
+	count := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s, the archive is truncated or corrupted: %w", archive, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean("/" + header.Name)[1:]
+		if err := a.spoolEntry(tr, path.Join(prefix, name)); err != nil {
+			return fmt.Errorf("failed to read %s from %s: %w", name, archive, err)
+		}
+		count++
+	}
+	logging.Infof("Read %d files from archive %s", count, archive)
+	return nil
+}
+
+func (a *ArchiveStorage) spoolEntry(reader io.Reader, name string) error {
+	f, err := os.CreateTemp(a.spoolDir, "file-*"+path.Ext(name))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			logging.Warnf("can't close spool file %s: %v", f.Name(), closeErr)
+		}
+	}()
+	if _, err := io.Copy(f, reader); err != nil {
+		return err
+	}
+	a.files[name] = f.Name()
+	a.debugf("Spooled %s to %s", name, f.Name())
+	return nil
+}
+
+// Download opens a file spooled by List.
+func (a *ArchiveStorage) Download(filename string) (io.ReadCloser, error) {
+	a.mu.Lock()
+	spooled, ok := a.files[filename]
+	a.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("file %s not found in archive: %w", filename, os.ErrNotExist)
+	}
+	f, err := os.Open(spooled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spooled file %s: %w", filename, err)
+	}
+	return a.decompressStream(f, filename), nil
+}
+
+// Size returns the size of a file spooled by List.
+func (a *ArchiveStorage) Size(filename string) (int64, error) {
+	a.mu.Lock()
+	spooled, ok := a.files[filename]
+	a.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("file %s not found in archive: %w", filename, os.ErrNotExist)
+	}
+	info, err := os.Stat(spooled)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat spooled file %s: %w", filename, err)
+	}
+	return info.Size(), nil
+}
+
+// Delete drops a listed file, the archive object itself is replaced as a whole by the next dump.
+func (a *ArchiveStorage) Delete(filename string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if spooled, ok := a.files[filename]; ok {
+		delete(a.files, filename)
+		return os.Remove(spooled)
+	}
+	return nil
+}
+
+// Finish finishes the written archive and waits for its upload, it does nothing when nothing
+// was written or the archive is already finished.
+func (a *ArchiveStorage) Finish() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.finish()
+}
+
+func (a *ArchiveStorage) finish() error {
+	if a.tw == nil {
+		return nil
+	}
+	var closeErr error
+	if !a.failed {
+		if closeErr = a.tw.Close(); closeErr != nil {
+			closeErr = a.fail(fmt.Errorf("failed to finish archive: %w", closeErr))
+		} else {
+			_ = a.pipe.Close()
+		}
+	}
+	a.tw = nil
+	if err := <-a.uploadErr; err != nil {
+		return errors.Join(closeErr, fmt.Errorf("failed to upload %s%s: %w", a.prefix, ArchiveExt, err))
+	}
+	a.debugf("Uploaded %s%s", a.prefix, ArchiveExt)
+	return closeErr
+}
+
+// Close finishes the written archive, removes spooled files and closes the underlying storage.
+func (a *ArchiveStorage) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	errs := []error{a.finish()}
+	if a.spoolDir != "" {
+		errs = append(errs, os.RemoveAll(a.spoolDir))
+		a.spoolDir = ""
+		clear(a.files)
+		clear(a.archives)
+	}
+	errs = append(errs, a.remote.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveStorageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	remote, err := NewFileStorage(dir, false)
+	require.NoError(t, err)
+	writer, err := NewArchiveStorage(remote, filepath.Join(dir, "backup"), t.TempDir(), false)
+	require.NoError(t, err)
+
+	// A missing archive lists nothing, e.g. when the dump checks for an existing backup
+	listed, err := writer.List(filepath.Join(dir, "backup"), true)
+	require.NoError(t, err)
+	require.Empty(t, listed)
+
+	files := map[string]string{
+		"db.database.sql": "CREATE DATABASE IF NOT EXISTS db",
+		"db/t.schema.sql": "CREATE TABLE db.t (s String) ENGINE = Log",
+		"db/t.data.sql":   strings.Repeat("INSERT INTO `db`.`t` VALUES ('x');\n", 100000),
+		"manifest.json":   `{"version":1}`,
+	}
+	var wg sync.WaitGroup
+	for name, content := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, writer.Upload(filepath.Join(dir, "backup", name), strings.NewReader(content), "zstd", 1, ""))
+		}()
+	}
+	wg.Wait()
+	require.Error(t, writer.Upload(filepath.Join(dir, "other", "t.sql"), strings.NewReader(""), "none", 0, ""))
+	require.NoError(t, writer.Finish())
+	require.NoError(t, writer.Close())
+
+	// One object, entries named relative to the backup with their compression extension
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "backup.tar", entries[0].Name())
+	f, err := os.Open(filepath.Join(dir, "backup.tar"))
+	require.NoError(t, err)
+	var names []string
+	tr := tar.NewReader(f)
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		names = append(names, header.Name)
+	}
+	require.NoError(t, f.Close())
+	require.ElementsMatch(t, []string{"db.database.sql.zstd", "db/t.schema.sql.zstd", "db/t.data.sql.zstd", "manifest.json.zstd"}, names)
+
+	remote, err = NewFileStorage(dir, false)
+	require.NoError(t, err)
+	reader, err := NewArchiveStorage(remote, filepath.Join(dir, "backup"), t.TempDir(), false)
+	require.NoError(t, err)
+	prefix := filepath.Join(dir, "backup")
+	listed, err = reader.List(prefix, true)
+	require.NoError(t, err)
+	require.Len(t, listed, len(files))
+	for _, name := range listed {
+		r, err := reader.Download(name)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, files[strings.TrimSuffix(strings.TrimPrefix(name, prefix+"/"), ".zstd")], string(data))
+	}
+	size, err := reader.Size(prefix + "/db/t.data.sql.zstd")
+	require.NoError(t, err)
+	require.Positive(t, size)
+	listed, err = reader.List(prefix+"/db", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{prefix + "/db/t.data.sql.zstd", prefix + "/db/t.schema.sql.zstd"}, listed)
+	require.NoError(t, reader.Close())
+}
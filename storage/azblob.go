@@ -1,27 +1,58 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"io"
 	"log"
+	"math"
 	"net/url"
+	"os"
+	"sort"
 	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
 )
 
 type AzBlobStorage struct {
 	containerURL azblob.ContainerURL
 	debug        bool // Debug flag
 	// Store for potential use/logging
-	accountName   string
-	containerName string
+	accountName     string
+	containerName   string
+	compressionMode string // CompressionModeExtension or CompressionModeTransparent
+	contentType     string // Content-Type of uploaded blobs, empty means detected from the blob name
+	accessTier      azblob.AccessTierType
+	options         AzBlobOptions
+	decoding
+}
+
+// AzBlobOptions tunes downloads, zero values keep the defaults.
+type AzBlobOptions struct {
+	TmpDir              string // Directory of temporary files of parallel downloads, empty means the OS default
+	DownloadConcurrency int    // Ranges downloaded in parallel per blob, 0 or 1 streams every blob with one request
+	VerifyUpload        bool   // Stage blocks with their MD5, so Azure rejects corrupted uploads
 }
 
+// azblobParallelDownloadMinSize is the smallest blob downloaded in parallel ranges,
+// smaller blobs are streamed because a temporary file doesn't pay off for them.
+const azblobParallelDownloadMinSize = 64 * 1024 * 1024
+
+// azblobDownloadBlockSize is the size of one range of a parallel download.
+const azblobDownloadBlockSize = 8 * 1024 * 1024
+
+// azblobVerifiedBlockSize is the block size of uploads with VerifyUpload, blobs are limited
+// to 50000 blocks, about 390 GiB.
+const azblobVerifiedBlockSize = 8 * 1024 * 1024
+
 // debugf logs debug messages if debug is enabled
 func (a *AzBlobStorage) debugf(format string, args ...interface{}) {
-	if a.debug {
+	if a.debug || logging.Enabled(logging.LevelDebug) {
 		log.Printf("[azblob:debug] "+format, args...)
 	}
 }
@@ -30,23 +61,48 @@ func (a *AzBlobStorage) azblobDebugLog(level pipeline.LogLevel, msg string) {
 	a.debugf("[azblob:%v] %s", level, msg)
 }
 
-// NewAzBlobStorage creates a new Azure Blob Storage client.
-func NewAzBlobStorage(accountName, accountKey, containerName, endpoint string, debug bool) (*AzBlobStorage, error) {
+// azblobAccessTier parses an access tier name, empty means the account default tier.
+func azblobAccessTier(tier string) (azblob.AccessTierType, error) {
+	switch strings.ToLower(tier) {
+	case "":
+		return azblob.AccessTierNone, nil
+	case "hot":
+		return azblob.AccessTierHot, nil
+	case "cool":
+		return azblob.AccessTierCool, nil
+	case "archive":
+		return azblob.AccessTierArchive, nil
+	}
+	return azblob.AccessTierNone, fmt.Errorf("unsupported azure access tier %s, expected Hot, Cool or Archive", tier)
+}
+
+// NewAzBlobStorage creates a new Azure Blob Storage client, uploaded blobs are written
+// into accessTier, empty means the account default tier.
+func NewAzBlobStorage(accountName, accountKey, containerName, endpoint, compressionMode, contentType, accessTier string, options AzBlobOptions, debug bool) (*AzBlobStorage, error) {
 	if accountName == "" || accountKey == "" || containerName == "" {
 		return nil, fmt.Errorf("azure storage account name, key, and container name cannot be empty")
 	}
+	tier, err := azblobAccessTier(accessTier)
+	if err != nil {
+		return nil, err
+	}
 	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create azure shared key credential: %w", err)
 	}
 
 	storage := &AzBlobStorage{
-		accountName: accountName,
-		debug:       debug,
+		accountName:     accountName,
+		containerName:   containerName,
+		compressionMode: compressionMode,
+		contentType:     contentType,
+		accessTier:      tier,
+		options:         options,
+		debug:           debug,
 	}
-	options := azblob.PipelineOptions{}
+	pipelineOptions := azblob.PipelineOptions{}
 	if debug {
-		options.Log = pipeline.LogOptions{
+		pipelineOptions.Log = pipeline.LogOptions{
 			Log: storage.azblobDebugLog,
 			ShouldLog: func(level pipeline.LogLevel) bool {
 				return true
@@ -55,7 +111,7 @@ func NewAzBlobStorage(accountName, accountKey, containerName, endpoint string, d
 	}
 
 	// Use default pipeline options
-	p := azblob.NewPipeline(credential, options)
+	p := azblob.NewPipeline(credential, pipelineOptions)
 
 	// Construct the container URL
 	// For Azurite (local testing), use the custom endpoint if provided
@@ -108,31 +164,40 @@ func (a *AzBlobStorage) Upload(filename string, reader io.Reader, compressFormat
 	ctx := context.Background()
 	blobName := filename
 	var finalReader = reader
+	var ext string
 	if contentEncoding != "" {
 		a.debugf("pre-compressed data with contentEncoding: %s for blob %s", contentEncoding, blobName)
-		actualEncoding := strings.ToLower(contentEncoding)
-		switch actualEncoding {
-		case "gzip":
-			blobName += ".gz"
-		case "zstd":
-			blobName += ".zstd"
-		default:
+		ext = extensionForEncoding(contentEncoding)
+		if ext == "" {
 			a.debugf("unknown contentEncoding '%s' for blob %s, uploading as is", contentEncoding, blobName)
 		}
 	} else if compressFormat != "" && compressFormat != "none" {
 		a.debugf("compressing data with format: %s, level: %d for blob %s", compressFormat, compressLevel, blobName)
-		var ext string
 		finalReader, ext = compressStream(reader, compressFormat, compressLevel)
-		blobName += ext
 	} else {
 		a.debugf("uploading data uncompressed for blob %s", blobName)
 	}
 
+	uploadOptions := azblob.UploadStreamToBlockBlobOptions{BlobAccessTier: a.accessTier}
+	if a.compressionMode == CompressionModeTransparent && ext != "" {
+		uploadOptions.BlobHTTPHeaders.ContentEncoding = encodingForExtension(ext)
+	} else {
+		blobName += ext
+	}
+
+	uploadOptions.BlobHTTPHeaders.ContentType = a.contentType
+	if uploadOptions.BlobHTTPHeaders.ContentType == "" {
+		uploadOptions.BlobHTTPHeaders.ContentType = contentTypeFor(blobName)
+	}
 	a.debugf("final blob name: %s", blobName)
 	blobURL := a.containerURL.NewBlockBlobURL(blobName)
 
-	uploadOptions := azblob.UploadStreamToBlockBlobOptions{}
-	_, err := azblob.UploadStreamToBlockBlob(ctx, finalReader, blobURL, uploadOptions)
+	var err error
+	if a.options.VerifyUpload {
+		err = a.uploadVerified(ctx, finalReader, blobURL, uploadOptions)
+	} else {
+		_, err = azblob.UploadStreamToBlockBlob(ctx, finalReader, blobURL, uploadOptions)
+	}
 	if err != nil {
 		a.debugf("Failed to upload blob %s: %v", blobName, err)
 		return fmt.Errorf("failed to upload %s to azure container %s: %w", blobName, a.containerName, err)
@@ -141,9 +206,49 @@ func (a *AzBlobStorage) Upload(filename string, reader io.Reader, compressFormat
 	return nil
 }
 
+// uploadVerified stages blocks one by one with their MD5, which Azure checks against the received
+// block, and commits them with the MD5 of the whole blob as its Content-MD5.
+func (a *AzBlobStorage) uploadVerified(ctx context.Context, reader io.Reader, blobURL azblob.BlockBlobURL, options azblob.UploadStreamToBlockBlobOptions) error {
+	whole := md5.New()
+	buf := make([]byte, azblobVerifiedBlockSize)
+	var blockIDs []string
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if n > 0 {
+			block := buf[:n]
+			whole.Write(block)
+			sum := md5.Sum(block)
+			// Block ids of a blob must have the same length
+			blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(blockIDs))))
+			if _, err := blobURL.StageBlock(ctx, blockID, bytes.NewReader(block), azblob.LeaseAccessConditions{}, sum[:], azblob.ClientProvidedKeyOptions{}); err != nil {
+				return fmt.Errorf("failed to stage block %d: %w", len(blockIDs), err)
+			}
+			blockIDs = append(blockIDs, blockID)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	headers := options.BlobHTTPHeaders
+	headers.ContentMD5 = whole.Sum(nil)
+	a.debugf("committing %d verified blocks", len(blockIDs))
+	_, err := blobURL.CommitBlockList(ctx, blockIDs, headers, azblob.Metadata{}, azblob.BlobAccessConditions{}, options.BlobAccessTier, nil, azblob.ClientProvidedKeyOptions{}, azblob.ImmutabilityPolicyOptions{})
+	return err
+}
+
+// OpenWriter implements WriterStorage, blocks are staged as they are written and committed on Close.
+func (a *AzBlobStorage) OpenWriter(filename string, compressFormat string, compressLevel int, contentEncoding string) (io.WriteCloser, error) {
+	return newUploadWriter(filename, func(r io.Reader) error {
+		return a.Upload(filename, r, compressFormat, compressLevel, contentEncoding)
+	}), nil
+}
+
 // Download retrieves a blob from Azure Blob Storage.
-// If noClientDecompression is true, the raw blob stream is returned.
-// Otherwise, decompressStream is used based on the filename's extension.
+// Decompression is based on the filename's extension, or on the blob's ContentEncoding
+// for blobs stored in transparent compression mode.
 func (a *AzBlobStorage) Download(filename string) (io.ReadCloser, error) {
 	ctx := context.Background()
 	a.debugf("attempting to download blob: %s", filename)
@@ -153,12 +258,59 @@ func (a *AzBlobStorage) Download(filename string) (io.ReadCloser, error) {
 	response, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
 		a.debugf("Failed to download blob %s: %v", filename, err)
-		return nil, fmt.Errorf("failed to download %s from azure container %s: %w", filename, a.containerName, err)
+		return nil, a.downloadError(filename, err)
+	}
+
+	if a.options.DownloadConcurrency > 1 && response.ContentLength() >= azblobParallelDownloadMinSize {
+		// The ranges are fetched again in parallel, the first response only provided size and ETag
+		if closeErr := response.Response().Body.Close(); closeErr != nil {
+			a.debugf("Failed to close response body of %s: %v", filename, closeErr)
+		}
+		return a.downloadParallel(ctx, blobURL.BlobURL, filename, response.ContentLength(), response.ETag(), response.ContentEncoding())
 	}
 
 	bodyStream := response.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
 
-	return decompressStream(bodyStream, filename), nil
+	return a.decompressStreamWithEncoding(bodyStream, filename, response.ContentEncoding()), nil
+}
+
+// downloadParallel downloads a large blob in DownloadConcurrency parallel ranges into a temporary
+// file, which is deleted on Close. The ETag check fails the download if the blob changes meanwhile.
+func (a *AzBlobStorage) downloadParallel(ctx context.Context, blobURL azblob.BlobURL, filename string, size int64, etag azblob.ETag, contentEncoding string) (io.ReadCloser, error) {
+	tempFile, err := os.CreateTemp(a.options.TmpDir, "azblob-download-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	a.debugf("Downloading blob %s (%d bytes) in %d parallel ranges to %s", filename, size, a.options.DownloadConcurrency, tempFile.Name())
+	err = azblob.DownloadBlobToFile(ctx, blobURL, 0, size, tempFile, azblob.DownloadFromBlobOptions{
+		BlockSize:                  azblobDownloadBlockSize,
+		Parallelism:                uint16(min(a.options.DownloadConcurrency, math.MaxUint16)),
+		AccessConditions:           azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: etag}},
+		RetryReaderOptionsPerBlock: azblob.RetryReaderOptions{MaxRetryRequests: 3},
+	})
+	if err == nil {
+		_, err = tempFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		a.debugf("Failed to download blob %s in parallel: %v", filename, err)
+		return nil, a.downloadError(filename, err)
+	}
+	return &tempFileCloser{ReadCloser: a.decompressStreamWithEncoding(tempFile, filename, contentEncoding), name: tempFile.Name()}, nil
+}
+
+// downloadError explains download errors of archived blobs, which need a rehydration first.
+func (a *AzBlobStorage) downloadError(filename string, err error) error {
+	if stgErr, ok := err.(azblob.StorageError); ok {
+		switch stgErr.ServiceCode() {
+		case azblob.ServiceCodeBlobArchived:
+			return fmt.Errorf("blob %s in azure container %s is in the Archive tier, rehydrate the backup to the Hot or Cool tier before restoring, e.g. az storage blob set-tier --tier Hot --rehydrate-priority High: %w", filename, a.containerName, err)
+		case azblob.ServiceCodeBlobBeingRehydrated:
+			return fmt.Errorf("blob %s in azure container %s is still being rehydrated from the Archive tier, retry the restore when rehydration finishes: %w", filename, a.containerName, err)
+		}
+	}
+	return fmt.Errorf("failed to download %s from azure container %s: %w", filename, a.containerName, err)
 }
 
 // List returns a list of blob names in the Azure container matching the prefix.
@@ -199,9 +351,30 @@ func (a *AzBlobStorage) List(prefix string, recursive bool) ([]string, error) {
 	}
 
 	a.debugf("Found %d blobs matching prefix: %s", len(blobNames), prefix)
+	sort.Strings(blobNames)
 	return blobNames, nil
 }
 
+// Size returns the blob size from its properties.
+func (a *AzBlobStorage) Size(filename string) (int64, error) {
+	blobURL := a.containerURL.NewBlockBlobURL(filename)
+	props, err := blobURL.GetProperties(context.Background(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of %s in azure container %s: %w", filename, a.containerName, err)
+	}
+	return props.ContentLength(), nil
+}
+
+// Delete removes a blob and its snapshots from Azure Blob Storage.
+func (a *AzBlobStorage) Delete(filename string) error {
+	a.debugf("Deleting blob: %s", filename)
+	blobURL := a.containerURL.NewBlockBlobURL(filename)
+	if _, err := blobURL.Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{}); err != nil {
+		return fmt.Errorf("failed to delete %s from azure container %s: %w", filename, a.containerName, err)
+	}
+	return nil
+}
+
 // Close closes the Azure Blob Storage connection.
 func (a *AzBlobStorage) Close() error {
 	// Azure SDK doesn't require explicit closing of connections
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeAzBlobServer serves one blob with ranged GETs like Azure Blob Storage, ignoring authentication.
+func newFakeAzBlobServer(t *testing.T, blob []byte, rangeRequests *atomic.Int32) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("x-ms-version", "2019-12-12")
+		if req.URL.Query().Get("restype") == "container" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("ETag", `"0x8D9"`)
+		if match := req.Header.Get("If-Match"); match != "" && match != `"0x8D9"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		start, end := int64(0), int64(len(blob))-1
+		status := http.StatusOK
+		if r := req.Header.Get("x-ms-range"); r != "" {
+			rangeRequests.Add(1)
+			_, _ = fmt.Sscanf(strings.TrimPrefix(r, "bytes="), "%d-%d", &start, &end)
+			end = min(end, int64(len(blob))-1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(blob)))
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.WriteHeader(status)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(blob[start : end+1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestAzBlobStorageParallelDownload(t *testing.T) {
+	blob := make([]byte, azblobParallelDownloadMinSize+3*1024*1024)
+	_, err := rand.Read(blob)
+	require.NoError(t, err)
+	var rangeRequests atomic.Int32
+	endpoint := newFakeAzBlobServer(t, blob, &rangeRequests)
+	key := base64.StdEncoding.EncodeToString([]byte("key"))
+
+	for _, concurrency := range []int{1, 4} {
+		rangeRequests.Store(0)
+		tmpDir := t.TempDir()
+		s, err := NewAzBlobStorage("account", key, "backups", endpoint, CompressionModeExtension, "", "", AzBlobOptions{TmpDir: tmpDir, DownloadConcurrency: concurrency}, false)
+		require.NoError(t, err)
+		reader, err := s.Download("backup/db/t.data.native")
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.True(t, bytes.Equal(blob, data), "concurrency %d", concurrency)
+		if concurrency == 1 {
+			require.Zero(t, rangeRequests.Load(), "a single stream doesn't request ranges")
+		} else {
+			require.EqualValues(t, (len(blob)+azblobDownloadBlockSize-1)/azblobDownloadBlockSize, rangeRequests.Load())
+		}
+		entries, err := os.ReadDir(tmpDir)
+		require.NoError(t, err)
+		require.Empty(t, entries, "Close removes the temporary file")
+	}
+}
+
+func TestAzBlobStorageVerifyUpload(t *testing.T) {
+	var stored, committed atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("x-ms-version", "2019-12-12")
+		if req.Method != http.MethodPut {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// The first received byte is flipped like a faulty network would
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		if len(body) > 0 && req.URL.Query().Get("comp") != "blocklist" {
+			body[0] ^= 0xff
+		}
+		if contentMD5 := req.Header.Get("Content-MD5"); contentMD5 != "" {
+			sum := md5.Sum(body)
+			if base64.StdEncoding.EncodeToString(sum[:]) != contentMD5 {
+				w.Header().Set("x-ms-error-code", "Md5Mismatch")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		switch req.URL.Query().Get("comp") {
+		case "blocklist":
+			committed.Add(1)
+		case "block":
+			stored.Add(1)
+		default:
+			stored.Add(1)
+			committed.Add(1)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	key := base64.StdEncoding.EncodeToString([]byte("key"))
+
+	s, err := NewAzBlobStorage("account", key, "backups", server.URL, CompressionModeExtension, "", "", AzBlobOptions{}, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "none", 0, ""))
+	require.EqualValues(t, 1, committed.Load(), "without verification the corrupted body is stored")
+
+	s, err = NewAzBlobStorage("account", key, "backups", server.URL, CompressionModeExtension, "", "", AzBlobOptions{VerifyUpload: true}, false)
+	require.NoError(t, err)
+	err = s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "none", 0, "")
+	require.ErrorContains(t, err, "Md5Mismatch")
+	require.EqualValues(t, 1, committed.Load(), "the rejected block is not committed")
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// CacheStorage implements RemoteStorage over another storage and keeps a local copy of every
+// uploaded file under dir. With preferCache, downloads read the local copy when it exists.
+// The cache is best effort, failing to write it only logs a warning.
+type CacheStorage struct {
+	remote      RemoteStorage
+	remotePath  string
+	dir         string
+	preferCache bool
+	debug       bool
+	decoding
+}
+
+// debugf logs only if debug is enabled
+func (c *CacheStorage) debugf(format string, args ...interface{}) {
+	if c.debug || logging.Enabled(logging.LevelDebug) {
+		log.Printf("[cache:debug] "+format, args...)
+	}
+}
+
+// NewCacheStorage creates a CacheStorage, remotePath is the storage path used to build
+// filenames, it is replaced by dir for the local copies.
+func NewCacheStorage(remote RemoteStorage, remotePath, dir string, preferCache bool, debug bool) (*CacheStorage, error) {
+	if !debug && os.Getenv("LOG_LEVEL") == "debug" {
+		debug = true
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create local cache directory %s: %w", dir, err)
+	}
+	return &CacheStorage{
+		remote:      remote,
+		remotePath:  remotePath,
+		dir:         dir,
+		preferCache: preferCache,
+		debug:       debug,
+	}, nil
+}
+
+// cachePath returns the local path of a filename built from the remote path or returned by List.
+func (c *CacheStorage) cachePath(name string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, c.remotePath), "/")
+	return filepath.Join(c.dir, filepath.FromSlash(rel))
+}
+
+// cachedFile returns the local copy of filename, which may carry a compression extension the
+// listed name lacks with --compression-mode=transparent, or "" if there is none.
+func (c *CacheStorage) cachedFile(filename string) string {
+	base := c.cachePath(filename)
+	for _, candidate := range []string{base, base + ".gz", base + ".zstd"} {
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Upload tees reader into the local cache while uploading it to the remote storage.
+func (c *CacheStorage) Upload(filename string, reader io.Reader, compressFormat string, compressLevel int, contentEncoding string) error {
+	pipeReader, pipeWriter := io.Pipe()
+	cacheErr := make(chan error, 1)
+	go func() {
+		cacheErr <- c.store(filename, pipeReader, compressFormat, compressLevel, contentEncoding)
+	}()
+	err := c.remote.Upload(filename, io.TeeReader(reader, pipeWriter), compressFormat, compressLevel, contentEncoding)
+	_ = pipeWriter.CloseWithError(err)
+	if storeErr := <-cacheErr; storeErr != nil {
+		logging.Warnf("can't keep a local copy of %s: %v", filename, storeErr)
+	}
+	return err
+}
+
+// store writes the local copy through a temporary file, so an interrupted upload never leaves a
+// truncated copy behind. The reader is drained on failure to not block the remote upload.
+func (c *CacheStorage) store(filename string, reader io.Reader, compressFormat string, compressLevel int, contentEncoding string) (err error) {
+	defer func() {
+		if err != nil {
+			_, _ = io.Copy(io.Discard, reader)
+		}
+	}()
+	finalReader := reader
+	var ext string
+	if contentEncoding != "" {
+		ext = extensionForEncoding(contentEncoding)
+	} else {
+		finalReader, ext = compressStream(reader, compressFormat, compressLevel)
+	}
+	target := c.cachePath(filename) + ext
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", target, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*"+partialSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", target, err)
+	}
+	if _, err := io.Copy(tmp, finalReader); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rename %s: %w", target, err)
+	}
+	c.debugf("Kept local copy of %s in %s", filename, target)
+	return nil
+}
+
+// Download reads the local copy with preferCache, or the remote file.
+func (c *CacheStorage) Download(filename string) (io.ReadCloser, error) {
+	if c.preferCache {
+		if cached := c.cachedFile(filename); cached != "" {
+			f, err := os.Open(cached)
+			if err == nil {
+				c.debugf("Reading %s from local copy %s", filename, cached)
+				return c.decompressStream(f, cached), nil
+			}
+			logging.Warnf("can't open local copy %s, downloading %s: %v", cached, filename, err)
+		}
+	}
+	return c.remote.Download(filename)
+}
+
+// List lists the remote storage, the cache may miss files uploaded by other runs.
+func (c *CacheStorage) List(prefix string, recursive bool) ([]string, error) {
+	return c.remote.List(prefix, recursive)
+}
+
+// SetFileCompression records the compression of a file for the local copies and the remote.
+func (c *CacheStorage) SetFileCompression(filename, compression string) {
+	c.decoding.SetFileCompression(filename, compression)
+	if decoder, ok := c.remote.(Decoder); ok {
+		decoder.SetFileCompression(filename, compression)
+	}
+}
+
+// AddZstdDictionary adds a zstd dictionary for the local copies and the remote.
+func (c *CacheStorage) AddZstdDictionary(dict []byte) error {
+	if err := c.decoding.AddZstdDictionary(dict); err != nil {
+		return err
+	}
+	if decoder, ok := c.remote.(Decoder); ok {
+		return decoder.AddZstdDictionary(dict)
+	}
+	return nil
+}
+
+// ResetDecoding drops the compression records and zstd dictionaries of the local copies and the remote.
+func (c *CacheStorage) ResetDecoding() {
+	c.decoding.ResetDecoding()
+	if decoder, ok := c.remote.(Decoder); ok {
+		decoder.ResetDecoding()
+	}
+}
+
+// ListAll lists every copy of a remote keeping several, like a mirror storage, else it is List.
+func (c *CacheStorage) ListAll(prefix string, recursive bool) ([]string, error) {
+	if all, ok := c.remote.(AllLister); ok {
+		return all.ListAll(prefix, recursive)
+	}
+	return c.remote.List(prefix, recursive)
+}
+
+// Size returns the size of the local copy with preferCache, or of the remote file.
+func (c *CacheStorage) Size(filename string) (int64, error) {
+	if c.preferCache {
+		if cached := c.cachedFile(filename); cached != "" {
+			if info, err := os.Stat(cached); err == nil {
+				return info.Size(), nil
+			}
+		}
+	}
+	return c.remote.Size(filename)
+}
+
+// Delete removes filename from the remote storage and its local copy.
+func (c *CacheStorage) Delete(filename string) error {
+	if cached := c.cachedFile(filename); cached != "" {
+		if err := os.Remove(cached); err != nil {
+			logging.Warnf("can't remove local copy %s: %v", cached, err)
+		}
+	}
+	return c.remote.Delete(filename)
+}
+
+// Close closes the remote storage.
+func (c *CacheStorage) Close() error {
+	return c.remote.Close()
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingUploadStorage reads part of every upload and fails it.
+type failingUploadStorage struct {
+	RemoteStorage
+}
+
+func (f *failingUploadStorage) Upload(_ string, reader io.Reader, _ string, _ int, _ string) error {
+	_, _ = io.CopyN(io.Discard, reader, 10)
+	return errors.New("upload failed")
+}
+
+func TestCacheStorage(t *testing.T) {
+	remoteDir, cacheDir := t.TempDir(), t.TempDir()
+	remote, err := NewFileStorage(remoteDir, false)
+	require.NoError(t, err)
+	c, err := NewCacheStorage(remote, remoteDir, cacheDir, true, false)
+	require.NoError(t, err)
+
+	content := strings.Repeat("INSERT INTO t VALUES (1);\n", 10000)
+	require.NoError(t, c.Upload(filepath.Join(remoteDir, "backup", "db", "t.data.sql"), strings.NewReader(content), "gzip", 6, ""))
+	require.FileExists(t, filepath.Join(remoteDir, "backup", "db", "t.data.sql.gz"))
+	require.FileExists(t, filepath.Join(cacheDir, "backup", "db", "t.data.sql.gz"))
+
+	files, err := c.List("backup", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join("backup", "db", "t.data.sql.gz")}, files)
+
+	// The local copy is read even after the remote file is gone
+	require.NoError(t, os.Remove(filepath.Join(remoteDir, "backup", "db", "t.data.sql.gz")))
+	reader, err := c.Download(files[0])
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, content, string(data))
+
+	// Without preferCache the remote storage is read
+	c.preferCache = false
+	_, err = c.Download(files[0])
+	require.Error(t, err)
+
+	// A failed upload leaves no partial copy behind
+	failing, err := NewCacheStorage(&failingUploadStorage{RemoteStorage: remote}, remoteDir, cacheDir, true, false)
+	require.NoError(t, err)
+	require.Error(t, failing.Upload(filepath.Join(remoteDir, "backup", "db", "u.data.sql"), strings.NewReader(content), "", 0, ""))
+	entries, err := os.ReadDir(filepath.Join(cacheDir, "backup", "db"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "t.data.sql.gz", entries[0].Name())
+}
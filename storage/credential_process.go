@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// credentialProcessTimeout limits one run of the S3 credential process.
+var credentialProcessTimeout = time.Minute
+
+// credentialProcessOutput is the JSON a credential process prints, as documented for the
+// credential_process setting of the AWS CLI.
+type credentialProcessOutput struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+// credentialProcessProvider runs an external command for S3 credentials, see --s3-credential-process.
+type credentialProcessProvider struct {
+	command string
+}
+
+// newCredentialProcessProvider returns a provider running command through the shell, cached until
+// a minute before the credentials expire, then the command runs again.
+func newCredentialProcessProvider(command string) aws.CredentialsProvider {
+	return aws.NewCredentialsCache(&credentialProcessProvider{command: command}, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = time.Minute
+	})
+}
+
+// Retrieve runs the command and parses its output.
+func (p *credentialProcessProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialProcessTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", p.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", p.command)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", credentialProcessTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return aws.Credentials{}, fmt.Errorf("s3 credential process failed: %w", err)
+	}
+	creds, err := parseCredentialProcessOutput(stdout.Bytes())
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("s3 credential process printed invalid credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// parseCredentialProcessOutput validates the output of a credential process, credentials without
+// Expiration never expire.
+func parseCredentialProcessOutput(data []byte) (aws.Credentials, error) {
+	var out credentialProcessOutput
+	if err := json.Unmarshal(bytes.TrimSpace(data), &out); err != nil {
+		return aws.Credentials{}, fmt.Errorf("expected a JSON object with AccessKeyId and SecretAccessKey: %w", err)
+	}
+	if out.Version != 1 {
+		return aws.Credentials{}, fmt.Errorf("unsupported Version %d, only 1 is supported", out.Version)
+	}
+	if out.AccessKeyID == "" || out.SecretAccessKey == "" {
+		return aws.Credentials{}, fmt.Errorf("AccessKeyId and SecretAccessKey are required")
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     out.AccessKeyID,
+		SecretAccessKey: out.SecretAccessKey,
+		SessionToken:    out.SessionToken,
+		Source:          "CredentialProcess",
+	}
+	if out.Expiration != "" {
+		expires, err := time.Parse(time.RFC3339, out.Expiration)
+		if err != nil {
+			return aws.Credentials{}, fmt.Errorf("invalid Expiration %q, expected RFC3339: %w", out.Expiration, err)
+		}
+		creds.CanExpire = true
+		creds.Expires = expires
+	}
+	return creds, nil
+}
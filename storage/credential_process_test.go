@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCredentialProcessOutput(t *testing.T) {
+	creds, err := parseCredentialProcessOutput([]byte(`{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "secret", "SessionToken": "token", "Expiration": "2030-01-02T03:04:05Z"}` + "\n"))
+	require.NoError(t, err)
+	require.Equal(t, "AKID", creds.AccessKeyID)
+	require.Equal(t, "secret", creds.SecretAccessKey)
+	require.Equal(t, "token", creds.SessionToken)
+	require.True(t, creds.CanExpire)
+	require.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), creds.Expires.UTC())
+
+	creds, err = parseCredentialProcessOutput([]byte(`{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "secret"}`))
+	require.NoError(t, err)
+	require.False(t, creds.CanExpire, "credentials without Expiration never expire")
+
+	invalid := map[string]string{
+		`not json`: "expected a JSON object",
+		`{"AccessKeyId": "AKID", "SecretAccessKey": "secret"}`:                             "unsupported Version 0",
+		`{"Version": 2, "AccessKeyId": "AKID", "SecretAccessKey": "secret"}`:               "unsupported Version 2",
+		`{"Version": 1, "AccessKeyId": "AKID"}`:                                            "AccessKeyId and SecretAccessKey are required",
+		`{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "s", "Expiration": "x"}`: "invalid Expiration",
+	}
+	for output, expected := range invalid {
+		_, err := parseCredentialProcessOutput([]byte(output))
+		require.ErrorContains(t, err, expected, output)
+	}
+}
+
+func TestCredentialProcessProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test command needs sh")
+	}
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "runs")
+	// Credentials expiring within the expiry window are fetched again on every Retrieve
+	expiration := time.Now().Add(30 * time.Second).UTC().Format(time.RFC3339)
+	command := fmt.Sprintf(`echo run >> %s; echo '{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "secret", "Expiration": "%s"}'`, counter, expiration)
+	provider := newCredentialProcessProvider(command)
+	for i := 0; i < 2; i++ {
+		creds, err := provider.Retrieve(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "AKID", creds.AccessKeyID)
+	}
+	runs, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(runs), "run"))
+
+	require.NoError(t, os.Remove(counter))
+	command = fmt.Sprintf(`echo run >> %s; echo '{"Version": 1, "AccessKeyId": "AKID", "SecretAccessKey": "secret"}'`, counter)
+	provider = newCredentialProcessProvider(command)
+	for i := 0; i < 2; i++ {
+		_, err := provider.Retrieve(context.Background())
+		require.NoError(t, err)
+	}
+	runs, err = os.ReadFile(counter)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(runs), "run"), "credentials are cached until they expire")
+
+	_, err = newCredentialProcessProvider("echo 'vault is sealed' >&2; exit 3").Retrieve(context.Background())
+	require.ErrorContains(t, err, "s3 credential process failed: exit status 3: vault is sealed")
+	_, err = newCredentialProcessProvider("echo '{}'").Retrieve(context.Background())
+	require.ErrorContains(t, err, "s3 credential process printed invalid credentials")
+}
@@ -6,18 +6,22 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/Slach/clickhouse-dump/logging"
 )
 
 // FileStorage implements RemoteStorage for local filesystem
 type FileStorage struct {
 	basePath string
 	debug    bool
+	decoding
 }
 
 // debugf logs only if debug is enabled
 func (f *FileStorage) debugf(format string, args ...interface{}) {
-	if f.debug {
+	if f.debug || logging.Enabled(logging.LevelDebug) {
 		log.Printf("[file:debug] "+format, args...)
 	}
 }
@@ -119,6 +123,13 @@ func (f *FileStorage) Upload(filename string, reader io.Reader, compressFormat s
 	return nil
 }
 
+// OpenWriter implements WriterStorage.
+func (f *FileStorage) OpenWriter(filename string, compressFormat string, compressLevel int, contentEncoding string) (io.WriteCloser, error) {
+	return newUploadWriter(filename, func(r io.Reader) error {
+		return f.Upload(filename, r, compressFormat, compressLevel, contentEncoding)
+	}), nil
+}
+
 // Download reads data from a local file.
 // If noClientDecompression is true, data is returned as is.
 // Otherwise, decompressStream is used.
@@ -135,7 +146,7 @@ func (f *FileStorage) Download(fileName string) (io.ReadCloser, error) {
 	}
 
 	f.debugf("Successfully opened file: %s", fullPath)
-	return decompressStream(file, fullPath), nil
+	return f.decompressStream(file, fullPath), nil
 }
 
 // List returns files matching the prefix in the base path
@@ -177,9 +188,36 @@ func (f *FileStorage) List(prefix string, recursive bool) ([]string, error) {
 	}
 
 	f.debugf("Found %d matching files", len(matches))
+	sort.Strings(matches)
 	return matches, nil
 }
 
+// Size returns the size of a file relative to the base path.
+func (f *FileStorage) Size(fileName string) (int64, error) {
+	fullPath := fileName
+	if !strings.HasPrefix(fileName, f.basePath) {
+		fullPath = filepath.Join(f.basePath, fileName)
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file %s: %w", fullPath, err)
+	}
+	return info.Size(), nil
+}
+
+// Delete removes a local file.
+func (f *FileStorage) Delete(fileName string) error {
+	fullPath := fileName
+	if !strings.HasPrefix(fileName, f.basePath) {
+		fullPath = filepath.Join(f.basePath, fileName)
+	}
+	f.debugf("Deleting file: %s", fullPath)
+	if err := os.Remove(fullPath); err != nil {
+		return fmt.Errorf("failed to delete file %s: %w", fullPath, err)
+	}
+	return nil
+}
+
 // Close is a no-op for local file storage
 func (f *FileStorage) Close() error {
 	f.debugf("Closing file storage at: %s", f.basePath)
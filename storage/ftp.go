@@ -4,13 +4,15 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/secsy/goftp"
+
+	"github.com/Slach/clickhouse-dump/logging"
 )
 
 // ftpLoggerAdapter implements io.Writer for goftp.Config.Logger
@@ -36,10 +38,12 @@ type FTPStorage struct {
 	dirCache       map[string]struct{}
 	clientMutex    sync.Mutex
 	dirCacheMutext sync.RWMutex // Mutex for directory operations
+	closed         bool         // Set by Close, guarded by clientMutex
+	decoding
 }
 
 func (f *FTPStorage) debugf(format string, args ...interface{}) {
-	if f.debug {
+	if f.debug || logging.Enabled(logging.LevelDebug) {
 		log.Printf("[ftp:debug] "+format, args...)
 	}
 }
@@ -105,8 +109,9 @@ func NewFTPStorage(host, user, password string, debug bool) (*FTPStorage, error)
 	}
 
 	// Add default port if not specified
-	if !strings.Contains(host, ":") {
-		host = net.JoinHostPort(host, "21")
+	host, err := hostWithDefaultPort(host, "21")
+	if err != nil {
+		return nil, fmt.Errorf("invalid ftp host: %w", err)
 	}
 
 	config := goftp.Config{
@@ -178,29 +183,49 @@ func (f *FTPStorage) Upload(filename string, reader io.Reader, compressFormat st
 		}
 	}
 
-	// Store the file
-	f.debugf("Storing file: %s", remoteFilename)
+	// Store to a partial file first, an interrupted upload never leaves a truncated file under the final name
+	partialFilename := remoteFilename + partialSuffix
+	f.debugf("Storing file: %s", partialFilename)
 	f.clientMutex.Lock()
 	defer f.clientMutex.Unlock()
-	if err := f.client.Store(remoteFilename, finalReader); err != nil {
+	if err := f.client.Store(partialFilename, finalReader); err != nil {
 		f.debugf("Failed to store file: %v", err)
+		f.removePartial(partialFilename)
 		return fmt.Errorf("failed to store file %s on ftp host %s: %w", remoteFilename, f.host, err)
 	}
+	if err := f.client.Rename(partialFilename, remoteFilename); err != nil {
+		// Some servers refuse to rename over an existing file
+		f.debugf("Rename of %s failed, retrying after removing %s: %v", partialFilename, remoteFilename, err)
+		_ = f.client.Delete(remoteFilename)
+		if err := f.client.Rename(partialFilename, remoteFilename); err != nil {
+			f.removePartial(partialFilename)
+			return fmt.Errorf("failed to rename %s to %s on ftp host %s: %w", partialFilename, remoteFilename, f.host, err)
+		}
+	}
 
 	f.debugf("Successfully uploaded file: %s", remoteFilename)
 	return nil
 }
 
+// removePartial deletes the partial file of a failed upload, the caller holds clientMutex.
+func (f *FTPStorage) removePartial(partialFilename string) {
+	if err := f.client.Delete(partialFilename); err != nil {
+		f.debugf("Can't remove partial ftp upload %s: %v", partialFilename, err)
+	}
+}
+
 func (f *FTPStorage) Download(filename string) (io.ReadCloser, error) {
 	f.debugf("attempting to download file: %s", filename)
 
 	// Create a pipe to stream the download
 	pr, pw := io.Pipe()
+	done := make(chan struct{})
 
 	go func() {
+		defer close(done)
 		defer func() {
 			if closeErr := pw.Close(); closeErr != nil {
-				log.Printf("can't close ftp pipe writer: %v", closeErr)
+				logging.Warnf("can't close ftp pipe writer: %v", closeErr)
 			}
 		}()
 
@@ -214,7 +239,23 @@ func (f *FTPStorage) Download(filename string) (io.ReadCloser, error) {
 		}
 	}()
 
-	return decompressStream(pr, filename), nil
+	return &ftpDownloadReader{ReadCloser: f.decompressStream(pr, filename), pipeReader: pr, done: done}, nil
+}
+
+// ftpDownloadReader closes the download pipe together with the decompressor, gzip and zstd readers
+// don't close their source, so Retrieve would block on the pipe forever if the caller stops reading early.
+type ftpDownloadReader struct {
+	io.ReadCloser
+	pipeReader *io.PipeReader
+	done       chan struct{}
+}
+
+// Close aborts an unfinished Retrieve and waits until it returns, so the client is free for the next call.
+func (r *ftpDownloadReader) Close() error {
+	err := r.ReadCloser.Close()
+	_ = r.pipeReader.CloseWithError(fmt.Errorf("ftp download reader closed"))
+	<-r.done
+	return err
 }
 
 func (f *FTPStorage) List(prefix string, recursive bool) ([]string, error) {
@@ -261,21 +302,46 @@ func (f *FTPStorage) List(prefix string, recursive bool) ([]string, error) {
 	}
 
 	f.debugf("Found %d matching files", len(matchingFiles))
+	sort.Strings(matchingFiles)
 	return matchingFiles, nil
 }
 
-func (f *FTPStorage) Close() error {
-	if f.client != nil {
-		f.debugf("Closing FTP connection to %s", f.host)
-		f.clientMutex.Lock()
-		err := f.client.Close()
-		f.clientMutex.Unlock()
-		if err != nil {
-			f.debugf("Error closing FTP connection: %v", err)
-		} else {
-			f.debugf("FTP connection closed successfully")
-		}
-		return err
+// Size returns the size of a remote file.
+func (f *FTPStorage) Size(filename string) (int64, error) {
+	f.clientMutex.Lock()
+	defer f.clientMutex.Unlock()
+	info, err := f.client.Stat(filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s on ftp host %s: %w", filename, f.host, err)
+	}
+	return info.Size(), nil
+}
+
+// Delete removes a file from FTP.
+func (f *FTPStorage) Delete(filename string) error {
+	f.debugf("Deleting file: %s", filename)
+	f.clientMutex.Lock()
+	defer f.clientMutex.Unlock()
+	if err := f.client.Delete(filename); err != nil {
+		return fmt.Errorf("failed to delete %s from ftp host %s: %w", filename, f.host, err)
 	}
 	return nil
 }
+
+// Close closes the FTP connections, further calls do nothing.
+func (f *FTPStorage) Close() error {
+	f.clientMutex.Lock()
+	defer f.clientMutex.Unlock()
+	if f.client == nil || f.closed {
+		return nil
+	}
+	f.closed = true
+	f.debugf("Closing FTP connection to %s", f.host)
+	err := f.client.Close()
+	if err != nil {
+		f.debugf("Error closing FTP connection: %v", err)
+	} else {
+		f.debugf("FTP connection closed successfully")
+	}
+	return err
+}
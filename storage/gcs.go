@@ -3,18 +3,24 @@ package storage
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"log"
+
+	"github.com/Slach/clickhouse-dump/logging"
 )
 
 // debugGCSTransport wraps an http.RoundTripper to log GCS requests and responses
@@ -116,25 +122,75 @@ func (r rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r.base.RoundTrip(req)
 }
 
+// Authentication modes of --gcs-auth.
+const (
+	GCSAuthADC  = "adc"  // Application Default Credentials of the environment
+	GCSAuthFile = "file" // Service account credentials JSON file
+	GCSAuthHMAC = "hmac" // HMAC keys through the S3-compatible XML API, see GCSXMLEndpoint
+	GCSAuthNone = "none" // Anonymous access to public buckets
+)
+
+// GCSXMLEndpoint is the S3-compatible endpoint of GCS used with HMAC keys.
+const GCSXMLEndpoint = "https://storage.googleapis.com"
+
+// ResolveGCSAuth validates a --gcs-auth mode against the storage key, which is a credentials
+// file path for file and an HMAC secret for hmac. An empty mode means file when a key is set
+// and none otherwise.
+func ResolveGCSAuth(auth, key string) (string, error) {
+	auth = strings.ToLower(auth)
+	if auth == "" {
+		if key != "" {
+			return GCSAuthFile, nil
+		}
+		return GCSAuthNone, nil
+	}
+	switch auth {
+	case GCSAuthFile, GCSAuthHMAC:
+		if key == "" {
+			return "", fmt.Errorf("gcs auth %s requires a storage key", auth)
+		}
+	case GCSAuthADC, GCSAuthNone:
+		if key != "" {
+			return "", fmt.Errorf("gcs auth %s doesn't use a storage key, use file for a credentials file or hmac for an HMAC secret", auth)
+		}
+	default:
+		return "", fmt.Errorf("unsupported gcs auth %q, expected adc, file, hmac or none", auth)
+	}
+	return auth, nil
+}
+
 type GCSStorage struct {
-	bucket     *storage.BucketHandle
-	bucketName string          // Store bucket name for logging
-	client     *storage.Client // Store client to close it later
-	endpoint   string          // Custom endpoint URL
-	debug      bool            // Debug logging flag
+	bucket          *storage.BucketHandle
+	bucketName      string          // Store bucket name for logging
+	client          *storage.Client // Store client to close it later
+	endpoint        string          // Custom endpoint URL
+	compressionMode string          // CompressionModeExtension or CompressionModeTransparent
+	contentType     string          // Content-Type of uploaded objects, empty means detected from the object name
+	debug           bool            // Debug logging flag
+	closed          bool            // Set by Close
+	decoding
 }
 
 func (g *GCSStorage) debugf(format string, args ...interface{}) {
-	if g.debug {
+	if g.debug || logging.Enabled(logging.LevelDebug) {
 		log.Printf("[gcs:debug] "+format, args...)
 	}
 }
 
-// NewGCSStorage creates a new Google Cloud Storage client.
-func NewGCSStorage(bucketName, endpoint, credentialsFile string, debug bool) (*GCSStorage, error) {
+// NewGCSStorage creates a new Google Cloud Storage client authenticated with auth, GCSAuthADC,
+// GCSAuthFile with credentialsFile or GCSAuthNone. HMAC keys use NewS3Storage with GCSXMLEndpoint.
+// createBucket creates the bucket when it doesn't exist.
+func NewGCSStorage(bucketName, endpoint, auth, credentialsFile, compressionMode, contentType string, createBucket, debug bool) (*GCSStorage, error) {
 	if bucketName == "" {
 		return nil, fmt.Errorf("gcs bucket name cannot be empty")
 	}
+	auth, err := ResolveGCSAuth(auth, credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	if auth == GCSAuthHMAC {
+		return nil, fmt.Errorf("gcs hmac keys are used through the S3-compatible API, not the GCS client")
+	}
 	ctx := context.Background()
 	if debug {
 		log.Printf("Initializing GCS storage with bucketName=%s, endpoint=%s, debug=%t", bucketName, endpoint, debug)
@@ -211,9 +267,10 @@ func NewGCSStorage(bucketName, endpoint, credentialsFile string, debug bool) (*G
 
 	storageClientOpts := []option.ClientOption{option.WithHTTPClient(httpClient)}
 
-	if credentialsFile == "" {
+	switch auth {
+	case GCSAuthNone:
 		storageClientOpts = append(storageClientOpts, option.WithoutAuthentication())
-	} else {
+	case GCSAuthFile:
 		storageClientOpts = append(storageClientOpts, option.WithCredentialsFile(credentialsFile))
 	}
 
@@ -226,16 +283,73 @@ func NewGCSStorage(bucketName, endpoint, credentialsFile string, debug bool) (*G
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gcs client: %w", err)
 	}
+	if createBucket {
+		if err := createGCSBucket(ctx, client.Bucket(bucketName), bucketName, gcsProjectID(credentialsFile), debug); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
 
 	return &GCSStorage{
-		bucket:     client.Bucket(bucketName),
-		bucketName: bucketName,
-		client:     client,
-		endpoint:   endpoint,
-		debug:      debug,
+		bucket:          client.Bucket(bucketName),
+		bucketName:      bucketName,
+		client:          client,
+		endpoint:        endpoint,
+		compressionMode: compressionMode,
+		contentType:     contentType,
+		debug:           debug,
 	}, nil
 }
 
+// createGCSBucket creates bucket in project for --create-bucket when it doesn't exist. A bucket
+// created concurrently in between is used as is.
+func createGCSBucket(ctx context.Context, bucket *storage.BucketHandle, bucketName, project string, debug bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	_, err := bucket.Attrs(ctx)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrBucketNotExist) {
+		return fmt.Errorf("failed to access gcs bucket %s: %w", bucketName, err)
+	}
+	err = bucket.Create(ctx, project, nil)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create gcs bucket %s in project %q: %w", bucketName, project, err)
+	}
+	if debug {
+		log.Printf("[gcs:debug] Bucket %s created in project %q", bucketName, project)
+	}
+	return nil
+}
+
+// gcsProjectID returns the project new buckets are created in: GOOGLE_CLOUD_PROJECT, else the
+// project_id of the credentials file or of GOOGLE_APPLICATION_CREDENTIALS.
+func gcsProjectID(credentialsFile string) string {
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project
+	}
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsFile == "" {
+		return ""
+	}
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return ""
+	}
+	var credentials struct {
+		ProjectID string `json:"project_id"`
+	}
+	_ = json.Unmarshal(data, &credentials)
+	return credentials.ProjectID
+}
+
 // Upload uploads data to GCS.
 // If contentEncoding is provided, it's assumed data is pre-compressed, and GCS object's ContentEncoding metadata is set.
 // Otherwise, compressFormat and compressLevel are used for client-side compression.
@@ -243,31 +357,36 @@ func (g *GCSStorage) Upload(filename string, reader io.Reader, compressFormat st
 	ctx := context.Background()
 	objectName := filename
 	var finalReader = reader
+	var ext string
 
 	if contentEncoding != "" {
 		g.debugf("GCS Upload: pre-compressed data with contentEncoding: %s for object %s", contentEncoding, objectName)
-		actualEncoding := strings.ToLower(contentEncoding)
-		switch actualEncoding {
-		case "gzip":
-			objectName += ".gz"
-		case "zstd":
-			objectName += ".zstd"
-		default:
+		ext = extensionForEncoding(contentEncoding)
+		if ext == "" {
 			g.debugf("GCS Upload: unknown contentEncoding '%s' for object %s, uploading as is", contentEncoding, objectName)
-			// objectName remains unchanged
 		}
 	} else if compressFormat != "" && compressFormat != "none" {
 		g.debugf("GCS Upload: compressing data with format: %s, level: %d for object %s", compressFormat, compressLevel, objectName)
-		var ext string
 		finalReader, ext = compressStream(reader, compressFormat, compressLevel)
-		objectName += ext
 	} else {
 		g.debugf("GCS Upload: uploading data uncompressed for object %s", objectName)
 	}
 
+	objectEncoding := ""
+	if g.compressionMode == CompressionModeTransparent && ext != "" {
+		objectEncoding = encodingForExtension(ext)
+	} else {
+		objectName += ext
+	}
+
 	g.debugf("GCS Upload: final object name: %s", objectName)
 	obj := g.bucket.Object(objectName)
 	writer := obj.NewWriter(ctx)
+	writer.ContentEncoding = objectEncoding
+	writer.ContentType = g.contentType
+	if writer.ContentType == "" {
+		writer.ContentType = contentTypeFor(objectName)
+	}
 
 	_, err := io.Copy(writer, finalReader)
 	if err != nil {
@@ -283,12 +402,13 @@ func (g *GCSStorage) Upload(filename string, reader io.Reader, compressFormat st
 }
 
 // Download retrieves an object from GCS.
-// If noClientDecompression is true, the raw object stream is returned.
-// Otherwise, decompressStream is used based on the filename's extension and object's ContentEncoding.
+// Decompression is based on the filename's extension, or on the object's ContentEncoding
+// for objects stored in transparent compression mode. The raw bytes are always requested,
+// so GCS decompressive transcoding doesn't interfere.
 func (g *GCSStorage) Download(filename string) (io.ReadCloser, error) {
 	ctx := context.Background()
 	g.debugf("attempting to download object: %s", filename)
-	obj := g.bucket.Object(filename)
+	obj := g.bucket.Object(filename).ReadCompressed(true)
 
 	// Attempt to create a reader for the object
 	reader, err := obj.NewReader(ctx)
@@ -296,8 +416,8 @@ func (g *GCSStorage) Download(filename string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("failed to create reader for gcs object %s in bucket %s: %w", filename, g.bucketName, err)
 	}
 
-	g.debugf("attempting client-side decompression for object %s", filename)
-	return decompressStream(reader, filename), nil
+	g.debugf("attempting client-side decompression for object %s (contentEncoding: '%s')", filename, reader.Attrs.ContentEncoding)
+	return g.decompressStreamWithEncoding(reader, filename, reader.Attrs.ContentEncoding), nil
 }
 
 // List returns a list of object names in the GCS bucket matching the prefix.
@@ -347,12 +467,32 @@ func (g *GCSStorage) List(prefix string, recursive bool) ([]string, error) {
 		}
 	}
 
+	sort.Strings(objectNames)
 	return objectNames, nil
 }
 
-// Close closes the underlying GCS client.
+// Size returns the object size from its attributes.
+func (g *GCSStorage) Size(filename string) (int64, error) {
+	attrs, err := g.bucket.Object(filename).Attrs(context.Background())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of gcs object %s in bucket %s: %w", filename, g.bucketName, err)
+	}
+	return attrs.Size, nil
+}
+
+// Delete removes an object from GCS.
+func (g *GCSStorage) Delete(filename string) error {
+	g.debugf("Deleting object: %s", filename)
+	if err := g.bucket.Object(filename).Delete(context.Background()); err != nil {
+		return fmt.Errorf("failed to delete gcs object %s in bucket %s: %w", filename, g.bucketName, err)
+	}
+	return nil
+}
+
+// Close closes the underlying GCS client, further calls do nothing.
 func (g *GCSStorage) Close() error {
-	if g.client != nil {
+	if g.client != nil && !g.closed {
+		g.closed = true
 		return g.client.Close()
 	}
 	return nil
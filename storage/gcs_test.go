@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveGCSAuth(t *testing.T) {
+	for _, tc := range []struct {
+		auth, key, expected string
+	}{
+		{"", "/etc/gcs.json", GCSAuthFile},
+		{"", "", GCSAuthNone},
+		{"ADC", "", GCSAuthADC},
+		{"file", "/etc/gcs.json", GCSAuthFile},
+		{"hmac", "secret", GCSAuthHMAC},
+		{"none", "", GCSAuthNone},
+	} {
+		auth, err := ResolveGCSAuth(tc.auth, tc.key)
+		require.NoError(t, err, tc.auth)
+		require.Equal(t, tc.expected, auth, tc.auth)
+	}
+	for _, tc := range []struct {
+		auth, key, message string
+	}{
+		{"file", "", "requires a storage key"},
+		{"hmac", "", "requires a storage key"},
+		{"none", "/etc/gcs.json", "doesn't use a storage key"},
+		{"oauth", "", "unsupported gcs auth"},
+	} {
+		_, err := ResolveGCSAuth(tc.auth, tc.key)
+		require.ErrorContains(t, err, tc.message, tc.auth)
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// MirrorTarget is one destination of a MirrorStorage, Path replaces the
+// primary storage path in filenames and prefixes passed to Storage.
+type MirrorTarget struct {
+	Name    string
+	Path    string
+	Storage RemoteStorage
+}
+
+// MirrorStorage implements RemoteStorage over several targets. Uploads read the
+// source once and write it to every target, reads use the first reachable target.
+type MirrorStorage struct {
+	primaryPath string
+	targets     []MirrorTarget
+	// readTarget is the index of the target chosen by List, -1 before. Restore workers read it
+	// while a List may set it
+	readTarget atomic.Int32
+	debug      bool
+}
+
+// debugf logs only if debug is enabled
+func (m *MirrorStorage) debugf(format string, args ...interface{}) {
+	if m.debug || logging.Enabled(logging.LevelDebug) {
+		log.Printf("[mirror:debug] "+format, args...)
+	}
+}
+
+// NewMirrorStorage creates a MirrorStorage, primaryPath is the storage path used
+// to build filenames and is replaced by the Path of each target.
+func NewMirrorStorage(primaryPath string, targets []MirrorTarget, debug bool) (*MirrorStorage, error) {
+	if !debug && os.Getenv("LOG_LEVEL") == "debug" {
+		debug = true
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("mirror storage requires at least one target")
+	}
+	m := &MirrorStorage{
+		primaryPath: primaryPath,
+		targets:     targets,
+		debug:       debug,
+	}
+	m.readTarget.Store(-1)
+	return m, nil
+}
+
+// targetPath rewrites a filename or prefix built from the primary path for target t.
+func (m *MirrorStorage) targetPath(t MirrorTarget, name string) string {
+	if t.Path == m.primaryPath {
+		return name
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, m.primaryPath), "/")
+	return path.Join(t.Path, rel)
+}
+
+// Upload streams reader to all targets through pipes, the upload fails if any target fails.
+func (m *MirrorStorage) Upload(filename string, reader io.Reader, compressFormat string, compressLevel int, contentEncoding string) error {
+	writers := make([]io.Writer, len(m.targets))
+	pipeWriters := make([]*io.PipeWriter, len(m.targets))
+	errs := make([]error, len(m.targets))
+	var wg sync.WaitGroup
+	for i, t := range m.targets {
+		pipeReader, pipeWriter := io.Pipe()
+		writers[i] = pipeWriter
+		pipeWriters[i] = pipeWriter
+		wg.Add(1)
+		go func(i int, t MirrorTarget) {
+			defer wg.Done()
+			targetFilename := m.targetPath(t, filename)
+			m.debugf("Uploading %s to %s", targetFilename, t.Name)
+			err := t.Storage.Upload(targetFilename, pipeReader, compressFormat, compressLevel, contentEncoding)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", t.Name, err)
+			}
+			// Unblock the writer if the target stopped reading before EOF
+			_ = pipeReader.CloseWithError(fmt.Errorf("%s upload finished", t.Name))
+		}(i, t)
+	}
+
+	_, copyErr := io.Copy(io.MultiWriter(writers...), reader)
+	for _, pipeWriter := range pipeWriters {
+		_ = pipeWriter.CloseWithError(copyErr)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("mirror upload of %s failed: %w", filename, err)
+	}
+	if copyErr != nil {
+		return fmt.Errorf("mirror upload of %s failed: %w", filename, copyErr)
+	}
+	return nil
+}
+
+// Download reads from the target chosen by List, or from the first target which returns the file.
+func (m *MirrorStorage) Download(filename string) (io.ReadCloser, error) {
+	if i := m.readTarget.Load(); i >= 0 {
+		return m.targets[i].Storage.Download(filename)
+	}
+	var errs []error
+	for _, t := range m.targets {
+		reader, err := t.Storage.Download(m.targetPath(t, filename))
+		if err == nil {
+			return reader, nil
+		}
+		logging.Warnf("mirror target %s download failed, trying next: %v", t.Name, err)
+		errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+	}
+	return nil, fmt.Errorf("download of %s failed on all mirror targets: %w", filename, errors.Join(errs...))
+}
+
+// List lists the first reachable target and uses it for subsequent downloads,
+// returned filenames are relative to that target.
+func (m *MirrorStorage) List(prefix string, recursive bool) ([]string, error) {
+	var errs []error
+	for i, t := range m.targets {
+		files, err := t.Storage.List(m.targetPath(t, prefix), recursive)
+		if err == nil {
+			m.debugf("Reading from mirror target %s", t.Name)
+			m.readTarget.Store(int32(i))
+			return files, nil
+		}
+		logging.Warnf("mirror target %s list failed, trying next: %v", t.Name, err)
+		errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+	}
+	return nil, fmt.Errorf("list of %s failed on all mirror targets: %w", prefix, errors.Join(errs...))
+}
+
+// ListAll lists every target and returns the union of their files, named as built from the
+// primary path so Delete removes each of them from every target. It fails if any target fails,
+// files missing from an unreachable copy can't be told apart.
+func (m *MirrorStorage) ListAll(prefix string, recursive bool) ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, t := range m.targets {
+		files, err := t.Storage.List(m.targetPath(t, prefix), recursive)
+		if err != nil {
+			return nil, fmt.Errorf("list of %s failed on mirror target %s: %w", prefix, t.Name, err)
+		}
+		for _, file := range files {
+			name := m.primaryName(t, file)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// primaryName rewrites a file listed on target t to the name built from the primary path,
+// file storages list names relative to their path, object storages with it.
+func (m *MirrorStorage) primaryName(t MirrorTarget, name string) string {
+	if p := strings.Trim(t.Path, "/"); p != "" {
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "/"), p+"/")
+	}
+	return path.Join(m.primaryPath, name)
+}
+
+// SetFileCompression records the compression of a listed file on every target.
+func (m *MirrorStorage) SetFileCompression(filename, compression string) {
+	for _, t := range m.targets {
+		if decoder, ok := t.Storage.(Decoder); ok {
+			decoder.SetFileCompression(filename, compression)
+		}
+	}
+}
+
+// AddZstdDictionary adds a zstd dictionary to every target.
+func (m *MirrorStorage) AddZstdDictionary(dict []byte) error {
+	for _, t := range m.targets {
+		if decoder, ok := t.Storage.(Decoder); ok {
+			if err := decoder.AddZstdDictionary(dict); err != nil {
+				return fmt.Errorf("%s: %w", t.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ResetDecoding drops the compression records and zstd dictionaries of every target.
+func (m *MirrorStorage) ResetDecoding() {
+	for _, t := range m.targets {
+		if decoder, ok := t.Storage.(Decoder); ok {
+			decoder.ResetDecoding()
+		}
+	}
+}
+
+// Size returns the size from the target chosen by List, or from the first target which has the file.
+func (m *MirrorStorage) Size(filename string) (int64, error) {
+	if i := m.readTarget.Load(); i >= 0 {
+		return m.targets[i].Storage.Size(filename)
+	}
+	var errs []error
+	for _, t := range m.targets {
+		size, err := t.Storage.Size(m.targetPath(t, filename))
+		if err == nil {
+			return size, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+	}
+	return 0, fmt.Errorf("size of %s failed on all mirror targets: %w", filename, errors.Join(errs...))
+}
+
+// Delete removes filename from every target, the delete fails if any target fails. Targets
+// without the file, e.g. a mirror added after older dumps, are skipped.
+func (m *MirrorStorage) Delete(filename string) error {
+	var errs []error
+	for _, t := range m.targets {
+		targetFilename := m.targetPath(t, filename)
+		m.debugf("Deleting %s from %s", targetFilename, t.Name)
+		if err := t.Storage.Delete(targetFilename); err != nil {
+			if _, sizeErr := t.Storage.Size(targetFilename); sizeErr != nil {
+				m.debugf("%s has no %s: %v", t.Name, targetFilename, sizeErr)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("mirror delete of %s failed: %w", filename, err)
+	}
+	return nil
+}
+
+// Close closes all targets.
+func (m *MirrorStorage) Close() error {
+	var errs []error
+	for _, t := range m.targets {
+		if err := t.Storage.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
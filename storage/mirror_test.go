@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorStorageUploadAndFallback(t *testing.T) {
+	primaryDir, mirrorDir := t.TempDir(), t.TempDir()
+	primary, err := NewFileStorage(primaryDir, false)
+	require.NoError(t, err)
+	mirror, err := NewFileStorage(mirrorDir, false)
+	require.NoError(t, err)
+
+	m, err := NewMirrorStorage(primaryDir, []MirrorTarget{
+		{Name: "primary", Path: primaryDir, Storage: primary},
+		{Name: "mirror", Path: mirrorDir, Storage: mirror},
+	}, false)
+	require.NoError(t, err)
+
+	content := strings.Repeat("INSERT INTO t VALUES (1);\n", 10000)
+	require.NoError(t, m.Upload(filepath.Join(primaryDir, "backup", "db", "t.data.sql"), strings.NewReader(content), "gzip", 6, ""))
+
+	for _, s := range []RemoteStorage{primary, mirror} {
+		files, err := s.List("backup", true)
+		require.NoError(t, err)
+		require.Equal(t, []string{filepath.Join("backup", "db", "t.data.sql.gz")}, files)
+		reader, err := s.Download(files[0])
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, content, string(data))
+	}
+
+	// Restore falls back to the mirror when the primary can't list the backup
+	broken, err := NewMirrorStorage(primaryDir, []MirrorTarget{
+		{Name: "primary", Path: primaryDir, Storage: &FileStorage{basePath: filepath.Join(primaryDir, "missing")}},
+		{Name: "mirror", Path: mirrorDir, Storage: mirror},
+	}, false)
+	require.NoError(t, err)
+	files, err := broken.List(filepath.Join(primaryDir, "backup"), true)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestMirrorStorageListAllAndDelete(t *testing.T) {
+	primaryDir, mirrorDir := t.TempDir(), t.TempDir()
+	primary, err := NewFileStorage(primaryDir, false)
+	require.NoError(t, err)
+	mirror, err := NewFileStorage(mirrorDir, false)
+	require.NoError(t, err)
+	m, err := NewMirrorStorage(primaryDir, []MirrorTarget{
+		{Name: "primary", Path: primaryDir, Storage: primary},
+		{Name: "mirror", Path: mirrorDir, Storage: mirror},
+	}, false)
+	require.NoError(t, err)
+
+	// An old dump written to both, and a table which was dumped when only the mirror was configured
+	require.NoError(t, m.Upload(filepath.Join(primaryDir, "backup", "db", "t.data.sql"), strings.NewReader("1"), "none", 0, ""))
+	require.NoError(t, mirror.Upload(filepath.Join(mirrorDir, "backup", "db", "old.data.sql"), strings.NewReader("2"), "none", 0, ""))
+
+	files, err := m.List(filepath.Join(primaryDir, "backup"), true)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "List reads the first target only")
+
+	all, err := m.ListAll(filepath.Join(primaryDir, "backup"), true)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(primaryDir, "backup", "db", "old.data.sql"), filepath.Join(primaryDir, "backup", "db", "t.data.sql")}, all)
+	for _, name := range all {
+		require.NoError(t, m.Delete(name), "targets without the file are skipped")
+	}
+	for _, dir := range []string{primaryDir, mirrorDir} {
+		require.NoFileExists(t, filepath.Join(dir, "backup", "db", "t.data.sql"))
+		require.NoFileExists(t, filepath.Join(dir, "backup", "db", "old.data.sql"))
+	}
+
+	// The cache storage passes ListAll through
+	cache, err := NewCacheStorage(m, primaryDir, t.TempDir(), false, false)
+	require.NoError(t, err)
+	require.NoError(t, mirror.Upload(filepath.Join(mirrorDir, "backup", "db", "old.data.sql"), strings.NewReader("2"), "none", 0, ""))
+	all, err = cache.ListAll(filepath.Join(primaryDir, "backup"), true)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(primaryDir, "backup", "db", "old.data.sql")}, all)
+}
+
+func TestMirrorStorageConcurrentReads(t *testing.T) {
+	primaryDir, mirrorDir := t.TempDir(), t.TempDir()
+	primary, err := NewFileStorage(primaryDir, false)
+	require.NoError(t, err)
+	mirror, err := NewFileStorage(mirrorDir, false)
+	require.NoError(t, err)
+	m, err := NewMirrorStorage(primaryDir, []MirrorTarget{
+		{Name: "primary", Path: primaryDir, Storage: primary},
+		{Name: "mirror", Path: mirrorDir, Storage: mirror},
+	}, false)
+	require.NoError(t, err)
+	require.NoError(t, m.Upload(filepath.Join(primaryDir, "backup", "t.data.sql"), strings.NewReader("1"), "none", 0, ""))
+
+	// Restore workers read while a List chooses the target, run with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Size(filepath.Join("backup", "t.data.sql"))
+			require.NoError(t, err)
+			reader, err := m.Download(filepath.Join("backup", "t.data.sql"))
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+		}()
+	}
+	_, err = m.List("backup", true)
+	require.NoError(t, err)
+	wg.Wait()
+}
+
+func TestMirrorStorageDecoding(t *testing.T) {
+	primaryDir, mirrorDir := t.TempDir(), t.TempDir()
+	primary, err := NewFileStorage(primaryDir, false)
+	require.NoError(t, err)
+	mirror, err := NewFileStorage(mirrorDir, false)
+	require.NoError(t, err)
+	m, err := NewMirrorStorage(primaryDir, []MirrorTarget{
+		{Name: "primary", Path: primaryDir, Storage: primary},
+		{Name: "mirror", Path: mirrorDir, Storage: mirror},
+	}, false)
+	require.NoError(t, err)
+	cache, err := NewCacheStorage(m, primaryDir, t.TempDir(), false, false)
+	require.NoError(t, err)
+
+	// Uncompressed Native data starting like a zstd frame, read by the record set through the wrappers
+	raw := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, "tiny"...)
+	name := filepath.Join(primaryDir, "backup", "db", "tiny.data.native")
+	require.NoError(t, cache.Upload(name, bytes.NewReader(raw), "none", 0, ""))
+	cache.SetFileCompression(name, "none")
+	for _, s := range []RemoteStorage{cache, primary} {
+		reader, err := s.Download(name)
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, raw, content)
+	}
+
+	cache.ResetDecoding()
+	reader, err := cache.Download(name)
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	require.Error(t, err)
+	require.NoError(t, reader.Close())
+}
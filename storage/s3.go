@@ -1,20 +1,29 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsMiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	awsV2Logging "github.com/aws/smithy-go/logging"
+	smithyMiddleware "github.com/aws/smithy-go/middleware"
+
+	"github.com/Slach/clickhouse-dump/logging"
 )
 
 type S3LogAdapter struct {
@@ -29,30 +38,79 @@ func (apapter S3LogAdapter) Logf(severity awsV2Logging.Classification, msg strin
 	log.Printf(msg, args...)
 }
 
+// S3Options holds optional S3 settings, the zero value keeps the defaults.
+type S3Options struct {
+	TmpDir               string // Directory for buffered downloads, empty means the system temp dir
+	CompressionMode      string // CompressionModeExtension or CompressionModeTransparent
+	PathStyle            *bool  // Force path-style (true) or virtual-hosted (false) addressing, nil means path-style for non-AWS endpoints
+	RequestPayer         string // "requester" for requester-pays buckets
+	ContentType          string // Content-Type of uploaded objects, empty means detected from the object name
+	PartSize             int64  // Multipart upload part size in bytes, 0 means the SDK default
+	UploadConcurrency    int    // Parts uploaded in parallel per file, 0 means the SDK default
+	DownloadConcurrency  int    // Parts downloaded in parallel per file, 0 means the SDK default
+	UserAgent            string // Appended to the SDK User-Agent as "name/version", empty keeps the SDK default
+	VerifyUpload         bool   // Send checksums of uploaded bodies, so S3 rejects corrupted uploads
+	StorageClass         string // Storage class of uploaded objects like STANDARD_IA or GLACIER, empty means the bucket default
+	ChecksumWhenRequired bool   // Send and validate SDK checksums only when required, for S3-compatible APIs like GCS rejecting them
+	CredentialProcess    string // Command printing credentials as JSON, run again when they expire, instead of static keys
+	CreateBucket         bool   // Create the bucket in the region when it doesn't exist
+}
+
+// S3MinPartSize is the smallest part size S3 accepts for multipart uploads.
+const S3MinPartSize = manager.MinUploadPartSize
+
 type S3Storage struct {
-	bucket     string
-	client     *s3.Client
-	uploader   *manager.Uploader
-	downloader *manager.Downloader
-	debug      bool
+	bucket          string
+	client          *s3.Client
+	uploader        *manager.Uploader
+	downloader      *manager.Downloader
+	tmpDir          string
+	compressionMode string // CompressionModeExtension or CompressionModeTransparent
+	requestPayer    types.RequestPayer
+	contentType     string
+	verifyUpload    bool
+	storageClass    types.StorageClass
+	debug           bool
+	decoding
 }
 
 func (s *S3Storage) debugf(format string, args ...interface{}) {
-	if s.debug {
+	if s.debug || logging.Enabled(logging.LevelDebug) {
 		log.Printf("[s3:debug] "+format, args...)
 	}
 }
 
-func NewS3Storage(bucket, region, accessKey, secretKey, endpoint string, debug bool) (*S3Storage, error) {
+// NewS3Storage creates a new S3 client, s3Options tunes optional behavior.
+func NewS3Storage(bucket, region, accessKey, secretKey, endpoint string, s3Options S3Options, debug bool) (*S3Storage, error) {
 	if debug {
 		log.Printf("Initializing S3 storage with bucket=%s, region=%s, endpoint=%s", bucket, region, endpoint)
 	}
+	if s3Options.RequestPayer != "" && s3Options.RequestPayer != string(types.RequestPayerRequester) {
+		return nil, fmt.Errorf("unsupported s3 request payer %q, only %q is allowed", s3Options.RequestPayer, types.RequestPayerRequester)
+	}
+	if s3Options.PartSize != 0 && s3Options.PartSize < S3MinPartSize {
+		return nil, fmt.Errorf("s3 part size %d is less than the minimum %d bytes", s3Options.PartSize, S3MinPartSize)
+	}
+	if s3Options.UploadConcurrency < 0 || s3Options.DownloadConcurrency < 0 {
+		return nil, fmt.Errorf("s3 upload and download concurrency must not be negative")
+	}
+	storageClass, err := s3StorageClass(s3Options.StorageClass)
+	if err != nil {
+		return nil, err
+	}
 	opts := []func(*config.LoadOptions) error{
 		config.WithRegion(region),
 	}
 
-	// Use explicit credentials if provided
-	if accessKey != "" && secretKey != "" {
+	// Use the credential process or explicit credentials if provided
+	if s3Options.CredentialProcess != "" {
+		provider := newCredentialProcessProvider(s3Options.CredentialProcess)
+		// Fails early with the error of the process instead of on the first request
+		if _, err := provider.Retrieve(context.Background()); err != nil {
+			return nil, err
+		}
+		opts = append(opts, config.WithCredentialsProvider(provider))
+	} else if accessKey != "" && secretKey != "" {
 		opts = append(opts, config.WithCredentialsProvider(aws.CredentialsProviderFunc(
 			func(ctx context.Context) (aws.Credentials, error) {
 				return aws.Credentials{
@@ -72,67 +130,236 @@ func NewS3Storage(bucket, region, accessKey, secretKey, endpoint string, debug b
 		cfg.ClientLogMode = aws.LogRequest | aws.LogResponse | aws.LogRetries
 	}
 
+	usePathStyle := s3UsePathStyle(endpoint, s3Options.PathStyle)
 	var clientOpts []func(*s3.Options)
-	if endpoint != "" {
-		clientOpts = append(clientOpts, func(o *s3.Options) {
+	clientOpts = append(clientOpts, func(o *s3.Options) {
+		if endpoint != "" {
 			o.BaseEndpoint = aws.String(endpoint)
-			o.UsePathStyle = true // Needed for MinIO and other S3-compatible services
-		})
-	}
+		}
+		o.UsePathStyle = usePathStyle
+		if s3Options.ChecksumWhenRequired {
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+		if s3Options.UserAgent != "" {
+			o.APIOptions = append(o.APIOptions, userAgentMiddleware(s3Options.UserAgent))
+		}
+	})
 
 	client := s3.NewFromConfig(cfg, clientOpts...)
 
+	if s3Options.CreateBucket {
+		if err := createS3Bucket(client, bucket, cfg.Region, debug); err != nil {
+			return nil, err
+		}
+	}
+
+	// A wrong region fails every request with PermanentRedirect or AuthorizationHeaderMalformed,
+	// AWS reports the bucket region, so an empty or wrong --storage-region is corrected here
+	if isAWSEndpoint(endpoint) {
+		detected, detectErr := detectS3Region(client, bucket, cfg.Region)
+		switch {
+		case detectErr != nil && cfg.Region == "":
+			return nil, fmt.Errorf("s3 region is not set and can't be detected for bucket %s, set --storage-region: %w", bucket, detectErr)
+		case detectErr != nil:
+			if debug {
+				log.Printf("[s3:debug] Can't detect region of bucket %s, using %s: %v", bucket, cfg.Region, detectErr)
+			}
+		case detected != cfg.Region:
+			if cfg.Region != "" {
+				logging.Warnf("s3 bucket %s is in region %s, not %s, using %s", bucket, detected, cfg.Region, detected)
+			}
+			cfg.Region = detected
+			client = s3.NewFromConfig(cfg, clientOpts...)
+		}
+	}
+
 	if debug {
 		log.Printf("S3 storage initialized successfully")
 	}
 	return &S3Storage{
-		bucket:     bucket,
-		client:     client,
-		uploader:   manager.NewUploader(client),
-		downloader: manager.NewDownloader(client),
-		debug:      debug,
+		bucket: bucket,
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			if s3Options.PartSize > 0 {
+				u.PartSize = s3Options.PartSize
+			}
+			if s3Options.UploadConcurrency > 0 {
+				u.Concurrency = s3Options.UploadConcurrency
+			}
+		}),
+		downloader: manager.NewDownloader(client, func(d *manager.Downloader) {
+			if s3Options.PartSize > 0 {
+				d.PartSize = s3Options.PartSize
+			}
+			if s3Options.DownloadConcurrency > 0 {
+				d.Concurrency = s3Options.DownloadConcurrency
+			}
+		}),
+		tmpDir:          s3Options.TmpDir,
+		compressionMode: s3Options.CompressionMode,
+		requestPayer:    types.RequestPayer(s3Options.RequestPayer),
+		contentType:     s3Options.ContentType,
+		verifyUpload:    s3Options.VerifyUpload,
+		storageClass:    storageClass,
+		debug:           debug,
 	}, nil
 }
 
+// s3StorageClass parses a storage class name, empty means the bucket default.
+func s3StorageClass(class string) (types.StorageClass, error) {
+	if class == "" {
+		return "", nil
+	}
+	for _, known := range types.StorageClass("").Values() {
+		if strings.EqualFold(class, string(known)) {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported s3 storage class %s, expected one of %v", class, types.StorageClass("").Values())
+}
+
+// s3UsePathStyle returns the addressing of endpoint: forced by pathStyle when set, otherwise
+// path-style for MinIO and other S3-compatible services and virtual-hosted style for AWS itself.
+func s3UsePathStyle(endpoint string, pathStyle *bool) bool {
+	if pathStyle != nil {
+		return *pathStyle
+	}
+	return !isAWSEndpoint(endpoint)
+}
+
+// isAWSEndpoint reports whether endpoint is AWS S3, empty means the default AWS endpoint.
+func isAWSEndpoint(endpoint string) bool {
+	return endpoint == "" || strings.Contains(endpoint, "amazonaws.com")
+}
+
+// detectS3Region returns the region of bucket reported by AWS, region is only used
+// to pick the AWS partition of the request and defaults to us-east-1.
+func detectS3Region(client *s3.Client, bucket, region string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return manager.GetBucketRegion(ctx, client, bucket, func(o *s3.Options) {
+		if region == "" {
+			o.Region = "us-east-1"
+		}
+	})
+}
+
+// createS3Bucket creates bucket for --create-bucket, a bucket already owned by the credentials is
+// used as is. Buckets outside us-east-1 need the region as location constraint, S3-compatible
+// services with region auto take none, an empty region creates the bucket in us-east-1.
+func createS3Bucket(client *s3.Client, bucket, region string, debug bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	input := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	if region != "" && region != "us-east-1" && region != "auto" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{LocationConstraint: types.BucketLocationConstraint(region)}
+	}
+	_, err := client.CreateBucket(ctx, input, func(o *s3.Options) {
+		if region == "" {
+			o.Region = "us-east-1"
+		}
+	})
+	var owned *types.BucketAlreadyOwnedByYou
+	switch {
+	case errors.As(err, &owned):
+		if debug {
+			log.Printf("[s3:debug] Bucket %s already exists", bucket)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to create s3 bucket %s: %w", bucket, err)
+	case debug:
+		log.Printf("[s3:debug] Bucket %s created", bucket)
+	}
+	return nil
+}
+
 // Upload uploads data to S3.
 // If contentEncoding is provided, it's assumed data is pre-compressed and ContentEncoding header is set.
 // Otherwise, compressFormat and compressLevel are used for client-side compression.
 func (s *S3Storage) Upload(filename string, reader io.Reader, compressFormat string, compressLevel int, contentEncoding string) error {
 	s3Key := strings.TrimPrefix(filename, "/")
 	var finalReader = reader
+	var ext string
 
 	if contentEncoding != "" {
 		s.debugf("S3 Upload: pre-compressed data with contentEncoding: %s for key %s", contentEncoding, s3Key)
-		actualEncoding := strings.ToLower(contentEncoding)
-		switch actualEncoding {
-		case "gzip":
-			s3Key += ".gz"
-		case "zstd":
-			s3Key += ".zstd"
-		default:
+		ext = extensionForEncoding(contentEncoding)
+		if ext == "" {
 			s.debugf("S3 Upload: unknown contentEncoding '%s' for key %s, uploading as is", contentEncoding, s3Key)
-			// s3Key remains unchanged, s3ObjectContentEncoding remains nil
 		}
 	} else if compressFormat != "" && compressFormat != "none" {
 		s.debugf("S3 Upload: compressing data with format: %s, level: %d for key %s", compressFormat, compressLevel, s3Key)
-		var ext string
 		finalReader, ext = compressStream(reader, compressFormat, compressLevel)
-		s3Key += ext
 	} else {
 		s.debugf("S3 Upload: uploading data uncompressed for key %s", s3Key)
 	}
 
-	s.debugf("S3 Upload: final S3 key: %s", s3Key)
 	uploadInput := &s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s3Key),
-		Body:   finalReader,
+		Bucket:       aws.String(s.bucket),
+		Body:         finalReader,
+		RequestPayer: s.requestPayer,
+		// The uploader passes it to CreateMultipartUpload for multipart uploads
+		StorageClass: s.storageClass,
+	}
+	if s.compressionMode == CompressionModeTransparent && ext != "" {
+		uploadInput.ContentEncoding = aws.String(encodingForExtension(ext))
+	} else {
+		s3Key += ext
+	}
+	uploadInput.Key = aws.String(s3Key)
+	contentType := s.contentType
+	if contentType == "" {
+		contentType = contentTypeFor(s3Key)
 	}
+	uploadInput.ContentType = aws.String(contentType)
 
+	if s.verifyUpload {
+		if err := s.setVerifiedBody(uploadInput); err != nil {
+			return fmt.Errorf("failed to read %s for upload: %w", s3Key, err)
+		}
+	}
+
+	s.debugf("S3 Upload: final S3 key: %s", s3Key)
 	_, err := s.uploader.Upload(context.Background(), uploadInput)
 	return err
 }
 
+// setVerifiedBody makes S3 reject corrupted uploads of input. A body fitting in one part is
+// buffered and sent with its Content-MD5. Larger bodies go through multipart uploads, where
+// Content-MD5 of the whole body doesn't apply, so the SDK sends a CRC32 checksum of every part.
+func (s *S3Storage) setVerifiedBody(input *s3.PutObjectInput) error {
+	first := make([]byte, s.uploader.PartSize)
+	n, err := io.ReadFull(input.Body, first)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		sum := md5.Sum(first[:n])
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		input.Body = bytes.NewReader(first[:n])
+	case err != nil:
+		return err
+	default:
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmCrc32
+		input.Body = io.MultiReader(bytes.NewReader(first), input.Body)
+	}
+	return nil
+}
+
+// OpenWriter implements WriterStorage, the data goes to the multipart uploader as it is written.
+func (s *S3Storage) OpenWriter(filename string, compressFormat string, compressLevel int, contentEncoding string) (io.WriteCloser, error) {
+	return newUploadWriter(filename, func(r io.Reader) error {
+		return s.Upload(filename, r, compressFormat, compressLevel, contentEncoding)
+	}), nil
+}
+
+// userAgentMiddleware appends userAgent like "clickhouse-dump/1.2.3" to the User-Agent of S3 requests.
+func userAgentMiddleware(userAgent string) func(*smithyMiddleware.Stack) error {
+	if name, version, ok := strings.Cut(userAgent, "/"); ok {
+		return awsMiddleware.AddUserAgentKeyValue(name, version)
+	}
+	return awsMiddleware.AddUserAgentKey(userAgent)
+}
+
 // tempFileCloser wraps an io.ReadCloser (usually *os.File)
 // and ensures the temporary file is deleted when Close is called.
 type tempFileCloser struct {
@@ -148,7 +375,7 @@ func (tfc *tempFileCloser) Close() error {
 		// If closing the reader failed, return this error.
 		// Log the removal error if it also occurred.
 		if removeErr != nil {
-			log.Printf("also failed to remove temporary file %s: %v", tfc.name, removeErr)
+			logging.Warnf("also failed to remove temporary file %s: %v", tfc.name, removeErr)
 		}
 		return closeErr
 	}
@@ -164,15 +391,16 @@ func (s *S3Storage) Download(filename string) (io.ReadCloser, error) {
 	s.debugf("attempting to download key: %s", s3Key)
 
 	// Create a temporary file for download
-	tempFile, err := os.CreateTemp("", "s3-download-*")
+	tempFile, err := os.CreateTemp(s.tmpDir, "s3-download-*")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temporary file: %w", err)
 	}
 
 	// Try to download
 	_, err = s.downloader.Download(context.Background(), tempFile, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s3Key),
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(s3Key),
+		RequestPayer: s.requestPayer,
 	})
 
 	if err == nil {
@@ -184,7 +412,23 @@ func (s *S3Storage) Download(filename string) (io.ReadCloser, error) {
 			return nil, fmt.Errorf("failed to seek temporary file: %w", seekErr)
 		}
 
-		return &tempFileCloser{ReadCloser: decompressStream(tempFile, s3Key), name: tempFile.Name()}, nil
+		// Only transparent mode stores the compression in Content-Encoding alone, the ranged
+		// downloads don't return it. Without it the content is sniffed, so a failed HEAD isn't fatal
+		var contentEncoding string
+		if s.compressionMode == CompressionModeTransparent && GetCompressionExtension(s3Key) == "" {
+			head, headErr := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+				Bucket:       aws.String(s.bucket),
+				Key:          aws.String(s3Key),
+				RequestPayer: s.requestPayer,
+			})
+			if headErr != nil {
+				logging.Warnf("can't get the Content-Encoding of %s from S3, detecting the compression from its content: %v", s3Key, headErr)
+			} else {
+				contentEncoding = aws.ToString(head.ContentEncoding)
+			}
+		}
+
+		return &tempFileCloser{ReadCloser: s.decompressStreamWithEncoding(tempFile, s3Key, contentEncoding), name: tempFile.Name()}, nil
 	}
 
 	// Download failed, clean up the current tempFile
@@ -196,20 +440,46 @@ func (s *S3Storage) Download(filename string) (io.ReadCloser, error) {
 	if errors.As(err, &nsk) {
 		return nil, fmt.Errorf("object %s not found in S3: %w", s3Key, err)
 	}
+	var archived *types.InvalidObjectState
+	if errors.As(err, &archived) {
+		return nil, s.archivedError(s3Key, err)
+	}
 
 	// Для других ошибок S3 возвращаем немедленно
 	return nil, fmt.Errorf("failed to download %s from S3: %w", s3Key, err)
 }
 
+// archivedError explains download errors of GLACIER and DEEP_ARCHIVE objects, which need a
+// restore-object first, with the x-amz-restore status of the object.
+func (s *S3Storage) archivedError(s3Key string, err error) error {
+	head, headErr := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(s3Key),
+		RequestPayer: s.requestPayer,
+	})
+	if headErr != nil {
+		return fmt.Errorf("object %s in S3 bucket %s is archived, restore it with aws s3api restore-object before restoring the backup: %w", s3Key, s.bucket, err)
+	}
+	switch restore := aws.ToString(head.Restore); {
+	case restore == "":
+		return fmt.Errorf("object %s in S3 bucket %s is in the %s storage class, restore it with aws s3api restore-object before restoring the backup: %w", s3Key, s.bucket, head.StorageClass, err)
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return fmt.Errorf("object %s in S3 bucket %s is still being restored from the %s storage class, retry when it finishes (x-amz-restore: %s): %w", s3Key, s.bucket, head.StorageClass, restore, err)
+	default:
+		return fmt.Errorf("object %s in S3 bucket %s in the %s storage class can't be read (x-amz-restore: %s): %w", s3Key, s.bucket, head.StorageClass, restore, err)
+	}
+}
+
 func (s *S3Storage) List(prefix string, recursive bool) ([]string, error) {
 	ctx := context.Background()
 	var objectNames []string
 
 	s3Prefix := strings.TrimPrefix(prefix, "/")
 	input := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s.bucket),
-		Prefix:    aws.String(s3Prefix),
-		Delimiter: aws.String("/"),
+		Bucket:       aws.String(s.bucket),
+		Prefix:       aws.String(s3Prefix),
+		Delimiter:    aws.String("/"),
+		RequestPayer: s.requestPayer,
 	}
 
 	if recursive {
@@ -237,9 +507,39 @@ func (s *S3Storage) List(prefix string, recursive bool) ([]string, error) {
 		}
 	}
 
+	sort.Strings(objectNames)
 	return objectNames, nil
 }
 
+// Size returns the object size from a HEAD request.
+func (s *S3Storage) Size(filename string) (int64, error) {
+	s3Key := strings.TrimPrefix(filename, "/")
+	head, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(s3Key),
+		RequestPayer: s.requestPayer,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of %s in s3 bucket %s: %w", s3Key, s.bucket, err)
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
+
+// Delete removes an object from S3.
+func (s *S3Storage) Delete(filename string) error {
+	s3Key := strings.TrimPrefix(filename, "/")
+	s.debugf("Deleting key: %s", s3Key)
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(s3Key),
+		RequestPayer: s.requestPayer,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from s3 bucket %s: %w", s3Key, s.bucket, err)
+	}
+	return nil
+}
+
 func (s *S3Storage) Close() error {
 	// AWS SDK v2 clients don't need explicit closing
 	return nil
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3StorageUserAgent(t *testing.T) {
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userAgents = append(userAgents, req.Header.Get("User-Agent"))
+		w.Header().Set("Content-Length", "3")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	s, err := NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{UserAgent: "clickhouse-dump/1.2.3"}, false)
+	require.NoError(t, err)
+	size, err := s.Size("backup/db.database.sql")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), size)
+	require.Len(t, userAgents, 1)
+	require.Contains(t, userAgents[0], "aws-sdk-go-v2/", "the SDK part of the User-Agent is kept")
+	require.Contains(t, userAgents[0], " clickhouse-dump/1.2.3")
+}
+
+// newCorruptingS3Server accepts PutObject, flipping the first received byte like a faulty
+// network would, and rejects bodies not matching their Content-MD5 like S3 does.
+func newCorruptingS3Server(t *testing.T) (string, *[][]byte) {
+	var stored [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		if len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		if contentMD5 := req.Header.Get("Content-MD5"); contentMD5 != "" {
+			sum := md5.Sum(body)
+			if base64.StdEncoding.EncodeToString(sum[:]) != contentMD5 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = io.WriteString(w, "<Error><Code>BadDigest</Code><Message>The Content-MD5 you specified did not match what we received.</Message></Error>")
+				return
+			}
+		}
+		stored = append(stored, body)
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, &stored
+}
+
+func TestS3StorageVerifyUpload(t *testing.T) {
+	endpoint, stored := newCorruptingS3Server(t)
+	s, err := NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{}, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "none", 0, ""))
+	require.Len(t, *stored, 1, "without verification the corrupted body is stored")
+
+	s, err = NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{VerifyUpload: true}, false)
+	require.NoError(t, err)
+	err = s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "none", 0, "")
+	require.ErrorContains(t, err, "BadDigest")
+	require.Len(t, *stored, 1)
+
+	// Bodies larger than one part are uploaded with a checksum per part instead
+	input := &s3.PutObjectInput{Body: bytes.NewReader(make([]byte, s.uploader.PartSize+1))}
+	require.NoError(t, s.setVerifiedBody(input))
+	require.Nil(t, input.ContentMD5)
+	require.Equal(t, types.ChecksumAlgorithmCrc32, input.ChecksumAlgorithm)
+	body, err := io.ReadAll(input.Body)
+	require.NoError(t, err)
+	require.Len(t, body, int(s.uploader.PartSize+1))
+}
+
+func TestS3StorageClass(t *testing.T) {
+	_, err := NewS3Storage("bucket", "us-east-1", "key", "secret", "http://localhost", S3Options{StorageClass: "COLD"}, false)
+	require.ErrorContains(t, err, "unsupported s3 storage class COLD")
+
+	var classes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		switch {
+		case req.Method == http.MethodPost && req.URL.Query().Has("uploads"):
+			classes = append(classes, req.Header.Get("X-Amz-Storage-Class"))
+			_, _ = io.WriteString(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>k</Key><UploadId>1</UploadId></InitiateMultipartUploadResult>")
+		case req.Method == http.MethodPost:
+			_, _ = io.WriteString(w, "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>")
+		case req.Method == http.MethodPut:
+			if !req.URL.Query().Has("partNumber") {
+				classes = append(classes, req.Header.Get("X-Amz-Storage-Class"))
+			}
+			w.Header().Set("ETag", `"etag"`)
+		case req.Method == http.MethodHead:
+			w.Header().Set("X-Amz-Storage-Class", "GLACIER")
+			w.Header().Set("X-Amz-Restore", `ongoing-request="true"`)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, "<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message><StorageClass>GLACIER</StorageClass></Error>")
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	s, err := NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{StorageClass: "glacier", PartSize: S3MinPartSize}, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "none", 0, ""))
+	require.NoError(t, s.Upload("backup/db/big.data.sql", bytes.NewReader(make([]byte, S3MinPartSize+1)), "none", 0, ""))
+	require.Equal(t, []string{"GLACIER", "GLACIER"}, classes, "single and multipart uploads set the storage class")
+
+	_, err = s.Download("backup/db/t.data.sql")
+	require.ErrorContains(t, err, "still being restored from the GLACIER storage class")
+	require.ErrorContains(t, err, `ongoing-request="true"`)
+}
+
+func TestS3StorageCreateBucket(t *testing.T) {
+	var created []string
+	errorCode := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if req.Method != http.MethodPut {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		created = append(created, req.URL.Path+" "+string(body))
+		if errorCode != "" {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = io.WriteString(w, "<Error><Code>"+errorCode+"</Code><Message>bucket exists</Message></Error>")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	_, err := NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{}, false)
+	require.NoError(t, err)
+	require.Empty(t, created, "buckets are only created with CreateBucket")
+
+	_, err = NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{CreateBucket: true}, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/bucket "}, created, "us-east-1 takes no location constraint")
+
+	created = nil
+	_, err = NewS3Storage("bucket", "eu-west-1", "key", "secret", server.URL, S3Options{CreateBucket: true}, false)
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+	require.Contains(t, created[0], "<LocationConstraint>eu-west-1</LocationConstraint>")
+
+	errorCode = "BucketAlreadyOwnedByYou"
+	_, err = NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{CreateBucket: true}, false)
+	require.NoError(t, err)
+
+	errorCode = "BucketAlreadyExists"
+	_, err = NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{CreateBucket: true}, false)
+	require.ErrorContains(t, err, "failed to create s3 bucket bucket")
+}
+
+// s3Object is an object stored by newMemoryS3Server.
+type s3Object struct {
+	body            []byte
+	contentEncoding string
+}
+
+// newMemoryS3Server serves PutObject, GetObject and HeadObject of path-style requests from
+// memory, with the Content-Encoding of the objects like S3. It records the request headers.
+func newMemoryS3Server(t *testing.T) (string, map[string]s3Object, *[]http.Header) {
+	objects := make(map[string]s3Object)
+	var headers []http.Header
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		headers = append(headers, req.Header.Clone())
+		switch req.Method {
+		case http.MethodPut:
+			objects[req.URL.Path] = s3Object{body: body, contentEncoding: req.Header.Get("Content-Encoding")}
+			w.Header().Set("ETag", `"etag"`)
+		case http.MethodGet, http.MethodHead:
+			object, ok := objects[req.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+				return
+			}
+			if object.contentEncoding != "" {
+				w.Header().Set("Content-Encoding", object.contentEncoding)
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(object.body)))
+			if req.Method == http.MethodGet {
+				_, _ = w.Write(object.body)
+			}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, objects, &headers
+}
+
+func TestS3StorageTransparentCompression(t *testing.T) {
+	endpoint, objects, _ := newMemoryS3Server(t)
+	s, err := NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{CompressionMode: CompressionModeTransparent}, false)
+	require.NoError(t, err)
+
+	// The stored name keeps .sql, the compression is in Content-Encoding
+	require.NoError(t, s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "gzip", 0, ""))
+	require.Contains(t, objects, "/bucket/backup/db/t.data.sql")
+	require.NotContains(t, objects, "/bucket/backup/db/t.data.sql.gz")
+	stored := objects["/bucket/backup/db/t.data.sql"]
+	require.Equal(t, "gzip", stored.contentEncoding)
+	require.Equal(t, []byte{0x1f, 0x8b}, stored.body[:2], "the body is stored compressed")
+	require.Equal(t, "INSERT INTO t VALUES (1);", readAll(t, s, "backup/db/t.data.sql"))
+
+	require.NoError(t, s.Upload("backup/db/z.data.sql", strings.NewReader("INSERT INTO z VALUES (1);"), "zstd", 0, ""))
+	require.Equal(t, "zstd", objects["/bucket/backup/db/z.data.sql"].contentEncoding)
+	require.Equal(t, "INSERT INTO z VALUES (1);", readAll(t, s, "backup/db/z.data.sql"))
+
+	// Download decompresses by the metadata, not the name: a zstd object under a .sql name is
+	// decompressed, an object without Content-Encoding is returned as stored
+	objects["/bucket/backup/db/moved.data.sql"] = objects["/bucket/backup/db/z.data.sql"]
+	require.Equal(t, "INSERT INTO z VALUES (1);", readAll(t, s, "backup/db/moved.data.sql"))
+	objects["/bucket/backup/db/plain.data.sql"] = s3Object{body: []byte("INSERT INTO p VALUES (1);")}
+	require.Equal(t, "INSERT INTO p VALUES (1);", readAll(t, s, "backup/db/plain.data.sql"))
+
+	// Uncompressed uploads get no Content-Encoding
+	require.NoError(t, s.Upload("backup/db/n.data.sql", strings.NewReader("INSERT INTO n VALUES (1);"), "none", 0, ""))
+	require.Empty(t, objects["/bucket/backup/db/n.data.sql"].contentEncoding)
+
+	// In extension mode the extension is appended instead
+	s, err = NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{}, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Upload("backup/db/e.data.sql", strings.NewReader("INSERT INTO e VALUES (1);"), "gzip", 0, ""))
+	require.Contains(t, objects, "/bucket/backup/db/e.data.sql.gz")
+	require.Empty(t, objects["/bucket/backup/db/e.data.sql.gz"].contentEncoding)
+	require.Equal(t, "INSERT INTO e VALUES (1);", readAll(t, s, "backup/db/e.data.sql.gz"))
+}
+
+func TestS3StorageDownloadContentEncoding(t *testing.T) {
+	compressed, _ := compressStream(strings.NewReader("INSERT INTO t VALUES (1);"), "zstd", 3)
+	body, err := io.ReadAll(compressed)
+	require.NoError(t, err)
+	var mu sync.Mutex
+	methods := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		methods[req.Method]++
+		mu.Unlock()
+		if req.Method == http.MethodHead {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	// Extension mode doesn't ask for the Content-Encoding of names without extension
+	s, err := NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{}, false)
+	require.NoError(t, err)
+	require.Equal(t, "INSERT INTO t VALUES (1);", readAll(t, s, "backup/db/t.data.sql"))
+	require.Equal(t, 0, methods[http.MethodHead])
+
+	// Transparent mode does, a failed HEAD falls back to the content
+	s, err = NewS3Storage("bucket", "us-east-1", "key", "secret", server.URL, S3Options{CompressionMode: CompressionModeTransparent}, false)
+	require.NoError(t, err)
+	require.Equal(t, "INSERT INTO t VALUES (1);", readAll(t, s, "backup/db/t.data.sql"))
+	require.Equal(t, 1, methods[http.MethodHead])
+}
+
+// readAll downloads a file and returns its content.
+func readAll(t *testing.T, s RemoteStorage, filename string) string {
+	reader, err := s.Download(filename)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, reader.Close()) }()
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestS3UsePathStyle(t *testing.T) {
+	forced, virtual := true, false
+	tests := []struct {
+		endpoint  string
+		pathStyle *bool
+		want      bool
+	}{
+		{endpoint: "", want: false},
+		{endpoint: "https://s3.eu-west-1.amazonaws.com", want: false},
+		{endpoint: "https://s3.dualstack.us-east-1.amazonaws.com", want: false},
+		{endpoint: "http://minio:9000", want: true},
+		{endpoint: "https://storage.googleapis.com", want: true},
+		{endpoint: "https://s3.eu-west-1.amazonaws.com", pathStyle: &forced, want: true},
+		{endpoint: "", pathStyle: &forced, want: true},
+		{endpoint: "http://minio:9000", pathStyle: &virtual, want: false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, s3UsePathStyle(tt.endpoint, tt.pathStyle), "endpoint %q, path style %v", tt.endpoint, tt.pathStyle)
+	}
+}
+
+func TestS3StorageRequestPayer(t *testing.T) {
+	endpoint, _, headers := newMemoryS3Server(t)
+	s, err := NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{RequestPayer: "requester"}, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "none", 0, ""))
+	require.Equal(t, "INSERT INTO t VALUES (1);", readAll(t, s, "backup/db/t.data.sql"))
+	_, err = s.Size("backup/db/t.data.sql")
+	require.NoError(t, err)
+	// PutObject, GetObject and HeadObject for Size
+	require.Len(t, *headers, 3)
+	for _, header := range *headers {
+		require.Equal(t, "requester", header.Get("X-Amz-Request-Payer"))
+	}
+
+	*headers = nil
+	s, err = NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{}, false)
+	require.NoError(t, err)
+	require.Equal(t, "INSERT INTO t VALUES (1);", readAll(t, s, "backup/db/t.data.sql"))
+	require.NotEmpty(t, *headers)
+	for _, header := range *headers {
+		require.Empty(t, header.Get("X-Amz-Request-Payer"))
+	}
+}
+
+func TestS3StorageDownloadTmpDir(t *testing.T) {
+	endpoint, _, _ := newMemoryS3Server(t)
+	tmpDir := t.TempDir()
+	s, err := NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{TmpDir: tmpDir}, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Upload("backup/db/t.data.sql", strings.NewReader("INSERT INTO t VALUES (1);"), "gzip", 0, ""))
+
+	reader, err := s.Download("backup/db/t.data.sql.gz")
+	require.NoError(t, err)
+	buffered, err := filepath.Glob(filepath.Join(tmpDir, "s3-download-*"))
+	require.NoError(t, err)
+	require.Len(t, buffered, 1, "the download is buffered in --tmp-dir")
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "INSERT INTO t VALUES (1);", string(content))
+	require.NoError(t, reader.Close())
+	require.NoFileExists(t, buffered[0])
+
+	s, err = NewS3Storage("bucket", "us-east-1", "key", "secret", endpoint, S3Options{TmpDir: filepath.Join(tmpDir, "missing")}, false)
+	require.NoError(t, err)
+	_, err = s.Download("backup/db/t.data.sql.gz")
+	require.ErrorContains(t, err, "failed to create temporary file")
+}
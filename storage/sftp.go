@@ -4,32 +4,47 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/Slach/clickhouse-dump/logging"
 )
 
+// sftpMaxPacket is the largest packet every SFTP server has to accept, transfers get faster
+// through concurrent requests per file rather than through bigger packets.
+const sftpMaxPacket = 32768
+
+// SFTPOptions tunes the SFTP connection, zero values keep the defaults.
+type SFTPOptions struct {
+	KeepAliveInterval time.Duration // Interval of keepalive@openssh.com requests, 0 disables them
+	Concurrency       int           // Concurrent read and write requests per file, 0 means the library default of 64
+}
+
 type SFTPStorage struct {
-	client *sftp.Client
-	conn   *ssh.Client
-	host   string
-	user   string
-	debug  bool
+	client        *sftp.Client
+	conn          *ssh.Client
+	host          string
+	user          string
+	debug         bool
+	stopKeepAlive chan struct{}
+	keepAliveDone chan struct{}
+	decoding
 }
 
 func (s *SFTPStorage) debugf(format string, args ...interface{}) {
-	if s.debug {
+	if s.debug || logging.Enabled(logging.LevelDebug) {
 		log.Printf("[sftp:debug] "+format, args...)
 	}
 }
 
-// NewSFTPStorage creates a new SFTP storage client.
-func NewSFTPStorage(host, user, password string, debug bool) (*SFTPStorage, error) {
+// NewSFTPStorage creates a new SFTP storage client, Close stops the keepalive requests.
+func NewSFTPStorage(host, user, password string, sftpOptions SFTPOptions, debug bool) (*SFTPStorage, error) {
 	s := &SFTPStorage{
 		host:  host,
 		user:  user,
@@ -41,11 +56,14 @@ func NewSFTPStorage(host, user, password string, debug bool) (*SFTPStorage, erro
 	if host == "" || user == "" { // Password might be empty if using key auth (not implemented here)
 		return nil, fmt.Errorf("sftp host and user cannot be empty")
 	}
+	if sftpOptions.KeepAliveInterval < 0 || sftpOptions.Concurrency < 0 {
+		return nil, fmt.Errorf("sftp keepalive interval and concurrency cannot be negative")
+	}
 
 	// Add default port if not specified
-	if !strings.Contains(host, ":") {
-		s.debugf("No port specified, using default port 22")
-		host = net.JoinHostPort(host, "22")
+	host, err := hostWithDefaultPort(host, "22")
+	if err != nil {
+		return nil, fmt.Errorf("invalid sftp host: %w", err)
 	}
 
 	// Configure SSH client
@@ -72,12 +90,19 @@ func NewSFTPStorage(host, user, password string, debug bool) (*SFTPStorage, erro
 
 	// Create SFTP client from SSH connection
 	s.debugf("Creating SFTP client from SSH connection")
-	client, err := sftp.NewClient(conn)
+	clientOptions := []sftp.ClientOption{
+		sftp.MaxPacket(sftpMaxPacket),
+		sftp.UseConcurrentWrites(true),
+	}
+	if sftpOptions.Concurrency > 0 {
+		clientOptions = append(clientOptions, sftp.MaxConcurrentRequestsPerFile(sftpOptions.Concurrency))
+	}
+	client, err := sftp.NewClient(conn, clientOptions...)
 	if err != nil {
 		s.debugf("Failed to create SFTP client: %v", err)
 		if closeErr := conn.Close(); closeErr != nil {
 			s.debugf("Failed to close SSH connection: %v", closeErr)
-			log.Printf("can't close sftp connection: %v", closeErr)
+			logging.Warnf("can't close sftp connection: %v", closeErr)
 		} else {
 			s.debugf("SSH connection closed successfully")
 		}
@@ -87,12 +112,47 @@ func NewSFTPStorage(host, user, password string, debug bool) (*SFTPStorage, erro
 
 	s.client = client
 	s.conn = conn
+	if sftpOptions.KeepAliveInterval > 0 {
+		s.stopKeepAlive = make(chan struct{})
+		s.keepAliveDone = make(chan struct{})
+		go s.keepAlive(sftpOptions.KeepAliveInterval)
+	}
 
 	s.debugf("Connected to SFTP server %s as user %s", host, user)
 
 	return s, nil
 }
 
+// keepAlive sends keepalive@openssh.com requests until Close, so servers and firewalls
+// don't drop the connection while a long upload is waiting for ClickHouse.
+func (s *SFTPStorage) keepAlive(interval time.Duration) {
+	defer close(s.keepAliveDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopKeepAlive:
+			return
+		case <-ticker.C:
+			if _, _, err := s.conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				logging.Warnf("sftp keepalive to %s failed, stopping keepalive: %v", s.host, err)
+				return
+			}
+			s.debugf("Sent keepalive to %s", s.host)
+		}
+	}
+}
+
+// unknownSizeReader hides the size of a stream from sftp.File.ReadFrom, which then
+// writes it with all concurrent requests instead of one packet at a time.
+type unknownSizeReader struct {
+	io.Reader
+}
+
+func (unknownSizeReader) Size() int64 {
+	return -1
+}
+
 // Upload uploads data via SFTP.
 // If contentEncoding is provided, it's assumed data is pre-compressed.
 // Otherwise, compressFormat and compressLevel are used for client-side compression.
@@ -121,9 +181,10 @@ func (s *SFTPStorage) Upload(filename string, reader io.Reader, compressFormat s
 
 	s.debugf("SFTP Upload: final remote path: %s", remoteFilename)
 
-	// Create the remote file
-	s.debugf("Attempting to create remote file: %s", remoteFilename)
-	dstFile, err := s.client.Create(remoteFilename)
+	// Write to a partial file first, an interrupted upload never leaves a truncated file under the final name
+	partialFilename := remoteFilename + partialSuffix
+	s.debugf("Attempting to create remote file: %s", partialFilename)
+	dstFile, err := s.client.Create(partialFilename)
 	if err != nil {
 		s.debugf("Failed to create remote file: %v", err)
 		if os.IsNotExist(err) || strings.Contains(err.Error(), "no such file") { // Error messages vary
@@ -150,7 +211,7 @@ func (s *SFTPStorage) Upload(filename string, reader io.Reader, compressFormat s
 						}
 					}
 					s.debugf("Retrying file creation after directory creation")
-					dstFile, err = s.client.Create(remoteFilename)
+					dstFile, err = s.client.Create(partialFilename)
 					if err != nil {
 						s.debugf("Still failed to create file after directory creation: %v", err)
 						return fmt.Errorf("failed to create remote directory %s for sftp upload on %s: %w", parentDir, s.host, mkdirErr)
@@ -158,36 +219,69 @@ func (s *SFTPStorage) Upload(filename string, reader io.Reader, compressFormat s
 					s.debugf("File creation successful after directory creation")
 				} else {
 					s.debugf("Directory creation successful, retrying file creation")
-					dstFile, err = s.client.Create(remoteFilename)
+					dstFile, err = s.client.Create(partialFilename)
 				}
 			}
 		}
 		if err != nil {
 			s.debugf("Failed to create remote file after all attempts: %v", err)
-			return fmt.Errorf("failed to create remote file %s for sftp upload on %s: %w", remoteFilename, s.host, err)
+			return fmt.Errorf("failed to create remote file %s for sftp upload on %s: %w", partialFilename, s.host, err)
 		}
 	}
 	s.debugf("Remote file created successfully")
-	defer func() {
-		if closeErr := dstFile.Close(); closeErr != nil {
-			s.debugf("SFTP Upload: error closing remote file %s: %v", remoteFilename, closeErr)
-		} else {
-			s.debugf("SFTP Upload: remote file %s closed successfully after copy", remoteFilename)
-		}
-	}()
 
 	// Copy data to the remote file
-	s.debugf("Copying data to remote file: %s", remoteFilename)
-	bytesWritten, err := io.Copy(dstFile, finalReader)
+	s.debugf("Copying data to remote file: %s", partialFilename)
+	bytesWritten, err := dstFile.ReadFrom(unknownSizeReader{finalReader})
 	if err != nil {
-		s.debugf("Failed to copy data to remote file %s: %v", remoteFilename, err)
+		s.debugf("Failed to copy data to remote file %s: %v", partialFilename, err)
+		_ = dstFile.Close()
+		s.removePartial(partialFilename)
 		return fmt.Errorf("failed to copy data to remote file %s via sftp on %s: %w", remoteFilename, s.host, err)
 	}
-	s.debugf("Successfully copied %d bytes to remote file %s", bytesWritten, remoteFilename)
+	if err := dstFile.Close(); err != nil {
+		s.removePartial(partialFilename)
+		return fmt.Errorf("failed to close remote file %s via sftp on %s: %w", partialFilename, s.host, err)
+	}
+	s.debugf("Successfully copied %d bytes to remote file %s", bytesWritten, partialFilename)
+
+	if err := s.rename(partialFilename, remoteFilename); err != nil {
+		s.removePartial(partialFilename)
+		return fmt.Errorf("failed to rename %s to %s via sftp on %s: %w", partialFilename, remoteFilename, s.host, err)
+	}
+	s.debugf("SFTP Upload: renamed %s to %s", partialFilename, remoteFilename)
 
 	return nil
 }
 
+// OpenWriter implements WriterStorage, the file is renamed from its .partial name on Close.
+func (s *SFTPStorage) OpenWriter(filename string, compressFormat string, compressLevel int, contentEncoding string) (io.WriteCloser, error) {
+	return newUploadWriter(filename, func(r io.Reader) error {
+		return s.Upload(filename, r, compressFormat, compressLevel, contentEncoding)
+	}), nil
+}
+
+// rename moves a finished upload over the final name, replacing an existing file.
+// Plain SFTP rename fails if the target exists, so the posix-rename extension is preferred.
+func (s *SFTPStorage) rename(from, to string) error {
+	err := s.client.PosixRename(from, to)
+	if err == nil {
+		return nil
+	}
+	s.debugf("posix-rename %s failed, falling back to remove and rename: %v", from, err)
+	if err := s.client.Remove(to); err != nil && !os.IsNotExist(err) {
+		s.debugf("Failed to remove existing %s before rename: %v", to, err)
+	}
+	return s.client.Rename(from, to)
+}
+
+// removePartial deletes the partial file of a failed upload.
+func (s *SFTPStorage) removePartial(partialFilename string) {
+	if err := s.client.Remove(partialFilename); err != nil && !os.IsNotExist(err) {
+		logging.Warnf("can't remove partial sftp upload %s: %v", partialFilename, err)
+	}
+}
+
 // Download retrieves a file from SFTP.
 func (s *SFTPStorage) Download(filename string) (io.ReadCloser, error) {
 	s.debugf("attempting to download file: %s", filename)
@@ -198,7 +292,7 @@ func (s *SFTPStorage) Download(filename string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("failed to download %s from sftp host %s: %w", filename, s.host, err)
 	}
 	s.debugf("File opened successfully for download")
-	return decompressStream(file, filename), nil
+	return s.decompressStream(file, filename), nil
 }
 
 // List returns a list of filenames in the SFTP server matching the prefix.
@@ -266,22 +360,60 @@ func (s *SFTPStorage) List(prefix string, recursive bool) ([]string, error) {
 	}
 
 	s.debugf("Found %d matching files", len(matchingFiles))
+	sort.Strings(matchingFiles)
 	return matchingFiles, nil
 }
 
-// Close closes the SFTP client and the underlying SSH connection.
+// Size returns the size of a remote file.
+func (s *SFTPStorage) Size(filename string) (int64, error) {
+	info, err := s.client.Stat(filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s on sftp host %s: %w", filename, s.host, err)
+	}
+	return info.Size(), nil
+}
+
+// Delete removes a file from SFTP.
+func (s *SFTPStorage) Delete(filename string) error {
+	s.debugf("Deleting file: %s", filename)
+	if err := s.client.Remove(filename); err != nil {
+		return fmt.Errorf("failed to delete %s from sftp host %s: %w", filename, s.host, err)
+	}
+	return nil
+}
+
+// sftpCloseTimeout bounds closing the SFTP client, which waits for the server to end the session.
+var sftpCloseTimeout = 10 * time.Second
+
+// Close closes the SFTP client and the underlying SSH connection, further calls do nothing.
+// A server which doesn't end the SFTP session within sftpCloseTimeout gets its SSH connection
+// closed, so Close doesn't hang.
 func (s *SFTPStorage) Close() error {
 	s.debugf("Closing SFTP storage connections")
+	if s.stopKeepAlive != nil {
+		close(s.stopKeepAlive)
+		s.stopKeepAlive = nil
+		// A keepalive waiting for its reply returns once the connection is closed below
+		defer func() { <-s.keepAliveDone }()
+	}
 
 	var firstErr error
 	if s.client != nil {
 		s.debugf("Closing SFTP client")
-		err := s.client.Close()
-		if err != nil {
-			s.debugf("Failed to close SFTP client: %v", err)
-			firstErr = fmt.Errorf("failed to close sftp client: %w", err)
-		} else {
-			s.debugf("SFTP client closed successfully")
+		client := s.client
+		s.client = nil
+		closed := make(chan error, 1)
+		go func() { closed <- client.Close() }()
+		select {
+		case err := <-closed:
+			if err != nil {
+				s.debugf("Failed to close SFTP client: %v", err)
+				firstErr = fmt.Errorf("failed to close sftp client: %w", err)
+			} else {
+				s.debugf("SFTP client closed successfully")
+			}
+		case <-time.After(sftpCloseTimeout):
+			logging.Warnf("SFTP client of %s not closed after %s, closing the SSH connection", s.host, sftpCloseTimeout)
 		}
 	} else {
 		s.debugf("SFTP client was nil, nothing to close")
@@ -290,6 +422,7 @@ func (s *SFTPStorage) Close() error {
 	if s.conn != nil {
 		s.debugf("Closing SSH connection")
 		err := s.conn.Close()
+		s.conn = nil
 		if err != nil {
 			s.debugf("Failed to close SSH connection: %v", err)
 			if firstErr == nil {
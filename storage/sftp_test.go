@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+)
+
+// newInMemorySFTPStorage connects an SFTPStorage to an in-memory SFTP server.
+func newInMemorySFTPStorage(t *testing.T) *SFTPStorage {
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.InMemHandler())
+	go func() { _ = server.Serve() }()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return &SFTPStorage{client: client, host: "in-memory"}
+}
+
+// failingReader returns some data, then fails like an interrupted dump query.
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestSFTPStorageUploadIsAtomic(t *testing.T) {
+	s := newInMemorySFTPStorage(t)
+	require.NoError(t, s.client.MkdirAll("/backup/db"))
+
+	require.NoError(t, s.Upload("/backup/db/t.data.sql", strings.NewReader("complete"), "none", 0, ""))
+	reader, err := s.Download("/backup/db/t.data.sql")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "complete", string(data))
+
+	// A failed upload keeps the previous file and leaves no partial file behind
+	err = s.Upload("/backup/db/t.data.sql", &failingReader{data: strings.NewReader("truncat")}, "none", 0, "")
+	require.ErrorContains(t, err, "connection reset")
+	_, err = s.client.Stat("/backup/db/t.data.sql" + partialSuffix)
+	require.True(t, os.IsNotExist(err), "partial file must be removed, got %v", err)
+	reader, err = s.Download("/backup/db/t.data.sql")
+	require.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "complete", string(data))
+
+	// A successful upload replaces the existing file
+	require.NoError(t, s.Upload("/backup/db/t.data.sql", strings.NewReader("replaced"), "none", 0, ""))
+	entries, err := s.client.ReadDir("/backup/db")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "t.data.sql", entries[0].Name())
+	size, err := s.Size("/backup/db/t.data.sql")
+	require.NoError(t, err)
+	require.EqualValues(t, len("replaced"), size)
+}
+
+// hungConn ignores Close, like a server which never ends the SFTP session.
+type hungConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (hungConn) Close() error { return nil }
+
+func TestSFTPStorageCloseIsBounded(t *testing.T) {
+	sftpCloseTimeout = 50 * time.Millisecond
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	t.Cleanup(func() { _ = serverWriter.Close() })
+	server := sftp.NewRequestServer(hungConn{Reader: serverReader, Writer: serverWriter}, sftp.InMemHandler())
+	go func() { _ = server.Serve() }()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	require.NoError(t, err)
+	s := &SFTPStorage{client: client, host: "hung"}
+
+	start := time.Now()
+	require.NoError(t, s.Close())
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.NoError(t, s.Close(), "closing twice does nothing")
+}
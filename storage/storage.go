@@ -1,11 +1,18 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"fmt"
 	"io"
+	"net"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/Slach/clickhouse-dump/logging"
 	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/zstd"
 )
@@ -26,16 +33,42 @@ type RemoteStorage interface {
 	// extensions (.gz, .zstd)
 	Download(filename string) (io.ReadCloser, error)
 
-	// List returns a list of filenames in the storage backend matching the prefix.
+	// List returns a lexicographically sorted list of filenames in the storage backend matching the prefix.
 	// The returned filenames might include compression extensions.
 	// If recursive is true, it will list all files under the prefix recursively.
 	// The prefix should be treated as a directory path when recursive=true.
 	List(prefix string, recursive bool) ([]string, error)
 
+	// Size returns the stored size in bytes of filename as returned by List, compressed files
+	// report their compressed size.
+	Size(filename string) (int64, error)
+
+	// Delete removes the specified filename, as returned by List, from the storage backend.
+	Delete(filename string) error
+
 	// Close terminates the connection to the storage backend, if applicable.
 	Close() error
 }
 
+// AllLister is implemented by storages keeping several copies of a backup, ListAll lists the
+// files of every copy where List reads only one.
+type AllLister interface {
+	ListAll(prefix string, recursive bool) ([]string, error)
+}
+
+// Compression modes control how compressed objects are named in storage.
+const (
+	// CompressionModeExtension appends .gz/.zstd to the object name, this is the default.
+	CompressionModeExtension = "extension"
+	// CompressionModeTransparent keeps the logical .sql name and records the compression
+	// in the object's Content-Encoding metadata. Only s3, gcs and azblob support it.
+	CompressionModeTransparent = "transparent"
+)
+
+// partialSuffix is appended to sftp and ftp uploads until they complete, then the file is
+// renamed to its final name, like object stores which only show a PUT once it succeeds.
+const partialSuffix = ".partial"
+
 // compressStream wraps the reader with a compression writer based on format and level.
 // It returns the reader end of the pipe and the appropriate file extension.
 // If format is empty or "none", it returns the original reader and an empty extension.
@@ -54,8 +87,8 @@ func compressStream(reader io.Reader, format string, level int) (io.Reader, stri
 	case "gzip":
 		ext = ".gz"
 		go func() {
-			// Ensure level is valid for gzip
-			if level < gzip.BestSpeed || level > gzip.BestCompression {
+			// Ensure level is valid for gzip, 0 stores the data uncompressed in the gzip container
+			if level != gzip.NoCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
 				level = gzip.DefaultCompression
 			}
 			gw, _ := gzip.NewWriterLevel(pw, level)
@@ -74,8 +107,11 @@ func compressStream(reader io.Reader, format string, level int) (io.Reader, stri
 	case "zstd":
 		ext = ".zstd"
 		go func() {
-			// Ensure level is valid for zstd (maps to zstd levels)
+			// Ensure level is valid for zstd (maps to zstd levels), zstd has no store mode so 0 is the fastest level
 			zstdLevel := zstd.EncoderLevelFromZstd(level) // Use mapping function
+			if level == 0 {
+				zstdLevel = zstd.SpeedFastest
+			}
 			zw, _ := zstd.NewWriter(pw, zstd.WithEncoderLevel(zstdLevel))
 			_, err := io.Copy(zw, reader)
 			// Close the zstd writer *before* closing the pipe writer
@@ -111,12 +147,222 @@ func (zrc *zstdReaderCloser) Close() error {
 	return zrc.underlyingReader.Close()
 }
 
+// Decoder is implemented by storages decompressing downloads with the compression records and zstd
+// dictionaries of the backup being restored. They are kept by the storage instance until
+// ResetDecoding, a restore resets them so the records of one backup never decode another.
+type Decoder interface {
+	// SetFileCompression records the compression a listed file was stored with, gzip, zstd or
+	// none, e.g. from the manifest of a backup. Download then reads the file by the record
+	// instead of guessing from its content, name and Content-Encoding, see recordedExtension.
+	SetFileCompression(filename, compression string)
+	// AddZstdDictionary makes Download decompress zstd frames compressed with dict, frames
+	// without a dictionary are decompressed as before.
+	AddZstdDictionary(dict []byte) error
+	// ResetDecoding drops the recorded compressions and the zstd dictionaries.
+	ResetDecoding()
+}
+
+// decoding implements Decoder for the storages embedding it. A nil decoding has no records and
+// no dictionaries.
+type decoding struct {
+	mu           sync.RWMutex
+	compressions map[string]map[string]string // base name to recorded names to compression
+	dicts        [][]byte
+}
+
+// SetFileCompression implements Decoder.
+func (d *decoding) SetFileCompression(filename, compression string) {
+	name := strings.TrimPrefix(filename, "/")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.compressions == nil {
+		d.compressions = make(map[string]map[string]string)
+	}
+	base := path.Base(name)
+	if d.compressions[base] == nil {
+		d.compressions[base] = make(map[string]string)
+	}
+	d.compressions[base][name] = strings.ToLower(compression)
+}
+
+// AddZstdDictionary implements Decoder.
+func (d *decoding) AddZstdDictionary(dict []byte) error {
+	if _, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict)); err != nil {
+		return fmt.Errorf("invalid zstd dictionary: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dicts = append(d.dicts, dict)
+	return nil
+}
+
+// ResetDecoding implements Decoder.
+func (d *decoding) ResetDecoding() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.compressions = nil
+	d.dicts = nil
+}
+
+func (d *decoding) zstdDecoderOptions() []zstd.DOption {
+	if d == nil {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.dicts) == 0 {
+		return nil
+	}
+	return []zstd.DOption{zstd.WithDecoderDicts(d.dicts...)}
+}
+
 // decompressStream wraps the reader with a decompression reader if the filename suggests compression.
 // It now returns an io.ReadCloser to ensure the underlying reader can be closed.
 // If no known compression extension is found, it returns the original reader.
-func decompressStream(reader io.ReadCloser, filename string) io.ReadCloser {
-	compressionExtension := GetCompressionExtension(filename)
-	switch compressionExtension {
+func (d *decoding) decompressStream(reader io.ReadCloser, filename string) io.ReadCloser {
+	return d.decompressStreamByExtension(reader, filename, GetCompressionExtension(filename))
+}
+
+// decompressStreamWithEncoding is like decompressStream, but falls back to the object's stored
+// Content-Encoding when the filename has no compression extension (transparent compression mode).
+func (d *decoding) decompressStreamWithEncoding(reader io.ReadCloser, filename string, contentEncoding string) io.ReadCloser {
+	ext := GetCompressionExtension(filename)
+	if ext == "" {
+		ext = extensionForEncoding(contentEncoding)
+	}
+	return d.decompressStreamByExtension(reader, filename, ext)
+}
+
+// extensionForEncoding maps a Content-Encoding value to the compression extension used in filenames.
+func extensionForEncoding(contentEncoding string) string {
+	switch strings.ToLower(contentEncoding) {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zstd"
+	default:
+		return ""
+	}
+}
+
+// encodingForExtension maps a compression extension back to its Content-Encoding value.
+func encodingForExtension(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".gz":
+		return "gzip"
+	case ".zstd":
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// contentTypeFor returns the MIME type of a stored object name, the compression extension wins over the file type.
+// Objects stored with a Content-Encoding keep the type of their uncompressed content.
+func contentTypeFor(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".gz"):
+		return "application/gzip"
+	case strings.HasSuffix(lower, ".zstd"):
+		return "application/zstd"
+	case strings.HasSuffix(lower, ".sql"):
+		return "application/sql"
+	case strings.HasSuffix(lower, ".json"):
+		return "application/json"
+	case strings.HasSuffix(lower, ".parquet"):
+		return "application/vnd.apache.parquet"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// Magic numbers of the compressed formats, checked before the extension.
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// sniffPeekSize is how many leading bytes are peeked to detect the compression, enough for the
+// gzip header of files stored without a long file name, others fall back to the extension.
+const sniffPeekSize = 64
+
+// sniffCompression returns the compression extension of the format the leading bytes of a file
+// are compressed with, or "" when they aren't gzip or zstd. A gzip magic must also start a
+// valid gzip header, so uncompressed Native data starting with the same bytes isn't mistaken.
+func sniffCompression(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, zstdMagic):
+		return ".zstd"
+	case bytes.HasPrefix(head, gzipMagic):
+		if _, err := gzip.NewReader(bytes.NewReader(head)); err == nil {
+			return ".gz"
+		}
+	}
+	return ""
+}
+
+// recordedCompression returns the compression recorded for filename by SetFileCompression.
+// Storages may prefix the listed name with their base path, the longest recorded name wins.
+func (d *decoding) recordedCompression(filename string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	name := strings.TrimPrefix(filepath.ToSlash(filename), "/")
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	compression, longest := "", -1
+	for recorded, c := range d.compressions[path.Base(name)] {
+		if (name == recorded || strings.HasSuffix(name, "/"+recorded)) && len(recorded) > longest {
+			compression, longest = c, len(recorded)
+		}
+	}
+	return compression, longest >= 0
+}
+
+// recordedExtension returns the compression extension of a file with a recorded compression.
+// Files recorded as uncompressed are never decompressed, even when their content starts like a
+// compressed stream, e.g. Native data with the bytes of the zstd magic number. A compressed file
+// whose content is compressed otherwise is read by its content, with a warning.
+func (d *decoding) recordedExtension(filename string, head []byte) (string, bool) {
+	compression, ok := d.recordedCompression(filename)
+	if !ok {
+		return "", false
+	}
+	if compression == "none" {
+		return "", true
+	}
+	ext := extensionForEncoding(compression)
+	sniffed := sniffCompression(head)
+	if sniffed == "" && ext == ".gz" && bytes.HasPrefix(head, gzipMagic) {
+		// A gzip header with a long file name doesn't fit the peeked bytes
+		sniffed = ext
+	}
+	if ext == "" || sniffed != ext {
+		logging.Warnf("%s is recorded as %s compressed, but its content is %s, reading it by its content", filename, compression, cmp.Or(encodingForExtension(sniffed), "uncompressed"))
+		return sniffed, true
+	}
+	return ext, true
+}
+
+// decompressStreamByExtension decompresses by the compression recorded with SetFileCompression,
+// else by the magic number of the content, so renamed files and objects stored without extension
+// or Content-Encoding are still read, and by compressionExtension when the content has no known
+// magic number.
+func (d *decoding) decompressStreamByExtension(reader io.ReadCloser, filename string, compressionExtension string) io.ReadCloser {
+	buffered := bufio.NewReaderSize(reader, sniffPeekSize)
+	head, _ := buffered.Peek(sniffPeekSize)
+	if recorded, ok := d.recordedExtension(filename, head); ok {
+		compressionExtension = recorded
+	} else if sniffed := sniffCompression(head); sniffed != "" {
+		if !strings.EqualFold(sniffed, compressionExtension) {
+			logging.Debugf("%s is %s compressed by its content, not by its name", filename, encodingForExtension(sniffed))
+		}
+		compressionExtension = sniffed
+	}
+	reader = &bufferedReadCloser{Reader: buffered, Closer: reader}
+
+	switch strings.ToLower(compressionExtension) {
 	case ".gz":
 		gr, err := gzip.NewReader(reader)
 		if err != nil {
@@ -126,7 +372,7 @@ func decompressStream(reader io.ReadCloser, filename string) io.ReadCloser {
 		// Gzip reader needs to be closed to close the underlying reader.
 		return gr // gr implements io.ReadCloser
 	case ".zstd":
-		zr, err := zstd.NewReader(reader)
+		zr, err := zstd.NewReader(reader, d.zstdDecoderOptions()...)
 		if err != nil {
 			closeErr := reader.Close()
 			return &errorReaderCloser{err: fmt.Errorf("failed to create zstd reader for %s: %w, reader closed %w", filename, err, closeErr)}
@@ -149,6 +395,12 @@ func GetCompressionExtension(filename string) string {
 	return ""
 }
 
+// bufferedReadCloser reads through the sniffing buffer and closes the original reader.
+type bufferedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // --- Helper for returning errors from decompressStream ---
 
 // errorReaderCloser is an io.ReadCloser that always returns an error on Read.
@@ -163,3 +415,25 @@ func (e *errorReaderCloser) Read(_ []byte) (n int, err error) {
 func (e *errorReaderCloser) Close() error {
 	return e.err // Or return nil? Let's return the error.
 }
+
+// hostWithDefaultPort returns host as "host:port" for dialing, adding defaultPort when host has none.
+// IPv6 literals are accepted with or without brackets, e.g. "::1", "[::1]" or "[::1]:2222".
+func hostWithDefaultPort(host, defaultPort string) (string, error) {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if h == "" || port == "" {
+			return "", fmt.Errorf("invalid host %q, expected host or host:port", host)
+		}
+		return host, nil
+	}
+	h := host
+	if strings.HasPrefix(h, "[") || strings.HasSuffix(h, "]") {
+		if !strings.HasPrefix(h, "[") || !strings.HasSuffix(h, "]") {
+			return "", fmt.Errorf("invalid host %q, unbalanced brackets", host)
+		}
+		h = h[1 : len(h)-1]
+	}
+	if h == "" {
+		return "", fmt.Errorf("invalid host %q, expected host or host:port", host)
+	}
+	return net.JoinHostPort(h, defaultPort), nil
+}
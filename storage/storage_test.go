@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentTypeFor(t *testing.T) {
+	for name, expected := range map[string]string{
+		"backup/db.schema.sql":               "application/sql",
+		"backup/db/t.data.sql.gz":            "application/gzip",
+		"backup/db/t.data.sql.zstd":          "application/zstd",
+		"backup/db/t.data.parquet":           "application/vnd.apache.parquet",
+		"backup/metadata.json":               "application/json",
+		"backup/db/t.chunk00001.data.native": "application/octet-stream",
+	} {
+		require.Equal(t, expected, contentTypeFor(name), name)
+	}
+}
+
+func TestHostWithDefaultPort(t *testing.T) {
+	for host, expected := range map[string]string{
+		"backup":              "backup:22",
+		"backup:2222":         "backup:2222",
+		"10.0.0.1":            "10.0.0.1:22",
+		"::1":                 "[::1]:22",
+		"2001:db8::1":         "[2001:db8::1]:22",
+		"[2001:db8::1]":       "[2001:db8::1]:22",
+		"[2001:db8::1]:2222":  "[2001:db8::1]:2222",
+		"[fe80::1%eth0]:2222": "[fe80::1%eth0]:2222",
+	} {
+		actual, err := hostWithDefaultPort(host, "22")
+		require.NoError(t, err, host)
+		require.Equal(t, expected, actual, host)
+	}
+	for _, host := range []string{"backup:", ":22", "[::1", "[]"} {
+		_, err := hostWithDefaultPort(host, "22")
+		require.Error(t, err, host)
+	}
+}
+
+func TestAzBlobAccessTier(t *testing.T) {
+	for name, expected := range map[string]azblob.AccessTierType{
+		"":        azblob.AccessTierNone,
+		"Hot":     azblob.AccessTierHot,
+		"cool":    azblob.AccessTierCool,
+		"ARCHIVE": azblob.AccessTierArchive,
+	} {
+		tier, err := azblobAccessTier(name)
+		require.NoError(t, err, name)
+		require.Equal(t, expected, tier, name)
+	}
+	_, err := azblobAccessTier("Premium")
+	require.Error(t, err)
+}
+
+func TestIsAWSEndpoint(t *testing.T) {
+	require.True(t, isAWSEndpoint(""))
+	require.True(t, isAWSEndpoint("https://s3.eu-west-1.amazonaws.com"))
+	require.False(t, isAWSEndpoint("http://minio:9000"))
+	require.False(t, isAWSEndpoint("https://ns.compat.objectstorage.us-ashburn-1.oraclecloud.com"))
+}
+
+func TestCompressStreamLevelZero(t *testing.T) {
+	plain := strings.Repeat("INSERT INTO `db`.`t` (`id`, `name`) VALUES (1, 'name');\n", 1000)
+	var d decoding
+	compress := func(format string, level int) []byte {
+		reader, _ := compressStream(strings.NewReader(plain), format, level)
+		compressed, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return compressed
+	}
+	for _, tc := range []struct {
+		format, ext string
+	}{{"gzip", ".gz"}, {"zstd", ".zstd"}} {
+		stored := compress(tc.format, 0)
+		decompressed, err := io.ReadAll(d.decompressStream(io.NopCloser(bytes.NewReader(stored)), "db/t.data.sql"+tc.ext))
+		require.NoError(t, err)
+		require.Equal(t, plain, string(decompressed), tc.format)
+	}
+	// Level 0 stores gzip data, level 6 compresses it
+	require.Greater(t, len(compress("gzip", 0)), len(plain))
+	require.Less(t, len(compress("gzip", 6)), len(plain)/10)
+}
+
+func TestDecompressStreamSniffing(t *testing.T) {
+	plain := strings.Repeat("INSERT INTO `db`.`t` (`id`, `name`) VALUES (1, 'name');\n", 1000)
+	var d decoding
+	for _, format := range []string{"gzip", "zstd"} {
+		reader, _ := compressStream(strings.NewReader(plain), format, 3)
+		stored, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		// Renamed to .sql, with the other extension, or stored with the extension it has
+		for _, name := range []string{"db/t.data.sql", "db/t.data.sql.gz", "db/t.data.sql.zstd"} {
+			decompressed, err := io.ReadAll(d.decompressStream(io.NopCloser(bytes.NewReader(stored)), name))
+			require.NoError(t, err, format+" "+name)
+			require.Equal(t, plain, string(decompressed), format+" "+name)
+		}
+	}
+
+	// Uncompressed content starting like a gzip magic but without a valid header is read as is
+	raw := append([]byte{0x1f, 0x8b, 0x08, 0xff}, plain...)
+	decompressed, err := io.ReadAll(d.decompressStream(io.NopCloser(bytes.NewReader(raw)), "db/t.data.native"))
+	require.NoError(t, err)
+	require.Equal(t, raw, decompressed)
+	decompressed, err = io.ReadAll(d.decompressStream(io.NopCloser(strings.NewReader("SELECT 1")), "db/t.schema.sql"))
+	require.NoError(t, err)
+	require.Equal(t, "SELECT 1", string(decompressed))
+}
+
+func TestDecompressStreamRecordedCompression(t *testing.T) {
+	plain := strings.Repeat("INSERT INTO `db`.`t` VALUES (1);\n", 100)
+	gzipped, _ := compressStream(strings.NewReader(plain), "gzip", 3)
+	stored, err := io.ReadAll(gzipped)
+	require.NoError(t, err)
+	var d decoding
+
+	// Listed names are matched at a path boundary of the name a storage downloads
+	d.SetFileCompression("/recorded/b1/db/t.data.sql", "gzip")
+	compression, ok := d.recordedCompression("/var/backups/recorded/b1/db/t.data.sql")
+	require.True(t, ok)
+	require.Equal(t, "gzip", compression)
+	_, ok = d.recordedCompression("/var/backups/other_recorded/b1/db/t.data.sql")
+	require.False(t, ok)
+
+	// Uncompressed content starting with the zstd magic number is read as is
+	raw := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, plain...)
+	d.SetFileCompression("recorded/b1/db/raw.data.native.zstd", "none")
+	decompressed, err := io.ReadAll(d.decompressStream(io.NopCloser(bytes.NewReader(raw)), "recorded/b1/db/raw.data.native.zstd"))
+	require.NoError(t, err)
+	require.Equal(t, raw, decompressed)
+
+	// A compressed record disagreeing with the content is overruled by it
+	d.SetFileCompression("recorded/b1/db/u.data.sql.zstd", "zstd")
+	decompressed, err = io.ReadAll(d.decompressStream(io.NopCloser(bytes.NewReader(stored)), "recorded/b1/db/u.data.sql.zstd"))
+	require.NoError(t, err)
+	require.Equal(t, plain, string(decompressed))
+
+	// Records are kept by the storage instance until they are reset
+	var other decoding
+	_, ok = other.recordedCompression("/var/backups/recorded/b1/db/t.data.sql")
+	require.False(t, ok)
+	d.ResetDecoding()
+	_, ok = d.recordedCompression("/var/backups/recorded/b1/db/t.data.sql")
+	require.False(t, ok)
+	decompressed, err = io.ReadAll(d.decompressStream(io.NopCloser(bytes.NewReader(raw)), "recorded/b1/db/raw.data.native.zstd"))
+	require.Error(t, err, "without the record the zstd magic number is decompressed")
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Slach/clickhouse-dump/logging"
+)
+
+// Stream framing used by the stdout and stdin storages, all control lines end with "\n":
+//
+//	CLICKHOUSE-DUMP-STREAM 1      header, once at the start
+//	FILE "<quoted filename>"      starts a file, filename includes the compression extension
+//	<hex length>                  followed by exactly length bytes of file content, repeated
+//	0                             ends the file, or "ABORT" if the upload failed midway
+//	END                           written by Close when every upload succeeded
+//
+// A stream without END comes from a failed or interrupted dump and is rejected on restore.
+const (
+	streamHeader    = "CLICKHOUSE-DUMP-STREAM 1"
+	streamEnd       = "END"
+	streamAbort     = "ABORT"
+	streamChunkSize = 1024 * 1024
+)
+
+// StreamStorage implements RemoteStorage as a single framed stream. Dumps write all files
+// into writer one after another, restores spool the stream from reader into tmpDir on List.
+type StreamStorage struct {
+	writer   *bufio.Writer
+	reader   io.Reader
+	tmpDir   string
+	debug    bool
+	mu       sync.Mutex
+	started  bool
+	failed   bool
+	closed   bool
+	spoolDir string
+	files    map[string]string
+	names    []string
+	decoding
+}
+
+// debugf logs only if debug is enabled
+func (s *StreamStorage) debugf(format string, args ...interface{}) {
+	if s.debug || logging.Enabled(logging.LevelDebug) {
+		log.Printf("[stream:debug] "+format, args...)
+	}
+}
+
+// NewStreamStorage creates a StreamStorage writing dumps into writer and restoring from reader,
+// either can be nil when the storage is used in one direction only.
+func NewStreamStorage(writer io.Writer, reader io.Reader, tmpDir string, debug bool) (*StreamStorage, error) {
+	if !debug && os.Getenv("LOG_LEVEL") == "debug" {
+		debug = true
+	}
+	s := &StreamStorage{
+		reader: reader,
+		tmpDir: tmpDir,
+		debug:  debug,
+	}
+	if writer != nil {
+		s.writer = bufio.NewWriterSize(writer, streamChunkSize)
+	}
+	return s, nil
+}
+
+// Upload writes filename as one frame, uploads are serialized because the stream is sequential.
+func (s *StreamStorage) Upload(filename string, reader io.Reader, compressFormat string, compressLevel int, contentEncoding string) error {
+	if s.writer == nil {
+		return fmt.Errorf("stream storage is opened for reading, can't upload %s", filename)
+	}
+	finalReader := reader
+	if contentEncoding != "" {
+		filename += extensionForEncoding(contentEncoding)
+	} else {
+		var ext string
+		finalReader, ext = compressStream(reader, compressFormat, compressLevel)
+		filename += ext
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		if _, err := fmt.Fprintln(s.writer, streamHeader); err != nil {
+			return s.fail(fmt.Errorf("failed to write stream header: %w", err))
+		}
+		s.started = true
+	}
+	s.debugf("Writing %s to stream", filename)
+	if _, err := fmt.Fprintf(s.writer, "FILE %s\n", strconv.Quote(filename)); err != nil {
+		return s.fail(fmt.Errorf("failed to write %s to stream: %w", filename, err))
+	}
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, readErr := io.ReadFull(finalReader, buf)
+		if n > 0 {
+			if _, err := fmt.Fprintf(s.writer, "%x\n", n); err != nil {
+				return s.fail(fmt.Errorf("failed to write %s to stream: %w", filename, err))
+			}
+			if _, err := s.writer.Write(buf[:n]); err != nil {
+				return s.fail(fmt.Errorf("failed to write %s to stream: %w", filename, err))
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			_, _ = fmt.Fprintln(s.writer, streamAbort)
+			return s.fail(fmt.Errorf("failed to read %s for stream: %w", filename, readErr))
+		}
+	}
+	if _, err := fmt.Fprintln(s.writer, "0"); err != nil {
+		return s.fail(fmt.Errorf("failed to write %s to stream: %w", filename, err))
+	}
+	if err := s.writer.Flush(); err != nil {
+		return s.fail(fmt.Errorf("failed to flush %s to stream: %w", filename, err))
+	}
+	return nil
+}
+
+// fail marks the stream incomplete, so Close doesn't write the END marker.
+func (s *StreamStorage) fail(err error) error {
+	s.failed = true
+	return err
+}
+
+// Download opens a file spooled by List.
+func (s *StreamStorage) Download(filename string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	spooled, ok := s.files[filename]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("file %s not found in stream", filename)
+	}
+	f, err := os.Open(spooled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spooled file %s: %w", filename, err)
+	}
+	return s.decompressStream(f, filename), nil
+}
+
+// List reads the whole stream into tmpDir on first call and returns the files under prefix.
+func (s *StreamStorage) List(prefix string, recursive bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		if s.reader == nil {
+			return nil, fmt.Errorf("stream storage is opened for writing, can't list %s", prefix)
+		}
+		if err := s.spool(); err != nil {
+			return nil, err
+		}
+	}
+	prefix = strings.TrimPrefix(prefix, "/")
+	var result []string
+	for _, name := range s.names {
+		rel := strings.TrimPrefix(name, "/")
+		if prefix != "" && rel != prefix && !strings.HasPrefix(rel, strings.TrimSuffix(prefix, "/")+"/") {
+			continue
+		}
+		if !recursive && strings.Contains(strings.TrimPrefix(strings.TrimPrefix(rel, prefix), "/"), "/") {
+			continue
+		}
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// spool splits the stream into files in a temporary directory.
+func (s *StreamStorage) spool() error {
+	spoolDir, err := os.MkdirTemp(s.tmpDir, "clickhouse-dump-stream-*")
+	if err != nil {
+		return fmt.Errorf("failed to create stream spool directory: %w", err)
+	}
+	s.spoolDir = spoolDir
+	s.files = make(map[string]string)
+	r := bufio.NewReaderSize(s.reader, streamChunkSize)
+
+	line, err := readStreamLine(r)
+	if err != nil {
+		return err
+	}
+	if line != streamHeader {
+		return fmt.Errorf("input is not a clickhouse-dump stream, unexpected header %q", line)
+	}
+	for {
+		line, err := readStreamLine(r)
+		if err == io.EOF {
+			return fmt.Errorf("stream ended without %s marker, the dump failed or was interrupted", streamEnd)
+		}
+		if err != nil {
+			return err
+		}
+		if line == streamEnd {
+			s.debugf("Spooled %d files from stream into %s", len(s.names), spoolDir)
+			return nil
+		}
+		quoted, ok := strings.CutPrefix(line, "FILE ")
+		if !ok {
+			return fmt.Errorf("unexpected stream line %q", line)
+		}
+		name, err := strconv.Unquote(quoted)
+		if err != nil {
+			return fmt.Errorf("invalid stream file name %s: %w", quoted, err)
+		}
+		if err := s.spoolFile(r, name); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *StreamStorage) spoolFile(r *bufio.Reader, name string) error {
+	f, err := os.CreateTemp(s.spoolDir, "file-*"+filepath.Ext(name))
+	if err != nil {
+		return fmt.Errorf("failed to create spool file for %s: %w", name, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			logging.Warnf("can't close spool file %s: %v", f.Name(), closeErr)
+		}
+	}()
+	for {
+		line, err := readStreamLine(r)
+		if err != nil {
+			return fmt.Errorf("stream truncated inside %s: %w", name, err)
+		}
+		if line == streamAbort {
+			return fmt.Errorf("upload of %s was aborted during the dump", name)
+		}
+		size, err := strconv.ParseInt(line, 16, 64)
+		if err != nil {
+			return fmt.Errorf("invalid chunk length %q in %s: %w", line, name, err)
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(f, r, size); err != nil {
+			return fmt.Errorf("stream truncated inside %s: %w", name, err)
+		}
+	}
+	s.files[name] = f.Name()
+	s.names = append(s.names, name)
+	s.debugf("Spooled %s to %s", name, f.Name())
+	return nil
+}
+
+func readStreamLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// Size returns the size of a file spooled by List.
+func (s *StreamStorage) Size(filename string) (int64, error) {
+	s.mu.Lock()
+	spooled, ok := s.files[filename]
+	s.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("file %s not found in stream", filename)
+	}
+	info, err := os.Stat(spooled)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat spooled file %s: %w", filename, err)
+	}
+	return info.Size(), nil
+}
+
+// Delete is not supported, a stream can't take back what was already written.
+func (s *StreamStorage) Delete(filename string) error {
+	return fmt.Errorf("stream storage can't delete %s", filename)
+}
+
+// Close finishes the written stream with the END marker, or removes spooled files after a restore.
+// Further calls do nothing.
+func (s *StreamStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.writer != nil && !s.failed {
+		if !s.started {
+			if _, err := fmt.Fprintln(s.writer, streamHeader); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(s.writer, streamEnd); err != nil {
+			return err
+		}
+		if err := s.writer.Flush(); err != nil {
+			return err
+		}
+	}
+	if s.spoolDir != "" {
+		return os.RemoveAll(s.spoolDir)
+	}
+	return nil
+}
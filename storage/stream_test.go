@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamStorageRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	writer, err := NewStreamStorage(&stream, nil, "", false)
+	require.NoError(t, err)
+
+	files := map[string]string{
+		"backup/db.database.sql":    "CREATE DATABASE IF NOT EXISTS db",
+		"backup/db/t.schema.sql":    "CREATE TABLE db.t (s String) ENGINE = Log",
+		"backup/db/t.data.sql":      strings.Repeat("INSERT INTO `db`.`t` VALUES ('0\\n1\\nEND\\n');\n", 100000),
+		"other/db/skipped.data.sql": "INSERT INTO t VALUES (1);",
+	}
+	for name, content := range files {
+		require.NoError(t, writer.Upload(name, strings.NewReader(content), "zstd", 1, ""))
+	}
+	require.NoError(t, writer.Close())
+	written := stream.Len()
+	require.NoError(t, writer.Close())
+	require.Equal(t, written, stream.Len(), "closing twice writes a single END marker")
+
+	reader, err := NewStreamStorage(nil, &stream, t.TempDir(), false)
+	require.NoError(t, err)
+	listed, err := reader.List("backup", true)
+	require.NoError(t, err)
+	// Files are uploaded in map order and listed sorted
+	require.Equal(t, []string{"backup/db.database.sql.zstd", "backup/db/t.data.sql.zstd", "backup/db/t.schema.sql.zstd"}, listed)
+	for _, name := range listed {
+		r, err := reader.Download(name)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Equal(t, files[strings.TrimSuffix(name, ".zstd")], string(data))
+	}
+	require.NoError(t, reader.Close())
+}
+
+func TestStreamStorageRejectsIncompleteStream(t *testing.T) {
+	var stream bytes.Buffer
+	writer, err := NewStreamStorage(&stream, nil, "", false)
+	require.NoError(t, err)
+	require.NoError(t, writer.Upload("backup/db.database.sql", strings.NewReader("CREATE DATABASE db"), "none", 0, ""))
+	// No Close, as when the dump process is killed
+
+	reader, err := NewStreamStorage(nil, &stream, t.TempDir(), false)
+	require.NoError(t, err)
+	_, err = reader.List("backup", true)
+	require.ErrorContains(t, err, "without END marker")
+	require.NoError(t, reader.Close())
+}
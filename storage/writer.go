@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// WriterStorage is implemented by backends which can take a file as a stream of writes
+// instead of an io.Reader, for callers producing data incrementally.
+type WriterStorage interface {
+	RemoteStorage
+
+	// OpenWriter starts an upload of filename, naming and compression follow Upload.
+	// The file is complete only after Close returned nil. The returned writer also has
+	// CloseWithError(err error) error, which aborts the upload with err.
+	OpenWriter(filename string, compressFormat string, compressLevel int, contentEncoding string) (io.WriteCloser, error)
+}
+
+// uploadWriter feeds an Upload running in its own goroutine through a pipe.
+type uploadWriter struct {
+	pipeWriter *io.PipeWriter
+	done       chan error
+	closeOnce  sync.Once
+	err        error
+}
+
+// newUploadWriter runs upload with the read end of a pipe and returns the write end.
+func newUploadWriter(filename string, upload func(io.Reader) error) *uploadWriter {
+	pipeReader, pipeWriter := io.Pipe()
+	w := &uploadWriter{pipeWriter: pipeWriter, done: make(chan error, 1)}
+	go func() {
+		err := upload(pipeReader)
+		if err != nil {
+			// Fail pending and later writes with the upload error
+			_ = pipeReader.CloseWithError(err)
+		} else {
+			_ = pipeReader.CloseWithError(fmt.Errorf("upload of %s already finished", filename))
+		}
+		w.done <- err
+	}()
+	return w
+}
+
+// Write passes p to the upload, it fails once the upload failed.
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	return w.pipeWriter.Write(p)
+}
+
+// Close ends the data and waits until the upload finished.
+func (w *uploadWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError aborts the upload with err, the backend discards or leaves a partial file
+// like a failed Upload. A nil err is the same as Close.
+func (w *uploadWriter) CloseWithError(err error) error {
+	w.closeOnce.Do(func() {
+		_ = w.pipeWriter.CloseWithError(err)
+		w.err = <-w.done
+	})
+	return w.err
+}
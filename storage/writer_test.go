@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorageOpenWriter(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage, err := NewFileStorage(dir, false)
+	require.NoError(t, err)
+	var s RemoteStorage = fileStorage
+	ws, ok := s.(WriterStorage)
+	require.True(t, ok, "file storage must support OpenWriter")
+
+	w, err := ws.OpenWriter("backup/db/t.data.sql", "gzip", 1, "")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := io.WriteString(w, "INSERT INTO t VALUES (1);\n")
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close(), "repeated Close returns the upload result")
+
+	reader, err := ws.Download("backup/db/t.data.sql.gz")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, "INSERT INTO t VALUES (1);\nINSERT INTO t VALUES (1);\nINSERT INTO t VALUES (1);\n", string(data))
+}
+
+func TestSFTPStorageOpenWriterAbort(t *testing.T) {
+	s := newInMemorySFTPStorage(t)
+	require.NoError(t, s.client.MkdirAll("/backup"))
+
+	w, err := s.OpenWriter("/backup/t.data.sql", "none", 0, "")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "half")
+	require.NoError(t, err)
+	aborter, ok := w.(interface{ CloseWithError(error) error })
+	require.True(t, ok)
+	require.ErrorContains(t, aborter.CloseWithError(errors.New("query failed")), "query failed")
+
+	entries, err := s.client.ReadDir("/backup")
+	require.NoError(t, err)
+	require.Empty(t, entries, "an aborted upload leaves neither the file nor its partial")
+}